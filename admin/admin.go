@@ -0,0 +1,154 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/parvit/qpep/flows"
+	"github.com/parvit/qpep/logger"
+)
+
+// UNIX_SOCKET_PREFIX selects a unix socket path instead of a TCP address
+const UNIX_SOCKET_PREFIX = "unix:"
+
+// Server is the local admin API listing and aborting the flows of a registry:
+//
+//	GET    /sessions       live sessions with their streams
+//	GET    /sessions/{id}  a single session
+//	DELETE /sessions/{id}  close a session and all its streams
+//	DELETE /streams/{id}   reset a single stream, by the ID listed with its session
+type Server struct {
+	listener   net.Listener
+	httpServer *http.Server
+	registry   *flows.Registry
+}
+
+// StartServer listens on "unix:<path>" or on a loopback "host:port" address, other
+// addresses are refused as the API has no authentication
+func StartServer(address string, registry *flows.Registry) (*Server, error) {
+	listener, err := listen(address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{listener: listener, registry: registry}
+	server.httpServer = &http.Server{Handler: server.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("Admin API stopped: %s", err)
+		}
+	}()
+	return server, nil
+}
+
+// handler routes the requests of the API
+func (server *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", server.handleSessions)
+	mux.HandleFunc("/sessions/", server.handleSession)
+	mux.HandleFunc("/streams/", server.handleStream)
+	return mux
+}
+
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, UNIX_SOCKET_PREFIX) {
+		path := strings.TrimPrefix(address, UNIX_SOCKET_PREFIX)
+		// a socket left behind by a previous run prevents binding
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.Chmod(path, 0600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin API address %s is not a loopback address", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// Addr returns the address the server is listening on
+func (server *Server) Addr() net.Addr {
+	return server.listener.Addr()
+}
+
+func (server *Server) Close() error {
+	return server.httpServer.Close()
+}
+
+func (server *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.registry.Sessions())
+}
+
+func (server *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	switch r.Method {
+	case http.MethodGet:
+		info, ok := server.registry.Session(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "session %s not found", id)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case http.MethodDelete:
+		if !server.registry.AbortSession(id) {
+			writeError(w, http.StatusNotFound, "session %s not found", id)
+			return
+		}
+		logger.Info("Session %s aborted through the admin API", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (server *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/streams/")
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+	if !server.registry.AbortStream(id) {
+		writeError(w, http.StatusNotFound, "stream %s not found", id)
+		return
+	}
+	logger.Info("Stream %s aborted through the admin API", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
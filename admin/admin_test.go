@@ -0,0 +1,101 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/parvit/qpep/flows"
+)
+
+// request sends a request to the handler of an API serving registry and returns the response
+func request(t *testing.T, registry *flows.Registry, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	server := &Server{registry: registry}
+	recorder := httptest.NewRecorder()
+	server.handler().ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	return recorder
+}
+
+func TestListSessions(t *testing.T) {
+	registry := flows.NewRegistry()
+	session := registry.AddSession("192.0.2.1:4000", "site-a", nil)
+	stream := session.AddStream("54502f312e310d0a", 0, "10.0.0.1:5000", "198.51.100.1:443")
+
+	response := request(t, registry, http.MethodGet, "/sessions")
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("list answered %d with %q", response.Code, response.Header().Get("Content-Type"))
+	}
+	var sessions []flows.SessionInfo
+	if err := json.Unmarshal(response.Body.Bytes(), &sessions); err != nil {
+		t.Fatalf("decode the sessions: %s", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != session.ID || sessions[0].Client != "site-a" ||
+		len(sessions[0].Streams) != 1 || sessions[0].Streams[0].ID != stream.ID {
+		t.Errorf("listed %+v, expected the session and its stream", sessions)
+	}
+
+	response = request(t, registry, http.MethodGet, "/sessions/"+session.ID)
+	var info flows.SessionInfo
+	if err := json.Unmarshal(response.Body.Bytes(), &info); err != nil || response.Code != http.StatusOK || info.ID != session.ID {
+		t.Errorf("session answered %d with %+v (%v), expected the session", response.Code, info, err)
+	}
+
+	response = request(t, registry, http.MethodPost, "/sessions")
+	if response.Code != http.StatusMethodNotAllowed || response.Header().Get("Allow") != http.MethodGet {
+		t.Errorf("POST answered %d allowing %q, expected 405 allowing GET", response.Code, response.Header().Get("Allow"))
+	}
+}
+
+func TestKill(t *testing.T) {
+	registry := flows.NewRegistry()
+	aborted := ""
+	session := registry.AddSession("192.0.2.1:4000", "site-a", func() { aborted = "session" })
+	stream := session.AddStream("54502f312e310d0a", 0, "10.0.0.1:5000", "198.51.100.1:443")
+	stream.SetAbort(func() { aborted = "stream" })
+
+	if response := request(t, registry, http.MethodDelete, "/streams/"+stream.ID); response.Code != http.StatusNoContent || aborted != "stream" {
+		t.Errorf("stream kill answered %d and aborted the %q, expected 204 and the stream", response.Code, aborted)
+	}
+	if response := request(t, registry, http.MethodDelete, "/sessions/"+session.ID); response.Code != http.StatusNoContent || aborted != "session" {
+		t.Errorf("session kill answered %d and aborted the %q, expected 204 and the session", response.Code, aborted)
+	}
+	if response := request(t, registry, http.MethodGet, "/streams/"+stream.ID); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET of a stream answered %d, expected 405", response.Code)
+	}
+}
+
+func TestUnknownID(t *testing.T) {
+	registry := flows.NewRegistry()
+	for _, test := range []struct{ method, path string }{
+		{http.MethodGet, "/sessions/42"},
+		{http.MethodDelete, "/sessions/42"},
+		{http.MethodDelete, "/streams/54502f312e310d0a"},
+	} {
+		response := request(t, registry, test.method, test.path)
+		var body map[string]string
+		if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || response.Code != http.StatusNotFound || body["error"] == "" {
+			t.Errorf("%s %s answered %d with %q, expected 404 with an error", test.method, test.path, response.Code, response.Body.String())
+		}
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	for _, address := range []string{"0.0.0.0:0", "192.0.2.1:0", "[::]:0", "example.com:0", ":0"} {
+		if listener, err := listen(address); err == nil {
+			listener.Close()
+			t.Errorf("listened on %s, not a loopback address", address)
+		}
+	}
+
+	for _, address := range []string{"127.0.0.1:0", "localhost:0", UNIX_SOCKET_PREFIX + filepath.Join(t.TempDir(), "admin.sock")} {
+		server, err := StartServer(address, flows.NewRegistry())
+		if err != nil {
+			t.Errorf("listen on %s: %s", address, err)
+			continue
+		}
+		server.Close()
+	}
+}
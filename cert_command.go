@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/parvit/qpep/pki"
+	"github.com/parvit/qpep/shared"
+)
+
+const certCommandUsage = `Usage: qpep cert <command> [options]
+
+Commands:
+  init     create a new certificate authority
+  server   issue a server certificate
+  client   issue a client certificate
+  revoke   revoke certificates by serial or name and update the CRL
+  crl      sign again the CRL of the authority
+  list     list the certificates issued by the authority
+
+Run "qpep cert <command> -h" for the options of each command.
+`
+
+// runCertCommand implements the "qpep cert" subcommands and returns the exit code of the process
+func runCertCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, certCommandUsage)
+		return 1
+	}
+
+	commands := map[string]func([]string) error{
+		"init":   certInit,
+		"server": certIssueServer,
+		"client": certIssueClient,
+		"revoke": certRevoke,
+		"crl":    certCRL,
+		"list":   certList,
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown cert command %q\n\n%s", args[0], certCommandUsage)
+		return 1
+	}
+	if err := command(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "qpep cert %s: %s\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func certInit(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	dir := flags.String("dir", "qpep-ca", "Directory of the certificate authority")
+	name := flags.String("name", "qpep CA", "Common name of the CA certificate")
+	keyType := flags.String("keyType", pki.KEY_TYPE_ECDSA, "Key type, ecdsa or ed25519")
+	days := flags.Int("days", daysOf(pki.DEFAULT_CA_VALIDITY), "Validity of the CA certificate in days")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	authority, err := pki.CreateAuthority(*dir, *name, *keyType, daysDuration(*days))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created CA %q in %s\n", *name, authority.Dir)
+	fmt.Printf("  certificate: %s (use with -ca on clients and -clientCA on the server)\n", filepath.Join(authority.Dir, pki.CA_CERT_FILE))
+	fmt.Printf("  CRL:         %s (use with -crl on the server)\n", authority.CRLPath())
+	return nil
+}
+
+func certIssueServer(args []string) error {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	dir := flags.String("dir", "qpep-ca", "Directory of the certificate authority")
+	name := flags.String("name", "qpep-server", "Common name of the server certificate")
+	hosts := flags.String("hosts", "", "Comma separated DNS names and IP addresses the clients use to reach the server")
+	out := flags.String("out", "server", "Prefix of the output files, <out>.pem and <out>.key")
+	keyType := flags.String("keyType", pki.KEY_TYPE_ECDSA, "Key type, ecdsa or ed25519")
+	days := flags.Int("days", daysOf(pki.DEFAULT_CERT_VALIDITY), "Validity of the certificate in days")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *hosts == "" {
+		return fmt.Errorf("at least one host is required with -hosts")
+	}
+
+	authority, err := pki.LoadAuthority(*dir)
+	if err != nil {
+		return err
+	}
+	cert, key, err := authority.IssueServer(*name, strings.Split(*hosts, ","), *keyType, daysDuration(*days))
+	if err != nil {
+		return err
+	}
+	if err = writeCertificateFiles(*out, cert, key); err != nil {
+		return err
+	}
+	fmt.Printf("Issued server certificate %q, serial %s\n", *name, cert.SerialNumber.Text(16))
+	fmt.Printf("  run the server with: -cert %s.pem -key %s.key\n", *out, *out)
+	fmt.Printf("  key pin:             %s\n", shared.SPKIPin(cert))
+	return nil
+}
+
+func certIssueClient(args []string) error {
+	flags := flag.NewFlagSet("client", flag.ContinueOnError)
+	dir := flags.String("dir", "qpep-ca", "Directory of the certificate authority")
+	name := flags.String("name", "", "Name of the client, reported by the server in logs and used by the per client rules")
+	out := flags.String("out", "", "Prefix of the output files, <out>.pem and <out>.key (default is the client name)")
+	keyType := flags.String("keyType", pki.KEY_TYPE_ECDSA, "Key type, ecdsa or ed25519")
+	days := flags.Int("days", daysOf(pki.DEFAULT_CERT_VALIDITY), "Validity of the certificate in days")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return fmt.Errorf("the client name is required with -name")
+	}
+	if *out == "" {
+		*out = *name
+	}
+
+	authority, err := pki.LoadAuthority(*dir)
+	if err != nil {
+		return err
+	}
+	cert, key, err := authority.IssueClient(*name, *keyType, daysDuration(*days))
+	if err != nil {
+		return err
+	}
+	if err = writeCertificateFiles(*out, cert, key); err != nil {
+		return err
+	}
+	fmt.Printf("Issued client certificate %q, serial %s\n", *name, cert.SerialNumber.Text(16))
+	fmt.Printf("  run the client with: -clientCert %s.pem -clientKey %s.key\n", *out, *out)
+	return nil
+}
+
+func certRevoke(args []string) error {
+	flags := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	dir := flags.String("dir", "qpep-ca", "Directory of the certificate authority")
+	crlDays := flags.Int("crlDays", daysOf(pki.DEFAULT_CRL_VALIDITY), "Validity of the updated CRL in days")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: qpep cert revoke [options] <serial or name>...\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("serial or name of the certificate to revoke is required")
+	}
+
+	authority, err := pki.LoadAuthority(*dir)
+	if err != nil {
+		return err
+	}
+	for _, target := range flags.Args() {
+		count, err := authority.Revoke(target)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked %d certificate(s) for %s\n", count, target)
+	}
+	if err = authority.WriteCRL(daysDuration(*crlDays)); err != nil {
+		return err
+	}
+	fmt.Printf("Updated CRL %s\n", authority.CRLPath())
+	return nil
+}
+
+func certCRL(args []string) error {
+	flags := flag.NewFlagSet("crl", flag.ContinueOnError)
+	dir := flags.String("dir", "qpep-ca", "Directory of the certificate authority")
+	days := flags.Int("days", daysOf(pki.DEFAULT_CRL_VALIDITY), "Validity of the CRL in days")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	authority, err := pki.LoadAuthority(*dir)
+	if err != nil {
+		return err
+	}
+	if err = authority.WriteCRL(daysDuration(*days)); err != nil {
+		return err
+	}
+	fmt.Printf("Updated CRL %s\n", authority.CRLPath())
+	return nil
+}
+
+func certList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	dir := flags.String("dir", "qpep-ca", "Directory of the certificate authority")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	authority, err := pki.LoadAuthority(*dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-34s %-7s %-10s %-8s %s\n", "SERIAL", "TYPE", "EXPIRES", "STATUS", "NAME")
+	for _, entry := range authority.Issued() {
+		status := "valid"
+		if entry.Revoked {
+			status = "revoked"
+		} else if time.Now().After(entry.NotAfter) {
+			status = "expired"
+		}
+		fmt.Printf("%-34s %-7s %-10s %-8s %s\n", entry.Serial, entry.Type, entry.NotAfter.Format("2006-01-02"), status, entry.Name)
+	}
+	return nil
+}
+
+func writeCertificateFiles(prefix string, cert *x509.Certificate, key crypto.Signer) error {
+	keyPEM, err := pki.EncodeKey(key)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(prefix+".key", keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(prefix+".pem", pki.EncodeCertificate(cert), 0644)
+}
+
+func daysOf(duration time.Duration) int {
+	return int(duration / (24 * time.Hour))
+}
+
+func daysDuration(days int) time.Duration {
+	return time.Duration(days) * 24 * time.Hour
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/parvit/qpep/shared"
+)
+
+// DEFAULT_INTERACTIVE_PORTS are the destination ports of the streams of the interactive class when
+// no rule matches them: ssh, telnet, dns, rdp and vnc
+var DEFAULT_INTERACTIVE_PORTS = []int{22, 23, 53, 3389, 5900}
+
+// ClassRule assigns a traffic class to the connections to a network, to a port or to both
+type ClassRule struct {
+	// Network matches every destination when nil, Port every port when 0
+	Network *net.IPNet
+	Port    int
+	Class   shared.TrafficClass
+}
+
+// ParseClassRules parses a comma separated list of destination=class rules, the destination being a
+// port, an address or network, or both as 10.0.0.0/8:873 or [2001:db8::/32]:873
+func ParseClassRules(value string) ([]ClassRule, error) {
+	var rules []ClassRule
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid class rule %q, expected destination=class", item)
+		}
+		class, err := shared.ParseTrafficClass(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		rule := ClassRule{Class: class}
+		destination, port := strings.TrimSpace(parts[0]), ""
+		if separator := strings.LastIndex(destination, ":"); separator >= 0 &&
+			(strings.HasPrefix(destination, "[") || strings.Count(destination, ":") == 1) {
+			destination, port = strings.Trim(destination[:separator], "[]"), destination[separator+1:]
+		} else if _, err = strconv.Atoi(destination); err == nil {
+			destination, port = "", destination
+		}
+		if port != "" {
+			if rule.Port, err = strconv.Atoi(port); err != nil || rule.Port < 1 || rule.Port > 65535 {
+				return nil, fmt.Errorf("invalid port in class rule %q", item)
+			}
+		}
+		if destination != "" {
+			if rule.Network, err = parseNetwork(destination); err != nil {
+				return nil, fmt.Errorf("invalid destination in class rule %q", item)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseNetwork parses a network in CIDR notation or a single address
+func parseNetwork(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", value)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+func (rule ClassRule) matches(destination *net.TCPAddr) bool {
+	if rule.Port != 0 && rule.Port != destination.Port {
+		return false
+	}
+	return rule.Network == nil || rule.Network.Contains(destination.IP)
+}
+
+// classOfDSCP returns the class of the DSCP marks of RFC 4594 with a matching class: telephony,
+// signaling, real-time and conferencing, and low-latency data are interactive; high-throughput,
+// low-priority and lower effort data are bulk
+func classOfDSCP(dscp int) (shared.TrafficClass, bool) {
+	switch dscp {
+	case 46, 40, 32, 34, 36, 38, 18, 20, 22:
+		return shared.CLASS_INTERACTIVE, true
+	case 10, 12, 14, 8, 1:
+		return shared.CLASS_BULK, true
+	}
+	return shared.CLASS_DEFAULT, false
+}
+
+// classify returns the traffic class of a connection to the destination: the class of the first
+// rule matching it, then the class of its DSCP mark when it can be read, then the interactive class
+// for the interactive ports and the default class otherwise
+func (client *Client) classify(conn net.Conn, destination *net.TCPAddr) shared.TrafficClass {
+	for _, rule := range client.config.ClassRules {
+		if rule.matches(destination) {
+			return rule.Class
+		}
+	}
+	if dscp, ok := connectionDSCP(conn); ok {
+		if class, ok := classOfDSCP(dscp); ok {
+			return class
+		}
+	}
+	for _, port := range client.config.InteractivePorts {
+		if destination.Port == port {
+			return shared.CLASS_INTERACTIVE
+		}
+	}
+	return shared.CLASS_DEFAULT
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/parvit/qpep/shared"
+)
+
+func TestParseClassRules(t *testing.T) {
+	rules, err := ParseClassRules("873=bulk, 10.0.0.0/8:22=bulk,192.168.1.10=interactive,[2001:db8::/32]:443=interactive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		network string
+		port    int
+		class   shared.TrafficClass
+	}{
+		{"", 873, shared.CLASS_BULK},
+		{"10.0.0.0/8", 22, shared.CLASS_BULK},
+		{"192.168.1.10/32", 0, shared.CLASS_INTERACTIVE},
+		{"2001:db8::/32", 443, shared.CLASS_INTERACTIVE},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("parsed %d rules, expected %d", len(rules), len(expected))
+	}
+	for i, rule := range rules {
+		network := ""
+		if rule.Network != nil {
+			network = rule.Network.String()
+		}
+		if network != expected[i].network || rule.Port != expected[i].port || rule.Class != expected[i].class {
+			t.Errorf("rule %d is %s:%d=%s, expected %s:%d=%s", i, network, rule.Port, rule.Class,
+				expected[i].network, expected[i].port, expected[i].class)
+		}
+	}
+
+	for _, invalid := range []string{"22", "22=urgent", "70000=bulk", "10.0.0.0/33=bulk", "example.com=bulk"} {
+		if _, err = ParseClassRules(invalid); err == nil {
+			t.Errorf("rule %q accepted", invalid)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	rules, err := ParseClassRules("10.0.0.0/8:22=bulk,10.1.0.0/16=interactive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := New(ClientConfig{ClassRules: rules, InteractivePorts: DEFAULT_INTERACTIVE_PORTS})
+	for _, test := range []struct {
+		destination string
+		class       shared.TrafficClass
+	}{
+		{"10.1.2.3:22", shared.CLASS_BULK},
+		{"10.1.2.3:80", shared.CLASS_INTERACTIVE},
+		{"172.16.0.1:22", shared.CLASS_INTERACTIVE},
+		{"172.16.0.1:80", shared.CLASS_DEFAULT},
+	} {
+		destination, err := net.ResolveTCPAddr("tcp", test.destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if class := client.classify(nil, destination); class != test.class {
+			t.Errorf("connection to %s in the %s class, expected %s", destination, class, test.class)
+		}
+	}
+
+	for _, test := range []struct {
+		dscp  int
+		class shared.TrafficClass
+		ok    bool
+	}{
+		{46, shared.CLASS_INTERACTIVE, true},
+		{8, shared.CLASS_BULK, true},
+		{0, shared.CLASS_DEFAULT, false},
+	} {
+		if class, ok := classOfDSCP(test.dscp); class != test.class || ok != test.ok {
+			t.Errorf("DSCP %d in the %s class, expected %s", test.dscp, class, test.class)
+		}
+	}
+}
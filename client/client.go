@@ -1,37 +1,31 @@
 package client
 
 import (
-	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"runtime/debug"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/parvit/qpep/admin"
+	"github.com/parvit/qpep/dialer"
+	"github.com/parvit/qpep/flows"
+	"github.com/parvit/qpep/logger"
+	"github.com/parvit/qpep/metrics"
 	"github.com/parvit/qpep/shared"
 	"github.com/parvit/qpep/windivert"
 	"golang.org/x/net/context"
 )
 
-var (
-	proxyListener       net.Listener
-	ClientConfiguration = ClientConfig{
-		ListenHost: "0.0.0.0", ListenPort: 9443,
-		GatewayHost: "198.56.1.10", GatewayPort: 443,
-		QuicStreamTimeout: 2, MultiStream: shared.QuicConfiguration.MultiStream,
-		ConnectionRetries: 3,
-		IdleTimeout:       time.Duration(300) * time.Second,
-		WinDivertThreads:  1,
-		Verbose:           false,
-	}
-	quicSession             quic.Session
-	QuicClientConfiguration = quic.Config{
-		MaxIncomingStreams: 40000,
-	}
-)
+// TRANSPORT_RETRY_INTERVAL is how long the sessions keep being opened on the fallback transport
+// before the preferred one is tried first again
+const TRANSPORT_RETRY_INTERVAL = 5 * time.Minute
+
+var errShuttingDown = errors.New("client is shutting down")
 
 type ClientConfig struct {
 	ListenHost        string
@@ -44,121 +38,468 @@ type ClientConfig struct {
 	ConnectionRetries int
 	WinDivertThreads  int
 	Verbose           bool
+	GatewayCAFile     string
+	GatewayPin        string
+	GatewayServerName string
+	ClientCertFile    string
+	ClientKeyFile     string
+	AuthToken         string
+	MetricsAddress    string
+	AdminAddress      string
+	Qlog              shared.QlogConfig
+	FlowRecords       flows.ExportConfig
+	// ShutdownGrace is the time given to the active streams to finish when the context of Start is done
+	ShutdownGrace time.Duration
+	// Transport is the preferred transport to the gateway, QUIC or TCP
+	Transport string
+	// TransportFallback opens the sessions on the other transport when the preferred one fails
+	TransportFallback bool
+	// Paths are the uplinks a session is kept open on at all times, the streams are then scheduled
+	// across them by PathPolicy; when empty the sessions are opened on demand from the default route
+	Paths      []PathConfig
+	PathPolicy string
+	// InteractivePorts are the destination ports of the streams of the interactive class, when no
+	// class rule matches them
+	InteractivePorts []int
+	// ClassRules assign the traffic class of the streams, the first rule matching the destination applies
+	ClassRules []ClassRule
+	// ClassSessions opens a session for each traffic class when no paths are configured, otherwise
+	// the streams of all the classes share the session
+	ClassSessions bool
+	// Migration moves the QUIC sessions to a new UDP socket when the local address changes
+	Migration bool
+	// FEC asks the gateway to protect the packets of the QUIC sessions with parity packets
+	FEC bool
+	// MaxPacketSize bounds the UDP payloads sent to the gateway, 0 leaves the size to MTUDiscovery
+	MaxPacketSize int
+	// MTUDiscovery probes the paths for the largest QUIC packets they carry, up to MaxPacketSize,
+	// otherwise the packets keep their initial size
+	MTUDiscovery bool
+	// Listener replaces the transparent proxy listener when set, e.g. with a plain TCP listener in tests
+	Listener net.Listener
+	// OriginalDestination returns the destination of an accepted connection when set, otherwise
+	// it is the local address of the connection as preserved by TPROXY or found by windivert
+	OriginalDestination func(conn net.Conn) *net.TCPAddr
 }
 
-func RunClient(ctx context.Context) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("PANIC: %v", err)
-			debug.PrintStack()
-		}
-		if proxyListener != nil {
-			proxyListener.Close()
+// DefaultConfig returns the configuration of a client with the default settings
+func DefaultConfig() ClientConfig {
+	return ClientConfig{
+		ListenHost: "0.0.0.0", ListenPort: 9443,
+		GatewayHost: "198.56.1.10", GatewayPort: 443,
+		QuicStreamTimeout: 2, MultiStream: true,
+		ConnectionRetries: 3,
+		IdleTimeout:       time.Duration(300) * time.Second,
+		WinDivertThreads:  1,
+		Verbose:           false,
+		ShutdownGrace:     10 * time.Second,
+		Transport:         shared.TRANSPORT_QUIC,
+		TransportFallback: true,
+		PathPolicy:        PATH_POLICY_SPLIT,
+		InteractivePorts:  DEFAULT_INTERACTIVE_PORTS,
+		Migration:         true,
+		ClassSessions:     true,
+		MTUDiscovery:      true,
+	}
+}
+
+// Client accepts the intercepted TCP connections and relays each of them on a QUIC stream to the
+// gateway, several clients can run in the same process
+type Client struct {
+	config   ClientConfig
+	metrics  *clientMetrics
+	flows    *flows.Registry
+	tracer   logging.Tracer
+	listener net.Listener
+	// closers are the metrics server, the admin server and the flow exporter, closed on shutdown
+	closers  []io.Closer
+	handlers sync.WaitGroup
+	streams  shared.ActiveStreams
+
+	shutdownOnce sync.Once
+	shutdownDone chan struct{}
+	shutdownErr  error
+	// closingCtx is canceled when the shutdown starts, it stops the sessions being opened
+	closingCtx    context.Context
+	cancelClosing context.CancelFunc
+
+	sessionMtx sync.Mutex
+	closing    bool
+	// classSessions are the sessions opened on demand by traffic class, only the one of the default
+	// class is used when ClassSessions is not set
+	classSessions [shared.TRAFFIC_CLASSES]classSession
+	sessions      map[quic.Session]struct{}
+	// defaultPath is the path of the sessions opened on demand when no paths are configured
+	defaultPath *path
+	paths       []*path
+	// pathsChanged is closed and replaced each time a path goes up or down
+	pathsChanged chan struct{}
+}
+
+type classSession struct {
+	session     quic.Session
+	flowSession *flows.Session
+	// dial is the session being opened when MultiStream is set, the streams opened meanwhile wait
+	// for it instead of opening their own
+	dial *sessionDial
+}
+
+// sessionDial is a session being opened outside of the session lock, done is closed once err is set
+// or the session is published in its class
+type sessionDial struct {
+	done chan struct{}
+	err  error
+}
+
+func New(config ClientConfig) *Client {
+	instanceMetrics := newClientMetrics()
+	closingCtx, cancelClosing := context.WithCancel(context.Background())
+	client := &Client{
+		config:        config,
+		metrics:       instanceMetrics,
+		flows:         flows.NewRegistry(),
+		tracer:        instanceMetrics.tracer,
+		shutdownDone:  make(chan struct{}),
+		closingCtx:    closingCtx,
+		cancelClosing: cancelClosing,
+		sessions:      make(map[quic.Session]struct{}),
+		pathsChanged:  make(chan struct{}),
+	}
+	client.defaultPath = &path{}
+	return client
+}
+
+// Start opens the listener and the optional services and returns, the client then runs until
+// Shutdown is called or ctx is done
+func (client *Client) Start(ctx context.Context) error {
+	if err := client.start(); err != nil {
+		client.closeServices()
+		return err
+	}
+	client.handlers.Add(1 + len(client.paths))
+	go client.acceptConnections()
+	for _, p := range client.paths {
+		go client.keepPath(p)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			graceCtx, cancel := context.WithTimeout(context.Background(), client.config.ShutdownGrace)
+			defer cancel()
+			client.Shutdown(graceCtx)
+		case <-client.shutdownDone:
 		}
 	}()
-	log.Println("Starting TCP-QPEP Tunnel Listener")
-	log.Printf("Binding to TCP %s:%d", ClientConfiguration.ListenHost, ClientConfiguration.ListenPort)
-	var err error
-	proxyListener, err = NewClientProxyListener("tcp", &net.TCPAddr{IP: net.ParseIP(ClientConfiguration.ListenHost),
-		Port: ClientConfiguration.ListenPort})
+	return nil
+}
+
+func (client *Client) start() error {
+	config := client.config
+	if config.Transport != shared.TRANSPORT_QUIC && config.Transport != shared.TRANSPORT_TCP {
+		return fmt.Errorf("unknown transport %q, expected %s or %s", config.Transport, shared.TRANSPORT_QUIC, shared.TRANSPORT_TCP)
+	}
+	if err := validatePaths(config); err != nil {
+		return err
+	}
+	if err := shared.ValidateMaxPacketSize(config.MaxPacketSize, config.FEC); err != nil {
+		return err
+	}
+	if config.MetricsAddress != "" {
+		metricsServer, err := metrics.StartServer(config.MetricsAddress, client.metrics.registry)
+		if err != nil {
+			return fmt.Errorf("start metrics server: %w", err)
+		}
+		client.closers = append(client.closers, metricsServer)
+		logger.Info("Serving metrics on http://%s/metrics", metricsServer.Addr())
+	}
+	if config.AdminAddress != "" {
+		adminServer, err := admin.StartServer(config.AdminAddress, client.flows)
+		if err != nil {
+			return fmt.Errorf("start admin API: %w", err)
+		}
+		client.closers = append(client.closers, adminServer)
+		logger.Info("Serving admin API on %s", config.AdminAddress)
+	}
+	if config.Qlog.Directory != "" {
+		qlogTracer, err := shared.NewQlogTracer(config.Qlog, "client")
+		if err != nil {
+			return fmt.Errorf("enable qlog tracing: %w", err)
+		}
+		client.tracer = logging.NewMultiplexedTracer(client.metrics.tracer, qlogTracer)
+		logger.Info("Writing qlog traces to %s", config.Qlog.Directory)
+	}
+	client.defaultPath.tracer = client.tracer
+	for _, pathConfig := range config.Paths {
+		client.paths = append(client.paths, client.newPath(pathConfig))
+	}
+	if config.FlowRecords.Destination != "" {
+		exporter, err := flows.NewExporter(config.FlowRecords, "client")
+		if err != nil {
+			return fmt.Errorf("open flow records destination: %w", err)
+		}
+		client.closers = append(client.closers, exporter)
+		client.flows.OnStreamClosed(func(record flows.FlowRecord) {
+			if err := exporter.Export(record); err != nil {
+				logger.With("conn", record.ConnectionID).Error("Unable to export flow record: %s", err)
+			}
+		})
+		logger.Info("Exporting flow records to %s", config.FlowRecords.Destination)
+	}
+	logger.Info("Starting TCP-QPEP Tunnel Listener")
+	if config.Listener != nil {
+		client.listener = config.Listener
+		return nil
+	}
+	logger.Debug("Binding to TCP %s:%d", config.ListenHost, config.ListenPort)
+	listener, err := NewClientProxyListener("tcp", &net.TCPAddr{IP: net.ParseIP(config.ListenHost), Port: config.ListenPort})
 	if err != nil {
-		log.Printf("Encountered error when binding client proxy listener: %s", err)
-		return
+		return fmt.Errorf("bind client proxy listener: %w", err)
 	}
+	client.listener = listener
+	return nil
+}
 
-	go ListenTCPConn()
+// Addr returns the address of the proxy listener once started
+func (client *Client) Addr() net.Addr {
+	return client.listener.Addr()
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			proxyListener.Close()
-			return
-		case <-time.After(10 * time.Millisecond):
-			continue
+// Shutdown refuses new connections and gives the active streams until ctx is done to finish, the
+// streams still active are then reset and the QUIC sessions closed; it returns once the client has
+// stopped, further calls wait for the first one to complete
+func (client *Client) Shutdown(ctx context.Context) error {
+	client.shutdownOnce.Do(func() {
+		go client.shutdown(ctx)
+	})
+	<-client.shutdownDone
+	return client.shutdownErr
+}
+
+func (client *Client) shutdown(ctx context.Context) {
+	defer close(client.shutdownDone)
+	logger.Info("Shutting down client, draining active streams")
+	if client.listener != nil {
+		client.listener.Close()
+	}
+	client.sessionMtx.Lock()
+	client.closing = true
+	client.sessionMtx.Unlock()
+	client.cancelClosing()
+
+	if reset := client.streams.Drain(ctx); reset > 0 {
+		logger.Warning("Reset %d streams still active at the end of the grace period", reset)
+	}
+	client.sessionMtx.Lock()
+	for session := range client.sessions {
+		session.CloseWithError(shared.QPEP_ERROR_SHUTDOWN, "client shutdown")
+	}
+	client.sessionMtx.Unlock()
+
+	client.handlers.Wait()
+	client.shutdownErr = client.closeServices()
+}
+
+func (client *Client) closeServices() error {
+	var firstErr error
+	for _, closer := range client.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
+	client.closers = nil
+	return firstErr
 }
 
-func ListenTCPConn() {
+func (client *Client) acceptConnections() {
+	defer client.handlers.Done()
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("PANIC: %v", err)
+			logger.Error("PANIC: %v", err)
 			debug.PrintStack()
 		}
 	}()
 	for {
-		conn, err := proxyListener.Accept()
+		conn, err := client.listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-				log.Printf("Temporary error when accepting connection: %s", netErr)
+				logger.Warning("Temporary error when accepting connection: %s", netErr)
 			}
-			log.Printf("Unrecoverable error while accepting connection: %s", err)
+			logger.Error("Unrecoverable error while accepting connection: %s", err)
 			return
 		}
 
-		go handleTCPConn(conn)
+		client.handlers.Add(1)
+		go func() {
+			defer client.handlers.Done()
+			client.handleTCPConn(conn)
+		}()
 	}
 }
 
-func handleTCPConn(tcpConn net.Conn) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("PANIC: %v", err)
-			debug.PrintStack()
+// openStream opens a stream on one of the paths when they are configured, otherwise on the current
+// session of the traffic class when multiple streams are allowed and on a new session, which
+// replaces the current one; the path is nil for the sessions opened on demand
+func (client *Client) openStream(connLog *logger.Logger, class shared.TrafficClass) (quic.Stream, *flows.Session, *path, error) {
+	if len(client.paths) > 0 {
+		return client.openPathStream(connLog, class)
+	}
+	if !client.config.ClassSessions {
+		class = shared.CLASS_DEFAULT
+	}
+	current := &client.classSessions[class]
+	sessionDied := false
+	client.sessionMtx.Lock()
+	for {
+		if client.closing {
+			client.sessionMtx.Unlock()
+			return nil, nil, nil, errShuttingDown
 		}
-	}()
-	log.Printf("Accepting TCP connection from %s with destination of %s", tcpConn.RemoteAddr().String(), tcpConn.LocalAddr().String())
-	defer tcpConn.Close()
-	var quicStream quic.Stream = nil
-	// if we allow for multiple streams in a session, lets try and open on the existing session
-	if ClientConfiguration.MultiStream {
-		//if we have already opened a quic session, lets check if we've expired our stream
-		if quicSession != nil {
-			var err error
-			log.Printf("Trying to open on existing session")
-			quicStream, err = quicSession.OpenStream()
+		// if we allow for multiple streams in a session, lets try and open on the existing session
+		if client.config.MultiStream && current.session != nil {
+			connLog.Debug("Trying to open on existing %s session", class)
+			quicStream, err := current.session.OpenStream()
 			// if we weren't able to open a quicStream on that session (usually inactivity timeout), we can try to open a new session
-			if err != nil {
-				log.Printf("Unable to open new stream on existing QUIC session: %s\n", err)
-				quicStream = nil
-			} else {
-				log.Printf("Opened a new stream: %d", quicStream.StreamID())
+			if err == nil {
+				connLog.Debug("Opened a new stream: %d", quicStream.StreamID())
+				flowSession := current.flowSession
+				client.sessionMtx.Unlock()
+				return quicStream, flowSession, nil, nil
 			}
+			connLog.Error("Unable to open new stream on existing QUIC session: %s", err)
+			// the stream limit is temporary, any other error means the session is closed
+			netErr, ok := err.(net.Error)
+			sessionDied = sessionDied || !ok || !netErr.Temporary()
+		}
+		if !client.config.MultiStream || current.dial == nil {
+			break
 		}
+		// another stream is already opening the session of the class
+		dial := current.dial
+		client.sessionMtx.Unlock()
+		select {
+		case <-dial.done:
+		case <-client.closingCtx.Done():
+			return nil, nil, nil, errShuttingDown
+		}
+		if dial.err != nil {
+			return nil, nil, nil, dial.err
+		}
+		client.sessionMtx.Lock()
 	}
-	// if we haven't opened a stream from multistream, we can open one with a new session
-	if quicStream == nil {
-		// open a new quicSession (with all the TLS jazz)
-		var err error
-		quicSession, err = openQuicSession()
-		// if we were unable to open a quic session, drop the TCP connection with RST
-		if err != nil {
-			return
+
+	// open a new session (with all the TLS jazz), without the lock so that the other streams and the
+	// shutdown are not blocked by the handshake
+	dial := &sessionDial{done: make(chan struct{})}
+	if client.config.MultiStream {
+		current.dial = dial
+	}
+	client.sessionMtx.Unlock()
+	session, err := client.openSession(client.closingCtx, client.defaultPath)
+	client.sessionMtx.Lock()
+	if current.dial == dial {
+		current.dial = nil
+	}
+	if client.closing {
+		if err == nil {
+			session.CloseWithError(shared.QPEP_ERROR_SHUTDOWN, "client shutdown")
 		}
+		err = errShuttingDown
+	}
+	if err != nil {
+		dial.err = err
+		close(dial.done)
+		client.sessionMtx.Unlock()
+		return nil, nil, nil, err
+	}
+	// the new session is a reconnect only when it replaces a closed one, not when each stream gets
+	// its own session
+	if current.session != nil && (sessionDied || current.session.Context().Err() != nil) {
+		client.metrics.reconnects.Inc()
+	}
+	flowSession := client.trackSession(session)
+	current.session = session
+	current.flowSession = flowSession
+	close(dial.done)
+	client.sessionMtx.Unlock()
 
-		//Open a stream to send data on this new session
-		quicStream, err = quicSession.OpenStreamSync(context.Background())
-		// if we cannot open a stream on this session, send a TCP RST and let the client decide to try again
-		if err != nil {
-			log.Printf("Unable to open QUIC stream: %s\n", err)
-			return
+	//Open a stream to send data on this new session
+	quicStream, err := session.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return quicStream, flowSession, nil, nil
+}
+
+// MigrateSessions moves the open QUIC sessions to new UDP sockets, as done when the local address
+// changes, and returns the number of sessions migrated
+func (client *Client) MigrateSessions() int {
+	client.sessionMtx.Lock()
+	sessions := make([]quic.Session, 0, len(client.sessions))
+	for session := range client.sessions {
+		sessions = append(sessions, session)
+	}
+	client.sessionMtx.Unlock()
+	migrated := 0
+	for _, session := range sessions {
+		if err := dialer.MigrateSession(session); err != nil {
+			if err != dialer.ErrNotMigratable {
+				logger.Warning("Unable to migrate session to %s: %s", session.RemoteAddr(), err)
+			}
+			continue
 		}
+		migrated++
 	}
-	defer quicStream.Close()
+	return migrated
+}
 
-	//We want to wait for both the upstream and downstream to finish so we'll set a wait group for the threads
-	var streamWait sync.WaitGroup
-	streamWait.Add(2)
+// trackSession counts a new session and lists it in the flows until it ends, it is called with
+// the session lock held
+func (client *Client) trackSession(session quic.Session) *flows.Session {
+	client.metrics.sessionsActive.Inc()
+	flowSession := client.flows.AddSession(session.RemoteAddr().String(), "", func() {
+		session.CloseWithError(shared.QPEP_ERROR_ADMIN_ABORTED, "aborted by administrator")
+	})
+	client.sessions[session] = struct{}{}
+	client.handlers.Add(1)
+	go func() {
+		defer client.handlers.Done()
+		<-session.Context().Done()
+		flowSession.Remove()
+		client.metrics.sessionsActive.Dec()
+		client.sessionMtx.Lock()
+		delete(client.sessions, session)
+		client.sessionMtx.Unlock()
+	}()
+	return flowSession
+}
+
+func (client *Client) handleTCPConn(tcpConn net.Conn) {
+	connectionID := shared.NewConnectionID()
+	connLog := logger.With("conn", connectionID)
+	defer func() {
+		if err := recover(); err != nil {
+			connLog.Error("PANIC: %v", err)
+			debug.PrintStack()
+		}
+	}()
+	connLog.Info("Accepting TCP connection from %s with destination of %s", tcpConn.RemoteAddr().String(), tcpConn.LocalAddr().String())
+	defer tcpConn.Close()
 
 	//Set our custom header to the QUIC session so the server can generate the correct TCP handshake on the other side
 	sessionHeader := shared.QpepHeader{
-		SourceAddr: tcpConn.RemoteAddr().(*net.TCPAddr),
-		DestAddr:   tcpConn.LocalAddr().(*net.TCPAddr),
+		SourceAddr:   tcpConn.RemoteAddr().(*net.TCPAddr),
+		DestAddr:     tcpConn.LocalAddr().(*net.TCPAddr),
+		ConnectionID: connectionID,
 	}
 
 	diverted, srcPort, dstPort, srcAddress, dstAddress := windivert.GetConnectionStateData(sessionHeader.SourceAddr.Port)
-	if diverted == windivert.DIVERT_OK {
-		log.Printf("Diverted connection: %v:%v %v:%v", srcAddress, srcPort, dstAddress, dstPort)
+	if client.config.OriginalDestination != nil {
+		sessionHeader.DestAddr = client.config.OriginalDestination(tcpConn)
+	} else if diverted == windivert.DIVERT_OK {
+		connLog.Debug("Diverted connection: %v:%v %v:%v", srcAddress, srcPort, dstAddress, dstPort)
 
 		sessionHeader.DestAddr = &net.TCPAddr{
 			IP:   net.ParseIP(dstAddress),
@@ -166,35 +507,81 @@ func handleTCPConn(tcpConn net.Conn) {
 		}
 	}
 
-	log.Printf("Sending QUIC header to server, SourceAddr: %v / DestAddr: %v", sessionHeader.SourceAddr, sessionHeader.DestAddr)
+	sessionHeader.Class = client.classify(tcpConn, sessionHeader.DestAddr)
+	connLog.Debug("Connection to %s is in the %s class", sessionHeader.DestAddr, sessionHeader.Class)
+
+	streamOpenStart := time.Now()
+	quicStream, flowSession, streamPath, err := client.openStream(connLog, sessionHeader.Class)
+	// if we cannot open a stream, send a TCP RST and let the client decide to try again
+	if err != nil {
+		connLog.Error("Unable to open QUIC stream: %s", err)
+		return
+	}
+	defer quicStream.Close()
+	defer client.releasePath(streamPath)
+	if !client.streams.Add(quicStream) {
+		connLog.Info("Refusing connection, the client is shutting down")
+		quicStream.CancelRead(shared.QPEP_ERROR_SHUTDOWN)
+		quicStream.CancelWrite(shared.QPEP_ERROR_SHUTDOWN)
+		return
+	}
+	defer client.streams.Remove(quicStream)
+	client.streams.SetReset(quicStream, func() { tcpConn.Close() })
+	client.metrics.streamOpenTime.Observe(time.Since(streamOpenStart).Seconds())
+	client.metrics.streamsActive.Inc()
+	defer client.metrics.streamsActive.Dec()
+	classBytesUp, classBytesDown := client.metrics.classes.Stream(sessionHeader.Class)
+
+	//We want to wait for both the upstream and downstream to finish so we'll set a wait group for the threads
+	var streamWait sync.WaitGroup
+	streamWait.Add(2)
+
+	flowStream := flowSession.AddStream(connectionID.String(), int64(quicStream.StreamID()),
+		sessionHeader.SourceAddr.String(), sessionHeader.DestAddr.String())
+	defer flowStream.Remove()
+	flowStream.SetAbort(func() {
+		flowStream.SetCloseReason(flows.CLOSE_RST)
+		quicStream.CancelRead(shared.QPEP_ERROR_ADMIN_ABORTED)
+		quicStream.CancelWrite(shared.QPEP_ERROR_ADMIN_ABORTED)
+		tcpConn.Close()
+	})
+
+	connLog.Debug("Sending QUIC header to server, SourceAddr: %v / DestAddr: %v", sessionHeader.SourceAddr, sessionHeader.DestAddr)
 
-	_, err := quicStream.Write(sessionHeader.ToBytes())
+	_, err = quicStream.Write(sessionHeader.ToBytes())
 	if err != nil {
-		log.Printf("Error writing to quic stream: %s", err.Error())
+		connLog.Error("Error writing to quic stream: %s", err.Error())
+		flowStream.SetCloseReason(flows.CLOSE_ERROR)
+		quicStream.CancelRead(shared.QPEP_ERROR_CONNECTION_FAILED)
+		return
 	}
+	flowStream.SetState(flows.STATE_OPEN)
 
+	// each direction is half-closed on its own, a FIN is forwarded as a FIN and an error resets the other side
 	streamQUICtoTCP := func(dst *net.TCPConn, src quic.Stream) {
-		_, err := io.Copy(dst, src)
-		dst.SetLinger(3)
-		dst.Close()
-		//src.CancelRead(1)
-		//src.Close()
+		_, err := io.Copy(flowStream.Writer(metrics.CountingWriter(metrics.CountingWriter(dst, client.metrics.bytesDown), classBytesDown), false), src)
 		if err != nil {
-			log.Printf("Error on Copy %s", err)
+			connLog.Warning("Error on Copy %s", err)
+			dst.SetLinger(0)
+			dst.Close()
+		} else {
+			dst.CloseWrite()
 		}
+		flowStream.SetCloseReason(shared.CloseReason(err))
+		flowStream.SetState(flows.STATE_HALF_CLOSED)
 		streamWait.Done()
 	}
 
 	streamTCPtoQUIC := func(dst quic.Stream, src *net.TCPConn) {
-		_, err := io.Copy(dst, src)
-		src.SetLinger(3)
-		src.Close()
-		//src.CloseWrite()
-		//dst.CancelWrite(1)
-		//dst.Close()
+		_, err := io.Copy(flowStream.Writer(metrics.CountingWriter(metrics.CountingWriter(dst, client.metrics.bytesUp), classBytesUp), true), src)
 		if err != nil {
-			log.Printf("Error on Copy %s", err)
+			connLog.Warning("Error on Copy %s", err)
+			dst.CancelWrite(shared.QPEP_ERROR_CONNECTION_FAILED)
+		} else {
+			dst.Close()
 		}
+		flowStream.SetCloseReason(shared.CloseReason(err))
+		flowStream.SetState(flows.STATE_HALF_CLOSED)
 		streamWait.Done()
 	}
 
@@ -204,25 +591,70 @@ func handleTCPConn(tcpConn net.Conn) {
 
 	//we exit (and close the TCP connection) once both streams are done copying
 	streamWait.Wait()
-	quicStream.Close()
-	log.Printf("Done sending data on %d", quicStream.StreamID())
+	tcpConn.(*net.TCPConn).SetLinger(3)
+	connLog.Debug("Done sending data on %d", quicStream.StreamID())
 }
 
-func openQuicSession() (quic.Session, error) {
-	var err error
+// openSession dials the gateway from the path on the preferred transport, or on the fallback one
+// while it recently had to be used on the path
+func (client *Client) openSession(ctx context.Context, p *path) (quic.Session, error) {
 	var session quic.Session
-	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"qpep"}}
-	gatewayPath := ClientConfiguration.GatewayHost + ":" + strconv.Itoa(ClientConfiguration.GatewayPort)
-	quicClientConfig := QuicClientConfiguration
-	for i := 0; i < ClientConfiguration.ConnectionRetries; i++ {
-		session, err = quic.DialAddr(gatewayPath, tlsConf, &quicClientConfig)
+	var err error
+	preferred := client.config.Transport
+	gateway := dialer.Config{
+		GatewayHost:       client.config.GatewayHost,
+		GatewayPort:       client.config.GatewayPort,
+		GatewayCAFile:     client.config.GatewayCAFile,
+		GatewayPin:        client.config.GatewayPin,
+		GatewayServerName: client.config.GatewayServerName,
+		ClientCertFile:    client.config.ClientCertFile,
+		ClientKeyFile:     client.config.ClientKeyFile,
+		AuthToken:         client.config.AuthToken,
+		Tracer:            p.tracer,
+		Transport:         preferred,
+		Fallback:          client.config.TransportFallback,
+		LocalAddress:      p.config.SourceAddress,
+		Interface:         p.config.Interface,
+		// the session of a path stays open while it has no streams
+		KeepAlive:           p != client.defaultPath,
+		Migrate:             client.config.Migration,
+		FEC:                 client.config.FEC,
+		FECRecovered:        client.metrics.fecRecovered.Inc,
+		MTUDropped:          client.metrics.mtuDropped.Inc,
+		MaxPacketSize:       client.config.MaxPacketSize,
+		DisableMTUDiscovery: !client.config.MTUDiscovery,
+	}
+	p.fallbackMtx.Lock()
+	fallback := client.config.TransportFallback && time.Now().Before(p.fallbackUntil)
+	p.fallbackMtx.Unlock()
+	if fallback {
+		gateway.Transport = shared.FallbackTransport(preferred)
+	}
+	for i := 0; i < client.config.ConnectionRetries; i++ {
+		session, err = dialer.DialSession(ctx, gateway)
 		if err == nil {
+			transport := shared.SessionTransport(session)
+			client.metrics.countSession(transport)
+			p.fallbackMtx.Lock()
+			if transport == preferred {
+				p.fallbackUntil = time.Time{}
+			} else {
+				if p.fallbackUntil.IsZero() {
+					logger.Warning("Opened session on the %s fallback transport, %s will be tried again in %s", transport, preferred, TRANSPORT_RETRY_INTERVAL)
+				}
+				client.metrics.fallbacks.Inc()
+				p.fallbackUntil = time.Now().Add(TRANSPORT_RETRY_INTERVAL)
+			}
+			p.fallbackMtx.Unlock()
 			return session, nil
+		} else if ctx.Err() != nil {
+			return nil, err
 		} else {
-			log.Printf("Failed to Open QUIC Session: %s\n    Retrying...\n", err)
+			client.metrics.dialFailures.Inc()
+			logger.Warning("Failed to Open Session: %s, retrying", err)
 		}
 	}
 
-	log.Printf("Max Retries Exceeded. Unable to Open QUIC Session: %s\n", err)
+	logger.Error("Max Retries Exceeded. Unable to Open Session: %s", err)
 	return nil, err
 }
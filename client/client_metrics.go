@@ -0,0 +1,121 @@
+package client
+
+import (
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/parvit/qpep/metrics"
+	"github.com/parvit/qpep/shared"
+)
+
+// clientMetrics are the metrics of a client instance, each instance has its own registry
+type clientMetrics struct {
+	registry *metrics.Registry
+
+	sessionsActive  *metrics.Gauge
+	streamsActive   *metrics.Gauge
+	bytesUp         *metrics.Counter
+	bytesDown       *metrics.Counter
+	dialFailures    *metrics.Counter
+	streamOpenTime  *metrics.Histogram
+	reconnects      *metrics.Counter
+	sessionsQUIC    *metrics.Counter
+	sessionsTCP     *metrics.Counter
+	fallbacks       *metrics.Counter
+	quicRTT         *metrics.Histogram
+	quicPacketsSent *metrics.Counter
+	quicPacketsLost *metrics.Counter
+	quicPacketSize  *metrics.Gauge
+	pathUp          *metrics.GaugeVec
+	pathRTT         *metrics.GaugeVec
+	pathStreams     *metrics.GaugeVec
+	fecRecovered    *metrics.Counter
+	mtuDropped      *metrics.Counter
+	classes         *shared.ClassMetrics
+	tracer          logging.Tracer
+}
+
+func newClientMetrics() *clientMetrics {
+	registry := metrics.NewRegistry("qpep_client")
+	bytesTotal := registry.CounterVec("bytes_total", "Bytes proxied through the tunnel", "direction")
+	sessionsTotal := registry.CounterVec("sessions_total", "Sessions opened to the gateway", "transport")
+	m := &clientMetrics{
+		registry:        registry,
+		sessionsActive:  registry.Gauge("sessions_active", "QUIC sessions currently open to the gateway"),
+		streamsActive:   registry.Gauge("streams_active", "QUIC streams currently proxying a TCP connection"),
+		bytesUp:         bytesTotal.WithLabelValues("upstream"),
+		bytesDown:       bytesTotal.WithLabelValues("downstream"),
+		dialFailures:    registry.Counter("dial_failures_total", "Failed attempts to open a QUIC session to the gateway"),
+		streamOpenTime:  registry.Histogram("stream_open_seconds", "Time taken to open a QUIC stream, including the session when needed", metrics.DefaultLatencyBuckets),
+		reconnects:      registry.Counter("session_reconnects_total", "QUIC sessions opened to replace a previous session"),
+		sessionsQUIC:    sessionsTotal.WithLabelValues(shared.TRANSPORT_QUIC),
+		sessionsTCP:     sessionsTotal.WithLabelValues(shared.TRANSPORT_TCP),
+		fallbacks:       registry.Counter("transport_fallbacks_total", "Sessions opened on the fallback transport"),
+		quicRTT:         registry.Histogram("quic_rtt_seconds", "Smoothed round trip time of the QUIC sessions", metrics.DefaultLatencyBuckets),
+		quicPacketsSent: registry.Counter("quic_packets_sent_total", "QUIC packets sent"),
+		quicPacketsLost: registry.Counter("quic_packets_lost_total", "QUIC packets declared lost"),
+		quicPacketSize:  registry.Gauge("quic_packet_size_bytes", "Smallest, across the live QUIC sessions, of the largest packet acknowledged by the gateway as grown by the path MTU discovery"),
+		pathUp:          registry.GaugeVec("path_up", "Whether the session of the path to the gateway is open", "path"),
+		pathRTT:         registry.GaugeVec("path_rtt_seconds", "Smoothed round trip time of the path to the gateway", "path"),
+		pathStreams:     registry.GaugeVec("path_streams_active", "Streams currently open on the path to the gateway", "path"),
+		fecRecovered:    registry.Counter("fec_recovered_packets_total", "QUIC packets of the gateway recovered by FEC"),
+		mtuDropped:      registry.Counter("oversized_packets_dropped_total", "Packets to the gateway dropped as larger than the max packet size or than the socket allows"),
+		classes:         shared.NewClassMetrics(registry),
+	}
+	m.tracer = shared.NewQuicMetricsTracer(shared.QuicMetrics{RTT: m.quicRTT, PacketsSent: m.quicPacketsSent, PacketsLost: m.quicPacketsLost, PacketSize: m.quicPacketSize})
+	return m
+}
+
+// countSession counts a session opened on the transport
+func (m *clientMetrics) countSession(transport string) {
+	if transport == shared.TRANSPORT_TCP {
+		m.sessionsTCP.Inc()
+	} else {
+		m.sessionsQUIC.Inc()
+	}
+}
+
+// Stats is a snapshot of the counters of a client
+type Stats struct {
+	SessionsActive int
+	StreamsActive  int
+	BytesUp        uint64
+	BytesDown      uint64
+	DialFailures   uint64
+	Reconnects     uint64
+	SessionsQUIC   uint64
+	SessionsTCP    uint64
+	Fallbacks      uint64
+	FECRecovered   uint64
+	MTUDropped     uint64
+	// PacketSize is the smallest, across the live QUIC sessions, of the largest packet acknowledged by the gateway
+	PacketSize int
+	// Paths are the configured paths, in the order of the configuration
+	Paths []PathStats
+	// Classes are the counters of the streams of each traffic class
+	Classes []shared.ClassStats
+}
+
+// Stats returns the current counters of the client
+func (client *Client) Stats() Stats {
+	m := client.metrics
+	return Stats{
+		SessionsActive: int(m.sessionsActive.Value()),
+		StreamsActive:  int(m.streamsActive.Value()),
+		BytesUp:        uint64(m.bytesUp.Value()),
+		BytesDown:      uint64(m.bytesDown.Value()),
+		DialFailures:   uint64(m.dialFailures.Value()),
+		Reconnects:     uint64(m.reconnects.Value()),
+		SessionsQUIC:   uint64(m.sessionsQUIC.Value()),
+		SessionsTCP:    uint64(m.sessionsTCP.Value()),
+		Fallbacks:      uint64(m.fallbacks.Value()),
+		FECRecovered:   uint64(m.fecRecovered.Value()),
+		MTUDropped:     uint64(m.mtuDropped.Value()),
+		PacketSize:     int(m.quicPacketSize.Value()),
+		Paths:          client.pathStats(),
+		Classes:        m.classes.Stats(),
+	}
+}
+
+// Metrics returns the registry of the client metrics
+func (client *Client) Metrics() *metrics.Registry {
+	return client.metrics.registry
+}
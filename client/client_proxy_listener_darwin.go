@@ -44,16 +44,28 @@ func NewClientProxyListener(network string, laddr *net.TCPAddr) (net.Listener, e
 		return nil, err
 	}
 
-	//Find associated file descriptor for listener to set socket options on
-	fileDescriptorSource, err := listener.File()
+	//Find associated file descriptor for listener to set socket options on, File() is not used as it
+	//would switch the socket to blocking mode and Close would not interrupt Accept anymore
+	rawConn, err := listener.SyscallConn()
 	if err != nil {
+		listener.Close()
 		return nil, &net.OpError{Op: "ClientListener", Net: network, Source: nil, Addr: laddr, Err: fmt.Errorf("get file descriptor: %s", err)}
 	}
-	defer fileDescriptorSource.Close()
 
-	if err = syscall.SetsockoptInt(int(fileDescriptorSource.Fd()), syscall.IPPROTO_TCP, unix.TCP_FASTOPEN, 1); err != nil {
-		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: laddr, Err: fmt.Errorf("set socket option: TCP_FASTOPEN: %s", err)}
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, unix.TCP_FASTOPEN, 1); err != nil {
+			sockoptErr = fmt.Errorf("set socket option: TCP_FASTOPEN: %s", err)
+		}
+	})
+	if err == nil {
+		err = sockoptErr
 	}
+	if err != nil {
+		listener.Close()
+		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: laddr, Err: err}
+	}
+
 	//return a derived TCP listener object with TCProxy support
 	return &ClientProxyListener{base: listener}, nil
 }
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"net"
+	"syscall"
+)
+
+// connectionDSCP returns the DSCP mark of an accepted connection, which is the one of the client
+// when the kernel reflects the TOS of the SYN in the accepted sockets (net.ipv4.tcp_reflect_tos)
+func connectionDSCP(conn net.Conn) (int, bool) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, false
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	level, option := syscall.IPPROTO_IP, syscall.IP_TOS
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok && remote.IP.To4() == nil {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	var tos int
+	var sockErr error
+	if err = rawConn.Control(func(fd uintptr) {
+		tos, sockErr = syscall.GetsockoptInt(int(fd), level, option)
+	}); err != nil || sockErr != nil || tos == 0 {
+		return 0, false
+	}
+	return tos >> 2, true
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import "net"
+
+// connectionDSCP returns the DSCP mark of an accepted connection, it is only read on linux
+func connectionDSCP(conn net.Conn) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,367 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/parvit/qpep/flows"
+	"github.com/parvit/qpep/logger"
+	"github.com/parvit/qpep/metrics"
+	"github.com/parvit/qpep/shared"
+)
+
+const (
+	// PATH_POLICY_SPLIT opens the streams of the interactive class on the path with the lowest RTT
+	// and the other streams on the path with the highest capacity
+	PATH_POLICY_SPLIT = "split"
+	// PATH_POLICY_LOWEST_RTT opens every stream on the path with the lowest RTT
+	PATH_POLICY_LOWEST_RTT = "lowest-rtt"
+	// PATH_POLICY_HIGHEST_CAPACITY opens every stream on the path with the highest capacity
+	PATH_POLICY_HIGHEST_CAPACITY = "highest-capacity"
+	// PATH_POLICY_BALANCE opens every stream on the path with the fewest active streams
+	PATH_POLICY_BALANCE = "balance"
+
+	// PATH_RETRY_INTERVAL is the time between the attempts to open the session of a path that is down
+	PATH_RETRY_INTERVAL = 10 * time.Second
+	// PATH_WAIT_TIMEOUT is how long a connection waits for a path to come up when all of them are down
+	PATH_WAIT_TIMEOUT = 10 * time.Second
+)
+
+// PathConfig is a local uplink the client keeps a session to the gateway on, selected by source
+// address, by network interface or both
+type PathConfig struct {
+	Name          string
+	SourceAddress net.IP
+	// Interface binds the session to a network interface, only supported on linux
+	Interface string
+}
+
+// ParsePaths parses a comma separated list of source addresses and interface names, each of them
+// named after itself
+func ParsePaths(value string) []PathConfig {
+	var paths []PathConfig
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		path := PathConfig{Name: item}
+		if path.SourceAddress = net.ParseIP(item); path.SourceAddress == nil {
+			path.Interface = item
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// ParsePorts parses a comma separated list of ports
+func ParsePorts(value string) ([]int, error) {
+	var ports []int
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		port, err := strconv.Atoi(item)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// validatePaths checks the multipath settings of the configuration
+func validatePaths(config ClientConfig) error {
+	if len(config.Paths) == 0 {
+		return nil
+	}
+	if !config.MultiStream {
+		return fmt.Errorf("multiple paths require multiple streams per session")
+	}
+	switch config.PathPolicy {
+	case PATH_POLICY_SPLIT, PATH_POLICY_LOWEST_RTT, PATH_POLICY_HIGHEST_CAPACITY, PATH_POLICY_BALANCE:
+	default:
+		return fmt.Errorf("unknown path policy %q, expected %s, %s, %s or %s", config.PathPolicy,
+			PATH_POLICY_SPLIT, PATH_POLICY_LOWEST_RTT, PATH_POLICY_HIGHEST_CAPACITY, PATH_POLICY_BALANCE)
+	}
+	names := make(map[string]bool)
+	for _, path := range config.Paths {
+		if path.SourceAddress == nil && path.Interface == "" {
+			return fmt.Errorf("path %q has neither a source address nor an interface", path.Name)
+		}
+		if names[path.Name] {
+			return fmt.Errorf("duplicate path %q", path.Name)
+		}
+		names[path.Name] = true
+	}
+	return nil
+}
+
+// path is an uplink to the gateway, its session is reopened on its own when it fails; in single
+// session mode the client has one path without a source address, whose session is opened on demand
+type path struct {
+	config PathConfig
+	// tracer reports the RTT and congestion window of the path sessions to the estimates
+	tracer logging.Tracer
+
+	upGauge      *metrics.Gauge
+	rttGauge     *metrics.Gauge
+	streamsGauge *metrics.Gauge
+
+	// fallbackUntil is set when a session was opened on the fallback transport, it is only used
+	// while opening the sessions of the path, several at a time on the default path
+	fallbackMtx   sync.Mutex
+	fallbackUntil time.Time
+
+	// the following fields are guarded by the session lock of the client
+	session     quic.Session
+	flowSession *flows.Session
+	transport   string
+	streams     int
+
+	estimateMtx sync.Mutex
+	rtt         time.Duration
+	// capacity is the congestion window over the RTT in bytes per second, 0 when unknown
+	capacity float64
+}
+
+func (client *Client) newPath(config PathConfig) *path {
+	p := &path{
+		config:       config,
+		upGauge:      client.metrics.pathUp.WithLabelValues(config.Name),
+		rttGauge:     client.metrics.pathRTT.WithLabelValues(config.Name),
+		streamsGauge: client.metrics.pathStreams.WithLabelValues(config.Name),
+	}
+	p.tracer = logging.NewMultiplexedTracer(client.tracer, shared.NewQuicMetricsTracer(shared.QuicMetrics{Estimate: p.updateEstimate}))
+	return p
+}
+
+func (p *path) updateEstimate(smoothedRTT time.Duration, congestionWindow logging.ByteCount) {
+	p.estimateMtx.Lock()
+	p.rtt = smoothedRTT
+	p.capacity = float64(congestionWindow) / smoothedRTT.Seconds()
+	p.estimateMtx.Unlock()
+	p.rttGauge.Set(smoothedRTT.Seconds())
+}
+
+func (p *path) estimate() (time.Duration, float64) {
+	p.estimateMtx.Lock()
+	defer p.estimateMtx.Unlock()
+	return p.rtt, p.capacity
+}
+
+// pathEstimate is what the scheduler knows of an open path, a zero RTT or capacity is unknown
+type pathEstimate struct {
+	RTT      time.Duration
+	Capacity float64
+	Streams  int
+}
+
+// selectPath returns the index of the path a new stream is opened on, interactive streams only
+// matter to PATH_POLICY_SPLIT; ties go to the path with the fewest active streams
+func selectPath(candidates []pathEstimate, policy string, interactive bool) int {
+	if policy == PATH_POLICY_SPLIT {
+		policy = PATH_POLICY_HIGHEST_CAPACITY
+		if interactive {
+			policy = PATH_POLICY_LOWEST_RTT
+		}
+	}
+	best := -1
+	for i, candidate := range candidates {
+		if best < 0 || betterPath(candidate, candidates[best], policy) {
+			best = i
+		}
+	}
+	return best
+}
+
+func betterPath(a, b pathEstimate, policy string) bool {
+	switch policy {
+	case PATH_POLICY_LOWEST_RTT:
+		if a.RTT != b.RTT {
+			return b.RTT == 0 || (a.RTT != 0 && a.RTT < b.RTT)
+		}
+	case PATH_POLICY_HIGHEST_CAPACITY:
+		if a.Capacity != b.Capacity {
+			return a.Capacity > b.Capacity
+		}
+	case PATH_POLICY_BALANCE:
+		if a.Streams != b.Streams {
+			return a.Streams < b.Streams
+		}
+		if a.RTT != b.RTT {
+			return b.RTT == 0 || (a.RTT != 0 && a.RTT < b.RTT)
+		}
+	}
+	return a.Streams < b.Streams
+}
+
+// openPathStream opens a stream on the path chosen by the policy for the traffic class among the
+// paths with an open session, waiting for one to come up when all of them are down
+func (client *Client) openPathStream(connLog *logger.Logger, class shared.TrafficClass) (quic.Stream, *flows.Session, *path, error) {
+	interactive := class == shared.CLASS_INTERACTIVE
+	timeout := time.NewTimer(PATH_WAIT_TIMEOUT)
+	defer timeout.Stop()
+	// failed holds the sessions a stream couldn't be opened on, they are skipped until replaced
+	failed := make(map[quic.Session]bool)
+	for {
+		client.sessionMtx.Lock()
+		if client.closing {
+			client.sessionMtx.Unlock()
+			return nil, nil, nil, errShuttingDown
+		}
+		var open []*path
+		var candidates []pathEstimate
+		for _, p := range client.paths {
+			if p.session == nil || failed[p.session] {
+				continue
+			}
+			rtt, capacity := p.estimate()
+			open = append(open, p)
+			candidates = append(candidates, pathEstimate{RTT: rtt, Capacity: capacity, Streams: p.streams})
+		}
+		if len(open) == 0 {
+			changed := client.pathsChanged
+			client.sessionMtx.Unlock()
+			select {
+			case <-changed:
+				continue
+			case <-timeout.C:
+				return nil, nil, nil, fmt.Errorf("no path to the gateway is up")
+			}
+		}
+		p := open[selectPath(candidates, client.config.PathPolicy, interactive)]
+		session, flowSession := p.session, p.flowSession
+		client.sessionMtx.Unlock()
+
+		stream, err := session.OpenStream()
+		if err == nil {
+			connLog.Debug("Opened stream %d on path %s", stream.StreamID(), p.config.Name)
+			client.acquirePath(p)
+			return stream, flowSession, p, nil
+		}
+		// the session is reopened by the loop of the path if it ended
+		connLog.Warning("Unable to open stream on path %s: %s", p.config.Name, err)
+		failed[session] = true
+	}
+}
+
+func (client *Client) acquirePath(p *path) {
+	client.sessionMtx.Lock()
+	p.streams++
+	client.sessionMtx.Unlock()
+	p.streamsGauge.Inc()
+}
+
+// releasePath ends a stream opened on the path, it accepts the nil path of the single session mode
+func (client *Client) releasePath(p *path) {
+	if p == nil {
+		return
+	}
+	client.sessionMtx.Lock()
+	p.streams--
+	client.sessionMtx.Unlock()
+	p.streamsGauge.Dec()
+}
+
+// setPathSession replaces the session of the path and wakes up the connections waiting for a
+// path, it is called with the session lock held
+func (client *Client) setPathSession(p *path, session quic.Session, flowSession *flows.Session) {
+	p.session = session
+	p.flowSession = flowSession
+	if session != nil {
+		p.transport = shared.SessionTransport(session)
+		p.upGauge.Set(1)
+	} else {
+		p.upGauge.Set(0)
+	}
+	close(client.pathsChanged)
+	client.pathsChanged = make(chan struct{})
+}
+
+// keepPath keeps a session open on the path until the client shuts down, the session is opened
+// again PATH_RETRY_INTERVAL after a failure
+func (client *Client) keepPath(p *path) {
+	defer client.handlers.Done()
+	pathLog := logger.With("path", p.config.Name)
+	for {
+		// the estimates of the previous session are replaced by the samples of the new handshake
+		p.estimateMtx.Lock()
+		p.rtt, p.capacity = 0, 0
+		p.estimateMtx.Unlock()
+		start := time.Now()
+		session, err := client.openSession(client.closingCtx, p)
+		if err != nil {
+			if client.closingCtx.Err() != nil {
+				return
+			}
+			pathLog.Warning("Path is down: %s, retrying in %s", err, PATH_RETRY_INTERVAL)
+			select {
+			case <-time.After(PATH_RETRY_INTERVAL):
+				continue
+			case <-client.closingCtx.Done():
+				return
+			}
+		}
+		if shared.SessionTransport(session) == shared.TRANSPORT_TCP {
+			// TCP sessions have no RTT samples, the handshake takes about two round trips
+			p.updateEstimate(time.Since(start)/2, 0)
+		}
+
+		client.sessionMtx.Lock()
+		if client.closing {
+			client.sessionMtx.Unlock()
+			session.CloseWithError(shared.QPEP_ERROR_SHUTDOWN, "client shutdown")
+			return
+		}
+		flowSession := client.trackSession(session)
+		client.setPathSession(p, session, flowSession)
+		client.sessionMtx.Unlock()
+		pathLog.Info("Path is up on %s to %s", shared.SessionTransport(session), session.RemoteAddr())
+
+		<-session.Context().Done()
+		client.sessionMtx.Lock()
+		if p.session == session {
+			client.setPathSession(p, nil, nil)
+		}
+		closing := client.closing
+		client.sessionMtx.Unlock()
+		if closing {
+			return
+		}
+		pathLog.Warning("Path session ended, reopening it")
+	}
+}
+
+// PathStats is a snapshot of the state of a path
+type PathStats struct {
+	Name      string
+	Up        bool
+	Transport string
+	RTT       time.Duration
+	// Capacity is the estimated capacity in bytes per second, 0 when unknown
+	Capacity      float64
+	StreamsActive int
+}
+
+func (client *Client) pathStats() []PathStats {
+	client.sessionMtx.Lock()
+	defer client.sessionMtx.Unlock()
+	var stats []PathStats
+	for _, p := range client.paths {
+		rtt, capacity := p.estimate()
+		stat := PathStats{Name: p.config.Name, Up: p.session != nil, StreamsActive: p.streams}
+		if stat.Up {
+			stat.Transport, stat.RTT, stat.Capacity = p.transport, rtt, capacity
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSelectPath(t *testing.T) {
+	// a low latency link with little capacity, a satellite link and a path without estimates yet
+	cellular := pathEstimate{RTT: 40 * time.Millisecond, Capacity: 1e6, Streams: 3}
+	satellite := pathEstimate{RTT: 600 * time.Millisecond, Capacity: 8e6, Streams: 1}
+	unknown := pathEstimate{Streams: 0}
+	candidates := []pathEstimate{unknown, cellular, satellite}
+
+	tests := []struct {
+		policy      string
+		interactive bool
+		expected    int
+	}{
+		{PATH_POLICY_SPLIT, true, 1},
+		{PATH_POLICY_SPLIT, false, 2},
+		{PATH_POLICY_LOWEST_RTT, false, 1},
+		{PATH_POLICY_HIGHEST_CAPACITY, true, 2},
+		{PATH_POLICY_BALANCE, false, 0},
+	}
+	for _, test := range tests {
+		if selected := selectPath(candidates, test.policy, test.interactive); selected != test.expected {
+			t.Errorf("policy %s, interactive %v: selected path %d, expected %d", test.policy, test.interactive, selected, test.expected)
+		}
+	}
+
+	// ties go to the path with the fewest streams, balance then prefers the lowest RTT
+	if selected := selectPath([]pathEstimate{cellular, {RTT: 40 * time.Millisecond, Capacity: 1e6}}, PATH_POLICY_LOWEST_RTT, false); selected != 1 {
+		t.Errorf("lowest-rtt tie: selected path %d, expected 1", selected)
+	}
+	if selected := selectPath([]pathEstimate{{RTT: 600 * time.Millisecond, Streams: 1}, {RTT: 40 * time.Millisecond, Streams: 1}}, PATH_POLICY_BALANCE, false); selected != 1 {
+		t.Errorf("balance tie: selected path %d, expected 1", selected)
+	}
+	if selected := selectPath(nil, PATH_POLICY_SPLIT, false); selected != -1 {
+		t.Errorf("no candidates: selected path %d, expected -1", selected)
+	}
+}
+
+func TestParsePaths(t *testing.T) {
+	paths := ParsePaths("10.0.0.2, wwan0,,fe80::1")
+	if len(paths) != 3 {
+		t.Fatalf("parsed %d paths, expected 3: %+v", len(paths), paths)
+	}
+	if !paths[0].SourceAddress.Equal(net.ParseIP("10.0.0.2")) || paths[0].Interface != "" || paths[0].Name != "10.0.0.2" {
+		t.Errorf("address path parsed as %+v", paths[0])
+	}
+	if paths[1].SourceAddress != nil || paths[1].Interface != "wwan0" || paths[1].Name != "wwan0" {
+		t.Errorf("interface path parsed as %+v", paths[1])
+	}
+	if paths[2].SourceAddress == nil {
+		t.Errorf("IPv6 path parsed as %+v", paths[2])
+	}
+
+	if _, err := ParsePorts("22,443,70000"); err == nil {
+		t.Error("port out of range accepted")
+	}
+	if ports, err := ParsePorts("22, 3389"); err != nil || len(ports) != 2 || ports[1] != 3389 {
+		t.Errorf("ports parsed as %v, %v", ports, err)
+	}
+}
+
+func TestValidatePaths(t *testing.T) {
+	config := DefaultConfig()
+	config.Paths = ParsePaths("127.0.0.1,127.0.0.2")
+	if err := validatePaths(config); err != nil {
+		t.Errorf("valid paths rejected: %s", err)
+	}
+	config.PathPolicy = "fastest"
+	if err := validatePaths(config); err == nil {
+		t.Error("unknown policy accepted")
+	}
+	config.PathPolicy = PATH_POLICY_BALANCE
+	config.MultiStream = false
+	if err := validatePaths(config); err == nil {
+		t.Error("paths accepted without multiple streams")
+	}
+	config.MultiStream = true
+	config.Paths = ParsePaths("127.0.0.1,127.0.0.1")
+	if err := validatePaths(config); err == nil {
+		t.Error("duplicate paths accepted")
+	}
+}
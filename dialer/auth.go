@@ -0,0 +1,25 @@
+package dialer
+
+import (
+	"context"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/parvit/qpep/shared"
+)
+
+// authenticateSession proves to the gateway the knowledge of the token on the first stream of the session,
+// it must complete before any data stream is opened
+func authenticateSession(ctx context.Context, session quic.Session, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, shared.QPEP_AUTH_TIMEOUT)
+	defer cancel()
+
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(shared.QPEP_AUTH_TIMEOUT))
+
+	return shared.RespondAuthChallenge(stream, token)
+}
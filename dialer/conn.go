@@ -0,0 +1,71 @@
+package dialer
+
+import (
+	"net"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/parvit/qpep/shared"
+)
+
+var _ net.Conn = &Conn{}
+
+// Conn is a TCP connection tunnelled on a QUIC stream, each direction can be closed on its own
+// with CloseWrite and CloseRead as with a *net.TCPConn
+type Conn struct {
+	stream       quic.Stream
+	localAddr    net.Addr
+	remoteAddr   net.Addr
+	connectionID shared.ConnectionID
+}
+
+func (conn *Conn) Read(p []byte) (int, error) {
+	return conn.stream.Read(p)
+}
+
+func (conn *Conn) Write(p []byte) (int, error) {
+	return conn.stream.Write(p)
+}
+
+// Close closes both directions, the data not read yet is discarded
+func (conn *Conn) Close() error {
+	conn.stream.CancelRead(shared.QPEP_ERROR_NONE)
+	return conn.stream.Close()
+}
+
+// CloseWrite sends a FIN to the destination once the data written is delivered
+func (conn *Conn) CloseWrite() error {
+	return conn.stream.Close()
+}
+
+// CloseRead asks the gateway to stop sending, the data not read yet is discarded
+func (conn *Conn) CloseRead() error {
+	conn.stream.CancelRead(shared.QPEP_ERROR_NONE)
+	return nil
+}
+
+// LocalAddr is the address of the QUIC session, sent to the gateway as the source of the connection
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *Conn) SetDeadline(t time.Time) error {
+	return conn.stream.SetDeadline(t)
+}
+
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	return conn.stream.SetReadDeadline(t)
+}
+
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	return conn.stream.SetWriteDeadline(t)
+}
+
+// ConnectionID returns the ID of the connection in the logs and flow records of the gateway
+func (conn *Conn) ConnectionID() shared.ConnectionID {
+	return conn.connectionID
+}
@@ -0,0 +1,165 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/parvit/qpep/logger"
+	"github.com/parvit/qpep/shared"
+)
+
+var errDialerClosed = errors.New("qpep dialer is closed")
+
+// Dialer opens TCP connections through a qpep gateway without the transparent proxy of the client,
+// e.g. as the DialContext of an http.Transport or a gRPC dialer. The connections are streams of a
+// single QUIC session, opened on the first dial and again whenever it is closed
+type Dialer struct {
+	config Config
+
+	mtx     sync.Mutex
+	closed  bool
+	session quic.Session
+}
+
+func New(config Config) *Dialer {
+	return &Dialer{config: config}
+}
+
+func (dialer *Dialer) Dial(network, address string) (net.Conn, error) {
+	return dialer.DialContext(context.Background(), network, address)
+}
+
+// DialContext opens a stream to address through the gateway, the host is resolved locally as the
+// stream header carries an IP address. ctx bounds the opening of the session and of the stream; the
+// gateway connects to the destination afterwards so an unreachable or denied destination shows as a
+// reset of the connection on its first read or write
+func (dialer *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	destination, err := resolveTCPAddr(ctx, network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	conn, err := dialer.dialStream(ctx, destination)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: destination, Err: err}
+	}
+	return conn, nil
+}
+
+func (dialer *Dialer) dialStream(ctx context.Context, destination *net.TCPAddr) (*Conn, error) {
+	session, err := dialer.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil && ctx.Err() == nil {
+		// the session was closed since it was last used, e.g. on idle timeout, it is opened again once
+		dialer.forgetSession(session)
+		if session, err = dialer.getSession(ctx); err != nil {
+			return nil, err
+		}
+		stream, err = session.OpenStreamSync(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	localAddr := session.LocalAddr().(*net.UDPAddr)
+	header := shared.QpepHeader{
+		SourceAddr:   &net.TCPAddr{IP: localAddr.IP, Port: localAddr.Port},
+		DestAddr:     destination,
+		ConnectionID: shared.NewConnectionID(),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetWriteDeadline(deadline)
+	}
+	if _, err = stream.Write(header.ToBytes()); err != nil {
+		stream.CancelRead(shared.QPEP_ERROR_CONNECTION_FAILED)
+		stream.CancelWrite(shared.QPEP_ERROR_CONNECTION_FAILED)
+		return nil, err
+	}
+	stream.SetWriteDeadline(time.Time{})
+	logger.With("conn", header.ConnectionID).Debug("Opened stream %d to %s", stream.StreamID(), destination)
+	return &Conn{stream: stream, localAddr: header.SourceAddr, remoteAddr: destination, connectionID: header.ConnectionID}, nil
+}
+
+// getSession returns the current session or opens a new one, making up to ConnectionRetries attempts
+func (dialer *Dialer) getSession(ctx context.Context) (quic.Session, error) {
+	dialer.mtx.Lock()
+	defer dialer.mtx.Unlock()
+	if dialer.closed {
+		return nil, errDialerClosed
+	}
+	if dialer.session != nil && dialer.session.Context().Err() == nil {
+		return dialer.session, nil
+	}
+	dialer.session = nil
+
+	var err error
+	for i := 0; i < dialer.config.ConnectionRetries || i == 0; i++ {
+		var session quic.Session
+		session, err = DialSession(ctx, dialer.config)
+		if err == nil {
+			dialer.session = session
+			return session, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		logger.Warning("Failed to Open QUIC Session: %s, retrying", err)
+	}
+	return nil, fmt.Errorf("open QUIC session to %s:%d: %w", dialer.config.GatewayHost, dialer.config.GatewayPort, err)
+}
+
+func (dialer *Dialer) forgetSession(session quic.Session) {
+	dialer.mtx.Lock()
+	defer dialer.mtx.Unlock()
+	if dialer.session == session {
+		dialer.session = nil
+	}
+}
+
+// Close closes the QUIC session, which resets the connections still open, and makes the next dials fail
+func (dialer *Dialer) Close() error {
+	dialer.mtx.Lock()
+	defer dialer.mtx.Unlock()
+	dialer.closed = true
+	if dialer.session == nil {
+		return nil
+	}
+	err := dialer.session.CloseWithError(shared.QPEP_ERROR_NONE, "dialer closed")
+	dialer.session = nil
+	return err
+}
+
+func resolveTCPAddr(ctx context.Context, network, address string) (*net.TCPAddr, error) {
+	host, portName, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, network, portName)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		isIPv4 := addr.IP.To4() != nil
+		if (network == "tcp4" && !isIPv4) || (network == "tcp6" && isIPv4) {
+			continue
+		}
+		return &net.TCPAddr{IP: addr.IP, Port: port, Zone: addr.Zone}, nil
+	}
+	return nil, &net.AddrError{Err: "no suitable address found", Addr: address}
+}
@@ -0,0 +1,45 @@
+package dialer
+
+import (
+	"net"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/parvit/qpep/logger"
+	"github.com/parvit/qpep/shared"
+)
+
+// negotiateFEC asks the gateway for FEC on the session, the packets sent to the gateway are
+// protected once it accepts; the datagrams of the gateway are received until the session ends
+func negotiateFEC(session quic.Session, conn *shared.FECConn, remoteAddr net.Addr) {
+	accepted := make(chan struct{})
+	go func() {
+		enabled := false
+		for {
+			message, err := session.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			if len(message) != 1 || message[0] != shared.QPEP_MESSAGE_FEC || enabled {
+				continue
+			}
+			enabled = true
+			conn.Enable(remoteAddr)
+			close(accepted)
+		}
+	}()
+	for i := 0; i < announceAttempts; i++ {
+		if err := session.SendMessage([]byte{shared.QPEP_MESSAGE_FEC}); err != nil {
+			return
+		}
+		select {
+		case <-accepted:
+			logger.Info("FEC enabled on session with %s", session.RemoteAddr())
+			return
+		case <-time.After(announceInterval):
+		case <-session.Context().Done():
+			return
+		}
+	}
+	logger.Warning("Gateway %s didn't accept FEC, the session is not protected", session.RemoteAddr())
+}
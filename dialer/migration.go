@@ -0,0 +1,332 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/parvit/qpep/logger"
+	"github.com/parvit/qpep/shared"
+)
+
+const (
+	// MIGRATION_CHECK_INTERVAL is the time between the checks of the local address of a migrating session
+	MIGRATION_CHECK_INTERVAL = 2 * time.Second
+
+	// the control datagrams are sent again until answered, as datagrams can be lost
+	announceInterval = 200 * time.Millisecond
+	announceAttempts = 25
+	maxPacketSize    = 2048
+	// challengesQueued bounds the path challenges of the gateway waiting for their answer
+	challengesQueued = 8
+)
+
+// ErrNotMigratable is returned when migrating a session that wasn't dialed with Migrate set
+var ErrNotMigratable = errors.New("session can't be migrated")
+
+// migrations are the migrating conns of the open sessions, by session
+var migrations sync.Map
+
+// MigrateSession moves a session dialed with Migrate set to a new UDP socket, as done when the
+// local address changes, and announces it to the gateway; it returns once announced
+func MigrateSession(session quic.Session) error {
+	conn, ok := migrations.Load(session)
+	if !ok {
+		return ErrNotMigratable
+	}
+	return conn.(*migratingConn).migrate(session)
+}
+
+type receivedPacket struct {
+	data []byte
+	addr net.Addr
+	err  error
+}
+
+// migratingConn is the packet conn of a QUIC session that can move to a new UDP socket, quic-go
+// keeps using it as a single conn; the first socket stays open as it identifies the conn to quic-go,
+// and receives the packets the gateway sends until it follows the session. The path challenges the
+// gateway sends to the new socket are answered on the session rather than passed to quic-go.
+type migratingConn struct {
+	first      net.PacketConn
+	listen     func() (net.PacketConn, error)
+	packets    chan receivedPacket
+	challenges chan []byte
+	closed     chan struct{}
+
+	mtx sync.Mutex
+	// current is the socket the packets are sent from, receivedNew is set when a packet is read on it
+	current     net.PacketConn
+	receivedNew bool
+	closeOnce   sync.Once
+}
+
+func newMigratingConn(conn net.PacketConn, listen func() (net.PacketConn, error)) *migratingConn {
+	migrating := &migratingConn{
+		first:      conn,
+		listen:     listen,
+		packets:    make(chan receivedPacket),
+		challenges: make(chan []byte, challengesQueued),
+		closed:     make(chan struct{}),
+		current:    conn,
+	}
+	go migrating.readLoop(conn)
+	return migrating
+}
+
+func (conn *migratingConn) readLoop(socket net.PacketConn) {
+	for {
+		buf := make([]byte, maxPacketSize)
+		n, addr, err := socket.ReadFrom(buf)
+		nonce, isChallenge := shared.ParsePathChallenge(buf[:n])
+		conn.mtx.Lock()
+		current := socket == conn.current
+		if current && err == nil && !isChallenge {
+			conn.receivedNew = true
+		}
+		conn.mtx.Unlock()
+		if err == nil && isChallenge {
+			// only the challenges of the socket the session moves to are answered
+			if current {
+				select {
+				case conn.challenges <- nonce:
+				default:
+				}
+			}
+			continue
+		}
+		if err != nil {
+			// the sockets replaced since are closed, their errors are not the ones of the conn
+			if !current {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+		}
+		select {
+		case conn.packets <- receivedPacket{data: buf[:n], addr: addr, err: err}:
+		case <-conn.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (conn *migratingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-conn.packets:
+		if packet.err != nil {
+			return 0, nil, packet.err
+		}
+		return copy(p, packet.data), packet.addr, nil
+	case <-conn.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (conn *migratingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	conn.mtx.Lock()
+	current := conn.current
+	conn.mtx.Unlock()
+	return current.WriteTo(p, addr)
+}
+
+// rebind opens a new socket the packets are then sent from, the previous one is closed unless it
+// is the first one
+func (conn *migratingConn) rebind() (net.Addr, error) {
+	socket, err := conn.listen()
+	if err != nil {
+		return nil, err
+	}
+	conn.mtx.Lock()
+	previous := conn.current
+	conn.current = socket
+	conn.receivedNew = false
+	conn.mtx.Unlock()
+	// the challenges of the previous socket are not answered
+	for drained := false; !drained; {
+		select {
+		case <-conn.challenges:
+		default:
+			drained = true
+		}
+	}
+	go conn.readLoop(socket)
+	if previous != conn.first {
+		previous.Close()
+	}
+	return socket.LocalAddr(), nil
+}
+
+// migrate rebinds the conn and announces it to the gateway with a datagram, which is sent again
+// until the gateway answers on the new socket as datagrams can be lost; the path challenges the
+// gateway sends meanwhile to the new socket are answered with a datagram as well
+func (conn *migratingConn) migrate(session quic.Session) error {
+	if !session.ConnectionState().SupportsDatagrams {
+		return ErrNotMigratable
+	}
+	address, err := conn.rebind()
+	if err != nil {
+		return err
+	}
+	logger.Info("Migrating session with %s to local address %s", session.RemoteAddr(), address)
+	for i := 0; i < announceAttempts; i++ {
+		if err = session.SendMessage([]byte{shared.QPEP_MESSAGE_MIGRATED}); err != nil {
+			return err
+		}
+		announced := time.After(announceInterval)
+	waitAnswer:
+		for {
+			select {
+			case nonce := <-conn.challenges:
+				if err = session.SendMessage(shared.PathResponse(nonce)); err != nil {
+					return err
+				}
+			case <-announced:
+				break waitAnswer
+			case <-session.Context().Done():
+				return session.Context().Err()
+			}
+		}
+		conn.mtx.Lock()
+		received := conn.receivedNew
+		conn.mtx.Unlock()
+		if received {
+			return nil
+		}
+	}
+	return errors.New("migration not acknowledged by the gateway")
+}
+
+// watch migrates the session when the local address returned by localAddress changes, until the
+// session ends
+func (conn *migratingConn) watch(session quic.Session, localAddress func() string) {
+	migrations.Store(session, conn)
+	defer migrations.Delete(session)
+	last := localAddress()
+	ticker := time.NewTicker(MIGRATION_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-session.Context().Done():
+			return
+		}
+		address := localAddress()
+		if address == last || address == "" {
+			continue
+		}
+		logger.Info("Local address changed from %s to %s", last, address)
+		last = address
+		if err := conn.migrate(session); err != nil {
+			logger.Warning("Unable to migrate session to %s: %s", session.RemoteAddr(), err)
+		}
+	}
+}
+
+func (conn *migratingConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		conn.mtx.Lock()
+		current := conn.current
+		conn.mtx.Unlock()
+		if current != conn.first {
+			current.Close()
+		}
+		conn.first.Close()
+	})
+	return nil
+}
+
+// LocalAddr is the address of the first socket, quic-go identifies the conn with it
+func (conn *migratingConn) LocalAddr() net.Addr {
+	return conn.first.LocalAddr()
+}
+
+func (conn *migratingConn) SetDeadline(t time.Time) error {
+	return errors.New("deadlines are not supported by migrating conns")
+}
+
+func (conn *migratingConn) SetReadDeadline(t time.Time) error {
+	return conn.SetDeadline(t)
+}
+
+func (conn *migratingConn) SetWriteDeadline(t time.Time) error {
+	return conn.SetDeadline(t)
+}
+
+// SetReadBuffer and SyscallConn let quic-go size the receive buffer of the first socket
+func (conn *migratingConn) SetReadBuffer(bytes int) error {
+	return shared.SetReadBuffer(conn.first, bytes)
+}
+
+func (conn *migratingConn) SyscallConn() (syscall.RawConn, error) {
+	return shared.SyscallConn(conn.first)
+}
+
+// localAddressFunc returns how the local address of a session of the configuration is found: the
+// addresses of its interface, or the source address of the route to the gateway; the address
+// never changes when it is set in the configuration
+func localAddressFunc(config Config, remoteAddr *net.UDPAddr) func() string {
+	switch {
+	case config.Interface != "":
+		return func() string {
+			iface, err := net.InterfaceByName(config.Interface)
+			if err != nil {
+				return ""
+			}
+			addrs, err := iface.Addrs()
+			if err != nil || len(addrs) == 0 {
+				return ""
+			}
+			names := make([]string, 0, len(addrs))
+			for _, addr := range addrs {
+				names = append(names, addr.String())
+			}
+			sort.Strings(names)
+			return strings.Join(names, ",")
+		}
+	case config.LocalAddress != nil:
+		return func() string {
+			return config.LocalAddress.String()
+		}
+	default:
+		return func() string {
+			// no packet is sent, connecting only selects the route
+			probe, err := net.DialUDP("udp", nil, remoteAddr)
+			if err != nil {
+				return ""
+			}
+			defer probe.Close()
+			return probe.LocalAddr().(*net.UDPAddr).IP.String()
+		}
+	}
+}
+
+// listenUDP opens the socket of a QUIC session of the configuration
+func listenUDP(ctx context.Context, config Config) (net.PacketConn, error) {
+	listenConfig := net.ListenConfig{}
+	if config.Interface != "" {
+		listenConfig.Control = shared.BindToInterface(config.Interface)
+	}
+	localAddr := ""
+	if config.LocalAddress != nil {
+		localAddr = net.JoinHostPort(config.LocalAddress.String(), "0")
+	}
+	conn, err := listenConfig.ListenPacket(ctx, "udp", localAddr)
+	if err == nil && !config.DisableMTUDiscovery {
+		if dfErr := shared.SetDontFragment(conn); dfErr != nil {
+			logger.Debug("Unable to set the don't fragment bit, fragmented probes can mislead the path MTU discovery: %s", dfErr)
+		}
+	}
+	return conn, err
+}
@@ -0,0 +1,191 @@
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/parvit/qpep/logger"
+	"github.com/parvit/qpep/mux"
+	"github.com/parvit/qpep/shared"
+)
+
+// Config is how a session to the gateway is opened and authenticated
+type Config struct {
+	GatewayHost       string
+	GatewayPort       int
+	GatewayCAFile     string
+	GatewayPin        string
+	GatewayServerName string
+	ClientCertFile    string
+	ClientKeyFile     string
+	AuthToken         string
+	// ConnectionRetries is the number of attempts made by the Dialer to open a session, at least one
+	ConnectionRetries int
+	// Tracer receives the events of the QUIC sessions when set
+	Tracer logging.Tracer
+	// Transport is the transport tried first, QUIC when empty
+	Transport string
+	// Fallback tries the other transport when the session can't be opened on the first one
+	Fallback bool
+	// LocalAddress is the source address of the session, chosen by the system when nil
+	LocalAddress net.IP
+	// Interface binds the session to a network interface, only supported on linux
+	Interface string
+	// KeepAlive keeps the QUIC session open while no stream is active
+	KeepAlive bool
+	// Migrate moves the QUIC session to a new UDP socket when the local address changes, the
+	// gateway follows it when it supports the migrations
+	Migrate bool
+	// FEC asks the gateway to protect the packets of the QUIC session with parity packets, both
+	// sides then send them
+	FEC bool
+	// FECRecovered is called for each packet of the gateway recovered by FEC when set
+	FECRecovered func()
+	// MaxPacketSize bounds the UDP payloads sent to the gateway, FEC header included, the path MTU
+	// discovery then stays below it; 0 leaves the size to the discovery alone
+	MaxPacketSize int
+	// MTUDropped is called for each packet dropped as larger than MaxPacketSize or than the
+	// socket allows, when set
+	MTUDropped func()
+	// DisableMTUDiscovery keeps the QUIC packets at their initial size instead of probing the path
+	// for the largest size it carries
+	DisableMTUDiscovery bool
+}
+
+// DialSession makes a single attempt to open a session to the gateway on the transport of the
+// configuration and, when enabled, on the fallback one; the session is authenticated with the
+// token of the configuration when set
+func DialSession(ctx context.Context, config Config) (quic.Session, error) {
+	transport := config.Transport
+	if transport == "" {
+		transport = shared.TRANSPORT_QUIC
+	}
+	session, err := dialTransport(ctx, config, transport)
+	// a rejected token would be rejected on the other transport as well
+	if err == nil || !config.Fallback || ctx.Err() != nil || errors.Is(err, shared.ErrAuthRejected) {
+		return session, err
+	}
+	fallback := shared.FallbackTransport(transport)
+	logger.Warning("Unable to open %s session to the gateway: %s, trying %s", transport, err, fallback)
+	session, fallbackErr := dialTransport(ctx, config, fallback)
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("%s: %w, %s: %v", transport, err, fallback, fallbackErr)
+	}
+	return session, nil
+}
+
+func dialTransport(ctx context.Context, config Config, transport string) (quic.Session, error) {
+	tlsConf, err := newTLSConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("prepare TLS configuration: %w", err)
+	}
+	gatewayPath := config.GatewayHost + ":" + strconv.Itoa(config.GatewayPort)
+	var session quic.Session
+	switch transport {
+	case shared.TRANSPORT_QUIC:
+		session, err = dialQUIC(ctx, config, gatewayPath, tlsConf)
+	case shared.TRANSPORT_TCP:
+		session, err = dialTCP(ctx, config, gatewayPath, tlsConf)
+	default:
+		return nil, fmt.Errorf("unknown transport %q", transport)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.AuthToken != "" {
+		if err = authenticateSession(ctx, session, config.AuthToken); err != nil {
+			session.CloseWithError(shared.QPEP_ERROR_AUTH_FAILED, "authentication failed")
+			return nil, fmt.Errorf("token authentication failed: %w", err)
+		}
+	}
+	return session, nil
+}
+
+func dialQUIC(ctx context.Context, config Config, gatewayPath string, tlsConf *tls.Config) (quic.Session, error) {
+	quicConfig := shared.NewQuicConfig()
+	quicConfig.Tracer = config.Tracer
+	quicConfig.KeepAlive = config.KeepAlive
+	quicConfig.DisablePathMTUDiscovery = config.DisableMTUDiscovery
+	if err := shared.ValidateMaxPacketSize(config.MaxPacketSize, config.FEC); err != nil {
+		return nil, err
+	}
+	if config.LocalAddress == nil && config.Interface == "" && !config.Migrate && !config.FEC &&
+		config.MaxPacketSize == 0 && config.DisableMTUDiscovery {
+		return quic.DialAddrContext(ctx, gatewayPath, tlsConf, quicConfig)
+	}
+
+	remoteAddr, err := net.ResolveUDPAddr("udp", gatewayPath)
+	if err != nil {
+		return nil, err
+	}
+	packetConn, err := listenUDP(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("bind local address: %w", err)
+	}
+	var migrating *migratingConn
+	if config.Migrate {
+		migrating = newMigratingConn(packetConn, func() (net.PacketConn, error) {
+			return listenUDP(context.Background(), config)
+		})
+		packetConn = migrating
+	}
+	// the size is bounded under the FEC header, the probes larger than the socket allows are dropped
+	if config.MaxPacketSize > 0 || !config.DisableMTUDiscovery {
+		packetConn = shared.NewMTUConn(packetConn, config.MaxPacketSize, config.MTUDropped)
+	}
+	var fecConn *shared.FECConn
+	if config.FEC {
+		fecConn = shared.NewFECConn(packetConn, config.FECRecovered)
+		packetConn = fecConn
+	}
+	session, err := quic.DialContext(ctx, packetConn, remoteAddr, config.GatewayHost, tlsConf, quicConfig)
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+	// quic-go leaves open the connections it didn't create
+	go func() {
+		<-session.Context().Done()
+		packetConn.Close()
+	}()
+	if migrating != nil && session.ConnectionState().SupportsDatagrams {
+		go migrating.watch(session, localAddressFunc(config, remoteAddr))
+	}
+	if fecConn != nil && session.ConnectionState().SupportsDatagrams {
+		go negotiateFEC(session, fecConn, remoteAddr)
+	}
+	return session, nil
+}
+
+func dialTCP(ctx context.Context, config Config, gatewayPath string, tlsConf *tls.Config) (quic.Session, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mux.HANDSHAKE_TIMEOUT)
+		defer cancel()
+	}
+	netDialer := &net.Dialer{KeepAlive: mux.KEEPALIVE_INTERVAL}
+	if config.LocalAddress != nil {
+		netDialer.LocalAddr = &net.TCPAddr{IP: config.LocalAddress}
+	}
+	if config.Interface != "" {
+		netDialer.Control = shared.BindToInterface(config.Interface)
+	}
+	conn, err := netDialer.DialContext(ctx, "tcp", gatewayPath)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = config.GatewayHost
+	}
+	session, err := mux.Client(ctx, conn, tlsConf)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
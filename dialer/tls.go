@@ -0,0 +1,104 @@
+package dialer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/parvit/qpep/logger"
+	"github.com/parvit/qpep/shared"
+)
+
+// newTLSConfig prepares the TLS configuration used to dial the gateway, the server certificate
+// is checked against the CA bundle and / or the SPKI pin set in the configuration
+func newTLSConfig(config Config) (*tls.Config, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{shared.QPEP_PROTOCOL}}
+
+	if config.ClientCertFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{clientCert}
+	}
+
+	pin := shared.NormalizeSPKIPin(config.GatewayPin)
+	if config.GatewayCAFile == "" && pin == "" {
+		logger.Warning("no CA bundle or key pin configured, the gateway certificate will not be verified")
+		return tlsConf, nil
+	}
+
+	var roots *x509.CertPool
+	if config.GatewayCAFile != "" {
+		caData, err := ioutil.ReadFile(config.GatewayCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.GatewayCAFile)
+		}
+	}
+
+	// the certificate generated by the server is only valid for its listen address, if set, and its own name
+	serverNames := []string{config.GatewayServerName}
+	if config.GatewayServerName == "" {
+		serverNames = []string{config.GatewayHost, shared.SELF_SIGNED_SERVER_NAME}
+	}
+
+	// the standard verification is replaced so that a mismatch is reported with a clear reason
+	tlsConf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return verifyGatewayCertificate(rawCerts, roots, serverNames, pin)
+	}
+	return tlsConf, nil
+}
+
+// verifyGatewayCertificate checks the chain against the roots, when set, for the first of the server names it
+// is valid for, and the key of the gateway against the pin, when set
+func verifyGatewayCertificate(rawCerts [][]byte, roots *x509.CertPool, serverNames []string, pin string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("gateway did not present a certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("gateway certificate is invalid: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		var err error
+		for i, serverName := range serverNames {
+			_, nameErr := certs[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				DNSName:       serverName,
+			})
+			// the error reported is the one of the configured name
+			if i == 0 || nameErr == nil {
+				err = nameErr
+			}
+			if nameErr == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("gateway certificate not trusted by CA bundle: %w", err)
+		}
+	}
+
+	if pin != "" {
+		if got := shared.SPKIPin(certs[0]); got != pin {
+			return fmt.Errorf("gateway key pin mismatch: got %s, expected %s", got, pin)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package dialer
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parvit/qpep/pki"
+	"github.com/parvit/qpep/shared"
+)
+
+// testGateway is a gateway certificate chain issued by a CA written to caFile
+type testGateway struct {
+	caFile string
+	chain  [][]byte
+	cert   *x509.Certificate
+}
+
+func newTestGateway(t *testing.T, hosts ...string) testGateway {
+	t.Helper()
+	dir := t.TempDir()
+	authority, err := pki.CreateAuthority(dir, "qpep test CA", pki.KEY_TYPE_ECDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _, err := authority.IssueServer("gateway", hosts, pki.KEY_TYPE_ECDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testGateway{caFile: filepath.Join(dir, pki.CA_CERT_FILE), chain: [][]byte{cert.Raw}, cert: cert}
+}
+
+// verify runs the verification of the TLS configuration made for config on the gateway chain
+func verify(t *testing.T, config Config, chain [][]byte) error {
+	t.Helper()
+	tlsConf, err := newTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tlsConf.InsecureSkipVerify || tlsConf.VerifyPeerCertificate == nil {
+		t.Fatal("gateway certificate not verified by the configuration")
+	}
+	return tlsConf.VerifyPeerCertificate(chain, nil)
+}
+
+func TestGatewayCA(t *testing.T) {
+	gateway := newTestGateway(t, "gateway.example", "192.0.2.1")
+	other := newTestGateway(t, "gateway.example")
+
+	if err := verify(t, Config{GatewayHost: "192.0.2.1", GatewayCAFile: gateway.caFile}, gateway.chain); err != nil {
+		t.Errorf("gateway certificate rejected: %s", err)
+	}
+	if err := verify(t, Config{GatewayHost: "192.0.2.1", GatewayServerName: "gateway.example", GatewayCAFile: gateway.caFile}, gateway.chain); err != nil {
+		t.Errorf("gateway certificate rejected with its server name: %s", err)
+	}
+	if err := verify(t, Config{GatewayHost: "192.0.2.2", GatewayCAFile: gateway.caFile}, gateway.chain); err == nil {
+		t.Error("gateway certificate accepted for another address")
+	}
+	err := verify(t, Config{GatewayHost: "gateway.example", GatewayCAFile: gateway.caFile}, other.chain)
+	if err == nil || !strings.Contains(err.Error(), "not trusted by CA bundle") {
+		t.Errorf("certificate of another CA verified with %v, expected a trust error", err)
+	}
+	if err = verify(t, Config{GatewayHost: "gateway.example", GatewayCAFile: gateway.caFile}, nil); err == nil {
+		t.Error("gateway without certificate accepted")
+	}
+
+	if _, err = newTLSConfig(Config{GatewayCAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("missing CA bundle accepted")
+	}
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err = ioutil.WriteFile(empty, []byte("no certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newTLSConfig(Config{GatewayCAFile: empty}); err == nil {
+		t.Error("CA bundle without certificates accepted")
+	}
+}
+
+// TestSelfSignedGateway checks the verification of the certificate generated by the server with the
+// certificate itself as the CA bundle
+func TestSelfSignedGateway(t *testing.T) {
+	cert, _, err := pki.SelfSignedServer(shared.SELF_SIGNED_SERVER_NAME, []string{shared.SELF_SIGNED_SERVER_NAME}, pki.KEY_TYPE_ECDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "server_cert.pem")
+	if err = ioutil.WriteFile(caFile, pki.EncodeCertificate(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+	chain := [][]byte{cert.Raw}
+
+	// the gateway address is not in the certificate of a server listening on all the addresses
+	if err = verify(t, Config{GatewayHost: "192.0.2.1", GatewayCAFile: caFile}, chain); err != nil {
+		t.Errorf("generated certificate rejected without a server name: %s", err)
+	}
+	err = verify(t, Config{GatewayHost: "192.0.2.1", GatewayServerName: "gateway.example", GatewayCAFile: caFile}, chain)
+	if err == nil || !strings.Contains(err.Error(), "gateway.example") {
+		t.Errorf("generated certificate verified for another server name with %v, expected a name error", err)
+	}
+}
+
+func TestGatewayPin(t *testing.T) {
+	gateway := newTestGateway(t, "gateway.example")
+	other := newTestGateway(t, "gateway.example")
+	pin := shared.SPKIPin(gateway.cert)
+
+	// the pin alone accepts the certificate whatever its issuer and names
+	for _, configured := range []string{pin, strings.TrimPrefix(pin, shared.SPKI_PIN_PREFIX), " " + pin + "\n"} {
+		if err := verify(t, Config{GatewayHost: "192.0.2.1", GatewayPin: configured}, gateway.chain); err != nil {
+			t.Errorf("gateway certificate rejected with the pin %q: %s", configured, err)
+		}
+	}
+	err := verify(t, Config{GatewayHost: "192.0.2.1", GatewayPin: pin}, other.chain)
+	if err == nil || !strings.Contains(err.Error(), "pin mismatch") {
+		t.Errorf("certificate with another key verified with %v, expected a pin mismatch", err)
+	}
+
+	// with a CA bundle both checks must pass
+	if err = verify(t, Config{GatewayHost: "gateway.example", GatewayCAFile: gateway.caFile, GatewayPin: pin}, gateway.chain); err != nil {
+		t.Errorf("gateway certificate rejected with the CA and the pin: %s", err)
+	}
+	if err = verify(t, Config{GatewayHost: "gateway.example", GatewayCAFile: other.caFile, GatewayPin: pin}, gateway.chain); err == nil {
+		t.Error("pinned certificate accepted from an untrusted CA")
+	}
+	if err = verify(t, Config{GatewayHost: "gateway.example", GatewayCAFile: gateway.caFile, GatewayPin: shared.SPKIPin(other.cert)}, gateway.chain); err == nil {
+		t.Error("trusted certificate accepted with another pin")
+	}
+}
@@ -0,0 +1,38 @@
+package e2e
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/parvit/qpep/client"
+	"github.com/parvit/qpep/server"
+)
+
+// TestGeneratedCertificate checks that a client given the certificate generated by the server as its
+// CA bundle, and no server name, verifies the gateway whether the server listens on its address or
+// on all the addresses
+func TestGeneratedCertificate(t *testing.T) {
+	for _, listenHost := range []string{"127.0.0.1", "0.0.0.0"} {
+		dir, err := ioutil.TempDir("", "qpep-e2e")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		h, err := startHarnessWith(dir, func(config *server.ServerConfig) {
+			config.ListenHost = listenHost
+		}, func(h *harness, config *client.ClientConfig) {
+			config.TransportFallback = false
+			config.GatewayCAFile = filepath.Join(dir, "server_cert.pem")
+		})
+		if err != nil {
+			t.Fatalf("listening on %s: start harness: %s", listenHost, err)
+		}
+		echoThrough(t, h, 64*1024)
+		if failures := h.client.Stats().DialFailures; failures > 0 {
+			t.Errorf("listening on %s: %d sessions refused by the client", listenHost, failures)
+		}
+		h.shutdown()
+	}
+}
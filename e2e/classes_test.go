@@ -0,0 +1,70 @@
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/parvit/qpep/client"
+	"github.com/parvit/qpep/shared"
+)
+
+// TestTrafficClasses checks that the streams of each class are sent on their own session and
+// counted in their class on both sides
+func TestTrafficClasses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	interactive, bulk, other := startEchoServer(t), startEchoServer(t), startEchoServer(t)
+	h, err := startHarnessWith(dir, nil, func(h *harness, config *client.ClientConfig) {
+		rules, err := client.ParseClassRules(fmt.Sprintf("127.0.0.1:%d=bulk", bulk.Addr().(*net.TCPAddr).Port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.ClassRules = rules
+		config.InteractivePorts = []int{interactive.Addr().(*net.TCPAddr).Port}
+	})
+	if err != nil {
+		t.Fatalf("start harness: %s", err)
+	}
+	defer h.shutdown()
+
+	sizes := map[shared.TrafficClass]int{shared.CLASS_INTERACTIVE: 100, shared.CLASS_BULK: 1024 * 1024, shared.CLASS_DEFAULT: 4096}
+	destinations := map[shared.TrafficClass]net.Addr{shared.CLASS_INTERACTIVE: interactive.Addr(), shared.CLASS_BULK: bulk.Addr(), shared.CLASS_DEFAULT: other.Addr()}
+	for class, destination := range destinations {
+		conn := h.mustDial(t, destination)
+		payload := randomPayload(t, sizes[class])
+		go func() {
+			conn.Write(payload)
+			conn.CloseWrite()
+		}()
+		received, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil || !bytes.Equal(received, payload) {
+			t.Fatalf("echo of the %s class: %v", class, err)
+		}
+	}
+
+	if err = h.shutdown(); err != nil {
+		t.Fatalf("harness shutdown: %s", err)
+	}
+	clientStats, serverStats := h.client.Stats(), h.server.Stats()
+	if clientStats.SessionsQUIC != shared.TRAFFIC_CLASSES || serverStats.SessionsQUIC != shared.TRAFFIC_CLASSES {
+		t.Errorf("%d sessions opened by the client and %d accepted by the server, expected one per class",
+			clientStats.SessionsQUIC, serverStats.SessionsQUIC)
+	}
+	for class, size := range sizes {
+		expected := shared.ClassStats{Class: class.String(), Streams: 1, BytesUp: uint64(size), BytesDown: uint64(size)}
+		if stats := clientStats.Classes[class]; stats != expected {
+			t.Errorf("client stats of the %s class %+v, expected %+v", class, stats, expected)
+		}
+		if stats := serverStats.Classes[class]; stats != expected {
+			t.Errorf("server stats of the %s class %+v, expected %+v", class, stats, expected)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/parvit/qpep/dialer"
+)
+
+// TestDialer connects through the harness server with the embeddable dialer instead of the client
+func TestDialer(t *testing.T) {
+	qpepDialer := dialer.New(dialer.Config{GatewayHost: "127.0.0.1", GatewayPort: testHarness.serverPort, ConnectionRetries: 1})
+	defer qpepDialer.Close()
+
+	body := randomPayload(t, 64*1024)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer httpServer.Close()
+	httpClient := &http.Client{Timeout: testTimeout, Transport: &http.Transport{DialContext: qpepDialer.DialContext}}
+	for i := 0; i < 3; i++ {
+		response, err := httpClient.Get(httpServer.URL)
+		if err != nil {
+			t.Fatalf("request %d: %s", i, err)
+		}
+		received, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil || !bytes.Equal(received, body) {
+			t.Fatalf("request %d: received %d bytes, %v", i, len(received), err)
+		}
+	}
+
+	echo := startEchoServer(t)
+	conn, err := qpepDialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err = conn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("read before the deadline returned %v instead of a timeout", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	conn.Write([]byte("half closed"))
+	conn.(*dialer.Conn).CloseWrite()
+	if received, err := ioutil.ReadAll(conn); err != nil || string(received) != "half closed" {
+		t.Fatalf("echo after CloseWrite: received %q, %v", received, err)
+	}
+
+	if _, err = qpepDialer.Dial("udp", echo.Addr().String()); err == nil {
+		t.Fatal("dialing udp through the gateway succeeded")
+	}
+}
@@ -0,0 +1,144 @@
+package e2e
+
+import (
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/parvit/qpep/client"
+	"github.com/parvit/qpep/server"
+	"github.com/parvit/qpep/shared"
+)
+
+// exchangeSize is the size of the requests and responses of the exchanges through the lossy relay,
+// the packets carrying them are the only ones larger than it
+const exchangeSize = 64
+
+// Packets dropped by the lossy relay
+const (
+	dropNone = iota
+	dropRequest
+	dropResponse
+)
+
+// lossyRelay forwards the UDP packets of a client to the gateway and back with a delay each way, it
+// drops the packet of the next request or response when told to by the test, so that the same
+// exchanges lose a packet from one run to the next whatever the other packets sent
+type lossyRelay struct {
+	*net.UDPConn
+	// drop is the packet to drop, reset to dropNone once it is dropped
+	drop int32
+}
+
+func startLossyRelay(t *testing.T, gateway *net.UDPAddr, delay time.Duration) *lossyRelay {
+	t.Helper()
+	relay := &lossyRelay{}
+	relay.UDPConn = startRelay(t, gateway, delay, func(packet []byte, toGateway bool) bool {
+		// the acknowledgements are smaller than the exchanges, and the parity packets carry no
+		// QUIC packet
+		if len(shared.FECPayload(packet)) <= exchangeSize {
+			return false
+		}
+		expected := int32(dropResponse)
+		if toGateway {
+			expected = dropRequest
+		}
+		return atomic.CompareAndSwapInt32(&relay.drop, expected, dropNone)
+	})
+	return relay
+}
+
+// lossStalls counts the request and response exchanges through a lossy link that took longer than
+// twice its round trip time, the time taken to recover a lost packet without FEC, and the exchanges
+// that lost a packet; the same one in ten exchanges loses its request or its response on each run
+func lossStalls(t *testing.T, fec bool) (int, int) {
+	const (
+		delay     = 10 * time.Millisecond
+		warmup    = 60
+		exchanges = 100
+	)
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var relay *lossyRelay
+	h, err := startHarnessWith(dir, func(config *server.ServerConfig) {
+		config.FEC = fec
+		config.MTUDiscovery = false
+	}, func(h *harness, config *client.ClientConfig) {
+		relay = startLossyRelay(t, h.server.Addr().(*net.UDPAddr), delay)
+		config.GatewayPort = relay.LocalAddr().(*net.UDPAddr).Port
+		config.TransportFallback = false
+		config.FEC = fec
+		// the probes of the path MTU discovery would be dropped in place of the exchanges
+		config.MTUDiscovery = false
+	})
+	if err != nil {
+		t.Fatalf("start harness: %s", err)
+	}
+	defer h.shutdown()
+
+	echo := startEchoServer(t)
+	conn := h.mustDial(t, echo.Addr())
+	defer conn.Close()
+	stalls, lost := 0, 0
+	request := randomPayload(t, exchangeSize)
+	response := make([]byte, len(request))
+	random := mathrand.New(mathrand.NewSource(1))
+	// the first exchanges let the loss be observed and reported
+	for i := 0; i < warmup+exchanges; i++ {
+		drop := int32(dropNone)
+		switch random.Intn(20) {
+		case 0:
+			drop = dropRequest
+		case 1:
+			drop = dropResponse
+		}
+		atomic.StoreInt32(&relay.drop, drop)
+		start := time.Now()
+		if _, err = conn.Write(request); err != nil {
+			t.Fatalf("write request %d: %s", i, err)
+		}
+		if _, err = io.ReadFull(conn, response); err != nil {
+			t.Fatalf("read response %d: %s", i, err)
+		}
+		if atomic.LoadInt32(&relay.drop) != dropNone {
+			t.Fatalf("exchange %d completed without losing its packet", i)
+		}
+		if i < warmup {
+			continue
+		}
+		if drop != dropNone {
+			lost++
+		}
+		if time.Since(start) > 4*delay {
+			stalls++
+		}
+	}
+	if fec {
+		if stats := h.client.Stats(); stats.FECRecovered == 0 {
+			t.Errorf("client stats %+v, expected packets recovered by FEC", stats)
+		}
+		if stats := h.server.Stats(); stats.FECSessions != 1 || stats.FECRecovered == 0 {
+			t.Errorf("server stats %+v, expected packets recovered by FEC on a single session", stats)
+		}
+	}
+	return stalls, lost
+}
+
+// TestFEC checks that FEC recovers most of the packets lost by one exchange in ten without waiting
+// for their retransmission
+func TestFEC(t *testing.T) {
+	stalls, lost := lossStalls(t, false)
+	fecStalls, _ := lossStalls(t, true)
+	t.Logf("%d exchanges of the %d losing a packet stalled without FEC, %d with FEC", stalls, lost, fecStalls)
+	if fecStalls*2 >= stalls {
+		t.Errorf("%d exchanges stalled with FEC, expected less than half of the %d without", fecStalls, stalls)
+	}
+}
@@ -0,0 +1,262 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parvit/qpep/client"
+	"github.com/parvit/qpep/logger"
+	"github.com/parvit/qpep/server"
+)
+
+const testTimeout = 10 * time.Second
+
+// harness runs a server and a client on loopback in the test process, the client accepts
+// connections on a plain TCP listener standing in for TPROXY and relays each of them to the
+// destination registered by dial
+type harness struct {
+	server       *server.Server
+	client       *client.Client
+	serverPort   int
+	listener     net.Listener
+	destinations sync.Map
+}
+
+var testHarness *harness
+
+func TestMain(m *testing.M) {
+	logger.Configure(logger.WARNING, logger.FORMAT_TEXT, os.Stderr)
+
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testHarness, err = startHarness(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to start harness:", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	if err = testHarness.shutdown(); err != nil {
+		fmt.Fprintln(os.Stderr, "unclean shutdown:", err)
+		code = 1
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startHarness starts a server and a client, the certificate and the policy of the server are kept in dir
+// and configure can change the rest of the server configuration
+func startHarness(dir string, configure ...func(config *server.ServerConfig)) (*harness, error) {
+	return startHarnessWith(dir, func(config *server.ServerConfig) {
+		for _, configureServer := range configure {
+			configureServer(config)
+		}
+	}, nil)
+}
+
+// startHarnessWith is startHarness with a configuration of the client as well, it is changed once the server is started
+func startHarnessWith(dir string, configureServer func(config *server.ServerConfig), configureClient func(h *harness, config *client.ClientConfig)) (*harness, error) {
+	// destinations are on loopback, which the default policy denies
+	policyFile := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(policyFile, []byte("disableDefaults: true\n"), 0600); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	h := &harness{listener: listener}
+
+	serverConfig := server.DefaultConfig()
+	serverConfig.ListenHost = "127.0.0.1"
+	serverConfig.ListenPort = 0
+	serverConfig.CertFile = filepath.Join(dir, "server_cert.pem")
+	serverConfig.KeyFile = filepath.Join(dir, "server_key.pem")
+	serverConfig.PolicyFile = policyFile
+	if configureServer != nil {
+		configureServer(&serverConfig)
+	}
+	h.server = server.New(serverConfig)
+	if err = h.server.Start(context.Background()); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	h.serverPort = h.server.Addr().(*net.UDPAddr).Port
+
+	clientConfig := client.DefaultConfig()
+	clientConfig.GatewayHost = "127.0.0.1"
+	clientConfig.GatewayPort = h.serverPort
+	clientConfig.Listener = listener
+	clientConfig.OriginalDestination = func(conn net.Conn) *net.TCPAddr {
+		// the destination is registered by dial once the connection is established
+		for start := time.Now(); time.Since(start) < testTimeout; time.Sleep(time.Millisecond) {
+			if destination, ok := h.destinations.Load(conn.RemoteAddr().String()); ok {
+				return destination.(*net.TCPAddr)
+			}
+		}
+		return conn.LocalAddr().(*net.TCPAddr)
+	}
+	if configureClient != nil {
+		configureClient(h, &clientConfig)
+	}
+	h.client = client.New(clientConfig)
+	if err = h.client.Start(context.Background()); err != nil {
+		h.server.Shutdown(context.Background())
+		return nil, err
+	}
+	return h, nil
+}
+
+// dial connects to the client listener as if the connection to destination had been intercepted
+func (h *harness) dial(destination net.Addr) (*net.TCPConn, error) {
+	conn, err := net.DialTimeout("tcp", h.listener.Addr().String(), testTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial client listener: %w", err)
+	}
+	h.destinations.Store(conn.LocalAddr().String(), destination.(*net.TCPAddr))
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	return conn.(*net.TCPConn), nil
+}
+
+func (h *harness) mustDial(t *testing.T, destination net.Addr) *net.TCPConn {
+	t.Helper()
+	conn, err := h.dial(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func (h *harness) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := h.client.Shutdown(ctx); err != nil {
+		return fmt.Errorf("client shutdown: %w", err)
+	}
+	if err := h.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("server shutdown: %w", err)
+	}
+	if conn, err := net.DialTimeout("tcp", h.listener.Addr().String(), time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("client listener still accepting connections")
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: h.serverPort})
+	if err != nil {
+		return fmt.Errorf("server port not released: %w", err)
+	}
+	conn.Close()
+	if tcpAddr := h.server.TCPAddr(); tcpAddr != nil {
+		tcpListener, err := net.Listen("tcp", tcpAddr.String())
+		if err != nil {
+			return fmt.Errorf("server TCP port not released: %w", err)
+		}
+		tcpListener.Close()
+	}
+	return nil
+}
+
+// startEchoServer echoes every connection back and half-closes it once the peer has
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func randomPayload(t *testing.T, size int) []byte {
+	t.Helper()
+	payload := make([]byte, size)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// echoThrough sends a payload through the harness to an echo server and checks it comes back
+func echoThrough(t *testing.T, h *harness, size int) {
+	t.Helper()
+	echo := startEchoServer(t)
+	payload := randomPayload(t, size)
+	conn := h.mustDial(t, echo.Addr())
+	defer conn.Close()
+	go func() {
+		conn.Write(payload)
+		conn.CloseWrite()
+	}()
+	received, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read echo: %s", err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatalf("received %d bytes, expected %d", len(received), len(payload))
+	}
+}
+
+// startRelay forwards the packets between the client of the first packet and the gateway after a
+// delay, except those selected by drop, which is called by a single goroutine with the direction
+// of the packet
+func startRelay(t *testing.T, gateway *net.UDPAddr, delay time.Duration, drop func(packet []byte, toGateway bool) bool) *net.UDPConn {
+	t.Helper()
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+	go func() {
+		var clientAddr net.Addr
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			destination := net.Addr(gateway)
+			if addr.String() == gateway.String() {
+				destination = clientAddr
+			} else {
+				clientAddr = addr
+			}
+			if destination == nil || drop(buf[:n], destination == net.Addr(gateway)) {
+				continue
+			}
+			packet := append([]byte(nil), buf[:n]...)
+			time.AfterFunc(delay, func() { relay.WriteTo(packet, destination) })
+		}
+	}()
+	return relay
+}
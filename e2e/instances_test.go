@@ -0,0 +1,46 @@
+package e2e
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestMultipleInstances runs a second client and server next to the harness ones
+func TestMultipleInstances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	second, err := startHarness(dir)
+	if err != nil {
+		t.Fatalf("start second harness: %s", err)
+	}
+	echo := startEchoServer(t)
+
+	before := testHarness.client.Stats()
+	for _, h := range []*harness{testHarness, second, testHarness} {
+		conn := h.mustDial(t, echo.Addr())
+		conn.Write([]byte("instance payload"))
+		conn.CloseWrite()
+		received, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(received) != "instance payload" {
+			t.Fatalf("received %q, %v", received, err)
+		}
+	}
+	if err = second.shutdown(); err != nil {
+		t.Fatalf("second harness shutdown: %s", err)
+	}
+
+	if stats := second.client.Stats(); stats.BytesUp != 16 || stats.BytesDown != 16 || stats.SessionsActive != 0 {
+		t.Errorf("second client stats %+v, expected 16 bytes each way and no session", stats)
+	}
+	if stats := second.server.Stats(); stats.BytesUp != 16 || stats.BytesDown != 16 {
+		t.Errorf("second server stats %+v, expected 16 bytes each way", stats)
+	}
+	if stats := testHarness.client.Stats(); stats.BytesUp-before.BytesUp != 32 || stats.SessionsActive != 1 {
+		t.Errorf("harness client stats %+v after %+v, expected 32 more bytes up on its session", stats, before)
+	}
+}
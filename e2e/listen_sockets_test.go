@@ -0,0 +1,143 @@
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/parvit/qpep/dialer"
+	"github.com/parvit/qpep/server"
+)
+
+// TestListenSockets checks that the packets of a session reach its listener across the sockets
+// bound with SO_REUSEPORT as its client migrates, whichever socket the kernel picks for them
+func TestListenSockets(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("several listen sockets are only supported on linux")
+	}
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, err := startHarness(dir, func(config *server.ServerConfig) {
+		config.ListenSockets = 4
+	})
+	if err != nil {
+		t.Fatalf("start harness: %s", err)
+	}
+	defer h.shutdown()
+
+	const migrations = 5
+	echo := startEchoServer(t)
+	conn := h.mustDial(t, echo.Addr())
+	defer conn.Close()
+	for i := 0; i <= migrations; i++ {
+		if i > 0 {
+			if migrated := h.client.MigrateSessions(); migrated != 1 {
+				t.Fatalf("migrated %d sessions, expected 1", migrated)
+			}
+		}
+		payload := randomPayload(t, 256*1024)
+		go conn.Write(payload)
+		received := make([]byte, len(payload))
+		if _, err = io.ReadFull(conn, received); err != nil {
+			t.Fatalf("read echo after %d migrations: %s", i, err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatalf("corrupted echo after %d migrations", i)
+		}
+	}
+	stats := h.server.Stats()
+	t.Logf("%d packets steered to the socket of their session", stats.SteeredPackets)
+	if stats.Migrations != migrations || stats.SessionsQUIC != 1 {
+		t.Errorf("server stats %+v, expected a single session migrated %d times", stats, migrations)
+	}
+}
+
+// BenchmarkListenSockets uploads through many sessions at once to a server reading them from one
+// socket and from several sockets bound with SO_REUSEPORT
+func BenchmarkListenSockets(b *testing.B) {
+	if runtime.GOOS != "linux" {
+		b.Skip("several listen sockets are only supported on linux")
+	}
+	const (
+		sessions  = 64
+		chunkSize = 32 * 1024
+	)
+	discard, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer discard.Close()
+	go func() {
+		for {
+			conn, err := discard.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	chunk := make([]byte, chunkSize)
+	for _, sockets := range []int{1, 4} {
+		b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "qpep-e2e")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			h, err := startHarness(dir, func(config *server.ServerConfig) {
+				config.ListenSockets = sockets
+			})
+			if err != nil {
+				b.Fatalf("start harness: %s", err)
+			}
+			defer h.shutdown()
+			// each dialer opens its own session
+			conns := make([]net.Conn, sessions)
+			for i := range conns {
+				qpepDialer := dialer.New(dialer.Config{GatewayHost: "127.0.0.1", GatewayPort: h.serverPort, ConnectionRetries: 1})
+				defer qpepDialer.Close()
+				if conns[i], err = qpepDialer.Dial("tcp", discard.Addr().String()); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.SetBytes(chunkSize)
+			b.ResetTimer()
+			chunks := int64(b.N)
+			var wg sync.WaitGroup
+			for _, conn := range conns {
+				wg.Add(1)
+				go func(conn net.Conn) {
+					defer wg.Done()
+					for atomic.AddInt64(&chunks, -1) >= 0 {
+						if _, err := conn.Write(chunk); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+					// the upload is complete once the destination closes the stream
+					conn.(*dialer.Conn).CloseWrite()
+					io.Copy(ioutil.Discard, conn)
+				}(conn)
+			}
+			wg.Wait()
+			b.StopTimer()
+			for _, conn := range conns {
+				conn.Close()
+			}
+		})
+	}
+}
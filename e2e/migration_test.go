@@ -0,0 +1,59 @@
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/parvit/qpep/client"
+	"github.com/parvit/qpep/server"
+)
+
+func TestMigration(t *testing.T) {
+	for _, fec := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fec=%v", fec), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "qpep-e2e")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			h, err := startHarnessWith(dir, func(config *server.ServerConfig) {
+				config.FEC = fec
+			}, func(h *harness, config *client.ClientConfig) {
+				config.FEC = fec
+			})
+			if err != nil {
+				t.Fatalf("start harness: %s", err)
+			}
+			defer h.shutdown()
+
+			// a transfer is carried on across two migrations of its session to a new socket, the
+			// path challenges of the server are sent outside of the FEC
+			echo := startEchoServer(t)
+			conn := h.mustDial(t, echo.Addr())
+			defer conn.Close()
+			for i := 0; i < 3; i++ {
+				if i > 0 {
+					if migrated := h.client.MigrateSessions(); migrated != 1 {
+						t.Fatalf("migrated %d sessions, expected 1", migrated)
+					}
+				}
+				payload := randomPayload(t, 512*1024)
+				go conn.Write(payload)
+				received := make([]byte, len(payload))
+				if _, err = io.ReadFull(conn, received); err != nil {
+					t.Fatalf("read echo after %d migrations: %s", i, err)
+				}
+				if !bytes.Equal(received, payload) {
+					t.Fatalf("corrupted echo after %d migrations", i)
+				}
+			}
+			if stats := h.server.Stats(); stats.Migrations != 2 || stats.SessionsQUIC != 1 {
+				t.Errorf("server stats %+v, expected a single session migrated twice", stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package e2e
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/parvit/qpep/client"
+	"github.com/parvit/qpep/server"
+	"github.com/parvit/qpep/shared"
+)
+
+// packetSizes transfers data through a harness configured by configure until both sides use
+// packets larger than the initial ones or the transfers of the test are done, it returns the
+// stats of the client and the server
+func packetSizes(t *testing.T, configure func(h *harness, config *client.ClientConfig), configureServer func(config *server.ServerConfig)) (client.Stats, server.Stats) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, err := startHarnessWith(dir, configureServer, func(h *harness, config *client.ClientConfig) {
+		config.TransportFallback = false
+		configure(h, config)
+	})
+	if err != nil {
+		t.Fatalf("start harness: %s", err)
+	}
+	defer h.shutdown()
+
+	for i := 0; i < 20; i++ {
+		echoThrough(t, h, 256*1024)
+		if h.client.Stats().PacketSize > shared.MIN_PACKET_SIZE && h.server.Stats().PacketSize > shared.MIN_PACKET_SIZE {
+			break
+		}
+	}
+	return h.client.Stats(), h.server.Stats()
+}
+
+// TestPathMTU checks that the path MTU discovery finds the largest packets carried by a relay
+// dropping the larger ones, and that the packets stay below the configured size
+func TestPathMTU(t *testing.T) {
+	const relayMTU = 1400
+	const maxPacketSize = 1300
+	var largest int32
+	dropLarge := func(h *harness, config *client.ClientConfig) {
+		relay := startRelay(t, h.server.Addr().(*net.UDPAddr), 0, func(packet []byte, toGateway bool) bool {
+			return len(packet) > relayMTU
+		})
+		config.GatewayPort = relay.LocalAddr().(*net.UDPAddr).Port
+	}
+	for _, test := range []struct {
+		name            string
+		configure       func(h *harness, config *client.ClientConfig)
+		configureServer func(config *server.ServerConfig)
+		min, max        int
+	}{
+		{"discovery", dropLarge, func(config *server.ServerConfig) {}, shared.MIN_PACKET_SIZE + 1, relayMTU},
+		// the FEC header is part of the packets crossing the relay
+		{"discovery with FEC", func(h *harness, config *client.ClientConfig) {
+			dropLarge(h, config)
+			config.FEC = true
+		}, func(config *server.ServerConfig) {
+			config.FEC = true
+		}, shared.MIN_PACKET_SIZE + 1, relayMTU - shared.MinPacketSize(true) + shared.MIN_PACKET_SIZE},
+		// the relay records the largest packet sent by either side
+		{"max packet size", func(h *harness, config *client.ClientConfig) {
+			relay := startRelay(t, h.server.Addr().(*net.UDPAddr), 0, func(packet []byte, toGateway bool) bool {
+				for size := atomic.LoadInt32(&largest); int32(len(packet)) > size; size = atomic.LoadInt32(&largest) {
+					if atomic.CompareAndSwapInt32(&largest, size, int32(len(packet))) {
+						break
+					}
+				}
+				return false
+			})
+			config.GatewayPort = relay.LocalAddr().(*net.UDPAddr).Port
+			config.MaxPacketSize = maxPacketSize
+		}, func(config *server.ServerConfig) {
+			config.MaxPacketSize = maxPacketSize
+		}, shared.MIN_PACKET_SIZE + 1, maxPacketSize},
+		{"no discovery", func(h *harness, config *client.ClientConfig) {
+			dropLarge(h, config)
+			config.MTUDiscovery = false
+		}, func(config *server.ServerConfig) {
+			config.MTUDiscovery = false
+		}, 1, shared.MIN_PACKET_SIZE},
+	} {
+		clientStats, serverStats := packetSizes(t, test.configure, test.configureServer)
+		t.Logf("%s: packets of %d bytes from the client, %d bytes from the server", test.name, clientStats.PacketSize, serverStats.PacketSize)
+		for _, size := range []int{clientStats.PacketSize, serverStats.PacketSize} {
+			if size < test.min || size > test.max {
+				t.Errorf("%s: packets of %d bytes, expected between %d and %d", test.name, size, test.min, test.max)
+			}
+		}
+		if test.name != "max packet size" {
+			continue
+		}
+		// the probes over the size are dropped before the relay
+		if size := atomic.LoadInt32(&largest); size > maxPacketSize {
+			t.Errorf("%s: relay forwarded a packet of %d bytes", test.name, size)
+		}
+		if clientStats.MTUDropped == 0 || serverStats.MTUDropped == 0 {
+			t.Errorf("%s: %d packets dropped by the client and %d by the server, expected the probes over the size", test.name, clientStats.MTUDropped, serverStats.MTUDropped)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package e2e
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/parvit/qpep/client"
+	"github.com/parvit/qpep/shared"
+)
+
+func TestMultipath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// two source addresses on loopback and an interface that doesn't exist, whose path stays down
+	h, err := startHarnessWith(dir, nil, func(h *harness, config *client.ClientConfig) {
+		config.Paths = client.ParsePaths("127.0.0.1,127.0.0.2,qpep-missing0")
+		config.PathPolicy = client.PATH_POLICY_BALANCE
+	})
+	if err != nil {
+		t.Fatalf("start harness: %s", err)
+	}
+	defer h.shutdown()
+
+	for start := time.Now(); h.server.Stats().SessionsQUIC < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > testTimeout {
+			t.Fatalf("paths not up, client stats %+v", h.client.Stats())
+		}
+	}
+
+	// the streams held open at once are spread across the paths that are up
+	echo := startEchoServer(t)
+	var conns []*net.TCPConn
+	for i := 0; i < 4; i++ {
+		conn := h.mustDial(t, echo.Addr())
+		defer conn.Close()
+		buf := []byte("ping")
+		conn.Write(buf)
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("read echo: %s", err)
+		}
+		conns = append(conns, conn)
+	}
+	paths := h.client.Stats().Paths
+	if len(paths) != 3 {
+		t.Fatalf("client stats list %d paths, expected 3", len(paths))
+	}
+	for _, path := range paths[:2] {
+		if !path.Up || path.Transport != shared.TRANSPORT_QUIC || path.RTT == 0 || path.StreamsActive != 2 {
+			t.Errorf("path %+v, expected to be up with 2 streams", path)
+		}
+	}
+	if paths[2].Up || paths[2].StreamsActive != 0 {
+		t.Errorf("path %+v, expected to be down", paths[2])
+	}
+	for _, conn := range conns {
+		conn.CloseWrite()
+		ioutil.ReadAll(conn)
+	}
+
+	echoThrough(t, h, 1024*1024)
+	if stats := h.server.Stats(); stats.SessionsQUIC != 2 {
+		t.Errorf("server stats %+v, expected a session per path", stats)
+	}
+}
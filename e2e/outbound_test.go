@@ -0,0 +1,67 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/parvit/qpep/server"
+)
+
+type failingDialer struct {
+	calls int32
+}
+
+func (dialer *failingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	atomic.AddInt32(&dialer.calls, 1)
+	return nil, fmt.Errorf("uplink down")
+}
+
+// TestOutboundDialer checks that the server connects to the destinations with the dialer of its configuration
+func TestOutboundDialer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	failing := &failingDialer{}
+	h, err := startHarness(dir, func(config *server.ServerConfig) {
+		config.OutboundDialer = server.ChainedDialer{
+			failing,
+			&server.DirectDialer{SourceAddress: net.IPv4(127, 0, 0, 2), Timeout: time.Second},
+		}
+	})
+	if err != nil {
+		t.Fatalf("start harness: %s", err)
+	}
+	defer h.shutdown()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(conn.RemoteAddr().(*net.TCPAddr).IP.String()))
+	}()
+
+	conn := h.mustDial(t, listener.Addr())
+	defer conn.Close()
+	source, err := ioutil.ReadAll(conn)
+	if err != nil || string(source) != "127.0.0.2" {
+		t.Fatalf("destination saw the connection from %q, %v, expected 127.0.0.2", source, err)
+	}
+	if calls := atomic.LoadInt32(&failing.calls); calls != 1 {
+		t.Fatalf("first dialer of the chain called %d times", calls)
+	}
+}
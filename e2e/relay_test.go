@@ -0,0 +1,153 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEchoDelivery(t *testing.T) {
+	echo := startEchoServer(t)
+	payload := randomPayload(t, 4*1024*1024)
+
+	conn := testHarness.mustDial(t, echo.Addr())
+	defer conn.Close()
+	go func() {
+		conn.Write(payload)
+		conn.CloseWrite()
+	}()
+	received, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read echo: %s", err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatalf("echoed %d bytes differ from the %d bytes sent", len(received), len(payload))
+	}
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	echo := startEchoServer(t)
+
+	var wait sync.WaitGroup
+	failures := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			payload := []byte(fmt.Sprintf("stream %d payload", i))
+			conn, err := testHarness.dial(echo.Addr())
+			if err != nil {
+				failures <- err
+				return
+			}
+			defer conn.Close()
+			conn.Write(payload)
+			conn.CloseWrite()
+			received, err := ioutil.ReadAll(conn)
+			if err != nil || !bytes.Equal(received, payload) {
+				failures <- fmt.Errorf("stream %d: received %q, %v", i, received, err)
+			}
+		}(i)
+	}
+	wait.Wait()
+	close(failures)
+	for err := range failures {
+		t.Error(err)
+	}
+}
+
+// TestDestinationCloseFirst checks that a FIN from the destination reaches the client while
+// the client can still send on its half of the connection
+func TestDestinationCloseFirst(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("greeting"))
+		conn.(*net.TCPConn).CloseWrite()
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+
+	conn := testHarness.mustDial(t, listener.Addr())
+	defer conn.Close()
+	greeting, err := ioutil.ReadAll(conn)
+	if err != nil || string(greeting) != "greeting" {
+		t.Fatalf("read greeting: %q, %v", greeting, err)
+	}
+	conn.Write([]byte("reply after FIN"))
+	conn.CloseWrite()
+	select {
+	case data := <-received:
+		if string(data) != "reply after FIN" {
+			t.Fatalf("destination received %q", data)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("destination did not receive the reply")
+	}
+}
+
+// TestUnreachableDestination checks that the client connection is closed when the server can't connect
+func TestUnreachableDestination(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := listener.Addr()
+	listener.Close()
+
+	conn := testHarness.mustDial(t, closedAddr)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	data, err := ioutil.ReadAll(conn)
+	if len(data) > 0 {
+		t.Fatalf("received %q from an unreachable destination", data)
+	}
+	if isTimeout(err) {
+		t.Fatal("connection to an unreachable destination was not closed")
+	}
+}
+
+func TestHTTPRequest(t *testing.T) {
+	body := randomPayload(t, 256*1024)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer httpServer.Close()
+	destination := httpServer.Listener.Addr()
+
+	httpClient := &http.Client{
+		Timeout: testTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return testHarness.dial(destination)
+			},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		response, err := httpClient.Get(httpServer.URL)
+		if err != nil {
+			t.Fatalf("request %d: %s", i, err)
+		}
+		received, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil || !bytes.Equal(received, body) {
+			t.Fatalf("request %d: received %d bytes, %v", i, len(received), err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package e2e
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/parvit/qpep/client"
+)
+
+// TestGracefulShutdown checks that a server shutting down refuses new streams, lets the active
+// streams finish within the grace period and resets the ones still active after it
+func TestGracefulShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, err := startHarness(dir)
+	if err != nil {
+		t.Fatalf("start harness: %s", err)
+	}
+	defer h.shutdown()
+
+	// the destination answers each request after a delay, or never for "hold" and "mute", keeping
+	// the connection open after the end of a "mute" one until the test returns
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	release := make(chan struct{})
+	defer close(release)
+	accepted := make(chan struct{}, 3)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request := make([]byte, 4)
+				if _, err := io.ReadFull(conn, request); err != nil {
+					return
+				}
+				accepted <- struct{}{}
+				if string(request) == "hold" {
+					ioutil.ReadAll(conn)
+					return
+				}
+				if string(request) == "mute" {
+					ioutil.ReadAll(conn)
+					<-release
+					return
+				}
+				time.Sleep(300 * time.Millisecond)
+				conn.Write([]byte("done"))
+			}()
+		}
+	}()
+
+	finishing := h.mustDial(t, listener.Addr())
+	defer finishing.Close()
+	holding := h.mustDial(t, listener.Addr())
+	defer holding.Close()
+	// the client of the half-closed stream is done sending, only the destination could end it
+	muted := h.mustDial(t, listener.Addr())
+	defer muted.Close()
+	finishing.Write([]byte("slow"))
+	holding.Write([]byte("hold"))
+	muted.Write([]byte("mute"))
+	muted.CloseWrite()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-accepted:
+		case <-time.After(testTimeout):
+			t.Fatal("destination did not receive the requests")
+		}
+	}
+
+	shutdownErr := make(chan error, 1)
+	shutdownStart := time.Now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdownErr <- h.server.Shutdown(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	refused := h.mustDial(t, listener.Addr())
+	defer refused.Close()
+	refused.Write([]byte("late"))
+	if data, err := ioutil.ReadAll(refused); len(data) > 0 || isTimeout(err) {
+		t.Errorf("new connection while draining: received %q, %v", data, err)
+	}
+
+	finishing.CloseWrite()
+	if data, err := ioutil.ReadAll(finishing); err != nil || string(data) != "done" {
+		t.Errorf("active stream did not finish while draining: received %q, %v", data, err)
+	}
+
+	if data, err := ioutil.ReadAll(holding); len(data) > 0 || err == nil || isTimeout(err) {
+		t.Errorf("stream active after the grace period was not reset: received %q, %v", data, err)
+	}
+	if data, err := ioutil.ReadAll(muted); len(data) > 0 || err == nil || isTimeout(err) {
+		t.Errorf("half-closed stream active after the grace period was not reset: received %q, %v", data, err)
+	}
+	if elapsed := time.Since(shutdownStart); elapsed < time.Second {
+		t.Errorf("stream reset after %s, before the end of the grace period", elapsed)
+	}
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Errorf("shutdown: %s", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("server did not stop")
+	}
+	if stats := h.server.Stats(); stats.SessionsActive != 0 || stats.StreamsActive != 0 {
+		t.Errorf("server stats after shutdown %+v, expected no session or stream", stats)
+	}
+}
+
+// TestShutdownWhileDialing checks that a client shutting down while it opens a session to a gateway
+// that never answers stops within the grace period instead of waiting for the handshake to time out
+func TestShutdownWhileDialing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dialing := make(chan struct{}, 1)
+	h, err := startHarnessWith(dir, nil, func(h *harness, config *client.ClientConfig) {
+		blackhole := startRelay(t, h.server.Addr().(*net.UDPAddr), 0, func(packet []byte, toGateway bool) bool {
+			select {
+			case dialing <- struct{}{}:
+			default:
+			}
+			return true
+		})
+		config.GatewayPort = blackhole.LocalAddr().(*net.UDPAddr).Port
+		config.TransportFallback = false
+	})
+	if err != nil {
+		t.Fatalf("start harness: %s", err)
+	}
+	defer h.shutdown()
+
+	echo := startEchoServer(t)
+	conn := h.mustDial(t, echo.Addr())
+	defer conn.Close()
+	select {
+	case <-dialing:
+	case <-time.After(testTimeout):
+		t.Fatal("client did not dial the gateway")
+	}
+
+	const gracePeriod = 500 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	start := time.Now()
+	if err = h.client.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > gracePeriod+time.Second {
+		t.Errorf("shutdown took %s while dialing, expected at most the %s grace period", elapsed, gracePeriod)
+	}
+	if data, err := ioutil.ReadAll(conn); len(data) > 0 || isTimeout(err) {
+		t.Errorf("connection waiting for the session: received %q, %v, expected it to be closed", data, err)
+	}
+}
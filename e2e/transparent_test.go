@@ -0,0 +1,67 @@
+package e2e
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/parvit/qpep/server"
+	"github.com/parvit/qpep/shared"
+)
+
+// TestTransparentSource checks that the server connects to the destinations from the source address
+// and port of the client connections
+func TestTransparentSource(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("transparent source addresses are only supported on linux")
+	}
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, err := startHarness(dir, func(config *server.ServerConfig) {
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		config.OutboundDialer = &server.DirectDialer{Transparent: true, TransparentSources: []*net.IPNet{loopback}, Timeout: time.Second}
+	})
+	if err != nil {
+		t.Fatalf("start harness: %s", err)
+	}
+	defer h.shutdown()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(conn.RemoteAddr().String()))
+	}()
+
+	// the connection to the client comes from another address than the one of the gateway, and
+	// reuses its address as the server binds it as well on the same host
+	clientDialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)},
+		Timeout:   testTimeout,
+		Control:   shared.TransparentSource,
+	}
+	conn, err := clientDialer.Dial("tcp", h.listener.Addr().String())
+	if err != nil {
+		t.Skipf("transparent sockets need CAP_NET_ADMIN: %s", err)
+	}
+	defer conn.Close()
+	h.destinations.Store(conn.LocalAddr().String(), listener.Addr().(*net.TCPAddr))
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	source, err := ioutil.ReadAll(conn)
+	if err != nil || string(source) != conn.LocalAddr().String() {
+		t.Fatalf("destination saw the connection from %q, %v, expected %s", source, err, conn.LocalAddr())
+	}
+}
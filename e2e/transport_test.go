@@ -0,0 +1,149 @@
+package e2e
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parvit/qpep/client"
+	"github.com/parvit/qpep/pki"
+	"github.com/parvit/qpep/server"
+	"github.com/parvit/qpep/shared"
+)
+
+// TestTCPTransport checks that the streams are relayed the same way on sessions over TLS on TCP
+func TestTCPTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, err := startHarnessWith(dir, nil, func(h *harness, config *client.ClientConfig) {
+		config.Transport = shared.TRANSPORT_TCP
+		config.TransportFallback = false
+	})
+	if err != nil {
+		t.Fatalf("start harness: %s", err)
+	}
+
+	echoThrough(t, h, 4*1024*1024)
+	echoThrough(t, h, 1024)
+	if err = h.shutdown(); err != nil {
+		t.Fatalf("harness shutdown: %s", err)
+	}
+	if stats := h.client.Stats(); stats.SessionsTCP != 1 || stats.SessionsQUIC != 0 || stats.Fallbacks != 0 {
+		t.Errorf("client stats %+v, expected a single TCP session", stats)
+	}
+	if stats := h.server.Stats(); stats.SessionsTCP != 1 || stats.SessionsQUIC != 0 || stats.BytesUp != 4*1024*1024+1024 {
+		t.Errorf("server stats %+v, expected a single TCP session", stats)
+	}
+}
+
+// TestClientCertificate checks that the sessions of a client with a certificate of the client CA of
+// the server are accepted on both transports
+func TestClientCertificate(t *testing.T) {
+	for _, transport := range []string{shared.TRANSPORT_QUIC, shared.TRANSPORT_TCP} {
+		t.Run(transport, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "qpep-e2e")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			authority, err := pki.CreateAuthority(filepath.Join(dir, "ca"), "qpep test CA", pki.KEY_TYPE_ECDSA, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, key, err := authority.IssueClient("site-a", pki.KEY_TYPE_ECDSA, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyPEM, err := pki.EncodeKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+			if err = ioutil.WriteFile(certFile, pki.EncodeCertificate(cert), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			h, err := startHarnessWith(dir, func(config *server.ServerConfig) {
+				config.ClientCAFile = filepath.Join(dir, "ca", pki.CA_CERT_FILE)
+				config.CRLFile = authority.CRLPath()
+			}, func(h *harness, config *client.ClientConfig) {
+				config.Transport = transport
+				config.TransportFallback = false
+				config.ClientCertFile = certFile
+				config.ClientKeyFile = keyFile
+			})
+			if err != nil {
+				t.Fatalf("start harness: %s", err)
+			}
+			echoThrough(t, h, 64*1024)
+			if err = h.shutdown(); err != nil {
+				t.Fatalf("harness shutdown: %s", err)
+			}
+			if stats := h.server.Stats(); stats.SessionsTCP+stats.SessionsQUIC != 1 || stats.BytesUp != 64*1024 {
+				t.Errorf("server stats %+v, expected a single %s session", stats, transport)
+			}
+		})
+	}
+}
+
+// TestTransportFallback checks that the client opens its session over TCP when UDP to the gateway
+// is blocked, the gateway is reached through a TCP only forwarder
+func TestTransportFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qpep-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	forwarder, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarder.Close()
+	h, err := startHarnessWith(dir, nil, func(h *harness, config *client.ClientConfig) {
+		config.GatewayPort = forwarder.Addr().(*net.TCPAddr).Port
+		go forwardTCP(forwarder, h.server.TCPAddr().String())
+	})
+	if err != nil {
+		t.Fatalf("start harness: %s", err)
+	}
+	defer h.shutdown()
+
+	// the first connection waits for the QUIC handshake to time out
+	echoThrough(t, h, 1024)
+	if stats := h.client.Stats(); stats.SessionsTCP != 1 || stats.SessionsQUIC != 0 || stats.Fallbacks != 1 || stats.DialFailures != 0 {
+		t.Errorf("client stats %+v, expected a TCP session opened on fallback", stats)
+	}
+	if stats := h.server.Stats(); stats.SessionsTCP != 1 || stats.SessionsQUIC != 0 {
+		t.Errorf("server stats %+v, expected a single TCP session", stats)
+	}
+}
+
+// forwardTCP relays the connections accepted by listener to address until the listener is closed
+func forwardTCP(listener net.Listener, address string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := net.Dial("tcp", address)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
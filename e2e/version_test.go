@@ -0,0 +1,30 @@
+package e2e
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/parvit/qpep/shared"
+)
+
+// TestProtocolVersion checks that the server refuses the sessions of the clients sending another
+// version of the stream header
+func TestProtocolVersion(t *testing.T) {
+	address := fmt.Sprintf("127.0.0.1:%d", testHarness.serverPort)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	_, err := quic.DialAddrContext(ctx, address, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"qpep"}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "no application protocol") {
+		t.Fatalf("session of a client without the connection ID opened with %v, expected an ALPN error", err)
+	}
+
+	session, err := quic.DialAddrContext(ctx, address, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{shared.QPEP_PROTOCOL}}, nil)
+	if err != nil {
+		t.Fatalf("session of the current version refused: %s", err)
+	}
+	session.CloseWithError(0, "")
+}
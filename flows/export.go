@@ -0,0 +1,141 @@
+package flows
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UDP_COLLECTOR_PREFIX selects a UDP collector instead of a file, one record is sent per datagram
+const UDP_COLLECTOR_PREFIX = "udp:"
+
+// FlowRecord describes a proxied TCP connection once its stream is closed, up is from the client to the destination
+type FlowRecord struct {
+	Role         string    `json:"role"`
+	ConnectionID string    `json:"connectionId"`
+	Session      string    `json:"session"`
+	Peer         string    `json:"peer"`
+	Client       string    `json:"client,omitempty"`
+	Source       string    `json:"source"`
+	Destination  string    `json:"destination"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	BytesUp      uint64    `json:"bytesUp"`
+	BytesDown    uint64    `json:"bytesDown"`
+	CloseReason  string    `json:"closeReason"`
+}
+
+// ExportConfig is where the flow records are written, a JSON-lines file rotated at MaxFileSize bytes
+// keeping MaxBackups old files, or "udp:host:port"
+type ExportConfig struct {
+	Destination string
+	MaxFileSize int64
+	MaxBackups  int
+}
+
+// Exporter writes the flow records of a client or a server
+type Exporter struct {
+	role   string
+	config ExportConfig
+
+	mtx  sync.Mutex
+	file *os.File
+	size int64
+	conn net.Conn
+}
+
+func NewExporter(config ExportConfig, role string) (*Exporter, error) {
+	exporter := &Exporter{role: role, config: config}
+	if strings.HasPrefix(config.Destination, UDP_COLLECTOR_PREFIX) {
+		conn, err := net.Dial("udp", strings.TrimPrefix(config.Destination, UDP_COLLECTOR_PREFIX))
+		if err != nil {
+			return nil, err
+		}
+		exporter.conn = conn
+		return exporter, nil
+	}
+	if err := exporter.openFile(); err != nil {
+		return nil, err
+	}
+	return exporter, nil
+}
+
+// Export writes the record, it is meant to be registered with Registry.OnStreamClosed
+func (exporter *Exporter) Export(record FlowRecord) error {
+	record.Role = exporter.role
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	exporter.mtx.Lock()
+	defer exporter.mtx.Unlock()
+	if exporter.conn != nil {
+		_, err = exporter.conn.Write(line)
+		return err
+	}
+	if exporter.file == nil {
+		return fmt.Errorf("flow records file %s is closed", exporter.config.Destination)
+	}
+	if exporter.config.MaxFileSize > 0 && exporter.size > 0 && exporter.size+int64(len(line)) > exporter.config.MaxFileSize {
+		if err = exporter.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := exporter.file.Write(line)
+	exporter.size += int64(n)
+	return err
+}
+
+func (exporter *Exporter) openFile() error {
+	file, err := os.OpenFile(exporter.config.Destination, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	exporter.file = file
+	exporter.size = info.Size()
+	return nil
+}
+
+// rotate renames the file to <file>.1, shifting the older backups, must be called with the lock held
+func (exporter *Exporter) rotate() error {
+	exporter.file.Close()
+	exporter.file = nil
+	path := exporter.config.Destination
+	if exporter.config.MaxBackups <= 0 {
+		os.Remove(path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", path, exporter.config.MaxBackups))
+		for i := exporter.config.MaxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		}
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	return exporter.openFile()
+}
+
+func (exporter *Exporter) Close() error {
+	exporter.mtx.Lock()
+	defer exporter.mtx.Unlock()
+	if exporter.conn != nil {
+		return exporter.conn.Close()
+	}
+	if exporter.file == nil {
+		return nil
+	}
+	err := exporter.file.Close()
+	exporter.file = nil
+	return err
+}
@@ -0,0 +1,134 @@
+package flows
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readRecords returns the connection IDs of the records in the file, nil when it doesn't exist
+func readRecords(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var ids []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record FlowRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if record.Role != "server" {
+			t.Errorf("%s: record of the role %q, expected server", path, record.Role)
+		}
+		ids = append(ids, record.ConnectionID)
+	}
+	return ids
+}
+
+// exportRecords exports the records numbered from first to last and returns the size of one
+func exportRecords(t *testing.T, exporter *Exporter, first, last int) int64 {
+	t.Helper()
+	var size int64
+	for i := first; i <= last; i++ {
+		record := FlowRecord{ConnectionID: fmt.Sprintf("%016d", i), Start: time.Unix(0, 0).UTC(), End: time.Unix(0, 0).UTC()}
+		if err := exporter.Export(record); err != nil {
+			t.Fatal(err)
+		}
+		record.Role = exporter.role
+		line, _ := json.Marshal(record)
+		size = int64(len(line)) + 1
+	}
+	return size
+}
+
+func TestExportRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	// the size of a record is known once one is written
+	probe, err := NewExporter(ExportConfig{Destination: path + ".probe"}, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordSize := exportRecords(t, probe, 0, 0)
+	probe.Close()
+
+	config := ExportConfig{Destination: path, MaxFileSize: 2 * recordSize, MaxBackups: 2}
+	exporter, err := NewExporter(config, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportRecords(t, exporter, 1, 3)
+	exporter.Close()
+	// the size of the existing file counts after a restart
+	if exporter, err = NewExporter(config, "server"); err != nil {
+		t.Fatal(err)
+	}
+	exportRecords(t, exporter, 4, 7)
+	exporter.Close()
+
+	for name, expected := range map[string][]string{
+		path:        {"0000000000000007"},
+		path + ".1": {"0000000000000005", "0000000000000006"},
+		path + ".2": {"0000000000000003", "0000000000000004"},
+		path + ".3": nil,
+	} {
+		if ids := readRecords(t, name); fmt.Sprint(ids) != fmt.Sprint(expected) {
+			t.Errorf("%s holds the records %v, expected %v", filepath.Base(name), ids, expected)
+		}
+	}
+	if err = exporter.Export(FlowRecord{}); err == nil {
+		t.Error("record exported after the close")
+	}
+
+	// without backups the full file is dropped
+	config = ExportConfig{Destination: filepath.Join(t.TempDir(), "flows.jsonl"), MaxFileSize: 2 * recordSize}
+	if exporter, err = NewExporter(config, "server"); err != nil {
+		t.Fatal(err)
+	}
+	exportRecords(t, exporter, 1, 3)
+	exporter.Close()
+	if ids := readRecords(t, config.Destination); fmt.Sprint(ids) != "[0000000000000003]" {
+		t.Errorf("file holds the records %v, expected the last one", ids)
+	}
+	if ids := readRecords(t, config.Destination+".1"); ids != nil {
+		t.Errorf("backup kept with the records %v, expected none", ids)
+	}
+}
+
+func TestExportUDP(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	exporter, err := NewExporter(ExportConfig{Destination: UDP_COLLECTOR_PREFIX + collector.LocalAddr().String()}, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Close()
+	if err = exporter.Export(FlowRecord{ConnectionID: "54502f312e310d0a", BytesUp: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := collector.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record FlowRecord
+	if err = json.Unmarshal(buf[:n], &record); err != nil || record.Role != "client" || record.ConnectionID != "54502f312e310d0a" || record.BytesUp != 10 {
+		t.Errorf("collector received %q, %v, expected the record of the client", buf[:n], err)
+	}
+}
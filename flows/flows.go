@@ -0,0 +1,328 @@
+package flows
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// States of a stream, from the time the header is exchanged to the end of both copies
+const (
+	STATE_CONNECTING  = "connecting"
+	STATE_OPEN        = "open"
+	STATE_HALF_CLOSED = "half-closed"
+	STATE_CLOSED      = "closed"
+)
+
+// Close reasons of a stream, from the least to the most significant
+const (
+	CLOSE_FIN     = "fin"
+	CLOSE_RST     = "rst"
+	CLOSE_TIMEOUT = "timeout"
+	CLOSE_ERROR   = "error"
+)
+
+var closeReasonRanks = map[string]int{CLOSE_FIN: 1, CLOSE_RST: 2, CLOSE_TIMEOUT: 3, CLOSE_ERROR: 4}
+
+// Registry keeps the QUIC sessions and the streams currently proxied by a client or a server
+type Registry struct {
+	mtx         sync.Mutex
+	nextSession uint64
+	nextStream  uint64
+	sessions    map[string]*Session
+	streams     map[string]*Stream
+	closeHooks  []func(FlowRecord)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{sessions: make(map[string]*Session), streams: make(map[string]*Stream)}
+}
+
+// Session is a live QUIC session, peer is the remote address and client the authenticated name if any
+type Session struct {
+	ID      string
+	Peer    string
+	Client  string
+	Started time.Time
+
+	registry *Registry
+	abort    func()
+}
+
+// Stream is a live TCP connection proxied over a QUIC stream, its ID is assigned by the registry while
+// the connection ID of the flow is chosen by the client and may be shared by several streams
+type Stream struct {
+	bytesUp   uint64
+	bytesDown uint64
+
+	ID           string
+	ConnectionID string
+	QuicStream   int64
+	Source       string
+	Destination  string
+	Started      time.Time
+
+	session     *Session
+	state       atomic.Value
+	mtx         sync.Mutex
+	abort       func()
+	closeReason string
+}
+
+// SessionInfo is the snapshot of a session returned by the admin API
+type SessionInfo struct {
+	ID         string       `json:"id"`
+	Peer       string       `json:"peer"`
+	Client     string       `json:"client,omitempty"`
+	Started    time.Time    `json:"started"`
+	AgeSeconds float64      `json:"ageSeconds"`
+	BytesUp    uint64       `json:"bytesUp"`
+	BytesDown  uint64       `json:"bytesDown"`
+	Streams    []StreamInfo `json:"streams"`
+}
+
+// StreamInfo is the snapshot of a stream, up is from the client to the destination
+type StreamInfo struct {
+	ID           string    `json:"id"`
+	ConnectionID string    `json:"connectionId"`
+	Session      string    `json:"session"`
+	QuicStream   int64     `json:"quicStream"`
+	Source       string    `json:"source"`
+	Destination  string    `json:"destination"`
+	Started      time.Time `json:"started"`
+	AgeSeconds   float64   `json:"ageSeconds"`
+	BytesUp      uint64    `json:"bytesUp"`
+	BytesDown    uint64    `json:"bytesDown"`
+	State        string    `json:"state"`
+}
+
+// AddSession registers a session, abort is called to close it from the admin API
+func (registry *Registry) AddSession(peer, client string, abort func()) *Session {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	registry.nextSession++
+	session := &Session{
+		ID:       strconv.FormatUint(registry.nextSession, 10),
+		Peer:     peer,
+		Client:   client,
+		Started:  time.Now(),
+		registry: registry,
+		abort:    abort,
+	}
+	registry.sessions[session.ID] = session
+	return session
+}
+
+// OnStreamClosed registers a function called with the flow record of every stream that is removed
+func (registry *Registry) OnStreamClosed(hook func(FlowRecord)) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	registry.closeHooks = append(registry.closeHooks, hook)
+}
+
+// Sessions returns the snapshots of the live sessions, oldest first
+func (registry *Registry) Sessions() []SessionInfo {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	now := time.Now()
+	infos := make([]SessionInfo, 0, len(registry.sessions))
+	indexes := make(map[*Session]int, len(registry.sessions))
+	addSession := func(session *Session) int {
+		indexes[session] = len(infos)
+		infos = append(infos, SessionInfo{
+			ID:         session.ID,
+			Peer:       session.Peer,
+			Client:     session.Client,
+			Started:    session.Started,
+			AgeSeconds: now.Sub(session.Started).Seconds(),
+			Streams:    []StreamInfo{},
+		})
+		return indexes[session]
+	}
+	for _, session := range registry.sessions {
+		addSession(session)
+	}
+	for _, stream := range registry.streams {
+		info := stream.info(now)
+		// streams still draining after their session was removed are listed under it
+		index, ok := indexes[stream.session]
+		if !ok {
+			index = addSession(stream.session)
+		}
+		sessionInfo := &infos[index]
+		sessionInfo.BytesUp += info.BytesUp
+		sessionInfo.BytesDown += info.BytesDown
+		sessionInfo.Streams = append(sessionInfo.Streams, info)
+	}
+	for i := range infos {
+		streams := infos[i].Streams
+		sort.Slice(streams, func(a, b int) bool { return streams[a].Started.Before(streams[b].Started) })
+	}
+	sort.Slice(infos, func(a, b int) bool { return infos[a].Started.Before(infos[b].Started) })
+	return infos
+}
+
+// Session returns the snapshot of a session
+func (registry *Registry) Session(id string) (SessionInfo, bool) {
+	for _, info := range registry.Sessions() {
+		if info.ID == id {
+			return info, true
+		}
+	}
+	return SessionInfo{}, false
+}
+
+// AbortSession closes a live session, false is returned if it does not exist
+func (registry *Registry) AbortSession(id string) bool {
+	registry.mtx.Lock()
+	session, ok := registry.sessions[id]
+	registry.mtx.Unlock()
+	if !ok {
+		return false
+	}
+	if session.abort != nil {
+		session.abort()
+	}
+	return true
+}
+
+// AbortStream resets a live stream, false is returned if it does not exist
+func (registry *Registry) AbortStream(id string) bool {
+	registry.mtx.Lock()
+	stream, ok := registry.streams[id]
+	registry.mtx.Unlock()
+	if !ok {
+		return false
+	}
+	stream.mtx.Lock()
+	abort := stream.abort
+	stream.mtx.Unlock()
+	if abort != nil {
+		abort()
+	}
+	return true
+}
+
+// Remove unregisters the session, its streams are removed by their own handlers
+func (session *Session) Remove() {
+	registry := session.registry
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	delete(registry.sessions, session.ID)
+}
+
+// AddStream registers a stream of the session in the connecting state
+func (session *Session) AddStream(connectionID string, quicStream int64, source, destination string) *Stream {
+	stream := &Stream{
+		ConnectionID: connectionID,
+		QuicStream:   quicStream,
+		Source:       source,
+		Destination:  destination,
+		Started:      time.Now(),
+		session:      session,
+	}
+	stream.state.Store(STATE_CONNECTING)
+
+	registry := session.registry
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	registry.nextStream++
+	stream.ID = strconv.FormatUint(registry.nextStream, 10)
+	registry.streams[stream.ID] = stream
+	return stream
+}
+
+// SetAbort sets the function called to reset the stream from the admin API
+func (stream *Stream) SetAbort(abort func()) {
+	stream.mtx.Lock()
+	defer stream.mtx.Unlock()
+	stream.abort = abort
+}
+
+func (stream *Stream) SetState(state string) {
+	stream.state.Store(state)
+}
+
+// SetCloseReason records why a side of the stream was closed, the most significant reason is kept
+func (stream *Stream) SetCloseReason(reason string) {
+	stream.mtx.Lock()
+	defer stream.mtx.Unlock()
+	if closeReasonRanks[reason] > closeReasonRanks[stream.closeReason] {
+		stream.closeReason = reason
+	}
+}
+
+// Writer returns a writer that counts the bytes written to w as upstream or downstream traffic of the stream
+func (stream *Stream) Writer(w io.Writer, upstream bool) io.Writer {
+	counter := &stream.bytesDown
+	if upstream {
+		counter = &stream.bytesUp
+	}
+	return &countingWriter{w: w, counter: counter}
+}
+
+// Remove unregisters the stream and passes its flow record to the close hooks
+func (stream *Stream) Remove() {
+	stream.SetState(STATE_CLOSED)
+	registry := stream.session.registry
+	registry.mtx.Lock()
+	delete(registry.streams, stream.ID)
+	hooks := registry.closeHooks
+	registry.mtx.Unlock()
+	if len(hooks) == 0 {
+		return
+	}
+
+	stream.mtx.Lock()
+	closeReason := stream.closeReason
+	stream.mtx.Unlock()
+	if closeReason == "" {
+		closeReason = CLOSE_FIN
+	}
+	record := FlowRecord{
+		ConnectionID: stream.ConnectionID,
+		Session:      stream.session.ID,
+		Peer:         stream.session.Peer,
+		Client:       stream.session.Client,
+		Source:       stream.Source,
+		Destination:  stream.Destination,
+		Start:        stream.Started,
+		End:          time.Now(),
+		BytesUp:      atomic.LoadUint64(&stream.bytesUp),
+		BytesDown:    atomic.LoadUint64(&stream.bytesDown),
+		CloseReason:  closeReason,
+	}
+	for _, hook := range hooks {
+		hook(record)
+	}
+}
+
+func (stream *Stream) info(now time.Time) StreamInfo {
+	return StreamInfo{
+		ID:           stream.ID,
+		ConnectionID: stream.ConnectionID,
+		Session:      stream.session.ID,
+		QuicStream:   stream.QuicStream,
+		Source:       stream.Source,
+		Destination:  stream.Destination,
+		Started:      stream.Started,
+		AgeSeconds:   now.Sub(stream.Started).Seconds(),
+		BytesUp:      atomic.LoadUint64(&stream.bytesUp),
+		BytesDown:    atomic.LoadUint64(&stream.bytesDown),
+		State:        stream.state.Load().(string),
+	}
+}
+
+type countingWriter struct {
+	w       io.Writer
+	counter *uint64
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	n, err := writer.w.Write(p)
+	atomic.AddUint64(writer.counter, uint64(n))
+	return n, err
+}
@@ -0,0 +1,103 @@
+package flows
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDuplicateConnectionIDs(t *testing.T) {
+	registry := NewRegistry()
+	var records []FlowRecord
+	registry.OnStreamClosed(func(record FlowRecord) { records = append(records, record) })
+
+	// two clients, or a hostile one, send streams with the same connection ID
+	first := registry.AddSession("192.0.2.1:4000", "site-a", nil)
+	second := registry.AddSession("192.0.2.2:4000", "site-b", nil)
+	firstStream := first.AddStream("54502f312e310d0a", 0, "10.0.0.1:5000", "198.51.100.1:443")
+	secondStream := second.AddStream("54502f312e310d0a", 0, "10.0.0.2:5000", "198.51.100.1:443")
+	if firstStream.ID == secondStream.ID {
+		t.Fatalf("streams with the same connection ID share the ID %s", firstStream.ID)
+	}
+	aborted := ""
+	firstStream.SetAbort(func() { aborted = "first" })
+	secondStream.SetAbort(func() { aborted = "second" })
+
+	if !registry.AbortStream(firstStream.ID) || aborted != "first" {
+		t.Errorf("abort of the first stream reset the %q one", aborted)
+	}
+	if registry.AbortStream("54502f312e310d0a") {
+		t.Errorf("stream aborted by its connection ID")
+	}
+
+	firstStream.Remove()
+	sessions := registry.Sessions()
+	if len(sessions) != 2 || len(sessions[0].Streams) != 0 || len(sessions[1].Streams) != 1 {
+		t.Fatalf("sessions after the removal of the first stream: %+v", sessions)
+	}
+	if info := sessions[1].Streams[0]; info.ID != secondStream.ID || info.ConnectionID != "54502f312e310d0a" || info.Source != "10.0.0.2:5000" {
+		t.Errorf("stream left %+v, expected the second one", info)
+	}
+	if !registry.AbortStream(secondStream.ID) || aborted != "second" {
+		t.Errorf("abort of the second stream reset the %q one", aborted)
+	}
+
+	secondStream.Remove()
+	if len(records) != 2 || records[0].ConnectionID != "54502f312e310d0a" || records[0].Client != "site-a" || records[1].Client != "site-b" {
+		t.Errorf("flow records %+v, expected one per stream", records)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	registry := NewRegistry()
+	var records []FlowRecord
+	registry.OnStreamClosed(func(record FlowRecord) { records = append(records, record) })
+	session := registry.AddSession("192.0.2.1:4000", "", nil)
+
+	for _, test := range []struct {
+		reasons  []string
+		expected string
+	}{
+		{nil, CLOSE_FIN},
+		{[]string{CLOSE_FIN, CLOSE_RST, CLOSE_FIN}, CLOSE_RST},
+		{[]string{CLOSE_RST, CLOSE_TIMEOUT, CLOSE_RST}, CLOSE_TIMEOUT},
+		{[]string{CLOSE_ERROR, CLOSE_TIMEOUT, CLOSE_FIN}, CLOSE_ERROR},
+		{[]string{"unknown"}, CLOSE_FIN},
+	} {
+		stream := session.AddStream("54502f312e310d0a", 0, "10.0.0.1:5000", "198.51.100.1:443")
+		// both sides of the stream report a reason concurrently
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for _, reason := range test.reasons {
+				stream.SetCloseReason(reason)
+			}
+		}()
+		for i := len(test.reasons) - 1; i >= 0; i-- {
+			stream.SetCloseReason(test.reasons[i])
+		}
+		<-done
+		stream.Remove()
+		if reason := records[len(records)-1].CloseReason; reason != test.expected {
+			t.Errorf("closed by %v: reason %q, expected %q", test.reasons, reason, test.expected)
+		}
+	}
+}
+
+func TestStreamBytes(t *testing.T) {
+	registry := NewRegistry()
+	var record FlowRecord
+	registry.OnStreamClosed(func(closed FlowRecord) { record = closed })
+	stream := registry.AddSession("192.0.2.1:4000", "site-a", nil).AddStream("54502f312e310d0a", 4, "10.0.0.1:5000", "198.51.100.1:443")
+
+	var up, down bytes.Buffer
+	stream.Writer(&up, true).Write(make([]byte, 1000))
+	stream.Writer(&down, false).Write(make([]byte, 300))
+	stream.Writer(&down, false).Write(make([]byte, 200))
+	if info := registry.Sessions()[0].Streams[0]; info.BytesUp != 1000 || info.BytesDown != 500 || info.State != STATE_CONNECTING {
+		t.Errorf("live stream %+v, expected 1000 bytes up, 500 down while connecting", info)
+	}
+	stream.Remove()
+	if record.BytesUp != 1000 || record.BytesDown != 500 || record.Source != "10.0.0.1:5000" || record.End.Before(record.Start) {
+		t.Errorf("flow record %+v, expected the bytes and endpoints of the stream", record)
+	}
+}
@@ -0,0 +1,208 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARNING
+	ERROR
+)
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+func (level Level) String() string {
+	if level < DEBUG || level > ERROR {
+		return fmt.Sprintf("level(%d)", int(level))
+	}
+	return levelNames[level]
+}
+
+// ParseLevel converts the name of a level, "warn" is accepted as a synonym of "warning"
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warn" {
+		return WARNING, nil
+	}
+	for level, levelName := range levelNames {
+		if name == levelName {
+			return Level(level), nil
+		}
+	}
+	return INFO, fmt.Errorf("unknown log level %q", name)
+}
+
+var (
+	outputMtx   sync.Mutex
+	output      io.Writer = os.Stderr
+	minLevel              = INFO
+	jsonEncoded           = false
+
+	root = &Logger{}
+)
+
+// Configure sets the minimum level and the format of the log lines written to out.
+// Lines logged through the standard log package are written at INFO level.
+func Configure(level Level, format string, out io.Writer) error {
+	if format != FORMAT_TEXT && format != FORMAT_JSON {
+		return fmt.Errorf("unknown log format %q, expected %s or %s", format, FORMAT_TEXT, FORMAT_JSON)
+	}
+	outputMtx.Lock()
+	output = out
+	minLevel = level
+	jsonEncoded = format == FORMAT_JSON
+	outputMtx.Unlock()
+
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(stdWriter{})
+	return nil
+}
+
+// Enabled reports if lines of the level are written, to skip building expensive messages
+func Enabled(level Level) bool {
+	outputMtx.Lock()
+	defer outputMtx.Unlock()
+	return level >= minLevel
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes lines carrying a fixed set of fields, e.g. the connection ID of a flow
+type Logger struct {
+	fields []field
+}
+
+// With returns a logger adding the field to every line
+func With(key string, value interface{}) *Logger {
+	return root.With(key, value)
+}
+
+func (logger *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, len(logger.fields), len(logger.fields)+1)
+	copy(fields, logger.fields)
+	return &Logger{fields: append(fields, field{key: key, value: value})}
+}
+
+func (logger *Logger) Debug(format string, args ...interface{}) {
+	logger.write(DEBUG, format, args)
+}
+
+func (logger *Logger) Info(format string, args ...interface{}) {
+	logger.write(INFO, format, args)
+}
+
+func (logger *Logger) Warning(format string, args ...interface{}) {
+	logger.write(WARNING, format, args)
+}
+
+func (logger *Logger) Error(format string, args ...interface{}) {
+	logger.write(ERROR, format, args)
+}
+
+func Debug(format string, args ...interface{}) {
+	root.write(DEBUG, format, args)
+}
+
+func Info(format string, args ...interface{}) {
+	root.write(INFO, format, args)
+}
+
+func Warning(format string, args ...interface{}) {
+	root.write(WARNING, format, args)
+}
+
+func Error(format string, args ...interface{}) {
+	root.write(ERROR, format, args)
+}
+
+func (logger *Logger) write(level Level, format string, args []interface{}) {
+	outputMtx.Lock()
+	defer outputMtx.Unlock()
+	if level < minLevel {
+		return
+	}
+	message := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	var line []byte
+	if jsonEncoded {
+		line = formatJSON(time.Now(), level, message, logger.fields)
+	} else {
+		line = formatText(time.Now(), level, message, logger.fields)
+	}
+	output.Write(line)
+}
+
+func formatText(now time.Time, level Level, message string, fields []field) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(now.Format("15:04:05.000000"))
+	buf.WriteByte(' ')
+	fmt.Fprintf(&buf, "%-7s ", strings.ToUpper(level.String()))
+	buf.WriteString(message)
+	for _, f := range fields {
+		value := fmt.Sprint(f.value)
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&buf, " %s=%s", f.key, value)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func formatJSON(now time.Time, level Level, message string, fields []field) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, now.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, message)
+	for _, f := range fields {
+		buf.WriteByte(',')
+		writeJSON(&buf, f.key)
+		buf.WriteByte(':')
+		if stringer, ok := f.value.(fmt.Stringer); ok {
+			writeJSON(&buf, stringer.String())
+		} else {
+			writeJSON(&buf, f.value)
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSON(buf *bytes.Buffer, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(encoded)
+}
+
+// stdWriter receives the lines of the standard log package
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	root.write(INFO, "%s", []interface{}{string(p)})
+	return len(p), nil
+}
@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"runtime/debug"
 	"syscall"
-	"time"
 
 	"github.com/parvit/qpep/client"
+	"github.com/parvit/qpep/logger"
 	"github.com/parvit/qpep/server"
 	"github.com/parvit/qpep/shared"
 
@@ -25,18 +27,114 @@ func main() {
 	}()
 
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
+	shared.ParseFlags()
 
-	client.ClientConfiguration.GatewayHost = shared.QuicConfiguration.GatewayIP
-	client.ClientConfiguration.GatewayPort = shared.QuicConfiguration.GatewayPort
-	client.ClientConfiguration.ListenPort = shared.QuicConfiguration.ListenPort
-	client.ClientConfiguration.WinDivertThreads = shared.QuicConfiguration.WinDivertThreads
-	client.ClientConfiguration.Verbose = shared.QuicConfiguration.Verbose
+	logLevel, err := logger.ParseLevel(shared.QuicConfiguration.LogLevel)
+	if err != nil {
+		log.Printf("Invalid log level: %s", err)
+		os.Exit(1)
+	}
+	if shared.QuicConfiguration.Verbose {
+		logLevel = logger.DEBUG
+	}
+	if err = logger.Configure(logLevel, shared.QuicConfiguration.LogFormat, os.Stderr); err != nil {
+		log.Printf("Invalid log format: %s", err)
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) == "cert" {
+		os.Exit(runCertCommand(flag.Args()[1:]))
+	}
+
+	clientConfig := client.DefaultConfig()
+	clientConfig.GatewayHost = shared.QuicConfiguration.GatewayIP
+	clientConfig.GatewayPort = shared.QuicConfiguration.GatewayPort
+	clientConfig.ListenPort = shared.QuicConfiguration.ListenPort
+	clientConfig.MultiStream = shared.QuicConfiguration.MultiStream
+	clientConfig.WinDivertThreads = shared.QuicConfiguration.WinDivertThreads
+	clientConfig.Verbose = shared.QuicConfiguration.Verbose
+	clientConfig.GatewayCAFile = shared.QuicConfiguration.GatewayCAFile
+	clientConfig.GatewayPin = shared.QuicConfiguration.GatewayPin
+	clientConfig.GatewayServerName = shared.QuicConfiguration.GatewayServerName
+	clientConfig.ClientCertFile = shared.QuicConfiguration.ClientCertFile
+	clientConfig.ClientKeyFile = shared.QuicConfiguration.ClientKeyFile
+	clientConfig.AuthToken = shared.QuicConfiguration.AuthToken
+	clientConfig.MetricsAddress = shared.QuicConfiguration.MetricsAddress
+	clientConfig.AdminAddress = shared.QuicConfiguration.AdminAddress
+	clientConfig.Qlog = shared.QuicConfiguration.Qlog
+	clientConfig.FlowRecords = shared.QuicConfiguration.FlowRecords
+	clientConfig.ShutdownGrace = shared.QuicConfiguration.ShutdownGrace
+	clientConfig.Transport = shared.QuicConfiguration.Transport
+	clientConfig.TransportFallback = shared.QuicConfiguration.TransportFallback
+	clientConfig.Paths = client.ParsePaths(shared.QuicConfiguration.Paths)
+	clientConfig.PathPolicy = shared.QuicConfiguration.PathPolicy
+	clientConfig.Migration = shared.QuicConfiguration.Migration
+	clientConfig.FEC = shared.QuicConfiguration.FEC
+	clientConfig.ClassSessions = shared.QuicConfiguration.ClassSessions
+	clientConfig.MaxPacketSize = shared.QuicConfiguration.MaxPacketSize
+	clientConfig.MTUDiscovery = shared.QuicConfiguration.MTUDiscovery
+	clientConfig.InteractivePorts, err = client.ParsePorts(shared.QuicConfiguration.InteractivePorts)
+	if err != nil {
+		log.Printf("Invalid interactive ports: %s", err)
+		os.Exit(1)
+	}
+	clientConfig.ClassRules, err = client.ParseClassRules(shared.QuicConfiguration.ClassRules)
+	if err != nil {
+		log.Printf("Invalid class rules: %s", err)
+		os.Exit(1)
+	}
+
+	serverConfig := server.DefaultConfig()
+	serverConfig.CertFile = shared.QuicConfiguration.ServerCertFile
+	serverConfig.KeyFile = shared.QuicConfiguration.ServerKeyFile
+	serverConfig.KeyType = shared.QuicConfiguration.ServerKeyType
+	serverConfig.ClientCAFile = shared.QuicConfiguration.ClientCAFile
+	serverConfig.CRLFile = shared.QuicConfiguration.CRLFile
+	serverConfig.TokensFile = shared.QuicConfiguration.TokensFile
+	serverConfig.PolicyFile = shared.QuicConfiguration.PolicyFile
+	serverConfig.AccountingFile = shared.QuicConfiguration.AccountingFile
+	serverConfig.QuotasFile = shared.QuicConfiguration.QuotasFile
+	serverConfig.MetricsAddress = shared.QuicConfiguration.MetricsAddress
+	serverConfig.AdminAddress = shared.QuicConfiguration.AdminAddress
+	serverConfig.Qlog = shared.QuicConfiguration.Qlog
+	serverConfig.FlowRecords = shared.QuicConfiguration.FlowRecords
+	serverConfig.ShutdownGrace = shared.QuicConfiguration.ShutdownGrace
+	outboundDialer := &server.DirectDialer{
+		Interface:   shared.QuicConfiguration.OutboundInterface,
+		Timeout:     shared.QuicConfiguration.OutboundTimeout,
+		Transparent: shared.QuicConfiguration.OutboundTransparent,
+	}
+	if shared.QuicConfiguration.OutboundAddress != "" {
+		outboundDialer.SourceAddress = net.ParseIP(shared.QuicConfiguration.OutboundAddress)
+		if outboundDialer.SourceAddress == nil {
+			log.Printf("Invalid outbound address: %s", shared.QuicConfiguration.OutboundAddress)
+			os.Exit(1)
+		}
+	}
+	outboundDialer.TransparentSources, err = server.ParseSourceNetworks(shared.QuicConfiguration.OutboundTransparentSources)
+	if err != nil {
+		log.Printf("Invalid transparent source networks: %s", err)
+		os.Exit(1)
+	}
+	if outboundDialer.Transparent && len(outboundDialer.TransparentSources) == 0 {
+		log.Printf("-outboundTransparent needs the client networks in -outboundTransparentSources")
+		os.Exit(1)
+	}
+	serverConfig.OutboundDialer = outboundDialer
+	serverConfig.EgressFile = shared.QuicConfiguration.EgressFile
+	serverConfig.ListenTCP = shared.QuicConfiguration.ListenTCP
+	serverConfig.Migration = shared.QuicConfiguration.Migration
+	serverConfig.FEC = shared.QuicConfiguration.FEC
+	serverConfig.MaxPacketSize = shared.QuicConfiguration.MaxPacketSize
+	serverConfig.MTUDiscovery = shared.QuicConfiguration.MTUDiscovery
+	serverConfig.ListenSockets = shared.QuicConfiguration.ListenSockets
 
 	execContext, cancelExecutionFunc := context.WithCancel(context.Background())
 
+	var instance service
 	if shared.QuicConfiguration.ClientFlag {
 		log.Println("Running Client")
-		windivert.EnableDiverterLogging(client.ClientConfiguration.Verbose)
+		windivert.EnableDiverterLogging(clientConfig.Verbose)
 
 		gatewayHost := shared.QuicConfiguration.GatewayIP
 		gatewayPort := shared.QuicConfiguration.GatewayPort
@@ -48,25 +146,44 @@ func main() {
 			windivert.CloseWinDivertEngine()
 			os.Exit(1)
 		}
-		go client.RunClient(execContext)
+		instance = client.New(clientConfig)
 	} else {
 		log.Println("Running Server")
-		go server.RunServer(execContext)
+		instance = server.New(serverConfig)
+	}
+	if err = instance.Start(execContext); err != nil {
+		log.Printf("Unable to start: %s", err)
+		windivert.CloseWinDivertEngine()
+		os.Exit(1)
 	}
 
-	interruptListener := make(chan os.Signal)
+	interruptListener := make(chan os.Signal, 1)
 	signal.Notify(interruptListener, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	<-interruptListener
 
+	// the active streams are drained before the diverter is stopped, a second signal exits right away
+	log.Printf("Shutdown, draining active streams for up to %s...", shared.QuicConfiguration.ShutdownGrace)
+	go func() {
+		<-interruptListener
+		log.Println("Interrupted while draining, exiting...")
+		os.Exit(1)
+	}()
+	shutdownContext, cancelShutdown := context.WithTimeout(context.Background(), shared.QuicConfiguration.ShutdownGrace)
+	err = instance.Shutdown(shutdownContext)
+	cancelShutdown()
 	cancelExecutionFunc()
-
-	<-execContext.Done()
-
-	log.Println("Shutdown...")
 	log.Println(windivert.CloseWinDivertEngine())
 
-	<-time.After(1 * time.Second)
-
+	if err != nil {
+		log.Printf("Unclean shutdown: %s", err)
+		os.Exit(1)
+	}
 	log.Println("Exiting...")
-	os.Exit(1)
+	os.Exit(0)
+}
+
+// service is implemented by the client and the server
+type service interface {
+	Start(ctx context.Context) error
+	Shutdown(ctx context.Context) error
 }
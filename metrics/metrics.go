@@ -0,0 +1,295 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds the metrics of a component, all of them share the namespace prefix
+// and are exported in the Prometheus text exposition format. The format is written here rather
+// than with prometheus/client_golang, which would bring its protobuf dependencies into the client
+// and server binaries for the handful of counters, gauges and histograms they export; the tests
+// check the output with the parser of Prometheus.
+type Registry struct {
+	namespace string
+
+	mtx      sync.Mutex
+	families map[string]family
+}
+
+type family interface {
+	write(w io.Writer, name string)
+}
+
+// NewRegistry creates an empty registry whose metrics are named <namespace>_<name>
+func NewRegistry(namespace string) *Registry {
+	return &Registry{namespace: namespace, families: make(map[string]family)}
+}
+
+// Counter registers a monotonic counter
+func (registry *Registry) Counter(name, help string) *Counter {
+	return registry.CounterVec(name, help).WithLabelValues()
+}
+
+// CounterVec registers a counter partitioned by the given labels
+func (registry *Registry) CounterVec(name, help string, labels ...string) *CounterVec {
+	vec := &CounterVec{vec: newVec("counter", help, labels)}
+	registry.register(name, vec)
+	return vec
+}
+
+// Gauge registers a value that can go up and down
+func (registry *Registry) Gauge(name, help string) *Gauge {
+	return registry.GaugeVec(name, help).WithLabelValues()
+}
+
+// GaugeVec registers a gauge partitioned by the given labels
+func (registry *Registry) GaugeVec(name, help string, labels ...string) *GaugeVec {
+	vec := &GaugeVec{vec: newVec("gauge", help, labels)}
+	registry.register(name, vec)
+	return vec
+}
+
+// Histogram registers a histogram with the given upper bounds, the +Inf bucket is implicit
+func (registry *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	histogram := &Histogram{help: help, buckets: append([]float64(nil), buckets...)}
+	sort.Float64s(histogram.buckets)
+	histogram.counts = make([]uint64, len(histogram.buckets))
+	registry.register(name, histogram)
+	return histogram
+}
+
+func (registry *Registry) register(name string, metric family) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	fullName := registry.namespace + "_" + name
+	if _, ok := registry.families[fullName]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", fullName))
+	}
+	registry.families[fullName] = metric
+}
+
+// Write outputs all the metrics, sorted by name, in the text exposition format
+func (registry *Registry) Write(w io.Writer) {
+	type namedFamily struct {
+		name   string
+		family family
+	}
+	registry.mtx.Lock()
+	families := make([]namedFamily, 0, len(registry.families))
+	for name, metric := range registry.families {
+		families = append(families, namedFamily{name, metric})
+	}
+	registry.mtx.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	for _, named := range families {
+		named.family.write(w, named.name)
+	}
+}
+
+// Counter is a float value that only increases
+type Counter struct {
+	bits uint64
+}
+
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+// Add increases the counter, negative values are ignored
+func (counter *Counter) Add(value float64) {
+	if value < 0 {
+		return
+	}
+	addFloat(&counter.bits, value)
+}
+
+func (counter *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&counter.bits))
+}
+
+// Gauge is a float value that can be set, increased and decreased
+type Gauge struct {
+	bits uint64
+}
+
+func (gauge *Gauge) Set(value float64) {
+	atomic.StoreUint64(&gauge.bits, math.Float64bits(value))
+}
+
+func (gauge *Gauge) Inc() {
+	addFloat(&gauge.bits, 1)
+}
+
+func (gauge *Gauge) Dec() {
+	addFloat(&gauge.bits, -1)
+}
+
+func (gauge *Gauge) Add(value float64) {
+	addFloat(&gauge.bits, value)
+}
+
+func (gauge *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&gauge.bits))
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	help    string
+	buckets []float64
+
+	mtx    sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	histogram.mtx.Lock()
+	defer histogram.mtx.Unlock()
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[i]++
+			break
+		}
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+func (histogram *Histogram) write(w io.Writer, name string) {
+	histogram.mtx.Lock()
+	defer histogram.mtx.Unlock()
+	writeHeader(w, name, "histogram", histogram.help)
+	var cumulative uint64
+	for i, bound := range histogram.buckets {
+		cumulative += histogram.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatValue(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, histogram.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatValue(histogram.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, histogram.count)
+}
+
+// CounterVec is a set of counters with the same name and different label values
+type CounterVec struct {
+	*vec
+}
+
+// WithLabelValues returns the counter for the label values, in the order the labels were registered
+func (counterVec *CounterVec) WithLabelValues(values ...string) *Counter {
+	return (*Counter)(counterVec.get(values))
+}
+
+// GaugeVec is a set of gauges with the same name and different label values
+type GaugeVec struct {
+	*vec
+}
+
+// WithLabelValues returns the gauge for the label values, in the order the labels were registered
+func (gaugeVec *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return (*Gauge)(gaugeVec.get(values))
+}
+
+// value is the storage shared by counters and gauges
+type value struct {
+	bits uint64
+}
+
+type vec struct {
+	metricType string
+	help       string
+	labels     []string
+
+	mtx    sync.Mutex
+	values map[string]*value
+	keys   map[string][]string
+}
+
+func newVec(metricType, help string, labels []string) *vec {
+	return &vec{
+		metricType: metricType, help: help, labels: labels,
+		values: make(map[string]*value), keys: make(map[string][]string),
+	}
+}
+
+func (v *vec) get(labelValues []string) *value {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if metric, ok := v.values[key]; ok {
+		return metric
+	}
+	metric := &value{}
+	v.values[key] = metric
+	v.keys[key] = append([]string(nil), labelValues...)
+	return metric
+}
+
+func (v *vec) write(w io.Writer, name string) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	writeHeader(w, name, v.metricType, v.help)
+	if len(v.labels) == 0 && len(v.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", name)
+		return
+	}
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		current := math.Float64frombits(atomic.LoadUint64(&v.values[key].bits))
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(v.labels, v.keys[key]), formatValue(current))
+	}
+}
+
+func writeHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = label + "=\"" + escaper.Replace(values[i]) + "\""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func addFloat(bits *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(bits, old, updated) {
+			return
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestScrapeOnLoopback(t *testing.T) {
+	registry := NewRegistry("qpep_test")
+	sessions := registry.Gauge("sessions_active", "Active sessions")
+	bytesTotal := registry.CounterVec("bytes_total", "Relayed bytes", "direction")
+	latency := registry.Histogram("stream_open_seconds", "Stream open latency", []float64{0.1, 1})
+
+	sessions.Inc()
+	sessions.Inc()
+	sessions.Dec()
+	bytesTotal.WithLabelValues("up").Add(1500)
+	bytesTotal.WithLabelValues("down").Add(42)
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(3)
+
+	server, err := StartServer("127.0.0.1:0", registry)
+	if err != nil {
+		t.Fatalf("start server: %s", err)
+	}
+	defer server.Close()
+
+	resp, err := http.Get("http://" + server.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("scrape: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %s", err)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+
+	expected := []string{
+		"# TYPE qpep_test_sessions_active gauge",
+		"qpep_test_sessions_active 1",
+		"# TYPE qpep_test_bytes_total counter",
+		`qpep_test_bytes_total{direction="down"} 42`,
+		`qpep_test_bytes_total{direction="up"} 1500`,
+		"# TYPE qpep_test_stream_open_seconds histogram",
+		`qpep_test_stream_open_seconds_bucket{le="0.1"} 1`,
+		`qpep_test_stream_open_seconds_bucket{le="1"} 2`,
+		`qpep_test_stream_open_seconds_bucket{le="+Inf"} 3`,
+		"qpep_test_stream_open_seconds_sum 3.55",
+		"qpep_test_stream_open_seconds_count 3",
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestCountingWriter(t *testing.T) {
+	registry := NewRegistry("qpep_test")
+	counter := registry.Counter("written_bytes_total", "Written bytes")
+
+	var buf bytes.Buffer
+	writer := CountingWriter(&buf, counter)
+	writer.Write([]byte("hello "))
+	writer.Write([]byte("world"))
+
+	if counter.Value() != 11 || buf.String() != "hello world" {
+		t.Errorf("expected 11 bytes of \"hello world\", got %v of %q", counter.Value(), buf.String())
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	registry := NewRegistry("qpep_test")
+	registry.CounterVec("errors_total", "Errors", "reason").WithLabelValues("say \"hi\"\n").Inc()
+
+	var buf bytes.Buffer
+	registry.Write(&buf)
+	if !strings.Contains(buf.String(), `qpep_test_errors_total{reason="say \"hi\"\n"} 1`) {
+		t.Errorf("label not escaped:\n%s", buf.String())
+	}
+}
+
+// TestExpositionFormat checks the output with the parser of Prometheus
+func TestExpositionFormat(t *testing.T) {
+	registry := NewRegistry("qpep_test")
+	registry.Counter("streams_total", "Streams opened\\closed")
+	registry.GaugeVec("path_up", "Path\nstate", "path").WithLabelValues(`uplink "a"\b`).Set(1)
+	latency := registry.Histogram("rtt_seconds", "RTT", []float64{0.01, 0.1})
+	latency.Observe(0.05)
+	latency.Observe(math.Inf(1))
+
+	var buf bytes.Buffer
+	registry.Write(&buf)
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(&buf)
+	if err != nil {
+		t.Fatalf("output rejected by the Prometheus parser: %s", err)
+	}
+	if len(families) != 3 {
+		t.Fatalf("parsed %d families, expected 3", len(families))
+	}
+
+	streams := families["qpep_test_streams_total"]
+	if streams.GetType() != dto.MetricType_COUNTER || streams.GetHelp() != "Streams opened\\closed" || streams.Metric[0].Counter.GetValue() != 0 {
+		t.Errorf("parsed counter %v, expected an empty counter with its help", streams)
+	}
+	pathUp := families["qpep_test_path_up"]
+	if pathUp.GetType() != dto.MetricType_GAUGE || pathUp.GetHelp() != "Path\nstate" || len(pathUp.Metric) != 1 {
+		t.Fatalf("parsed gauge %v, expected a single labeled gauge", pathUp)
+	}
+	if label := pathUp.Metric[0].Label[0]; label.GetName() != "path" || label.GetValue() != `uplink "a"\b` || pathUp.Metric[0].Gauge.GetValue() != 1 {
+		t.Errorf("parsed gauge %v, expected the label value to be unescaped", pathUp.Metric[0])
+	}
+	rtt := families["qpep_test_rtt_seconds"]
+	if rtt.GetType() != dto.MetricType_HISTOGRAM {
+		t.Fatalf("parsed histogram %v", rtt)
+	}
+	histogram := rtt.Metric[0].Histogram
+	buckets := histogram.Bucket
+	if histogram.GetSampleCount() != 2 || !math.IsInf(histogram.GetSampleSum(), 1) || len(buckets) != 3 ||
+		buckets[0].GetCumulativeCount() != 0 || buckets[1].GetUpperBound() != 0.1 || buckets[1].GetCumulativeCount() != 1 ||
+		!math.IsInf(buckets[2].GetUpperBound(), 1) || buckets[2].GetCumulativeCount() != 2 {
+		t.Errorf("parsed histogram %v, expected 1 observation up to 0.1 and 2 in total", histogram)
+	}
+}
+
+// TestWriteWhileRegistering checks that the metrics can be scraped while others are registered
+func TestWriteWhileRegistering(t *testing.T) {
+	registry := NewRegistry("qpep_test")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			registry.Counter(fmt.Sprintf("counter_%d", i), "Counter")
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			registry.Write(ioutil.Discard)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultLatencyBuckets are the histogram bounds in seconds used for latencies over satellite links
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 0.75, 1, 1.5, 2.5, 5, 10}
+
+// Server exposes the metrics of the registries on the /metrics path
+type Server struct {
+	listener   net.Listener
+	httpServer *http.Server
+}
+
+// StartServer listens on address and serves the registries in the background
+func StartServer(address string, registries ...*Registry) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, registry := range registries {
+			registry.Write(w)
+		}
+	})
+	server := &Server{
+		listener:   listener,
+		httpServer: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+	}
+	go func() {
+		if err := server.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server stopped: %s", err)
+		}
+	}()
+	return server, nil
+}
+
+// Addr returns the address the server is listening on
+func (server *Server) Addr() net.Addr {
+	return server.listener.Addr()
+}
+
+func (server *Server) Close() error {
+	return server.httpServer.Close()
+}
+
+// CountingWriter returns a writer that adds to the counter the bytes written to w
+func CountingWriter(w io.Writer, counter *Counter) io.Writer {
+	return &countingWriter{w: w, counter: counter}
+}
+
+type countingWriter struct {
+	w       io.Writer
+	counter *Counter
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	n, err := writer.w.Write(p)
+	writer.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,69 @@
+// Package mux carries the qpep streams on a single TLS connection over TCP, for the networks where
+// UDP and so QUIC is blocked. Its sessions, streams and listener implement the quic-go interfaces so
+// that client and server handle them as QUIC ones, with the same QpepHeader and payload on each stream.
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Every frame starts with its type, the ID of its stream and the length of its payload:
+//
+//	type (1 byte) | stream ID (4 bytes) | length (4 bytes) | payload
+//
+// DATA carries stream bytes, FIN ends the sending side of a stream, RESET aborts it and STOP asks the
+// peer to abort it, both with an 8 bytes error code; WINDOW grants the peer more bytes to send on a
+// stream, PING keeps the connection alive and CLOSE ends the session with an error code and a message.
+const (
+	frameData   = 0x00
+	frameFin    = 0x01
+	frameReset  = 0x02
+	frameStop   = 0x03
+	frameWindow = 0x04
+	framePing   = 0x05
+	frameClose  = 0x06
+
+	frameHeaderLength  = 9
+	maxFramePayload    = 16 * 1024
+	errorCodeLength    = 8
+	windowUpdateLength = 4
+)
+
+type frame struct {
+	frameType byte
+	streamID  uint32
+	payload   []byte
+}
+
+func (f frame) encode() []byte {
+	buf := make([]byte, frameHeaderLength+len(f.payload))
+	buf[0] = f.frameType
+	binary.BigEndian.PutUint32(buf[1:5], f.streamID)
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(f.payload)))
+	copy(buf[frameHeaderLength:], f.payload)
+	return buf
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	header := make([]byte, frameHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return frame{}, err
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > maxFramePayload {
+		return frame{}, fmt.Errorf("frame of %d bytes exceeds the maximum of %d", length, maxFramePayload)
+	}
+	f := frame{frameType: header[0], streamID: binary.BigEndian.Uint32(header[1:5]), payload: make([]byte, length)}
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, err
+	}
+	return f, nil
+}
+
+func encodeUint64(value uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	return buf
+}
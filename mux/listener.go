@@ -0,0 +1,180 @@
+package mux
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// muxTLSConfig adapts the TLS configuration of the QUIC sessions to the mux ones, including the
+// configurations returned by GetConfigForClient
+func muxTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	config := tlsConfig.Clone()
+	config.NextProtos = []string{NEXT_PROTO}
+	config.MinVersion = tls.VersionTLS13
+	if getConfigForClient := tlsConfig.GetConfigForClient; getConfigForClient != nil {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			clientConfig, err := getConfigForClient(hello)
+			if err != nil || clientConfig == nil {
+				return clientConfig, err
+			}
+			return muxTLSConfig(clientConfig), nil
+		}
+	}
+	return config
+}
+
+// DialContext opens a session over TLS on TCP to the address, the TLS configuration is the one
+// of the QUIC sessions to the same server
+func DialContext(ctx context.Context, address string, tlsConfig *tls.Config) (*Session, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, HANDSHAKE_TIMEOUT)
+		defer cancel()
+	}
+	netDialer := &net.Dialer{KeepAlive: KEEPALIVE_INTERVAL}
+	conn, err := netDialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return Client(ctx, conn, tlsConfig)
+}
+
+// Client runs the TLS handshake on a connection to the server and opens a session on it, the
+// connection is closed when the handshake fails
+func Client(ctx context.Context, conn net.Conn, tlsConfig *tls.Config) (*Session, error) {
+	config := muxTLSConfig(tlsConfig)
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, HANDSHAKE_TIMEOUT)
+		defer cancel()
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := handshake(ctx, tlsConn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newSession(tlsConn, true), nil
+}
+
+// handshake runs the TLS handshake until ctx is done
+func handshake(ctx context.Context, tlsConn *tls.Conn) error {
+	deadline, _ := ctx.Deadline()
+	tlsConn.SetDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			tlsConn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	if err := tlsConn.Handshake(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return tlsConn.SetDeadline(time.Time{})
+}
+
+var _ quic.Listener = &Listener{}
+
+// Listener accepts the sessions of the clients over TLS on TCP, it implements quic.Listener
+type Listener struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	sessions  chan *Session
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	closeErr  error
+}
+
+// Listen binds the TCP address, the TLS configuration is the one of the QUIC listener
+func Listen(address string, tlsConfig *tls.Config) (*Listener, error) {
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	listener := &Listener{
+		listener:  tcpListener,
+		tlsConfig: muxTLSConfig(tlsConfig),
+		sessions:  make(chan *Session),
+		closed:    make(chan struct{}),
+	}
+	go listener.acceptLoop()
+	return listener, nil
+}
+
+func (listener *Listener) acceptLoop() {
+	for {
+		conn, err := listener.listener.Accept()
+		if err != nil {
+			listener.close(err)
+			return
+		}
+		// a slow handshake doesn't hold the other clients
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), HANDSHAKE_TIMEOUT)
+			defer cancel()
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				tcpConn.SetKeepAlivePeriod(KEEPALIVE_INTERVAL)
+				tcpConn.SetKeepAlive(true)
+			}
+			tlsConn := tls.Server(conn, listener.tlsConfig)
+			if err := handshake(ctx, tlsConn); err != nil {
+				conn.Close()
+				return
+			}
+			session := newSession(tlsConn, false)
+			select {
+			case listener.sessions <- session:
+			case <-listener.closed:
+				session.CloseWithError(0, "")
+			}
+		}()
+	}
+}
+
+// Accept returns the next session with a completed TLS handshake
+func (listener *Listener) Accept(ctx context.Context) (quic.Session, error) {
+	select {
+	case session := <-listener.sessions:
+		return session, nil
+	case <-listener.closed:
+		return nil, listener.closeErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops accepting sessions, unlike QUIC listeners the accepted sessions are not closed
+func (listener *Listener) Close() error {
+	listener.close(net.ErrClosed)
+	return listener.listener.Close()
+}
+
+func (listener *Listener) close(err error) {
+	listener.closeOnce.Do(func() {
+		listener.closeErr = err
+		close(listener.closed)
+	})
+}
+
+func (listener *Listener) Addr() net.Addr {
+	return listener.listener.Addr()
+}
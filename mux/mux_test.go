@@ -0,0 +1,199 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/parvit/qpep/pki"
+)
+
+const testTimeout = 10 * time.Second
+
+// startPair returns the two ends of a session over loopback, the server end is accepted by a Listener
+func startPair(t *testing.T) (*Session, quic.Session) {
+	t.Helper()
+	cert, key, err := pki.SelfSignedServer("qpep-server", []string{"127.0.0.1"}, "ecdsa", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}, NextProtos: []string{"qpep"}}
+	listener, err := Listen("127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	clientSession, err := DialContext(ctx, listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"qpep"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSession, err := listener.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		clientSession.CloseWithError(0, "")
+		serverSession.CloseWithError(0, "")
+	})
+	if proto := clientSession.ConnectionState().TLS.NegotiatedProtocol; proto != NEXT_PROTO {
+		t.Errorf("negotiated protocol %q, expected %q", proto, NEXT_PROTO)
+	}
+	return clientSession, serverSession
+}
+
+// echoStreams accepts the streams of the session and writes back what they receive until the peer half-closes
+func echoStreams(session quic.Session) {
+	for {
+		stream, err := session.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(stream, stream)
+			stream.Close()
+		}()
+	}
+}
+
+func TestEchoStreams(t *testing.T) {
+	clientSession, serverSession := startPair(t)
+	go echoStreams(serverSession)
+
+	// each payload is larger than the stream window so that the echo relies on the window updates
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload := make([]byte, 3*STREAM_WINDOW+123)
+			rand.Read(payload)
+			stream, err := clientSession.OpenStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			stream.SetDeadline(time.Now().Add(testTimeout))
+			received := make(chan []byte)
+			go func() {
+				data, _ := ioutil.ReadAll(stream)
+				received <- data
+			}()
+			if _, err = stream.Write(payload); err != nil {
+				t.Error(err)
+				return
+			}
+			stream.Close()
+			if data := <-received; !bytes.Equal(data, payload) {
+				t.Errorf("stream %d echoed %d bytes, expected %d", stream.StreamID(), len(data), len(payload))
+			}
+		}()
+	}
+	wg.Wait()
+
+	clientSession.mtx.Lock()
+	defer clientSession.mtx.Unlock()
+	if len(clientSession.streams) != 0 {
+		t.Errorf("%d streams left open on the client", len(clientSession.streams))
+	}
+}
+
+func TestCancelStream(t *testing.T) {
+	clientSession, serverSession := startPair(t)
+	accepted := make(chan quic.Stream, 2)
+	go func() {
+		for {
+			stream, err := serverSession.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			accepted <- stream
+		}
+	}()
+
+	// a reset is read by the peer as a StreamError with the code
+	resetStream, _ := clientSession.OpenStream()
+	resetStream.Write([]byte("partial"))
+	resetStream.CancelWrite(5)
+	serverStream := <-accepted
+	serverStream.SetReadDeadline(time.Now().Add(testTimeout))
+	_, err := ioutil.ReadAll(serverStream)
+	var streamErr quic.StreamError
+	if !errors.As(err, &streamErr) || streamErr.ErrorCode() != 5 {
+		t.Errorf("read of a reset stream returned %v", err)
+	}
+
+	// the writer is reset once the peer stops reading, and its context is canceled
+	stoppedStream, _ := clientSession.OpenStream()
+	stoppedStream.Write([]byte("hello"))
+	serverStream = <-accepted
+	serverStream.CancelRead(7)
+	select {
+	case <-stoppedStream.Context().Done():
+	case <-time.After(testTimeout):
+		t.Fatal("stream context not canceled after STOP")
+	}
+	_, err = stoppedStream.Write([]byte("more"))
+	if !errors.As(err, &streamErr) || streamErr.ErrorCode() != 7 {
+		t.Errorf("write on a stopped stream returned %v", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	clientSession, serverSession := startPair(t)
+	go echoStreams(serverSession)
+
+	stream, _ := clientSession.OpenStream()
+	stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := stream.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("read past the deadline returned %v", err)
+	}
+	// the stream is still usable once the deadline is moved
+	stream.SetDeadline(time.Now().Add(testTimeout))
+	stream.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(stream, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("read after the deadline was moved: %q, %v", buf, err)
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	clientSession, serverSession := startPair(t)
+	stream, _ := clientSession.OpenStream()
+	stream.Write([]byte("hello"))
+	serverStream, err := serverSession.AcceptStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverSession.CloseWithError(0x6, "server shutdown")
+	select {
+	case <-clientSession.Context().Done():
+	case <-time.After(testTimeout):
+		t.Fatal("session context not canceled after CLOSE")
+	}
+	if _, err = clientSession.AcceptStream(context.Background()); err == nil || err.Error() != "Application error 0x6: server shutdown" {
+		t.Errorf("AcceptStream after CLOSE returned %v", err)
+	}
+	if _, err = stream.Read(make([]byte, 1)); err == nil {
+		t.Error("read on a closed session succeeded")
+	}
+	if _, err = serverStream.Write([]byte("late")); err == nil {
+		t.Error("write on a closed session succeeded")
+	}
+	if _, err = clientSession.OpenStream(); err == nil {
+		t.Error("stream opened on a closed session")
+	}
+}
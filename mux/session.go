@@ -0,0 +1,358 @@
+package mux
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+const (
+	// NEXT_PROTO is the ALPN protocol of the mux sessions, set in place of the one of the QUIC sessions
+	NEXT_PROTO = "qpep-mux"
+	// KEEPALIVE_INTERVAL is the time between the PING frames sent by both sides
+	KEEPALIVE_INTERVAL = 10 * time.Second
+	// IDLE_TIMEOUT closes the session when nothing is received from the peer for this long
+	IDLE_TIMEOUT = 3 * KEEPALIVE_INTERVAL
+	// HANDSHAKE_TIMEOUT bounds the TLS handshake when the context has no earlier deadline
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+	// STREAM_WINDOW is the number of bytes each side may send on a stream before the reader consumes them
+	STREAM_WINDOW = 1024 * 1024
+
+	closeTimeout = time.Second
+	// maxStreamsSkipped bounds the streams implicitly opened by the first frame of a later one
+	maxStreamsSkipped = 1024
+)
+
+var errUnsupported = errors.New("not supported by mux sessions")
+
+// ApplicationError ends a session closed by either side, its message is the one of the QUIC
+// application errors so that the same checks apply to both transports
+type ApplicationError struct {
+	Code    quic.ErrorCode
+	Message string
+}
+
+func (err *ApplicationError) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("Application error %#x", uint64(err.Code))
+	}
+	return fmt.Sprintf("Application error %#x: %s", uint64(err.Code), err.Message)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux: no recent network activity" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return false }
+
+var _ quic.Session = &Session{}
+
+// Session multiplexes the streams opened by both sides on one TLS connection, it implements quic.Session
+type Session struct {
+	conn     *tls.Conn
+	isClient bool
+	writeMtx sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mtx          sync.Mutex
+	streams      map[quic.StreamID]*Stream
+	nextStreamID quic.StreamID
+	nextPeerID   quic.StreamID
+	acceptQueue  []*Stream
+	acceptNotify chan struct{}
+	closeErr     error
+}
+
+// newSession starts serving a connection with a completed TLS handshake, stream IDs follow the
+// QUIC numbering of bidirectional streams, 0, 4, 8... for the client and 1, 5, 9... for the server
+func newSession(conn *tls.Conn, isClient bool) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &Session{
+		conn:         conn,
+		isClient:     isClient,
+		ctx:          ctx,
+		cancel:       cancel,
+		streams:      make(map[quic.StreamID]*Stream),
+		acceptNotify: make(chan struct{}, 1),
+	}
+	if isClient {
+		session.nextPeerID = 1
+	} else {
+		session.nextStreamID = 1
+	}
+	go session.readLoop()
+	go session.keepaliveLoop()
+	return session
+}
+
+func (session *Session) readLoop() {
+	reader := bufio.NewReader(session.conn)
+	for {
+		session.conn.SetReadDeadline(time.Now().Add(IDLE_TIMEOUT))
+		f, err := readFrame(reader)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = timeoutError{}
+			}
+			session.terminate(err)
+			return
+		}
+		if err = session.handleFrame(f); err != nil {
+			session.terminate(fmt.Errorf("mux protocol error: %w", err))
+			return
+		}
+	}
+}
+
+func (session *Session) keepaliveLoop() {
+	ticker := time.NewTicker(KEEPALIVE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			session.writeFrame(frame{frameType: framePing})
+		case <-session.ctx.Done():
+			return
+		}
+	}
+}
+
+func (session *Session) handleFrame(f frame) error {
+	switch f.frameType {
+	case framePing:
+		return nil
+	case frameClose:
+		if len(f.payload) < errorCodeLength {
+			return errors.New("truncated CLOSE frame")
+		}
+		session.terminate(&ApplicationError{
+			Code:    quic.ErrorCode(binary.BigEndian.Uint64(f.payload)),
+			Message: string(f.payload[errorCodeLength:]),
+		})
+		return nil
+	}
+
+	stream, err := session.frameStream(quic.StreamID(f.streamID))
+	if err != nil {
+		return err
+	}
+	if stream == nil {
+		// frames still in flight for a stream already closed on this side
+		return nil
+	}
+	switch f.frameType {
+	case frameData:
+		return stream.receiveData(f.payload)
+	case frameFin:
+		stream.receiveFin()
+	case frameReset, frameStop:
+		if len(f.payload) != errorCodeLength {
+			return fmt.Errorf("invalid error code in frame %#x", f.frameType)
+		}
+		code := quic.ErrorCode(binary.BigEndian.Uint64(f.payload))
+		if f.frameType == frameReset {
+			stream.receiveReset(code)
+		} else {
+			stream.receiveStop(code)
+		}
+	case frameWindow:
+		if len(f.payload) != windowUpdateLength {
+			return errors.New("invalid WINDOW frame")
+		}
+		stream.receiveWindowUpdate(int(binary.BigEndian.Uint32(f.payload)))
+	default:
+		return fmt.Errorf("unknown frame type %#x", f.frameType)
+	}
+	return nil
+}
+
+// frameStream returns the stream of a received frame, the first frame of a stream opened by the
+// peer queues it for AcceptStream together with the lower streams not seen yet, as they can be
+// written in any order; nil is returned for the streams already closed
+func (session *Session) frameStream(id quic.StreamID) (*Stream, error) {
+	session.mtx.Lock()
+	defer session.mtx.Unlock()
+	if stream, ok := session.streams[id]; ok {
+		return stream, nil
+	}
+	if session.closeErr != nil || id < session.nextPeerID || id%4 != session.nextPeerID%4 {
+		return nil, nil
+	}
+	if (id-session.nextPeerID)/4 >= maxStreamsSkipped {
+		return nil, fmt.Errorf("stream %d opened ahead of stream %d", id, session.nextPeerID)
+	}
+	for ; session.nextPeerID <= id; session.nextPeerID += 4 {
+		stream := newStream(session.nextPeerID, session)
+		session.streams[stream.id] = stream
+		session.acceptQueue = append(session.acceptQueue, stream)
+	}
+	signal(session.acceptNotify)
+	return session.streams[id], nil
+}
+
+func (session *Session) removeStream(id quic.StreamID) {
+	session.mtx.Lock()
+	defer session.mtx.Unlock()
+	delete(session.streams, id)
+}
+
+// writeFrame sends a frame, the writes of the streams are serialized on the connection
+func (session *Session) writeFrame(f frame) error {
+	session.mtx.Lock()
+	closeErr := session.closeErr
+	session.mtx.Unlock()
+	if closeErr != nil {
+		return closeErr
+	}
+	session.writeMtx.Lock()
+	_, err := session.conn.Write(f.encode())
+	session.writeMtx.Unlock()
+	if err != nil {
+		session.terminate(err)
+		return session.err()
+	}
+	return nil
+}
+
+func (session *Session) err() error {
+	session.mtx.Lock()
+	defer session.mtx.Unlock()
+	return session.closeErr
+}
+
+// terminate closes the connection and fails the streams with the first error that ended the session
+func (session *Session) terminate(err error) {
+	session.mtx.Lock()
+	if session.closeErr != nil {
+		session.mtx.Unlock()
+		return
+	}
+	session.closeErr = err
+	streams := make([]*Stream, 0, len(session.streams))
+	for _, stream := range session.streams {
+		streams = append(streams, stream)
+	}
+	session.mtx.Unlock()
+
+	session.conn.Close()
+	session.cancel()
+	for _, stream := range streams {
+		stream.terminate(err)
+	}
+}
+
+// AcceptStream returns the next stream opened by the peer, a stream is only seen by the peer once
+// something is sent on it
+func (session *Session) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	for {
+		session.mtx.Lock()
+		if len(session.acceptQueue) > 0 {
+			stream := session.acceptQueue[0]
+			session.acceptQueue = session.acceptQueue[1:]
+			session.mtx.Unlock()
+			return stream, nil
+		}
+		if session.closeErr != nil {
+			err := session.closeErr
+			session.mtx.Unlock()
+			return nil, err
+		}
+		session.mtx.Unlock()
+		select {
+		case <-session.acceptNotify:
+		case <-session.ctx.Done():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// OpenStream opens a new stream, there is no limit to the streams opened
+func (session *Session) OpenStream() (quic.Stream, error) {
+	session.mtx.Lock()
+	defer session.mtx.Unlock()
+	if session.closeErr != nil {
+		return nil, session.closeErr
+	}
+	stream := newStream(session.nextStreamID, session)
+	session.streams[stream.id] = stream
+	session.nextStreamID += 4
+	return stream, nil
+}
+
+// OpenStreamSync opens a new stream, it never blocks as OpenStream
+func (session *Session) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	return session.OpenStream()
+}
+
+// AcceptUniStream blocks until the session or ctx is done, unidirectional streams are not supported
+func (session *Session) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	select {
+	case <-session.ctx.Done():
+		return nil, session.err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (session *Session) OpenUniStream() (quic.SendStream, error) {
+	return nil, errUnsupported
+}
+
+func (session *Session) OpenUniStreamSync(context.Context) (quic.SendStream, error) {
+	return nil, errUnsupported
+}
+
+func (session *Session) LocalAddr() net.Addr {
+	return session.conn.LocalAddr()
+}
+
+func (session *Session) RemoteAddr() net.Addr {
+	return session.conn.RemoteAddr()
+}
+
+// CloseWithError sends the error to the peer and closes the session, the streams still open are reset
+func (session *Session) CloseWithError(code quic.ErrorCode, message string) error {
+	if session.err() != nil {
+		return nil
+	}
+	payload := append(encodeUint64(uint64(code)), message...)
+	if len(payload) > maxFramePayload {
+		payload = payload[:maxFramePayload]
+	}
+	// a connection blocked by the peer must not delay the close
+	session.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	session.writeFrame(frame{frameType: frameClose, payload: payload})
+	session.terminate(&ApplicationError{Code: code, Message: message})
+	return nil
+}
+
+// Context is canceled when the session is closed
+func (session *Session) Context() context.Context {
+	return session.ctx
+}
+
+// ConnectionState returns the state of the TLS connection
+func (session *Session) ConnectionState() quic.ConnectionState {
+	var state quic.ConnectionState
+	state.TLS.ConnectionState = session.conn.ConnectionState()
+	return state
+}
+
+func (session *Session) SendMessage([]byte) error {
+	return errUnsupported
+}
+
+func (session *Session) ReceiveMessage() ([]byte, error) {
+	return nil, errUnsupported
+}
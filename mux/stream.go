@@ -0,0 +1,357 @@
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// StreamError is returned by the operations on a stream canceled by either side, it implements quic.StreamError
+type StreamError struct {
+	StreamID quic.StreamID
+	Code     quic.ErrorCode
+	// Remote is set when the stream was canceled by the peer
+	Remote bool
+}
+
+func (err *StreamError) Error() string {
+	if err.Remote {
+		return fmt.Sprintf("stream %d canceled by peer with error code %d", err.StreamID, err.Code)
+	}
+	return fmt.Sprintf("stream %d canceled with error code %d", err.StreamID, err.Code)
+}
+
+func (err *StreamError) Canceled() bool {
+	return true
+}
+
+func (err *StreamError) ErrorCode() quic.ErrorCode {
+	return err.Code
+}
+
+type deadlineError struct{}
+
+func (deadlineError) Error() string   { return "deadline exceeded" }
+func (deadlineError) Timeout() bool   { return true }
+func (deadlineError) Temporary() bool { return true }
+func (deadlineError) Unwrap() error   { return os.ErrDeadlineExceeded }
+
+var errDeadline net.Error = deadlineError{}
+
+var _ quic.Stream = &Stream{}
+
+// Stream is a bidirectional stream of a mux session, it implements quic.Stream; each direction is
+// flow controlled on its own so that a slow reader doesn't stall the other streams of the session
+type Stream struct {
+	id        quic.StreamID
+	session   *Session
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+
+	mtx sync.Mutex
+	// readErr is set when the peer resets the stream, when reading is canceled and when the session ends
+	readBuf       []byte
+	readFin       bool
+	readErr       error
+	readConsumed  int
+	receiveWindow int
+	readDeadline  time.Time
+	readNotify    chan struct{}
+	// writeDone is set once FIN or RESET is sent, writeErr is then returned by Write
+	sendWindow    int
+	writeDone     bool
+	writeErr      error
+	writeDeadline time.Time
+	writeNotify   chan struct{}
+}
+
+func newStream(id quic.StreamID, session *Session) *Stream {
+	ctx, cancel := context.WithCancel(session.ctx)
+	return &Stream{
+		id:            id,
+		session:       session,
+		ctx:           ctx,
+		cancelCtx:     cancel,
+		receiveWindow: STREAM_WINDOW,
+		readNotify:    make(chan struct{}, 1),
+		sendWindow:    STREAM_WINDOW,
+		writeNotify:   make(chan struct{}, 1),
+	}
+}
+
+func (stream *Stream) StreamID() quic.StreamID {
+	return stream.id
+}
+
+func (stream *Stream) Read(p []byte) (int, error) {
+	for {
+		stream.mtx.Lock()
+		if stream.readErr != nil {
+			err := stream.readErr
+			stream.mtx.Unlock()
+			return 0, err
+		}
+		if len(stream.readBuf) > 0 {
+			n := copy(p, stream.readBuf)
+			stream.readBuf = stream.readBuf[n:]
+			update := 0
+			if !stream.readFin {
+				// the window is granted back once half of it was consumed
+				stream.readConsumed += n
+				if stream.readConsumed >= STREAM_WINDOW/2 {
+					update = stream.readConsumed
+					stream.receiveWindow += update
+					stream.readConsumed = 0
+				}
+			}
+			stream.mtx.Unlock()
+			if update > 0 {
+				payload := make([]byte, windowUpdateLength)
+				binary.BigEndian.PutUint32(payload, uint32(update))
+				stream.session.writeFrame(frame{frameType: frameWindow, streamID: uint32(stream.id), payload: payload})
+			}
+			return n, nil
+		}
+		if stream.readFin {
+			stream.mtx.Unlock()
+			stream.removeIfDone()
+			return 0, io.EOF
+		}
+		deadline := stream.readDeadline
+		stream.mtx.Unlock()
+		if expired(deadline) {
+			return 0, errDeadline
+		}
+		wait(stream.readNotify, deadline)
+	}
+}
+
+func (stream *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		stream.mtx.Lock()
+		if stream.writeErr != nil {
+			err := stream.writeErr
+			stream.mtx.Unlock()
+			return written, err
+		}
+		deadline := stream.writeDeadline
+		if expired(deadline) {
+			stream.mtx.Unlock()
+			return written, errDeadline
+		}
+		if stream.sendWindow == 0 {
+			stream.mtx.Unlock()
+			wait(stream.writeNotify, deadline)
+			continue
+		}
+		chunk := len(p)
+		if chunk > stream.sendWindow {
+			chunk = stream.sendWindow
+		}
+		if chunk > maxFramePayload {
+			chunk = maxFramePayload
+		}
+		stream.sendWindow -= chunk
+		stream.mtx.Unlock()
+		if err := stream.session.writeFrame(frame{frameType: frameData, streamID: uint32(stream.id), payload: p[:chunk]}); err != nil {
+			return written, err
+		}
+		written += chunk
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// Close ends the sending side of the stream, the peer reads the data written so far and then io.EOF
+func (stream *Stream) Close() error {
+	if !stream.finishWrite(fmt.Errorf("write on closed stream %d", stream.id)) {
+		return nil
+	}
+	stream.session.writeFrame(frame{frameType: frameFin, streamID: uint32(stream.id)})
+	stream.removeIfDone()
+	return nil
+}
+
+// CancelWrite aborts the sending side of the stream, the peer reads a StreamError with the code
+func (stream *Stream) CancelWrite(code quic.ErrorCode) {
+	if !stream.finishWrite(&StreamError{StreamID: stream.id, Code: code}) {
+		return
+	}
+	stream.session.writeFrame(frame{frameType: frameReset, streamID: uint32(stream.id), payload: encodeUint64(uint64(code))})
+	stream.removeIfDone()
+}
+
+// CancelRead aborts the receiving side of the stream and asks the peer to reset its sending side
+func (stream *Stream) CancelRead(code quic.ErrorCode) {
+	stream.mtx.Lock()
+	if stream.readDone() {
+		stream.mtx.Unlock()
+		return
+	}
+	stream.readErr = &StreamError{StreamID: stream.id, Code: code}
+	stream.readBuf = nil
+	stream.mtx.Unlock()
+	signal(stream.readNotify)
+	stream.session.writeFrame(frame{frameType: frameStop, streamID: uint32(stream.id), payload: encodeUint64(uint64(code))})
+	stream.removeIfDone()
+}
+
+// Context is canceled when the sending side of the stream is closed or reset, when the peer stops
+// reading and when the session ends
+func (stream *Stream) Context() context.Context {
+	return stream.ctx
+}
+
+func (stream *Stream) SetReadDeadline(t time.Time) error {
+	stream.mtx.Lock()
+	stream.readDeadline = t
+	stream.mtx.Unlock()
+	signal(stream.readNotify)
+	return nil
+}
+
+func (stream *Stream) SetWriteDeadline(t time.Time) error {
+	stream.mtx.Lock()
+	stream.writeDeadline = t
+	stream.mtx.Unlock()
+	signal(stream.writeNotify)
+	return nil
+}
+
+func (stream *Stream) SetDeadline(t time.Time) error {
+	stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+// finishWrite ends the sending side with the error returned by the next writes, it returns false
+// when the sending side was already finished
+func (stream *Stream) finishWrite(err error) bool {
+	stream.mtx.Lock()
+	if stream.writeDone {
+		stream.mtx.Unlock()
+		return false
+	}
+	stream.writeDone = true
+	stream.writeErr = err
+	stream.mtx.Unlock()
+	stream.cancelCtx()
+	signal(stream.writeNotify)
+	return true
+}
+
+// readDone reports whether nothing more will be read from the stream, it is called with the lock held
+func (stream *Stream) readDone() bool {
+	return stream.readErr != nil || (stream.readFin && len(stream.readBuf) == 0)
+}
+
+// removeIfDone forgets the stream once both sides are finished, the frames still received for it are dropped
+func (stream *Stream) removeIfDone() {
+	stream.mtx.Lock()
+	done := stream.readDone() && stream.writeDone
+	stream.mtx.Unlock()
+	if done {
+		stream.session.removeStream(stream.id)
+	}
+}
+
+func (stream *Stream) receiveData(payload []byte) error {
+	stream.mtx.Lock()
+	if stream.readErr != nil || stream.readFin {
+		stream.mtx.Unlock()
+		return nil
+	}
+	if len(payload) > stream.receiveWindow {
+		stream.mtx.Unlock()
+		return fmt.Errorf("stream %d exceeded its flow control window", stream.id)
+	}
+	stream.receiveWindow -= len(payload)
+	stream.readBuf = append(stream.readBuf, payload...)
+	stream.mtx.Unlock()
+	signal(stream.readNotify)
+	return nil
+}
+
+func (stream *Stream) receiveFin() {
+	stream.mtx.Lock()
+	stream.readFin = true
+	stream.mtx.Unlock()
+	signal(stream.readNotify)
+	stream.removeIfDone()
+}
+
+func (stream *Stream) receiveReset(code quic.ErrorCode) {
+	stream.mtx.Lock()
+	if !stream.readDone() {
+		stream.readErr = &StreamError{StreamID: stream.id, Code: code, Remote: true}
+		stream.readBuf = nil
+	}
+	stream.mtx.Unlock()
+	signal(stream.readNotify)
+	stream.removeIfDone()
+}
+
+// receiveStop resets the sending side with the code of the peer, as QUIC does on STOP_SENDING
+func (stream *Stream) receiveStop(code quic.ErrorCode) {
+	if !stream.finishWrite(&StreamError{StreamID: stream.id, Code: code, Remote: true}) {
+		return
+	}
+	stream.session.writeFrame(frame{frameType: frameReset, streamID: uint32(stream.id), payload: encodeUint64(uint64(code))})
+	stream.removeIfDone()
+}
+
+func (stream *Stream) receiveWindowUpdate(increment int) {
+	stream.mtx.Lock()
+	stream.sendWindow += increment
+	stream.mtx.Unlock()
+	signal(stream.writeNotify)
+}
+
+// terminate fails the pending and next operations with the error that ended the session, the data
+// already received is still readable when the peer finished sending
+func (stream *Stream) terminate(err error) {
+	stream.mtx.Lock()
+	if !stream.readFin && stream.readErr == nil {
+		stream.readErr = err
+	}
+	if !stream.writeDone {
+		stream.writeDone = true
+		stream.writeErr = err
+	}
+	stream.mtx.Unlock()
+	stream.cancelCtx()
+	signal(stream.readNotify)
+	signal(stream.writeNotify)
+}
+
+func signal(notify chan struct{}) {
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// wait blocks until notified or until the deadline, the caller checks again the state of the stream
+func wait(notify chan struct{}, deadline time.Time) {
+	if deadline.IsZero() {
+		<-notify
+		return
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-notify:
+	case <-timer.C:
+	}
+}
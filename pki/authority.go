@@ -0,0 +1,357 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	CA_CERT_FILE  = "ca.pem"
+	CA_KEY_FILE   = "ca.key"
+	CA_INDEX_FILE = "index.yaml"
+	CA_CRL_FILE   = "crl.pem"
+	// CA_CRL_NUMBER_FILE keeps the number of the last CRL, each new CRL gets the next one
+	CA_CRL_NUMBER_FILE = "crlnumber"
+
+	CERT_TYPE_SERVER = "server"
+	CERT_TYPE_CLIENT = "client"
+
+	DEFAULT_CA_VALIDITY   = 10 * 365 * 24 * time.Hour
+	DEFAULT_CERT_VALIDITY = 2 * 365 * 24 * time.Hour
+	DEFAULT_CRL_VALIDITY  = 30 * 24 * time.Hour
+)
+
+// IssuedCertificate is the record kept in the CA index for every certificate issued
+type IssuedCertificate struct {
+	Serial    string    `yaml:"serial"`
+	Name      string    `yaml:"name"`
+	Type      string    `yaml:"type"`
+	NotAfter  time.Time `yaml:"notAfter"`
+	Revoked   bool      `yaml:"revoked,omitempty"`
+	RevokedAt time.Time `yaml:"revokedAt,omitempty"`
+}
+
+// Authority is a small certificate authority stored in a directory, with its certificate, key and the
+// index of the issued certificates used to produce the revocation list
+type Authority struct {
+	Dir  string
+	Cert *x509.Certificate
+	Key  crypto.Signer
+
+	index []IssuedCertificate
+}
+
+// CreateAuthority generates a new self-signed CA in dir, refusing to overwrite an existing one
+func CreateAuthority(dir, name, keyType string, validity time.Duration) (*Authority, error) {
+	if _, err := os.Stat(filepath.Join(dir, CA_KEY_FILE)); err == nil {
+		return nil, fmt.Errorf("a CA already exists in %s", dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := GenerateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(name, validity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	cert, err := signCertificate(template, nil, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := EncodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, CA_KEY_FILE), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, CA_CERT_FILE), EncodeCertificate(cert), 0644); err != nil {
+		return nil, err
+	}
+
+	authority := &Authority{Dir: dir, Cert: cert, Key: key}
+	if err = authority.saveIndex(); err != nil {
+		return nil, err
+	}
+	return authority, authority.WriteCRL(DEFAULT_CRL_VALIDITY)
+}
+
+// LoadAuthority opens the CA previously created in dir
+func LoadAuthority(dir string) (*Authority, error) {
+	cert, err := LoadCertificate(filepath.Join(dir, CA_CERT_FILE))
+	if err != nil {
+		return nil, err
+	}
+	key, err := LoadKey(filepath.Join(dir, CA_KEY_FILE))
+	if err != nil {
+		return nil, err
+	}
+	authority := &Authority{Dir: dir, Cert: cert, Key: key}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, CA_INDEX_FILE))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(data, &authority.index); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", CA_INDEX_FILE, err)
+	}
+	return authority, nil
+}
+
+// IssueServer creates a certificate for a qpep server, hosts are added as DNS or IP subject alternative names
+func (authority *Authority) IssueServer(name string, hosts []string, keyType string, validity time.Duration) (*x509.Certificate, crypto.Signer, error) {
+	key, err := GenerateKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newServerTemplate(name, hosts, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := signCertificate(template, authority.Cert, key.Public(), authority.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, authority.record(cert, CERT_TYPE_SERVER)
+}
+
+// IssueClient creates a certificate for a qpep client, the name is used as common name and identifies the client on the server
+func (authority *Authority) IssueClient(name, keyType string, validity time.Duration) (*x509.Certificate, crypto.Signer, error) {
+	key, err := GenerateKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTemplate(name, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	cert, err := signCertificate(template, authority.Cert, key.Public(), authority.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, authority.record(cert, CERT_TYPE_CLIENT)
+}
+
+// Revoke marks as revoked the certificates matching the serial (hexadecimal) or the name and
+// returns how many were revoked, the CRL must be written again for the change to take effect
+func (authority *Authority) Revoke(serialOrName string) (int, error) {
+	revoked := 0
+	for i := range authority.index {
+		entry := &authority.index[i]
+		if entry.Revoked || (!strings.EqualFold(entry.Serial, serialOrName) && entry.Name != serialOrName) {
+			continue
+		}
+		entry.Revoked = true
+		entry.RevokedAt = time.Now().UTC()
+		revoked++
+	}
+	if revoked == 0 {
+		return 0, fmt.Errorf("no valid certificate found for %q", serialOrName)
+	}
+	return revoked, authority.saveIndex()
+}
+
+// Issued returns the index of the certificates issued by the authority
+func (authority *Authority) Issued() []IssuedCertificate {
+	return authority.index
+}
+
+// WriteCRL signs a new revocation list with all the revoked certificates and saves it in the CA directory
+func (authority *Authority) WriteCRL(validity time.Duration) error {
+	crlNumber, err := authority.nextCRLNumber()
+	if err != nil {
+		return err
+	}
+	// the number is saved first, a CRL failing to be written then only leaves a gap
+	numberPath := filepath.Join(authority.Dir, CA_CRL_NUMBER_FILE)
+	if err = ioutil.WriteFile(numberPath, []byte(crlNumber.String()+"\n"), 0600); err != nil {
+		return err
+	}
+	list := &x509.RevocationList{
+		Number:     crlNumber,
+		ThisUpdate: time.Now().UTC(),
+		NextUpdate: time.Now().UTC().Add(validity),
+	}
+	for _, entry := range authority.index {
+		if !entry.Revoked {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(entry.Serial, 16)
+		if !ok {
+			return fmt.Errorf("invalid serial %q in index", entry.Serial)
+		}
+		list.RevokedCertificates = append(list.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: entry.RevokedAt,
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, list, authority.Cert, authority.Key)
+	if err != nil {
+		return err
+	}
+	crlPEM := pemEncode("X509 CRL", der)
+	return ioutil.WriteFile(authority.CRLPath(), crlPEM, 0644)
+}
+
+// oidCRLNumber is the extension carrying the number of a CRL
+var oidCRLNumber = asn1.ObjectIdentifier{2, 5, 29, 20}
+
+// nextCRLNumber returns the number following the one of the last CRL, as saved in CA_CRL_NUMBER_FILE
+// or, for the authorities created without it, as found in their CRL
+func (authority *Authority) nextCRLNumber() (*big.Int, error) {
+	last := new(big.Int)
+	data, err := ioutil.ReadFile(filepath.Join(authority.Dir, CA_CRL_NUMBER_FILE))
+	switch {
+	case err == nil:
+		if _, ok := last.SetString(strings.TrimSpace(string(data)), 10); !ok {
+			return nil, fmt.Errorf("invalid CRL number in %s", CA_CRL_NUMBER_FILE)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if last, err = lastCRLNumber(authority.CRLPath()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return last.Add(last, big.NewInt(1)), nil
+}
+
+// lastCRLNumber returns the number of the CRL in path, zero when there is none
+func lastCRLNumber(path string) (*big.Int, error) {
+	number := new(big.Int)
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return number, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list, err := x509.ParseCRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, extension := range list.TBSCertList.Extensions {
+		if !extension.Id.Equal(oidCRLNumber) {
+			continue
+		}
+		if _, err = asn1.Unmarshal(extension.Value, &number); err != nil {
+			return nil, fmt.Errorf("parse the number of %s: %w", path, err)
+		}
+	}
+	return number, nil
+}
+
+// CRLPath returns the path of the revocation list to configure on the server
+func (authority *Authority) CRLPath() string {
+	return filepath.Join(authority.Dir, CA_CRL_FILE)
+}
+
+func (authority *Authority) record(cert *x509.Certificate, certType string) error {
+	authority.index = append(authority.index, IssuedCertificate{
+		Serial:   cert.SerialNumber.Text(16),
+		Name:     cert.Subject.CommonName,
+		Type:     certType,
+		NotAfter: cert.NotAfter,
+	})
+	return authority.saveIndex()
+}
+
+func (authority *Authority) saveIndex() error {
+	sort.SliceStable(authority.index, func(i, j int) bool {
+		return authority.index[i].Name < authority.index[j].Name
+	})
+	data, err := yaml.Marshal(authority.index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(authority.Dir, CA_INDEX_FILE), data, 0600)
+}
+
+// SelfSignedServer creates a self-signed server certificate, for servers whose clients use key pinning
+func SelfSignedServer(name string, hosts []string, keyType string, validity time.Duration) (*x509.Certificate, crypto.Signer, error) {
+	key, err := GenerateKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newServerTemplate(name, hosts, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := signCertificate(template, nil, key.Public(), key)
+	return cert, key, err
+}
+
+func newServerTemplate(name string, hosts []string, validity time.Duration) (*x509.Certificate, error) {
+	template, err := newTemplate(name, validity)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return template, nil
+}
+
+func newTemplate(name string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+// signCertificate signs the template with the parent certificate, or self-signs it when parent is nil
+func signCertificate(template, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) (*x509.Certificate, error) {
+	keyID, err := subjectKeyID(pub)
+	if err != nil {
+		return nil, err
+	}
+	template.SubjectKeyId = keyID
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
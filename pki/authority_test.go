@@ -0,0 +1,135 @@
+package pki
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadCRL parses the CRL of the authority and checks its signature
+func loadCRL(t *testing.T, authority *Authority) (serials map[string]bool, number *big.Int) {
+	t.Helper()
+	data, err := ioutil.ReadFile(authority.CRLPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := x509.ParseCRL(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = authority.Cert.CheckCRLSignature(list); err != nil {
+		t.Fatalf("CRL not signed by the authority: %s", err)
+	}
+	serials = make(map[string]bool)
+	for _, entry := range list.TBSCertList.RevokedCertificates {
+		serials[entry.SerialNumber.Text(16)] = true
+	}
+	number, err = lastCRLNumber(authority.CRLPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serials, number
+}
+
+func TestAuthority(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+	authority, err := CreateAuthority(dir, "qpep test CA", KEY_TYPE_ECDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CreateAuthority(dir, "qpep test CA", KEY_TYPE_ECDSA, time.Hour); err == nil {
+		t.Fatal("existing authority overwritten")
+	}
+	serverCert, _, err := authority.IssueServer("gateway", []string{"gateway.example", "192.0.2.1"}, KEY_TYPE_ED25519, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, _, err := authority.IssueClient("site-a", KEY_TYPE_ECDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Cert)
+	if _, err = serverCert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "192.0.2.1"}); err != nil {
+		t.Errorf("server certificate not valid for its address: %s", err)
+	}
+	if _, err = clientCert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("client certificate not valid for client authentication: %s", err)
+	}
+	serials, firstNumber := loadCRL(t, authority)
+	if len(serials) != 0 || firstNumber.Sign() <= 0 {
+		t.Fatalf("initial CRL revokes %v with number %s, expected none and a positive number", serials, firstNumber)
+	}
+
+	// the revocation is kept in the index and published by the next CRL
+	if _, err = authority.Revoke("site-b"); err == nil {
+		t.Error("unknown certificate revoked")
+	}
+	if revoked, err := authority.Revoke("site-a"); err != nil || revoked != 1 {
+		t.Fatalf("revoked %d certificates with %v, expected 1", revoked, err)
+	}
+	if err = authority.WriteCRL(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range reloaded.Issued() {
+		if entry.Revoked != (entry.Name == "site-a") {
+			t.Errorf("certificate %s revoked: %v after the reload", entry.Name, entry.Revoked)
+		}
+	}
+	serials, secondNumber := loadCRL(t, reloaded)
+	if !serials[clientCert.SerialNumber.Text(16)] || serials[serverCert.SerialNumber.Text(16)] || len(serials) != 1 {
+		t.Fatalf("CRL revokes %v, expected only the client certificate %s", serials, clientCert.SerialNumber.Text(16))
+	}
+	if _, err = reloaded.Revoke(clientCert.SerialNumber.Text(16)); err == nil {
+		t.Error("certificate revoked twice")
+	}
+
+	// the numbers keep increasing across reloads, even within the same second
+	if err = reloaded.WriteCRL(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	_, thirdNumber := loadCRL(t, reloaded)
+	if secondNumber.Cmp(firstNumber) <= 0 || thirdNumber.Cmp(secondNumber) <= 0 {
+		t.Fatalf("CRL numbers %s, %s, %s, expected them to increase", firstNumber, secondNumber, thirdNumber)
+	}
+}
+
+func TestCRLNumberUpgrade(t *testing.T) {
+	authority, err := CreateAuthority(filepath.Join(t.TempDir(), "ca"), "qpep test CA", KEY_TYPE_ECDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the authorities created before the counter have numbered their CRLs with a timestamp and
+	// have no counter file, the next number then follows the one of their CRL
+	if err = ioutil.WriteFile(filepath.Join(authority.Dir, CA_CRL_NUMBER_FILE), []byte("1700000000\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = authority.WriteCRL(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(authority.Dir, CA_CRL_NUMBER_FILE)); err != nil {
+		t.Fatal(err)
+	}
+	if err = authority.WriteCRL(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, number := loadCRL(t, authority); number.Cmp(big.NewInt(1700000002)) != 0 {
+		t.Fatalf("CRL number %s without the counter, expected the one of the last CRL plus 1", number)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(authority.Dir, CA_CRL_NUMBER_FILE), []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = authority.WriteCRL(time.Hour); err == nil {
+		t.Fatal("CRL written with an invalid counter")
+	}
+}
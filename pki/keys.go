@@ -0,0 +1,111 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+const (
+	KEY_TYPE_ECDSA   = "ecdsa"
+	KEY_TYPE_ED25519 = "ed25519"
+)
+
+// GenerateKey creates a new private key, keyType is either "ecdsa" (P-256) or "ed25519"
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KEY_TYPE_ECDSA, "":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KEY_TYPE_ED25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %q, use %s or %s", keyType, KEY_TYPE_ECDSA, KEY_TYPE_ED25519)
+	}
+}
+
+// EncodeKey returns the PKCS#8 PEM encoding of the private key
+func EncodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pemEncode("PRIVATE KEY", der), nil
+}
+
+// EncodeCertificate returns the PEM encoding of the certificate
+func EncodeCertificate(cert *x509.Certificate) []byte {
+	return pemEncode("CERTIFICATE", cert.Raw)
+}
+
+// LoadKey reads a PEM private key in PKCS#8, PKCS#1 or EC format
+func LoadKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported private key format", path)
+}
+
+// LoadCertificate reads the first certificate of a PEM file
+func LoadCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no certificate found", path)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// subjectKeyID derives the key identifier from the SHA-1 hash of the encoded public key
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	if len(der) == 0 {
+		return nil, errors.New("empty public key")
+	}
+	sum := sha1.Sum(der)
+	return sum[:], nil
+}
+
+func pemEncode(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
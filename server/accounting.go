@@ -0,0 +1,403 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/parvit/qpep/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ACCOUNTING_SAVE_INTERVAL = 1 * time.Minute
+	// ACCOUNTING_FLUSH_INTERVAL is how often the bytes relayed by a stream are added to the records of
+	// its client, they're accumulated by the stream in between and flushed when it ends
+	ACCOUNTING_FLUSH_INTERVAL = 1 * time.Second
+
+	QUOTA_ACTION_REJECT   = "reject"
+	QUOTA_ACTION_THROTTLE = "throttle"
+)
+
+// clientUsage is the traffic of a client in a period, up is from the client to the destinations
+type clientUsage struct {
+	BytesUp        uint64  `json:"bytesUp"`
+	BytesDown      uint64  `json:"bytesDown"`
+	Streams        uint64  `json:"streams"`
+	SessionSeconds float64 `json:"sessionSeconds"`
+}
+
+func (usage *clientUsage) bytes() uint64 {
+	return usage.BytesUp + usage.BytesDown
+}
+
+// clientAccount keeps the usage of a client for the current day, the current month and since the first session;
+// the accounts of the unauthenticated clients are keyed by source address and pruned once their month is over
+type clientAccount struct {
+	Day       string      `json:"day"`
+	Month     string      `json:"month"`
+	Daily     clientUsage `json:"daily"`
+	Monthly   clientUsage `json:"monthly"`
+	Total     clientUsage `json:"total"`
+	LastSeen  time.Time   `json:"lastSeen"`
+	Anonymous bool        `json:"anonymous,omitempty"`
+
+	limiter *rateLimiter
+}
+
+// quotaLimits are the byte limits of a client, zero means unlimited
+type quotaLimits struct {
+	Daily        uint64 `yaml:"daily"`
+	Monthly      uint64 `yaml:"monthly"`
+	Action       string `yaml:"action"`
+	ThrottleRate uint64 `yaml:"throttleRate"`
+}
+
+// quotaFile is the yaml layout of the file given with the -quotas flag
+type quotaFile struct {
+	Default quotaLimits            `yaml:"default"`
+	Clients map[string]quotaLimits `yaml:"clients"`
+}
+
+// accountingStore records the traffic of every client, keyed by authenticated name or by source address,
+// and enforces the quotas; the records are saved periodically to a local file to survive restarts
+type accountingStore struct {
+	path   string
+	quotas quotaFile
+
+	mtx      sync.Mutex
+	accounts map[string]*clientAccount
+	dirty    bool
+}
+
+// newAccountingStore loads the previous records from path, an empty path keeps the records only in memory
+func newAccountingStore(path, quotasPath string) (*accountingStore, error) {
+	store := &accountingStore{path: path, accounts: make(map[string]*clientAccount)}
+
+	if quotasPath != "" {
+		data, err := ioutil.ReadFile(quotasPath)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.Unmarshal(data, &store.quotas); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", quotasPath, err)
+		}
+		if err = store.quotas.Default.validate(); err != nil {
+			return nil, fmt.Errorf("%s: default: %w", quotasPath, err)
+		}
+		for name, limits := range store.quotas.Clients {
+			if err = limits.validate(); err != nil {
+				return nil, fmt.Errorf("%s: client %s: %w", quotasPath, name, err)
+			}
+		}
+	}
+
+	if path == "" {
+		return store, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &store.accounts); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	store.prune()
+	return store, nil
+}
+
+// accountKey is the name of the authenticated client or, for unauthenticated sessions, its source address
+func accountKey(identity ClientIdentity) string {
+	if identity.Name != "" {
+		return identity.Name
+	}
+	if identity.Address == nil {
+		return "<unknown>"
+	}
+	host, _, err := net.SplitHostPort(identity.Address.String())
+	if err != nil {
+		return identity.Address.String()
+	}
+	return host
+}
+
+// admitStream checks the quotas of the client before a new stream is relayed, a nil limiter is returned
+// when the stream is not throttled
+func (store *accountingStore) admitStream(identity ClientIdentity) (*rateLimiter, error) {
+	key := accountKey(identity)
+	limits := store.limitsFor(key)
+
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	account := store.account(identity)
+	exceeded := ""
+	if limits.Daily > 0 && account.Daily.bytes() >= limits.Daily {
+		exceeded = "daily"
+	} else if limits.Monthly > 0 && account.Monthly.bytes() >= limits.Monthly {
+		exceeded = "monthly"
+	}
+	if exceeded != "" && limits.Action != QUOTA_ACTION_THROTTLE {
+		return nil, fmt.Errorf("%s quota of %d bytes exceeded by %s", exceeded, quotaOf(limits, exceeded), key)
+	}
+
+	// only the streams relayed are counted
+	for _, usage := range []*clientUsage{&account.Daily, &account.Monthly, &account.Total} {
+		usage.Streams++
+	}
+	store.dirty = true
+	if exceeded == "" {
+		account.limiter = nil
+		return nil, nil
+	}
+	if account.limiter == nil {
+		logger.Warning("Throttling %s to %d bytes/s, %s quota of %d bytes exceeded", key, limits.ThrottleRate, exceeded, quotaOf(limits, exceeded))
+		account.limiter = newRateLimiter(limits.ThrottleRate)
+	}
+	return account.limiter, nil
+}
+
+// addBytes records traffic of the client, up is from the client to the destination
+func (store *accountingStore) addBytes(identity ClientIdentity, up, down uint64) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	account := store.account(identity)
+	for _, usage := range []*clientUsage{&account.Daily, &account.Monthly, &account.Total} {
+		usage.BytesUp += up
+		usage.BytesDown += down
+	}
+	store.dirty = true
+}
+
+// addSession records the duration of a closed session and returns the total usage of the client
+func (store *accountingStore) addSession(identity ClientIdentity, duration time.Duration) clientUsage {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	account := store.account(identity)
+	for _, usage := range []*clientUsage{&account.Daily, &account.Monthly, &account.Total} {
+		usage.SessionSeconds += duration.Seconds()
+	}
+	store.dirty = true
+	return account.Total
+}
+
+// account returns the record of the client, resetting the periods that are over, must be called with the lock held
+func (store *accountingStore) account(identity ClientIdentity) *clientAccount {
+	now := time.Now()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+
+	key := accountKey(identity)
+	account, ok := store.accounts[key]
+	if !ok {
+		account = &clientAccount{Day: day, Month: month, Anonymous: identity.Name == ""}
+		store.accounts[key] = account
+	}
+	if account.Day != day {
+		account.Day = day
+		account.Daily = clientUsage{}
+	}
+	if account.Month != month {
+		account.Month = month
+		account.Monthly = clientUsage{}
+	}
+	account.LastSeen = now
+	return account
+}
+
+// prune removes the accounts of the unauthenticated clients not seen in the current month, their usage
+// no longer counts for the quotas and the source addresses would otherwise pile up; it returns the
+// number of accounts removed
+func (store *accountingStore) prune() int {
+	month := time.Now().Format("2006-01")
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	pruned := 0
+	for key, account := range store.accounts {
+		if account.Anonymous && account.LastSeen.Format("2006-01") != month {
+			delete(store.accounts, key)
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		store.dirty = true
+	}
+	return pruned
+}
+
+func (store *accountingStore) limitsFor(key string) quotaLimits {
+	limits := store.quotas.Default
+	if clientLimits, ok := store.quotas.Clients[key]; ok {
+		if clientLimits.Daily > 0 {
+			limits.Daily = clientLimits.Daily
+		}
+		if clientLimits.Monthly > 0 {
+			limits.Monthly = clientLimits.Monthly
+		}
+		if clientLimits.Action != "" {
+			limits.Action = clientLimits.Action
+		}
+		if clientLimits.ThrottleRate > 0 {
+			limits.ThrottleRate = clientLimits.ThrottleRate
+		}
+	}
+	return limits
+}
+
+// save writes the records to the store file if they changed since the last save
+func (store *accountingStore) save() error {
+	store.mtx.Lock()
+	if store.path == "" || !store.dirty {
+		store.mtx.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(store.accounts, "", "  ")
+	store.dirty = false
+	store.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that a crash can't leave a truncated store behind
+	tmpPath := store.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, store.path)
+}
+
+// saveLoop prunes and saves the records periodically until done is closed
+func (store *accountingStore) saveLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(ACCOUNTING_SAVE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if pruned := store.prune(); pruned > 0 {
+				logger.Debug("Pruned %d accounts of unauthenticated clients not seen this month", pruned)
+			}
+			if err := store.save(); err != nil {
+				logger.Error("Unable to save accounting store: %s", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (limits quotaLimits) validate() error {
+	switch limits.Action {
+	case "", QUOTA_ACTION_REJECT:
+	case QUOTA_ACTION_THROTTLE:
+		if limits.ThrottleRate == 0 {
+			return errors.New("throttleRate is required with the throttle action")
+		}
+	default:
+		return fmt.Errorf("unknown action %q, use %s or %s", limits.Action, QUOTA_ACTION_REJECT, QUOTA_ACTION_THROTTLE)
+	}
+	return nil
+}
+
+func quotaOf(limits quotaLimits, period string) uint64 {
+	if period == "daily" {
+		return limits.Daily
+	}
+	return limits.Monthly
+}
+
+// rateLimiter is a token bucket shared by all the streams of a throttled client
+type rateLimiter struct {
+	rate uint64
+
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate uint64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// wait blocks until n bytes can be sent without exceeding the rate, or until ctx is done
+func (limiter *rateLimiter) wait(ctx context.Context, n int) error {
+	limiter.mtx.Lock()
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * float64(limiter.rate)
+	if limiter.tokens > float64(limiter.rate) {
+		limiter.tokens = float64(limiter.rate)
+	}
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	deficit := -limiter.tokens
+	limiter.mtx.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(deficit / float64(limiter.rate) * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// copyAccounted works like io.Copy, recording the bytes in the accounting store and applying the throttling if any
+// until ctx is done; the bytes are added to the store every ACCOUNTING_FLUSH_INTERVAL and on return rather than
+// for every write
+func copyAccounted(ctx context.Context, dst io.Writer, src io.Reader, store *accountingStore, identity ClientIdentity, upstream bool, limiter *rateLimiter) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written, flushed int64
+	lastFlush := time.Now()
+	flush := func() {
+		if written == flushed {
+			return
+		}
+		if upstream {
+			store.addBytes(identity, uint64(written-flushed), 0)
+		} else {
+			store.addBytes(identity, 0, uint64(written-flushed))
+		}
+		flushed = written
+	}
+	defer flush()
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if limiter != nil {
+				if err := limiter.wait(ctx, n); err != nil {
+					return written, err
+				}
+			}
+			wn, writeErr := dst.Write(buf[:n])
+			written += int64(wn)
+			if now := time.Now(); now.Sub(lastFlush) >= ACCOUNTING_FLUSH_INTERVAL {
+				flush()
+				lastFlush = now
+			}
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if wn != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeQuotas writes a quotas file and returns its path
+func writeQuotas(t *testing.T, quotas string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "quotas.yaml")
+	if err := ioutil.WriteFile(path, []byte(quotas), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// relayBytes accounts a stream of the client relaying size bytes in the direction
+func relayBytes(t *testing.T, store *accountingStore, identity ClientIdentity, size int, upstream bool) {
+	t.Helper()
+	var dst bytes.Buffer
+	if _, err := copyAccounted(context.Background(), &dst, bytes.NewReader(make([]byte, size)), store, identity, upstream, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	store, err := newAccountingStore("", writeQuotas(t, `
+default:
+  daily: 1000
+clients:
+  throttled:
+    daily: 2000
+    action: throttle
+    throttleRate: 100000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := ClientIdentity{Address: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 40000}}
+	throttled := ClientIdentity{Name: "throttled"}
+
+	if limiter, err := store.admitStream(limited); err != nil || limiter != nil {
+		t.Fatalf("first stream admitted with %v, %v, expected no limit", limiter, err)
+	}
+	relayBytes(t, store, limited, 600, true)
+	relayBytes(t, store, limited, 400, false)
+	if _, err = store.admitStream(limited); err == nil || !strings.Contains(err.Error(), "daily quota") {
+		t.Fatalf("stream over the quota admitted with %v, expected the daily quota rejection", err)
+	}
+	// the sessions from another port of the same address share the quota
+	limited.Address = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 40001}
+	if _, err = store.admitStream(limited); err == nil {
+		t.Fatal("stream from another port admitted over the quota")
+	}
+	usage := store.accounts[accountKey(limited)].Daily
+	if usage.BytesUp != 600 || usage.BytesDown != 400 || usage.Streams != 1 {
+		t.Fatalf("usage %+v, expected 600 bytes up, 400 down and only the admitted stream", usage)
+	}
+
+	// the client limits override the default ones
+	relayBytes(t, store, throttled, 1500, true)
+	if limiter, err := store.admitStream(throttled); err != nil || limiter != nil {
+		t.Fatalf("stream under the client quota admitted with %v, %v, expected no limit", limiter, err)
+	}
+	relayBytes(t, store, throttled, 500, false)
+	limiter, err := store.admitStream(throttled)
+	if err != nil || limiter == nil || limiter.rate != 100000 {
+		t.Fatalf("stream over the client quota admitted with %v, %v, expected the throttling", limiter, err)
+	}
+	if again, _ := store.admitStream(throttled); again != limiter {
+		t.Error("the streams of a throttled client don't share its limiter")
+	}
+	if streams := store.accounts["throttled"].Total.Streams; streams != 3 {
+		t.Errorf("counted %d streams, expected the 3 throttled or not", streams)
+	}
+
+	if _, err = newAccountingStore("", writeQuotas(t, "default:\n  action: throttle\n")); err == nil {
+		t.Error("loaded a throttle action without throttleRate")
+	}
+}
+
+func TestAccountingReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounting.json")
+	store, err := newAccountingStore(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := ClientIdentity{Name: "branch-office"}
+	if _, err = store.admitStream(identity); err != nil {
+		t.Fatal(err)
+	}
+	relayBytes(t, store, identity, 3000, true)
+	relayBytes(t, store, identity, 5000, false)
+	store.addSession(identity, 90*time.Second)
+	if err = store.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := newAccountingStore(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, ok := reloaded.accounts["branch-office"]
+	if !ok {
+		t.Fatal("client record lost across the reload")
+	}
+	for name, usage := range map[string]clientUsage{"daily": account.Daily, "monthly": account.Monthly, "total": account.Total} {
+		if usage.BytesUp != 3000 || usage.BytesDown != 5000 || usage.Streams != 1 || usage.SessionSeconds != 90 {
+			t.Errorf("%s usage %+v after the reload, expected the saved one", name, usage)
+		}
+	}
+
+	// the usage keeps growing from the reloaded records
+	relayBytes(t, reloaded, identity, 1000, true)
+	if total := reloaded.accounts["branch-office"].Total.BytesUp; total != 4000 {
+		t.Errorf("%d bytes up after the reload, expected 4000", total)
+	}
+
+	if err = ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newAccountingStore(path, ""); err == nil {
+		t.Error("loaded a corrupt accounting file")
+	}
+}
+
+func TestAccountingPrune(t *testing.T) {
+	store, err := newAccountingStore("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := ClientIdentity{Address: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 40000}}
+	active := ClientIdentity{Address: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 11), Port: 40000}}
+	named := ClientIdentity{Name: "branch-office"}
+	for _, identity := range []ClientIdentity{gone, active, named} {
+		relayBytes(t, store, identity, 1000, true)
+	}
+	// 40 days back is always in another month
+	lastMonth := time.Now().AddDate(0, 0, -40)
+	store.accounts[accountKey(gone)].LastSeen = lastMonth
+	store.accounts[accountKey(named)].LastSeen = lastMonth
+
+	if pruned := store.prune(); pruned != 1 {
+		t.Errorf("pruned %d accounts, expected the unauthenticated one not seen this month", pruned)
+	}
+	if _, ok := store.accounts[accountKey(gone)]; ok {
+		t.Error("kept the unauthenticated account not seen this month")
+	}
+	for _, identity := range []ClientIdentity{active, named} {
+		if _, ok := store.accounts[accountKey(identity)]; !ok {
+			t.Errorf("pruned the account of %s", identity)
+		}
+	}
+}
+
+func TestRateLimiterCanceled(t *testing.T) {
+	limiter := newRateLimiter(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	// the bytes take 100 s at the rate
+	if err := limiter.wait(ctx, 100000); err != context.Canceled {
+		t.Errorf("wait returned %v, expected the cancellation", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("wait returned after %s, expected the cancellation", elapsed)
+	}
+}
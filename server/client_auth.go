@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/parvit/qpep/logger"
+)
+
+// configureClientAuth enables mutual TLS on the server configuration, clients must present a certificate
+// issued by one of the CAs in caFile and not revoked by the optional CRL in crlFile
+func configureClientAuth(tlsConfig *tls.Config, caFile, crlFile string) error {
+	caData, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("read client CA bundle: %w", err)
+	}
+	roots, caCerts, err := parseCertificateBundle(caData)
+	if err != nil {
+		return fmt.Errorf("client CA bundle %s: %w", caFile, err)
+	}
+
+	var crl *revocationList
+	if crlFile != "" {
+		crl = &revocationList{path: crlFile, issuers: caCerts}
+		if err = crl.reload(); err != nil {
+			return err
+		}
+	}
+
+	// the certificate is only requested by the handshake and then checked in VerifyPeerCertificate,
+	// this way every rejected session, even without a certificate, can be logged with its address
+	tlsConfig.ClientAuth = tls.RequestClientCert
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		remote := "<unknown>"
+		if hello.Conn != nil {
+			remote = hello.Conn.RemoteAddr().String()
+		}
+		sessionConfig := tlsConfig.Clone()
+		sessionConfig.GetConfigForClient = nil
+		sessionConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			name, err := verifyClientCertificate(rawCerts, roots, crl)
+			if err != nil {
+				logger.Warning("Rejected client session from %s: %s", remote, err)
+				return err
+			}
+			logger.Info("Authenticated client %s from %s", name, remote)
+			return nil
+		}
+		return sessionConfig, nil
+	}
+	return nil
+}
+
+func verifyClientCertificate(rawCerts [][]byte, roots *x509.CertPool, crl *revocationList) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", errors.New("client did not present a certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return "", fmt.Errorf("client certificate is invalid: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", fmt.Errorf("client certificate %q not trusted: %w", certs[0].Subject.CommonName, err)
+	}
+
+	if crl != nil {
+		revoked, err := crl.isRevoked(certs[0].SerialNumber)
+		if err != nil {
+			return "", err
+		}
+		if revoked {
+			return "", fmt.Errorf("client certificate %q (serial %s) is revoked", certs[0].Subject.CommonName, certs[0].SerialNumber.Text(16))
+		}
+	}
+	return certs[0].Subject.CommonName, nil
+}
+
+func parseCertificateBundle(data []byte) (*x509.CertPool, []*x509.Certificate, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, nil, errors.New("no certificates found")
+	}
+	var certs []*x509.Certificate
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return pool, certs, nil
+}
+
+// revocationList keeps the serials revoked by a CRL file, the file is read again when it changes on disk
+// so that revoking a client does not require restarting the server
+type revocationList struct {
+	path    string
+	issuers []*x509.Certificate
+
+	mtx     sync.Mutex
+	modTime time.Time
+	serials map[string]bool
+}
+
+func (crl *revocationList) isRevoked(serial *big.Int) (bool, error) {
+	if err := crl.reload(); err != nil {
+		return false, err
+	}
+	crl.mtx.Lock()
+	defer crl.mtx.Unlock()
+	return crl.serials[serial.String()], nil
+}
+
+func (crl *revocationList) reload() error {
+	crl.mtx.Lock()
+	defer crl.mtx.Unlock()
+
+	info, err := os.Stat(crl.path)
+	if err != nil {
+		return fmt.Errorf("read CRL: %w", err)
+	}
+	if crl.serials != nil && info.ModTime().Equal(crl.modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(crl.path)
+	if err != nil {
+		return fmt.Errorf("read CRL: %w", err)
+	}
+	list, err := x509.ParseCRL(data)
+	if err != nil {
+		return fmt.Errorf("parse CRL %s: %w", crl.path, err)
+	}
+	if err = checkCRLIssuer(list, crl.issuers); err != nil {
+		return fmt.Errorf("CRL %s: %w", crl.path, err)
+	}
+
+	serials := make(map[string]bool, len(list.TBSCertList.RevokedCertificates))
+	for _, entry := range list.TBSCertList.RevokedCertificates {
+		serials[entry.SerialNumber.String()] = true
+	}
+	crl.serials = serials
+	crl.modTime = info.ModTime()
+	logger.Info("Loaded CRL %s with %d revoked certificates", crl.path, len(serials))
+	return nil
+}
+
+func checkCRLIssuer(list *pkix.CertificateList, issuers []*x509.Certificate) error {
+	for _, issuer := range issuers {
+		if issuer.CheckCRLSignature(list) == nil {
+			return nil
+		}
+	}
+	return errors.New("not signed by any of the client CAs")
+}
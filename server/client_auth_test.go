@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAuthority signs the client certificates and the CRLs of the tests
+type testAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestAuthority(t *testing.T) *testAuthority {
+	t.Helper()
+	cert, key := newTestCertificate(t, "qpep test CA", nil, func(template *x509.Certificate) {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	})
+	return &testAuthority{cert: cert, key: key}
+}
+
+// newTestCertificate signs a certificate with the authority, self-signed when nil, after the
+// template is adjusted by setup
+func newTestCertificate(t *testing.T, name string, authority *testAuthority, setup func(template *x509.Certificate)) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	setup(template)
+	parent, parentKey := template, key
+	if authority != nil {
+		parent, parentKey = authority.cert, authority.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func (authority *testAuthority) issueClient(t *testing.T, name string) *x509.Certificate {
+	t.Helper()
+	cert, _ := newTestCertificate(t, name, authority, func(template *x509.Certificate) {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	})
+	return cert
+}
+
+// writeCRL writes to path a CRL revoking the certificates, with a modification time moved by age
+// so that a rewrite within the resolution of the file system clock is still seen as a change
+func (authority *testAuthority) writeCRL(t *testing.T, path string, age time.Duration, revoked ...*x509.Certificate) {
+	t.Helper()
+	list := &x509.RevocationList{Number: big.NewInt(time.Now().UnixNano()), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+	for _, cert := range revoked {
+		list.RevokedCertificates = append(list.RevokedCertificates, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, list, authority.cert, authority.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(age)
+	if err = os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCertificateRevocation(t *testing.T) {
+	authority := newTestAuthority(t)
+	branch := authority.issueClient(t, "branch-office")
+	laptop := authority.issueClient(t, "laptop")
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.cert)
+	path := filepath.Join(t.TempDir(), "crl.pem")
+	authority.writeCRL(t, path, -time.Minute)
+	crl := &revocationList{path: path, issuers: []*x509.Certificate{authority.cert}}
+
+	if name, err := verifyClientCertificate([][]byte{branch.Raw}, roots, crl); err != nil || name != "branch-office" {
+		t.Fatalf("client certificate verified as %q, %v, expected branch-office", name, err)
+	}
+
+	// the CRL written after a revocation is loaded again without restarting
+	authority.writeCRL(t, path, 0, branch)
+	_, err := verifyClientCertificate([][]byte{branch.Raw}, roots, crl)
+	if err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatalf("revoked client certificate verified with %v, expected a revocation error", err)
+	}
+	if name, err := verifyClientCertificate([][]byte{laptop.Raw}, roots, crl); err != nil || name != "laptop" {
+		t.Fatalf("client certificate verified as %q, %v after another revocation, expected laptop", name, err)
+	}
+
+	// a CRL signed by another CA is refused rather than trusted
+	newTestAuthority(t).writeCRL(t, path, time.Minute)
+	if _, err = verifyClientCertificate([][]byte{laptop.Raw}, roots, crl); err == nil {
+		t.Fatal("client certificate verified with a CRL of another CA")
+	}
+}
+
+func TestClientCertificateRejected(t *testing.T) {
+	authority := newTestAuthority(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.cert)
+
+	other := newTestAuthority(t).issueClient(t, "intruder")
+	server, _ := newTestCertificate(t, "gateway", authority, func(template *x509.Certificate) {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	})
+	for name, chain := range map[string][][]byte{
+		"no certificate":       nil,
+		"invalid certificate":  {[]byte("not a certificate")},
+		"another CA":           {other.Raw},
+		"a server certificate": {server.Raw},
+	} {
+		if _, err := verifyClientCertificate(chain, roots, nil); err == nil {
+			t.Errorf("client with %s accepted", name)
+		}
+	}
+}
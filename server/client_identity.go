@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// ClientIdentity describes the client owning a QUIC session, it travels with every stream opened
+// on that session so that logging, access control and accounting can refer to it
+type ClientIdentity struct {
+	// Name is the authenticated name of the client, empty when the session is not authenticated
+	Name string
+	// Address is the remote address of the QUIC session
+	Address net.Addr
+}
+
+func (identity ClientIdentity) String() string {
+	address := "<unknown>"
+	if identity.Address != nil {
+		address = identity.Address.String()
+	}
+	if identity.Name == "" {
+		return address
+	}
+	return identity.Name + "@" + address
+}
+
+// sessionIdentity extracts the identity of the client from the certificate presented in the TLS handshake
+func sessionIdentity(session quic.Session) ClientIdentity {
+	identity := ClientIdentity{Address: session.RemoteAddr()}
+	peerCerts := session.ConnectionState().TLS.PeerCertificates
+	if len(peerCerts) > 0 {
+		identity.Name = peerCerts[0].Subject.CommonName
+	}
+	return identity
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultDeniedNetworks are never reachable through the gateway unless the policy disables the defaults:
+// loopback, unspecified, link-local (which includes the 169.254.169.254 metadata service), multicast
+// and the well known cloud metadata addresses outside of the link-local ranges
+var defaultDeniedNetworks = []string{
+	"127.0.0.0/8", "::1/128",
+	"0.0.0.0/8", "::/128",
+	"169.254.0.0/16", "fe80::/10",
+	"224.0.0.0/4", "ff00::/8",
+	"100.100.100.200/32", "fd00:ec2::254/128",
+}
+
+// privateNetworks are the RFC1918 and unique local ranges, denied with the defaults unless the policy
+// allows them for gateways serving private destinations
+var privateNetworks = []string{
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+// destinationPolicyFile is the yaml layout of the file given with the -policy flag
+type destinationPolicyFile struct {
+	// DisableDefaults removes the built-in deny rules for loopback, link-local, metadata, private and local addresses
+	DisableDefaults bool `yaml:"disableDefaults"`
+	// AllowPrivateNetworks keeps the private networks out of the built-in deny rules
+	AllowPrivateNetworks bool                       `yaml:"allowPrivateNetworks"`
+	Rules                policyRulesFile            `yaml:",inline"`
+	Clients              map[string]policyRulesFile `yaml:"clients"`
+}
+
+type policyRulesFile struct {
+	Allow      []string `yaml:"allow"`
+	Deny       []string `yaml:"deny"`
+	AllowPorts []string `yaml:"allowPorts"`
+	DenyPorts  []string `yaml:"denyPorts"`
+}
+
+type portRange struct {
+	first, last int
+}
+
+type policyRules struct {
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+	allowPorts []portRange
+	denyPorts  []portRange
+}
+
+// destinationPolicy decides which destinations the clients can reach through the gateway, deny rules
+// always take precedence over allow rules: the allow rules of a client widen the global ones but never
+// to a destination denied by the defaults or the global rules
+type destinationPolicy struct {
+	defaults []*net.IPNet
+	private  []*net.IPNet
+	global   policyRules
+	clients  map[string]policyRules
+
+	deniedStreams uint64
+}
+
+// loadDestinationPolicy reads the policy file, with an empty path only the default rules are applied
+func loadDestinationPolicy(path string) (*destinationPolicy, error) {
+	var policyFile destinationPolicyFile
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.Unmarshal(data, &policyFile); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	policy := &destinationPolicy{clients: make(map[string]policyRules)}
+	var err error
+	if policy.global, err = policyFile.Rules.parse(); err != nil {
+		return nil, err
+	}
+	if !policyFile.DisableDefaults {
+		if policy.defaults, err = parseNetworks(defaultDeniedNetworks); err != nil {
+			return nil, err
+		}
+		policy.defaults = append(policy.defaults, localNetworks()...)
+		if !policyFile.AllowPrivateNetworks {
+			if policy.private, err = parseNetworks(privateNetworks); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for name, clientRules := range policyFile.Clients {
+		// the client allow rules are checked outside of the global ones, ports alone would allow them on any address
+		if len(clientRules.AllowPorts) > 0 && len(clientRules.Allow) == 0 {
+			return nil, fmt.Errorf("client %s: allowPorts needs the allow networks they apply to, e.g. [0.0.0.0/0, \"::/0\"] for any address", name)
+		}
+		if policy.clients[name], err = clientRules.parse(); err != nil {
+			return nil, fmt.Errorf("client %s: %w", name, err)
+		}
+	}
+	return policy, nil
+}
+
+// allows reports if the client can open a connection to the destination, and the reason if it can't
+func (policy *destinationPolicy) allows(identity ClientIdentity, dest *net.TCPAddr) (bool, string) {
+	ip := dest.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if containsIP(policy.defaults, ip) {
+		return false, "denied by default rules"
+	}
+	if containsIP(policy.private, ip) {
+		return false, "private network denied by default rules, see allowPrivateNetworks"
+	}
+	clientRules, hasClientRules := policy.clients[identity.Name]
+	hasClientRules = hasClientRules && identity.Name != ""
+	if hasClientRules && clientRules.denies(ip, dest.Port) {
+		return false, "denied by rules of client " + identity.Name
+	}
+	if policy.global.denies(ip, dest.Port) {
+		return false, "denied by global rules"
+	}
+	if hasClientRules && len(clientRules.allow) > 0 && clientRules.allows(ip, dest.Port) {
+		return true, ""
+	}
+	if !policy.global.allows(ip, dest.Port) {
+		return false, "not in the allowed destinations"
+	}
+	return true, ""
+}
+
+// denied counts a stream rejected by the policy and returns the total count
+func (policy *destinationPolicy) denied() uint64 {
+	return atomic.AddUint64(&policy.deniedStreams, 1)
+}
+
+func (rules policyRules) denies(ip net.IP, port int) bool {
+	return containsIP(rules.deny, ip) || containsPort(rules.denyPorts, port)
+}
+
+func (rules policyRules) allows(ip net.IP, port int) bool {
+	if len(rules.allow) > 0 && !containsIP(rules.allow, ip) {
+		return false
+	}
+	return len(rules.allowPorts) == 0 || containsPort(rules.allowPorts, port)
+}
+
+func (rulesFile policyRulesFile) parse() (policyRules, error) {
+	var rules policyRules
+	var err error
+	if rules.allow, err = parseNetworks(rulesFile.Allow); err != nil {
+		return rules, err
+	}
+	if rules.deny, err = parseNetworks(rulesFile.Deny); err != nil {
+		return rules, err
+	}
+	if rules.allowPorts, err = parsePortRanges(rulesFile.AllowPorts); err != nil {
+		return rules, err
+	}
+	if rules.denyPorts, err = parsePortRanges(rulesFile.DenyPorts); err != nil {
+		return rules, err
+	}
+	return rules, nil
+}
+
+// parseNetworks accepts CIDRs and plain addresses, which are treated as single host networks
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			networks = append(networks, hostNetwork(ip))
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parsePortRanges accepts single ports ("443") and inclusive ranges ("8000-8100")
+func parsePortRanges(values []string) ([]portRange, error) {
+	ranges := make([]portRange, 0, len(values))
+	for _, value := range values {
+		bounds := strings.SplitN(value, "-", 2)
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port range %q", value)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				return nil, fmt.Errorf("invalid port range %q", value)
+			}
+		}
+		if first < 0 || last > 65535 || first > last {
+			return nil, fmt.Errorf("invalid port range %q", value)
+		}
+		ranges = append(ranges, portRange{first: first, last: last})
+	}
+	return ranges, nil
+}
+
+// localNetworks returns the addresses of the gateway itself, so that clients can't reach its management services
+func localNetworks() []*net.IPNet {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var networks []*net.IPNet
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			networks = append(networks, hostNetwork(ipNet.IP))
+		}
+	}
+	return networks
+}
+
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ranges []portRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.first && port <= r.last {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func loadTestPolicy(t *testing.T, rules string) *destinationPolicy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := loadDestinationPolicy(path)
+	if err != nil {
+		t.Fatalf("load policy: %s", err)
+	}
+	return policy
+}
+
+func TestDestinationPolicy(t *testing.T) {
+	site := ClientIdentity{Name: "site-a"}
+	other := ClientIdentity{Name: "site-b"}
+	cases := []struct {
+		name     string
+		rules    string
+		identity ClientIdentity
+		dest     string
+		allowed  bool
+	}{
+		{"defaults deny loopback", "", site, "127.0.0.1:80", false},
+		{"defaults deny metadata", "", site, "169.254.169.254:80", false},
+		{"defaults deny private networks", "", site, "192.168.1.1:80", false},
+		{"defaults deny private IPv6", "", site, "[fd12::1]:80", false},
+		{"defaults allow public", "", site, "192.0.2.1:443", true},
+		{"private networks allowed", "allowPrivateNetworks: true\n", site, "10.1.2.3:80", true},
+		{"metadata denied with private networks allowed", "allowPrivateNetworks: true\n", site, "169.254.169.254:80", false},
+		{"client allow doesn't beat defaults", "clients:\n  site-a:\n    allow: [0.0.0.0/0]\n", site, "127.0.0.1:80", false},
+		{"client allow doesn't beat metadata", "clients:\n  site-a:\n    allow: [0.0.0.0/0]\n", site, "169.254.169.254:80", false},
+		{"client allow doesn't beat global deny", "deny: [192.0.2.0/24]\nclients:\n  site-a:\n    allow: [0.0.0.0/0]\n", site, "192.0.2.1:443", false},
+		{"client allow doesn't beat global deny ports", "denyPorts: [\"25\"]\nclients:\n  site-a:\n    allow: [0.0.0.0/0]\n", site, "192.0.2.1:25", false},
+		{"client allow ports", "allowPorts: [\"443\"]\nclients:\n  site-a:\n    allow: [192.0.2.0/24]\n    allowPorts: [\"22\"]\n", site, "192.0.2.1:22", true},
+		{"client allow ports apply to the client allow", "allowPorts: [\"443\"]\nclients:\n  site-a:\n    allow: [192.0.2.0/24]\n    allowPorts: [\"22\"]\n", site, "198.51.100.1:22", false},
+		{"client allow widens global allow", "allow: [198.51.100.0/24]\nclients:\n  site-a:\n    allow: [192.0.2.0/24]\n", site, "192.0.2.1:443", true},
+		{"client allow is the client's own", "allow: [198.51.100.0/24]\nclients:\n  site-a:\n    allow: [192.0.2.0/24]\n", other, "192.0.2.1:443", false},
+		{"client deny", "clients:\n  site-a:\n    deny: [192.0.2.0/24]\n", site, "192.0.2.1:443", false},
+		{"client deny is the client's own", "clients:\n  site-a:\n    deny: [192.0.2.0/24]\n", other, "192.0.2.1:443", true},
+		{"global deny", "deny: [192.0.2.0/24]\n", site, "192.0.2.1:443", false},
+		{"global allow ports", "allowPorts: [\"443\"]\n", site, "192.0.2.1:80", false},
+		{"disable defaults", "disableDefaults: true\n", site, "127.0.0.1:80", true},
+		{"disable defaults keeps global deny", "disableDefaults: true\ndeny: [127.0.0.0/8]\n", site, "127.0.0.1:80", false},
+		{"anonymous client", "clients:\n  \"\":\n    allow: [0.0.0.0/0]\n", ClientIdentity{}, "127.0.0.1:80", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dest, err := net.ResolveTCPAddr("tcp", c.dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed, reason := loadTestPolicy(t, c.rules).allows(c.identity, dest); allowed != c.allowed {
+				t.Errorf("%s allowed: %v (%s), expected %v", c.dest, allowed, reason, c.allowed)
+			}
+		})
+	}
+}
+
+func TestDestinationPolicyInvalid(t *testing.T) {
+	for _, rules := range []string{
+		"deny: [10.0.0.0/33]\n",
+		"allowPorts: [\"70000\"]\n",
+		"clients:\n  site-a:\n    allow: [nowhere]\n",
+		// the ports would be allowed on any address
+		"clients:\n  site-a:\n    allowPorts: [\"22\"]\n",
+	} {
+		path := filepath.Join(t.TempDir(), "policy.yaml")
+		if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadDestinationPolicy(path); err == nil {
+			t.Errorf("policy %q loaded", rules)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/parvit/qpep/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// EGRESS_DIRECT is the route of the destinations reached without an upstream proxy
+const EGRESS_DIRECT = "direct"
+
+// egressFile is the yaml layout of the file given with the -egress flag
+type egressFile struct {
+	// Proxies are the upstream proxies by name, as socks5://[user:password@]host:port or http://[user:password@]host:port
+	Proxies map[string]string `yaml:"proxies"`
+	Rules   []egressRuleFile  `yaml:"rules"`
+	// Default is the route of the destinations matching no rule, direct when empty
+	Default string `yaml:"default"`
+}
+
+type egressRuleFile struct {
+	Destinations []string `yaml:"destinations"`
+	Ports        []string `yaml:"ports"`
+	Via          string   `yaml:"via"`
+}
+
+type egressRule struct {
+	destinations []*net.IPNet
+	ports        []portRange
+	via          string
+}
+
+// egressDialer routes each connection through the upstream proxy or the direct dialer of the first
+// rule matching its destination, a rule without destinations or ports matches any of them
+type egressDialer struct {
+	dialers  map[string]OutboundDialer
+	rules    []egressRule
+	fallback string
+}
+
+// loadEgressRules reads the egress file, direct is the dialer of the direct route and the one used to reach the proxies
+func loadEgressRules(path string, direct OutboundDialer) (*egressDialer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rulesFile egressFile
+	if err = yaml.Unmarshal(data, &rulesFile); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	egress := &egressDialer{dialers: map[string]OutboundDialer{EGRESS_DIRECT: direct}, fallback: rulesFile.Default}
+	for name, proxyURL := range rulesFile.Proxies {
+		if name == EGRESS_DIRECT {
+			return nil, fmt.Errorf("proxy name %q is reserved", EGRESS_DIRECT)
+		}
+		if egress.dialers[name], err = newProxyDialer(proxyURL, direct); err != nil {
+			return nil, fmt.Errorf("proxy %s: %w", name, err)
+		}
+	}
+	if egress.fallback == "" {
+		egress.fallback = EGRESS_DIRECT
+	}
+	if _, ok := egress.dialers[egress.fallback]; !ok {
+		return nil, fmt.Errorf("default route %q is not a proxy", egress.fallback)
+	}
+	for i, ruleFile := range rulesFile.Rules {
+		rule := egressRule{via: ruleFile.Via}
+		if _, ok := egress.dialers[rule.via]; !ok {
+			return nil, fmt.Errorf("rule %d: route %q is not a proxy", i+1, rule.via)
+		}
+		if rule.destinations, err = parseNetworks(ruleFile.Destinations); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		if rule.ports, err = parsePortRanges(ruleFile.Ports); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		egress.rules = append(egress.rules, rule)
+	}
+	return egress, nil
+}
+
+// newProxyDialer returns the dialer of the proxy URL, the credentials are taken from its user info
+func newProxyDialer(proxyURL string, forward OutboundDialer) (OutboundDialer, error) {
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Host == "" || parsed.Port() == "" {
+		return nil, fmt.Errorf("missing host:port in %q", proxyURL)
+	}
+	username := parsed.User.Username()
+	password, _ := parsed.User.Password()
+	switch parsed.Scheme {
+	case "socks5":
+		return &SOCKS5Dialer{Address: parsed.Host, Username: username, Password: password, Forward: forward}, nil
+	case "http":
+		return &HTTPConnectDialer{Address: parsed.Host, Username: username, Password: password, Forward: forward}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected socks5 or http", parsed.Scheme)
+	}
+}
+
+// route returns the name of the route of the destination
+func (egress *egressDialer) route(address string) string {
+	host, portName, err := net.SplitHostPort(address)
+	if err != nil {
+		return egress.fallback
+	}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	port, _ := strconv.Atoi(portName)
+	for _, rule := range egress.rules {
+		if len(rule.destinations) > 0 && (ip == nil || !containsIP(rule.destinations, ip)) {
+			continue
+		}
+		if len(rule.ports) > 0 && !containsPort(rule.ports, port) {
+			continue
+		}
+		return rule.via
+	}
+	return egress.fallback
+}
+
+func (egress *egressDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	route := egress.route(address)
+	logger.Debug("Connecting to %s via %s", address, route)
+	return egress.dialers[route].DialContext(ctx, network, address)
+}
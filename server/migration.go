@@ -0,0 +1,242 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/parvit/qpep/shared"
+)
+
+const (
+	// migrationConnectionIDLength is the length of the connection IDs of the server, set so that the
+	// packets of the sessions can be recognized from their short header
+	migrationConnectionIDLength = 8
+
+	// migrationCandidatesKept bounds the other addresses kept for a session, the most recent ones
+	migrationCandidatesKept = 4
+	// migrationChallengesKept bounds the challenges waiting for their answer for a session, the
+	// client announces its migration until it is done and each announce challenges the candidates
+	migrationChallengesKept = 16
+)
+
+// migratingPacketConn is the packet conn of the QUIC listener, it sends the packets of a session to
+// the address its client migrated to; quic-go keeps addressing the session with its first address.
+// The packets of a session can come from any address, the packets of an attacker included as
+// their connection IDs are not encrypted: the other addresses seen are only candidates. Once the
+// client announces its migration with a QPEP_MESSAGE_MIGRATED datagram the candidates are sent a
+// path challenge, and the session moves to the address whose challenge the client answers with a
+// QPEP_MESSAGE_PATH_RESPONSE datagram; only the client can send these datagrams on the session.
+type migratingPacketConn struct {
+	conn net.PacketConn
+	// challengeConn sends the path challenges outside of the QUIC session, under the FEC
+	challengeConn net.PacketConn
+
+	mtx sync.RWMutex
+	// peers are the accepted sessions by their first address, addresses maps the addresses the
+	// peers were seen at to their first one and connectionIDs the connection IDs of their packets
+	peers         map[shared.AddressKey]*migratingPeer
+	addresses     map[shared.AddressKey]shared.AddressKey
+	connectionIDs map[string]shared.AddressKey
+}
+
+type migratingPeer struct {
+	// current is the address the packets are sent to, candidates the other addresses seen with the
+	// connection IDs of the session and challenges the addresses challenged by nonce
+	current       net.Addr
+	candidates    []net.Addr
+	challenges    map[string]net.Addr
+	connectionIDs []string
+	addresses     []shared.AddressKey
+}
+
+// newMigratingPacketConn wraps the packet conn of the listener, challengeConn is the one the QUIC
+// packets are protected on
+func newMigratingPacketConn(conn, challengeConn net.PacketConn) *migratingPacketConn {
+	return &migratingPacketConn{
+		conn:          conn,
+		challengeConn: challengeConn,
+		peers:         make(map[shared.AddressKey]*migratingPeer),
+		addresses:     make(map[shared.AddressKey]shared.AddressKey),
+		connectionIDs: make(map[string]shared.AddressKey),
+	}
+}
+
+// track starts following the session of the address, accepted by the listener
+func (conn *migratingPacketConn) track(addr net.Addr) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	key := shared.NewAddressKey(addr)
+	if _, ok := conn.peers[key]; ok {
+		return
+	}
+	conn.peers[key] = &migratingPeer{current: addr, challenges: make(map[string]net.Addr), addresses: []shared.AddressKey{key}}
+	conn.addresses[key] = key
+}
+
+// forget stops following the session of the address once closed
+func (conn *migratingPacketConn) forget(addr net.Addr) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	key := shared.NewAddressKey(addr)
+	peer, ok := conn.peers[key]
+	if !ok {
+		return
+	}
+	for _, connectionID := range peer.connectionIDs {
+		delete(conn.connectionIDs, connectionID)
+	}
+	for _, address := range peer.addresses {
+		if conn.addresses[address] == key {
+			delete(conn.addresses, address)
+		}
+	}
+	delete(conn.peers, key)
+}
+
+// challenge sends a path challenge to the candidate addresses of the session of the address, it
+// returns the number of challenges sent
+func (conn *migratingPacketConn) challenge(addr net.Addr) int {
+	conn.mtx.Lock()
+	peer, ok := conn.peers[shared.NewAddressKey(addr)]
+	if !ok {
+		conn.mtx.Unlock()
+		return 0
+	}
+	candidates := append([]net.Addr(nil), peer.candidates...)
+	packets := make([][]byte, 0, len(candidates))
+	for range candidates {
+		nonce, packet, err := shared.NewPathChallenge()
+		if err != nil {
+			break
+		}
+		if len(peer.challenges) >= migrationChallengesKept {
+			peer.challenges = make(map[string]net.Addr)
+		}
+		peer.challenges[string(nonce)] = candidates[len(packets)]
+		packets = append(packets, packet)
+	}
+	conn.mtx.Unlock()
+	for i, packet := range packets {
+		conn.challengeConn.WriteTo(packet, candidates[i])
+	}
+	return len(packets)
+}
+
+// migrate sends the packets of the session of the address to the address of the challenge answered
+// by the client, it returns the new address or nil when the nonce is not one of a challenge
+func (conn *migratingPacketConn) migrate(addr net.Addr, nonce []byte) net.Addr {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	key := shared.NewAddressKey(addr)
+	peer, ok := conn.peers[key]
+	if !ok {
+		return nil
+	}
+	validated, ok := peer.challenges[string(nonce)]
+	if !ok {
+		return nil
+	}
+	peer.current, peer.candidates = validated, nil
+	peer.challenges = make(map[string]net.Addr)
+	address := shared.NewAddressKey(peer.current)
+	if _, ok := conn.addresses[address]; !ok {
+		conn.addresses[address] = key
+		peer.addresses = append(peer.addresses, address)
+	}
+	return peer.current
+}
+
+// isCandidate reports if the address is the current address of the peer or one of its candidates
+func (peer *migratingPeer) isCandidate(address shared.AddressKey) bool {
+	if address == shared.NewAddressKey(peer.current) {
+		return true
+	}
+	for _, candidate := range peer.candidates {
+		if address == shared.NewAddressKey(candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+func (conn *migratingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := conn.conn.ReadFrom(p)
+	// only the short header packets, sent once the handshake is complete, can come from a new address
+	if err != nil || n < 1+migrationConnectionIDLength || p[0]&0x80 != 0 {
+		return n, addr, err
+	}
+	address := shared.NewAddressKey(addr)
+	conn.mtx.RLock()
+	key, known := conn.connectionIDs[string(p[1:1+migrationConnectionIDLength])]
+	settled := false
+	if known {
+		settled = conn.peers[key].isCandidate(address)
+	} else {
+		_, known = conn.addresses[address]
+		settled = !known
+	}
+	conn.mtx.RUnlock()
+	if settled {
+		return n, addr, err
+	}
+
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	connectionID := string(p[1 : 1+migrationConnectionIDLength])
+	if key, known = conn.connectionIDs[connectionID]; !known {
+		// a new connection ID is only attributed to a session from one of its addresses
+		if key, known = conn.addresses[address]; !known {
+			return n, addr, err
+		}
+		conn.connectionIDs[connectionID] = key
+		conn.peers[key].connectionIDs = append(conn.peers[key].connectionIDs, connectionID)
+	}
+	if peer := conn.peers[key]; !peer.isCandidate(address) {
+		if len(peer.candidates) >= migrationCandidatesKept {
+			peer.candidates = peer.candidates[1:]
+		}
+		peer.candidates = append(peer.candidates, addr)
+	}
+	return n, addr, err
+}
+
+func (conn *migratingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	conn.mtx.RLock()
+	if peer, ok := conn.peers[shared.NewAddressKey(addr)]; ok {
+		addr = peer.current
+	}
+	conn.mtx.RUnlock()
+	return conn.conn.WriteTo(p, addr)
+}
+
+func (conn *migratingPacketConn) Close() error {
+	return conn.conn.Close()
+}
+
+func (conn *migratingPacketConn) LocalAddr() net.Addr {
+	return conn.conn.LocalAddr()
+}
+
+func (conn *migratingPacketConn) SetDeadline(t time.Time) error {
+	return conn.conn.SetDeadline(t)
+}
+
+func (conn *migratingPacketConn) SetReadDeadline(t time.Time) error {
+	return conn.conn.SetReadDeadline(t)
+}
+
+func (conn *migratingPacketConn) SetWriteDeadline(t time.Time) error {
+	return conn.conn.SetWriteDeadline(t)
+}
+
+// SetReadBuffer and SyscallConn let quic-go size the receive buffer, the other optimizations of
+// UDP sockets would bypass the redirection
+func (conn *migratingPacketConn) SetReadBuffer(bytes int) error {
+	return shared.SetReadBuffer(conn.conn, bytes)
+}
+
+func (conn *migratingPacketConn) SyscallConn() (syscall.RawConn, error) {
+	return shared.SyscallConn(conn.conn)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/parvit/qpep/shared"
+)
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	return conn
+}
+
+// shortHeaderPacket returns a 1-RTT packet for the connection ID, its payload doesn't matter here
+func shortHeaderPacket(connectionID byte) []byte {
+	packet := make([]byte, 1+migrationConnectionIDLength+16)
+	packet[0] = 0x40
+	for i := 1; i <= migrationConnectionIDLength; i++ {
+		packet[i] = connectionID
+	}
+	return packet
+}
+
+func TestMigratingPacketConn(t *testing.T) {
+	socket := listenLoopback(t)
+	conn := newMigratingPacketConn(socket, socket)
+	first, second, spoofer := listenLoopback(t), listenLoopback(t), listenLoopback(t)
+	buf := make([]byte, 1500)
+	send := func(from *net.UDPConn, packet []byte) {
+		t.Helper()
+		if _, err := from.WriteTo(packet, conn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the packets quic-go sends to the first address of the session must be received by expected
+	expectDelivery := func(expected *net.UDPConn) {
+		t.Helper()
+		payload := []byte("to the session")
+		if _, err := conn.WriteTo(payload, first.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := expected.ReadFrom(buf)
+		if err != nil || !bytes.Equal(buf[:n], payload) {
+			t.Fatalf("packet to the session not received at %s: %v", expected.LocalAddr(), err)
+		}
+	}
+	// challenge sends the path challenges and returns their nonces by the address they reached
+	challenge := func(expected ...*net.UDPConn) map[*net.UDPConn][]byte {
+		t.Helper()
+		if challenged := conn.challenge(first.LocalAddr()); challenged != len(expected) {
+			t.Fatalf("%d addresses challenged, expected %d", challenged, len(expected))
+		}
+		nonces := make(map[*net.UDPConn][]byte)
+		for _, at := range expected {
+			n, _, err := at.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("no challenge received at %s: %s", at.LocalAddr(), err)
+			}
+			nonce, ok := shared.ParsePathChallenge(buf[:n])
+			if !ok {
+				t.Fatalf("packet of %d bytes received at %s instead of a challenge", n, at.LocalAddr())
+			}
+			nonces[at] = append([]byte(nil), nonce...)
+		}
+		return nonces
+	}
+
+	conn.track(first.LocalAddr())
+	send(first, shortHeaderPacket(1))
+	// a connection ID first seen from another address is not attributed to the session
+	send(spoofer, shortHeaderPacket(2))
+	challenge()
+
+	// the packets of the session from other addresses, a spoofed one included, don't move it
+	send(spoofer, shortHeaderPacket(1))
+	send(second, shortHeaderPacket(1))
+	expectDelivery(first)
+	nonces := challenge(spoofer, second)
+	if address := conn.migrate(first.LocalAddr(), make([]byte, shared.PATH_NONCE_LENGTH)); address != nil {
+		t.Fatalf("session migrated to %s without the nonce of a challenge", address)
+	}
+	// the session moves to the address whose challenge the client answered
+	if address := conn.migrate(first.LocalAddr(), nonces[second]); address == nil || address.String() != second.LocalAddr().String() {
+		t.Fatalf("session migrated to %v, expected %s", address, second.LocalAddr())
+	}
+	expectDelivery(second)
+	if address := conn.migrate(first.LocalAddr(), nonces[spoofer]); address != nil {
+		t.Fatalf("session migrated to %s with the nonce of an earlier challenge", address)
+	}
+
+	// the connection IDs of the session are recognized from its new address as well
+	send(second, shortHeaderPacket(3))
+	send(first, shortHeaderPacket(3))
+	nonces = challenge(first)
+	if address := conn.migrate(first.LocalAddr(), nonces[first]); address == nil || address.String() != first.LocalAddr().String() {
+		t.Fatalf("session migrated back to %v, expected %s", address, first.LocalAddr())
+	}
+	expectDelivery(first)
+
+	conn.forget(first.LocalAddr())
+	if len(conn.peers) != 0 || len(conn.addresses) != 0 || len(conn.connectionIDs) != 0 {
+		t.Errorf("session state left after forget: %d peers, %d addresses, %d connection IDs", len(conn.peers), len(conn.addresses), len(conn.connectionIDs))
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/parvit/qpep/shared"
+)
+
+// DEFAULT_OUTBOUND_TIMEOUT bounds the connection to a destination when no outbound dialer is configured
+const DEFAULT_OUTBOUND_TIMEOUT = 10 * time.Second
+
+// OutboundDialer opens the connection of a stream to its destination, the context is done when the
+// client stops reading the stream or the session is closed
+type OutboundDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// sourceAddrKey is the context key of the source address of the client connection of a stream
+type sourceAddrKey struct{}
+
+// WithSourceAddr returns a context carrying the source address of the client connection of a stream,
+// the server dials the destination of each stream with it
+func WithSourceAddr(ctx context.Context, addr *net.TCPAddr) context.Context {
+	return context.WithValue(ctx, sourceAddrKey{}, addr)
+}
+
+// SourceAddrFromContext returns the source address of the client connection carried by the context, nil when none
+func SourceAddrFromContext(ctx context.Context) *net.TCPAddr {
+	addr, _ := ctx.Value(sourceAddrKey{}).(*net.TCPAddr)
+	return addr
+}
+
+// DirectDialer connects to the destinations from the gateway itself
+type DirectDialer struct {
+	// SourceAddress is the local address of the connections, chosen by the system when nil
+	SourceAddress net.IP
+	// Transparent binds the connections to the source address and port of the client connection
+	// carried by the context with IP_TRANSPARENT, only supported on linux. The destinations then see
+	// the client endpoints and must route them back through the gateway.
+	Transparent bool
+	// TransparentSources are the networks the client source addresses must belong to with Transparent,
+	// the connections from any other source are refused as the clients could spoof them
+	TransparentSources []*net.IPNet
+	// Interface binds the connections to a network interface, only supported on linux
+	Interface string
+	// Timeout bounds the connection, zero means no limit other than the one of the system
+	Timeout time.Duration
+}
+
+func (dialer *DirectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	netDialer := &net.Dialer{Timeout: dialer.Timeout}
+	if dialer.SourceAddress != nil {
+		netDialer.LocalAddr = &net.TCPAddr{IP: dialer.SourceAddress}
+	}
+	var controls []func(network, address string, rawConn syscall.RawConn) error
+	if dialer.Interface != "" {
+		controls = append(controls, shared.BindToInterface(dialer.Interface))
+	}
+	source := SourceAddrFromContext(ctx)
+	transparent := dialer.Transparent && source != nil
+	if transparent {
+		if err := dialer.checkSource(source); err != nil {
+			return nil, err
+		}
+		netDialer.LocalAddr = source
+		controls = append(controls, shared.TransparentSource)
+	}
+	if len(controls) > 0 {
+		netDialer.Control = func(network, address string, rawConn syscall.RawConn) error {
+			for _, control := range controls {
+				if err := control(network, address, rawConn); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	conn, err := netDialer.DialContext(ctx, network, address)
+	if err != nil && transparent && isAddrCollision(err) {
+		// the source port is bound by a socket of the gateway, or already connected to the same
+		// destination by an earlier stream which lingers
+		return nil, fmt.Errorf("source %s already in use towards %s: %w", source, address, err)
+	}
+	return conn, err
+}
+
+// checkSource refuses the client source addresses which are not endpoints the gateway may bind
+func (dialer *DirectDialer) checkSource(source *net.TCPAddr) error {
+	if source.IP.IsUnspecified() || source.Port == 0 {
+		return fmt.Errorf("source %s is not a client endpoint", source)
+	}
+	for _, network := range dialer.TransparentSources {
+		if network.Contains(source.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("source %s is not in the transparent source networks", source)
+}
+
+// isAddrCollision reports whether the connection failed because its local address and port are taken
+func isAddrCollision(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+// ParseSourceNetworks parses a comma separated list of networks and addresses, the latter being
+// single host networks
+func ParseSourceNetworks(value string) ([]*net.IPNet, error) {
+	if value == "" {
+		return nil, nil
+	}
+	values := strings.Split(value, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return parseNetworks(values)
+}
+
+// withoutSourceAddr returns a context carrying no source address, for the connections to the
+// upstream proxies which open the ones to the destinations from their own address
+func withoutSourceAddr(ctx context.Context) context.Context {
+	return WithSourceAddr(ctx, nil)
+}
+
+// ChainedDialer tries its dialers in order and returns the first connection established, e.g. to
+// fall back on a second uplink when the first one is down
+type ChainedDialer []OutboundDialer
+
+func (chain ChainedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("no dialer in the chain")
+	}
+	failures := make([]string, 0, len(chain))
+	for _, dialer := range chain {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		failures = append(failures, err.Error())
+	}
+	return nil, fmt.Errorf("all %d dialers failed: %s", len(chain), strings.Join(failures, "; "))
+}
+
+// closeWrite half-closes the connection when it supports it and closes it otherwise
+func closeWrite(conn net.Conn) error {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		return halfCloser.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// resetConn closes the connection, with a TCP RST when it is a TCP connection
+func resetConn(conn net.Conn) error {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// countingListener accepts and holds the connections of the dialers under test
+func countingListener(t *testing.T) (net.Listener, *int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener, &accepted
+}
+
+func TestTransparentSourceRefused(t *testing.T) {
+	listener, accepted := countingListener(t)
+	sources, err := ParseSourceNetworks("127.0.0.0/8, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &DirectDialer{Transparent: true, TransparentSources: sources, Timeout: testTimeout}
+
+	for _, source := range []*net.TCPAddr{
+		{IP: net.IPv4(192, 0, 2, 10), Port: 40000},
+		{IP: net.ParseIP("2001:db8::2"), Port: 40000},
+		{IP: net.IPv4zero, Port: 40000},
+		{IP: net.IPv6unspecified, Port: 40000},
+		{IP: net.IPv4(127, 0, 0, 2)},
+	} {
+		conn, err := dialer.DialContext(WithSourceAddr(context.Background(), source), "tcp", listener.Addr().String())
+		if err == nil {
+			conn.Close()
+			t.Errorf("connected from the spoofed source %s", source)
+		}
+	}
+	if count := atomic.LoadInt32(accepted); count != 0 {
+		t.Errorf("destination accepted %d connections, expected none", count)
+	}
+
+	// the streams without a source address are still connected from the gateway address
+	conn, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("connect without a source address: %s", err)
+	}
+	conn.Close()
+
+	if _, err = ParseSourceNetworks("10.0.0.0/8,invalid"); err == nil {
+		t.Error("parsed an invalid source network")
+	}
+}
+
+func TestTransparentSourceCollision(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("transparent source addresses are only supported on linux")
+	}
+	listener, _ := countingListener(t)
+	free, err := net.Listen("tcp", "127.0.0.3:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := free.Addr().(*net.TCPAddr)
+	free.Close()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	dialer := &DirectDialer{Transparent: true, TransparentSources: []*net.IPNet{loopback}, Timeout: testTimeout}
+	ctx := WithSourceAddr(context.Background(), source)
+	first, err := dialer.DialContext(ctx, "tcp", listener.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("transparent sockets need CAP_NET_ADMIN: %s", err)
+	}
+	if err != nil {
+		t.Fatalf("connect from %s: %s", source, err)
+	}
+	defer first.Close()
+
+	second, err := dialer.DialContext(ctx, "tcp", listener.Addr().String())
+	if err == nil {
+		second.Close()
+		t.Fatalf("connected twice from %s to the same destination", source)
+	}
+	if !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("second connection failed with %q, expected a source collision", err)
+	}
+}
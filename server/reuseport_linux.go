@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenReusePort binds count UDP sockets to the address with SO_REUSEPORT, the kernel then
+// spreads the packets across them by their addresses; when the port is 0 it is chosen by the
+// system for the first socket
+func listenReusePort(udpAddr *net.UDPAddr, count int) ([]*net.UDPConn, error) {
+	listenConfig := net.ListenConfig{Control: func(network, address string, rawConn syscall.RawConn) error {
+		var reuseErr error
+		err := rawConn.Control(func(fd uintptr) {
+			reuseErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return reuseErr
+	}}
+	address := udpAddr.String()
+	var conns []*net.UDPConn
+	for len(conns) < count {
+		conn, err := listenConfig.ListenPacket(context.Background(), "udp", address)
+		if err != nil {
+			for _, opened := range conns {
+				opened.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn.(*net.UDPConn))
+		address = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// listenReusePort binds count UDP sockets to the address with SO_REUSEPORT, the kernel then
+// spreads the packets across them by their addresses; when the port is 0 it is chosen by the
+// system for the first socket
+func listenReusePort(udpAddr *net.UDPAddr, count int) ([]*net.UDPConn, error) {
+	return nil, errors.New("several listen sockets are only supported on linux")
+}
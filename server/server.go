@@ -2,197 +2,740 @@ package server
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
-	"log"
-	"math/big"
 	"net"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/parvit/qpep/client"
+	"github.com/parvit/qpep/admin"
+	"github.com/parvit/qpep/flows"
+	"github.com/parvit/qpep/logger"
+	"github.com/parvit/qpep/metrics"
+	"github.com/parvit/qpep/mux"
 	"github.com/parvit/qpep/shared"
 
 	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
 )
 
-var (
-	serverConfig = ServerConfig{ListenHost: "0.0.0.0", ListenPort: 443}
-	quicListener quic.Listener
-	quicSession  quic.Session
-)
+// listenAttempts bounds the ports tried when the system chooses a UDP port that is in use for TCP
+const listenAttempts = 5
 
 type ServerConfig struct {
-	ListenHost string
-	ListenPort int
+	ListenHost     string
+	ListenPort     int
+	CertFile       string
+	KeyFile        string
+	KeyType        string
+	ClientCAFile   string
+	CRLFile        string
+	TokensFile     string
+	PolicyFile     string
+	AccountingFile string
+	QuotasFile     string
+	MetricsAddress string
+	AdminAddress   string
+	Qlog           shared.QlogConfig
+	FlowRecords    flows.ExportConfig
+	// ShutdownGrace is the time given to the active streams to finish when the context of Start is done
+	ShutdownGrace time.Duration
+	// OutboundDialer connects the streams to their destination, a DirectDialer with the default timeout when nil
+	OutboundDialer OutboundDialer
+	// EgressFile routes the connections through upstream proxies, OutboundDialer being the direct route
+	EgressFile string
+	// ListenTCP also accepts sessions over TLS on TCP, on the port of the QUIC listener
+	ListenTCP bool
+	// Migration follows the QUIC sessions of the clients that move to a new address
+	Migration bool
+	// FEC protects the packets of the QUIC sessions of the clients that ask for it with parity packets
+	FEC bool
+	// MaxPacketSize bounds the UDP payloads sent to the clients, 0 leaves the size to MTUDiscovery
+	MaxPacketSize int
+	// MTUDiscovery probes the paths for the largest QUIC packets they carry, up to MaxPacketSize,
+	// otherwise the packets keep their initial size
+	MTUDiscovery bool
+	// ListenSockets is the number of UDP sockets bound to the listen port with SO_REUSEPORT, each
+	// read by its own QUIC listener; several sockets are only supported on linux
+	ListenSockets int
 }
 
-func RunServer(ctx context.Context) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("PANIC: %v", err)
-			debug.PrintStack()
-		}
-		if quicListener != nil {
-			quicListener.Close()
+// DefaultConfig returns the configuration of a server with the default settings
+func DefaultConfig() ServerConfig {
+	return ServerConfig{
+		ListenHost: "0.0.0.0", ListenPort: 443,
+		CertFile: "server_cert.pem", KeyFile: "server_key.pem", KeyType: "ecdsa",
+		ShutdownGrace: 10 * time.Second,
+		ListenTCP:     true,
+		Migration:     true,
+		MTUDiscovery:  true,
+		ListenSockets: 1,
+	}
+}
+
+// Server accepts the QUIC sessions of the clients and connects each of their streams to its
+// destination, several servers can run in the same process
+type Server struct {
+	config         ServerConfig
+	metrics        *serverMetrics
+	flows          *flows.Registry
+	sessionTokens  []sessionToken
+	policy         *destinationPolicy
+	outbound       OutboundDialer
+	accounting     *accountingStore
+	accountingDone chan struct{}
+	// sockets are the UDP sockets of the QUIC listeners, all bound to the listen port
+	sockets     []*quicSocket
+	tcpListener quic.Listener
+	// closers are the metrics server, the admin server and the flow exporter, closed on shutdown
+	closers  []io.Closer
+	handlers sync.WaitGroup
+	streams  shared.ActiveStreams
+
+	shutdownOnce sync.Once
+	shutdownDone chan struct{}
+	shutdownErr  error
+
+	sessionsMtx sync.Mutex
+	closing     bool
+	sessions    map[quic.Session]struct{}
+}
+
+// quicSocket is a UDP socket of the server and its QUIC listener, steering is set when the socket
+// shares its port with others, migration when it follows the sessions and fec when it protects
+// their packets
+type quicSocket struct {
+	listener   quic.Listener
+	packetConn net.PacketConn
+	steering   *steeringConn
+	migration  *migratingPacketConn
+	fec        *shared.FECConn
+}
+
+func New(config ServerConfig) *Server {
+	if config.OutboundDialer == nil {
+		config.OutboundDialer = &DirectDialer{Timeout: DEFAULT_OUTBOUND_TIMEOUT}
+	}
+	return &Server{
+		config:       config,
+		metrics:      newServerMetrics(),
+		flows:        flows.NewRegistry(),
+		shutdownDone: make(chan struct{}),
+		sessions:     make(map[quic.Session]struct{}),
+	}
+}
+
+// Start loads the configured files, starts the optional services and binds the QUIC listener,
+// the server then runs until Shutdown is called or ctx is done
+func (server *Server) Start(ctx context.Context) error {
+	if err := server.start(); err != nil {
+		server.closeServices()
+		return err
+	}
+	for _, socket := range server.sockets {
+		server.handlers.Add(1)
+		go server.acceptSessions(socket.listener, socket)
+	}
+	if server.tcpListener != nil {
+		server.handlers.Add(1)
+		go server.acceptSessions(server.tcpListener, nil)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			graceCtx, cancel := context.WithTimeout(context.Background(), server.config.ShutdownGrace)
+			defer cancel()
+			server.Shutdown(graceCtx)
+		case <-server.shutdownDone:
 		}
 	}()
+	return nil
+}
 
-	listenAddr := serverConfig.ListenHost + ":" + strconv.Itoa(serverConfig.ListenPort)
-	log.Printf("Opening QPEP Server on: %s", listenAddr)
-	var err error
-	quicListener, err = quic.ListenAddr(listenAddr, generateTLSConfig(), &client.QuicClientConfiguration)
+func (server *Server) start() error {
+	config := server.config
+	if err := shared.ValidateMaxPacketSize(config.MaxPacketSize, config.FEC); err != nil {
+		return err
+	}
+	tlsConfig, err := loadTLSConfig(config.CertFile, config.KeyFile, config.KeyType, config.ListenHost)
 	if err != nil {
-		log.Printf("Encountered error while binding QUIC listener: %s", err)
-		return
+		return fmt.Errorf("load server TLS certificate: %w", err)
+	}
+	if config.ClientCAFile != "" {
+		if err = configureClientAuth(tlsConfig, config.ClientCAFile, config.CRLFile); err != nil {
+			return fmt.Errorf("enable client certificate authentication: %w", err)
+		}
+		logger.Info("Client certificate authentication enabled with CA bundle %s", config.ClientCAFile)
+	}
+	if config.TokensFile != "" {
+		server.sessionTokens, err = loadSessionTokens(config.TokensFile)
+		if err != nil {
+			return fmt.Errorf("load session tokens: %w", err)
+		}
+		logger.Info("Token authentication enabled with %d tokens", len(server.sessionTokens))
+	}
+	server.policy, err = loadDestinationPolicy(config.PolicyFile)
+	if err != nil {
+		return fmt.Errorf("load destination policy: %w", err)
+	}
+	server.accounting, err = newAccountingStore(config.AccountingFile, config.QuotasFile)
+	if err != nil {
+		return fmt.Errorf("load accounting store: %w", err)
+	}
+	server.outbound = config.OutboundDialer
+	if config.EgressFile != "" {
+		egress, err := loadEgressRules(config.EgressFile, config.OutboundDialer)
+		if err != nil {
+			return fmt.Errorf("load egress rules: %w", err)
+		}
+		server.outbound = egress
+		logger.Info("Routing connections with %d egress rules and %d upstream proxies, default route %s",
+			len(egress.rules), len(egress.dialers)-1, egress.fallback)
+	}
+
+	if config.MetricsAddress != "" {
+		metricsServer, err := metrics.StartServer(config.MetricsAddress, server.metrics.registry)
+		if err != nil {
+			return fmt.Errorf("start metrics server: %w", err)
+		}
+		server.closers = append(server.closers, metricsServer)
+		logger.Info("Serving metrics on http://%s/metrics", metricsServer.Addr())
+	}
+	if config.AdminAddress != "" {
+		adminServer, err := admin.StartServer(config.AdminAddress, server.flows)
+		if err != nil {
+			return fmt.Errorf("start admin API: %w", err)
+		}
+		server.closers = append(server.closers, adminServer)
+		logger.Info("Serving admin API on %s", config.AdminAddress)
+	}
+	if config.FlowRecords.Destination != "" {
+		exporter, err := flows.NewExporter(config.FlowRecords, "server")
+		if err != nil {
+			return fmt.Errorf("open flow records destination: %w", err)
+		}
+		server.closers = append(server.closers, exporter)
+		server.flows.OnStreamClosed(func(record flows.FlowRecord) {
+			if err := exporter.Export(record); err != nil {
+				logger.With("conn", record.ConnectionID).Error("Unable to export flow record: %s", err)
+			}
+		})
+		logger.Info("Exporting flow records to %s", config.FlowRecords.Destination)
 	}
-	defer quicListener.Close()
 
-	go ListenQuicSession()
+	quicServerConfig := shared.NewQuicConfig()
+	quicServerConfig.Tracer = server.metrics.tracer
+	quicServerConfig.DisablePathMTUDiscovery = !config.MTUDiscovery
+	if config.Qlog.Directory != "" {
+		qlogTracer, err := shared.NewQlogTracer(config.Qlog, "server")
+		if err != nil {
+			return fmt.Errorf("enable qlog tracing: %w", err)
+		}
+		quicServerConfig.Tracer = logging.NewMultiplexedTracer(server.metrics.tracer, qlogTracer)
+		logger.Info("Writing qlog traces to %s", config.Qlog.Directory)
+	}
+	return server.listen(tlsConfig, quicServerConfig)
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			quicListener.Close()
-			return
-		case <-time.After(10 * time.Millisecond):
-			continue
+func (server *Server) listen(tlsConfig *tls.Config, quicServerConfig *quic.Config) error {
+	listenAddr := server.config.ListenHost + ":" + strconv.Itoa(server.config.ListenPort)
+	logger.Info("Opening QPEP Server on: %s", listenAddr)
+	// the packets of the sessions are recognized from their connection IDs to follow and steer them
+	if server.config.Migration || server.config.ListenSockets > 1 {
+		quicServerConfig.ConnectionIDLength = migrationConnectionIDLength
+	}
+	for attempt := 1; ; attempt++ {
+		if err := server.listenQUIC(listenAddr, tlsConfig, quicServerConfig); err != nil {
+			return fmt.Errorf("bind QUIC listener: %w", err)
+		}
+		if !server.config.ListenTCP {
+			break
+		}
+		// the port is the one bound for QUIC, which can be chosen by the system
+		tcpAddr := server.config.ListenHost + ":" + strconv.Itoa(server.Addr().(*net.UDPAddr).Port)
+		tcpListener, err := mux.Listen(tcpAddr, tlsConfig)
+		if err == nil {
+			server.tcpListener = tcpListener
+			logger.Info("Accepting sessions over TLS on TCP %s", tcpListener.Addr())
+			break
+		}
+		server.closeSockets()
+		// a port chosen by the system for UDP can be in use for TCP, another one is then chosen
+		if server.config.ListenPort != 0 || attempt == listenAttempts || !errors.Is(err, syscall.EADDRINUSE) {
+			return fmt.Errorf("bind TCP listener: %w", err)
+		}
+	}
+	server.accountingDone = make(chan struct{})
+	go server.accounting.saveLoop(server.accountingDone)
+	return nil
+}
+
+// listenQUIC binds the UDP sockets of the QUIC listeners, the listeners don't close them
+func (server *Server) listenQUIC(address string, tlsConfig *tls.Config, quicServerConfig *quic.Config) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	var udpConns []*net.UDPConn
+	var steering *steeringGroup
+	if server.config.ListenSockets > 1 {
+		if udpConns, err = listenReusePort(udpAddr, server.config.ListenSockets); err != nil {
+			return err
+		}
+		steering = newSteeringGroup(server.metrics.steeredPackets.Inc)
+		logger.Info("Reading QUIC packets from %d sockets", len(udpConns))
+	} else {
+		udpConn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return err
+		}
+		udpConns = []*net.UDPConn{udpConn}
+	}
+	server.sockets = nil
+	for i, udpConn := range udpConns {
+		socket, err := server.newQUICSocket(udpConn, steering, i, tlsConfig, quicServerConfig)
+		if err != nil {
+			server.closeSockets()
+			for _, unused := range udpConns[i+1:] {
+				unused.Close()
+			}
+			return err
+		}
+		server.sockets = append(server.sockets, socket)
+	}
+	return nil
+}
+
+// newQUICSocket wraps the UDP socket in the packet conns of the configuration and starts its listener
+func (server *Server) newQUICSocket(udpConn *net.UDPConn, steering *steeringGroup, index int, tlsConfig *tls.Config, quicServerConfig *quic.Config) (*quicSocket, error) {
+	if server.config.MTUDiscovery {
+		if err := shared.SetDontFragment(udpConn); err != nil {
+			logger.Warning("Unable to set the don't fragment bit, fragmented probes can mislead the path MTU discovery: %s", err)
+		}
+	}
+	socket := &quicSocket{packetConn: udpConn}
+	// the packets are handed to the listener of their session before anything else
+	if steering != nil {
+		socket.steering = newSteeringConn(udpConn, steering, index)
+		socket.packetConn = socket.steering
+	}
+	// the size is bounded under the FEC header, the probes larger than the socket allows are dropped
+	if server.config.MaxPacketSize > 0 || server.config.MTUDiscovery {
+		socket.packetConn = shared.NewMTUConn(socket.packetConn, server.config.MaxPacketSize, server.metrics.mtuDropped.Inc)
+	}
+	challengeConn := socket.packetConn
+	// the FEC packets are decoded before the migrations see the QUIC packets
+	if server.config.FEC {
+		socket.fec = shared.NewFECConn(socket.packetConn, server.metrics.fecRecovered.Inc)
+		socket.packetConn = socket.fec
+	}
+	if server.config.Migration {
+		socket.migration = newMigratingPacketConn(socket.packetConn, challengeConn)
+		socket.packetConn = socket.migration
+	}
+	listener, err := quic.Listen(socket.packetConn, tlsConfig, quicServerConfig)
+	if err != nil {
+		socket.packetConn.Close()
+		return nil, err
+	}
+	socket.listener = listener
+	return socket, nil
+}
+
+// closeSockets closes the QUIC listeners and their sockets
+func (server *Server) closeSockets() {
+	for _, socket := range server.sockets {
+		socket.listener.Close()
+		socket.packetConn.Close()
+	}
+}
+
+// Addr returns the address of the QUIC listener once started
+func (server *Server) Addr() net.Addr {
+	return server.sockets[0].listener.Addr()
+}
+
+// TCPAddr returns the address of the TCP listener once started, nil when ListenTCP is not set
+func (server *Server) TCPAddr() net.Addr {
+	if server.tcpListener == nil {
+		return nil
+	}
+	return server.tcpListener.Addr()
+}
+
+// Shutdown refuses new sessions and streams and gives the active streams until ctx is done to
+// finish, the streams still active are then reset and the QUIC sessions closed; it returns once the
+// server has stopped, further calls wait for the first one to complete
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.shutdownOnce.Do(func() {
+		go server.shutdown(ctx)
+	})
+	<-server.shutdownDone
+	return server.shutdownErr
+}
+
+func (server *Server) shutdown(ctx context.Context) {
+	defer close(server.shutdownDone)
+	logger.Info("Shutting down server, draining active streams")
+	// the listener stays open while draining as closing it would also close the sessions
+	server.sessionsMtx.Lock()
+	server.closing = true
+	server.sessionsMtx.Unlock()
+
+	if reset := server.streams.Drain(ctx); reset > 0 {
+		logger.Warning("Reset %d streams still active at the end of the grace period", reset)
+	}
+	server.sessionsMtx.Lock()
+	for session := range server.sessions {
+		session.CloseWithError(shared.QPEP_ERROR_SHUTDOWN, "server shutdown")
+	}
+	server.sessionsMtx.Unlock()
+	// closing the listener also closes the sessions still in their handshake
+	server.closeSockets()
+	if server.tcpListener != nil {
+		server.tcpListener.Close()
+	}
+
+	server.handlers.Wait()
+	// the accounting store is saved from the moment the listener is bound
+	if server.accountingDone != nil {
+		close(server.accountingDone)
+		if err := server.accounting.save(); err != nil {
+			logger.Error("Unable to save accounting store: %s", err)
+			server.shutdownErr = err
 		}
 	}
+	if err := server.closeServices(); err != nil && server.shutdownErr == nil {
+		server.shutdownErr = err
+	}
+}
+
+func (server *Server) closeServices() error {
+	var firstErr error
+	for _, closer := range server.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	server.closers = nil
+	return firstErr
 }
 
-func ListenQuicSession() {
+// acceptSessions accepts the sessions of the listener, socket is the UDP socket of the QUIC listeners
+// and nil for the TCP one
+func (server *Server) acceptSessions(listener quic.Listener, socket *quicSocket) {
+	defer server.handlers.Done()
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("PANIC: %v", err)
+			logger.Error("PANIC: %v", err)
 			debug.PrintStack()
 		}
 	}()
 	for {
-		var err error
-		quicSession, err = quicListener.Accept(context.Background())
+		quicSession, err := listener.Accept(context.Background())
 		if err != nil {
-			log.Printf("Unrecoverable error while accepting QUIC session: %s", err)
+			if !server.isClosing() {
+				logger.Error("Unrecoverable error while accepting session on %s: %s", listener.Addr(), err)
+			}
 			return
 		}
-		go ListenQuicConn(quicSession)
+		if !server.trackSession(quicSession) {
+			logger.Info("Refusing QUIC session from %s, the server is shutting down", quicSession.RemoteAddr())
+			quicSession.CloseWithError(shared.QPEP_ERROR_SHUTDOWN, "server shutdown")
+			continue
+		}
+		server.handlers.Add(1)
+		go func() {
+			defer server.handlers.Done()
+			defer server.untrackSession(quicSession)
+			server.handleSession(quicSession, socket)
+		}()
+	}
+}
+
+// trackSession adds the session to those closed on shutdown, it returns false when shutting down
+func (server *Server) trackSession(quicSession quic.Session) bool {
+	server.sessionsMtx.Lock()
+	defer server.sessionsMtx.Unlock()
+	if server.closing {
+		return false
 	}
+	server.sessions[quicSession] = struct{}{}
+	return true
+}
+
+func (server *Server) isClosing() bool {
+	server.sessionsMtx.Lock()
+	defer server.sessionsMtx.Unlock()
+	return server.closing
+}
+
+func (server *Server) untrackSession(quicSession quic.Session) {
+	server.sessionsMtx.Lock()
+	defer server.sessionsMtx.Unlock()
+	delete(server.sessions, quicSession)
 }
 
-func ListenQuicConn(quicSession quic.Session) {
+func (server *Server) handleSession(quicSession quic.Session, socket *quicSocket) {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("PANIC: %v", err)
+			logger.Error("PANIC: %v", err)
 			debug.PrintStack()
 		}
 	}()
+	identity := sessionIdentity(quicSession)
+	if len(server.sessionTokens) > 0 {
+		name, err := authenticateSession(quicSession, server.sessionTokens)
+		if err != nil {
+			server.metrics.authFailures.Inc()
+			logger.Warning("Rejected QUIC session from %s: token authentication failed: %s", identity, err)
+			quicSession.CloseWithError(shared.QPEP_ERROR_AUTH_FAILED, "authentication failed")
+			return
+		}
+		identity.Name = name
+	}
+	transport := shared.SessionTransport(quicSession)
+	logger.Info("Accepted %s session from %s", strings.ToUpper(transport), identity)
+	server.metrics.countSession(transport)
+	server.metrics.countReconnect(identity)
+	server.metrics.sessionsActive.Inc()
+	flowSession := server.flows.AddSession(identity.Address.String(), identity.Name, func() {
+		quicSession.CloseWithError(shared.QPEP_ERROR_ADMIN_ABORTED, "aborted by administrator")
+	})
+	sessionStart := time.Now()
+	var streams sync.WaitGroup
+	defer func() {
+		// the usage is complete once all the streams of the session are closed
+		streams.Wait()
+		flowSession.Remove()
+		server.metrics.sessionsActive.Dec()
+		server.metrics.sessionClosed(identity)
+		duration := time.Since(sessionStart)
+		usage := server.accounting.addSession(identity, duration)
+		logger.Info("Closed QUIC session from %s after %s, total usage: %d bytes up, %d bytes down, %d streams",
+			identity, duration.Round(time.Second), usage.BytesUp, usage.BytesDown, usage.Streams)
+	}()
+	// only the authenticated sessions are followed to a new address
+	if socket != nil && socket.steering != nil {
+		socket.steering.track(quicSession.RemoteAddr())
+		defer socket.steering.forget(quicSession.RemoteAddr())
+	}
+	if socket != nil && (socket.migration != nil || socket.fec != nil) {
+		if socket.migration != nil {
+			socket.migration.track(quicSession.RemoteAddr())
+			defer socket.migration.forget(quicSession.RemoteAddr())
+		}
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			server.receiveMessages(quicSession, identity, socket)
+		}()
+	}
 	for {
 		stream, err := quicSession.AcceptStream(context.Background())
 		if err != nil {
-			if err.Error() != "NO_ERROR: No recent network activity" {
-				log.Printf("Unrecoverable error while accepting QUIC stream: %s", err)
+			if !shared.IsNormalSessionClose(err) && !server.isClosing() {
+				logger.Error("Unrecoverable error while accepting QUIC stream: %s", err)
 			}
 			return
 		}
-		log.Printf("Opening QUIC StreamID: %d\n", stream.StreamID())
+		if !server.streams.Add(stream) {
+			logger.Info("Refusing QUIC StreamID: %d for %s, the server is shutting down", stream.StreamID(), identity)
+			stream.CancelRead(shared.QPEP_ERROR_SHUTDOWN)
+			stream.CancelWrite(shared.QPEP_ERROR_SHUTDOWN)
+			continue
+		}
+		logger.Debug("Opening QUIC StreamID: %d for %s", stream.StreamID(), identity)
 
-		go HandleQuicStream(stream)
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			defer server.streams.Remove(stream)
+			server.handleStream(quicSession.Context(), stream, identity, flowSession)
+		}()
 	}
 }
 
-func HandleQuicStream(stream quic.Stream) {
+// receiveMessages handles the datagrams of the client until the session ends
+func (server *Server) receiveMessages(quicSession quic.Session, identity ClientIdentity, socket *quicSocket) {
+	if !quicSession.ConnectionState().SupportsDatagrams {
+		return
+	}
+	// address is the current address of the client, fecAddresses the ones its packets are protected to
+	address := quicSession.RemoteAddr()
+	var fecAddresses []net.Addr
+	defer func() {
+		for _, fecAddress := range fecAddresses {
+			socket.fec.Disable(fecAddress)
+		}
+	}()
+	for {
+		message, err := quicSession.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		nonce, isPathResponse := shared.ParsePathResponse(message)
+		switch {
+		case len(message) == 1 && message[0] == shared.QPEP_MESSAGE_MIGRATED && socket.migration != nil:
+			if challenged := socket.migration.challenge(quicSession.RemoteAddr()); challenged > 0 {
+				logger.Debug("Sent a path challenge to %d addresses of the QUIC session from %s", challenged, identity)
+			}
+		case isPathResponse && socket.migration != nil:
+			migrated := socket.migration.migrate(quicSession.RemoteAddr(), nonce)
+			if migrated == nil || migrated.String() == address.String() {
+				continue
+			}
+			address = migrated
+			server.metrics.migrations.Inc()
+			logger.Info("QUIC session from %s migrated to %s", identity, address)
+			if len(fecAddresses) > 0 {
+				socket.fec.Enable(address)
+				fecAddresses = append(fecAddresses, address)
+			}
+		case len(message) == 1 && message[0] == shared.QPEP_MESSAGE_FEC && socket.fec != nil:
+			if len(fecAddresses) == 0 {
+				socket.fec.Enable(address)
+				fecAddresses = append(fecAddresses, address)
+				server.metrics.fecSessions.Inc()
+				logger.Info("FEC enabled on QUIC session from %s", identity)
+			}
+			// every request is answered as the answers can be lost
+			quicSession.SendMessage([]byte{shared.QPEP_MESSAGE_FEC})
+		default:
+			logger.Debug("Ignoring unknown message of %d bytes from %s", len(message), identity)
+		}
+	}
+}
+
+func (server *Server) handleStream(ctx context.Context, stream quic.Stream, identity ClientIdentity, flowSession *flows.Session) {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("PANIC: %v", err)
+			logger.Error("PANIC: %v", err)
 			debug.PrintStack()
 		}
 	}()
 	qpepHeader, err := shared.GetQpepHeader(stream)
 	if err != nil {
-		log.Printf("Unable to find QPEP header: %s", err)
+		logger.Error("Unable to find QPEP header: %s", err)
 		return
 	}
-	go handleTCPConn(stream, qpepHeader)
+	connLog := logger.With("conn", qpepHeader.ConnectionID).With("client", identity).With("stream", stream.StreamID())
+	flowStream := flowSession.AddStream(qpepHeader.ConnectionID.String(), int64(stream.StreamID()),
+		qpepHeader.SourceAddr.String(), qpepHeader.DestAddr.String())
+	flowStream.SetAbort(func() {
+		flowStream.SetCloseReason(flows.CLOSE_RST)
+		stream.CancelRead(shared.QPEP_ERROR_ADMIN_ABORTED)
+		stream.CancelWrite(shared.QPEP_ERROR_ADMIN_ABORTED)
+	})
+	server.handleTCPConn(ctx, stream, qpepHeader, identity, connLog, flowStream)
 }
 
-func handleTCPConn(stream quic.Stream, qpepHeader shared.QpepHeader) {
+// handleTCPConn relays the stream to a TCP connection to its destination until both directions are closed,
+// the session of the stream ending with ctx
+func (server *Server) handleTCPConn(ctx context.Context, stream quic.Stream, qpepHeader shared.QpepHeader, identity ClientIdentity, connLog *logger.Logger, flowStream *flows.Stream) {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("PANIC: %v", err)
+			connLog.Error("PANIC: %v", err)
 			debug.PrintStack()
 		}
 	}()
-	log.Printf("Opening TCP Connection to %s\n", qpepHeader.DestAddr.String())
-	tcpConn, err := net.DialTimeout("tcp", qpepHeader.DestAddr.String(), time.Duration(10)*time.Second)
+	defer flowStream.Remove()
+	if allowed, reason := server.policy.allows(identity, qpepHeader.DestAddr); !allowed {
+		deniedCount := server.policy.denied()
+		server.metrics.policyDenied.Inc()
+		connLog.Warning("Denied stream to %s: %s (%d streams denied)", qpepHeader.DestAddr, reason, deniedCount)
+		flowStream.SetCloseReason(flows.CLOSE_RST)
+		stream.CancelRead(shared.QPEP_ERROR_POLICY_DENIED)
+		stream.CancelWrite(shared.QPEP_ERROR_POLICY_DENIED)
+		return
+	}
+	limiter, err := server.accounting.admitStream(identity)
+	if err != nil {
+		server.metrics.quotaRejected.Inc()
+		connLog.Warning("Rejected stream to %s: %s", qpepHeader.DestAddr, err)
+		flowStream.SetCloseReason(flows.CLOSE_RST)
+		stream.CancelRead(shared.QPEP_ERROR_QUOTA_EXCEEDED)
+		stream.CancelWrite(shared.QPEP_ERROR_QUOTA_EXCEEDED)
+		return
+	}
+
+	connLog.Info("Opening TCP Connection to %s for a stream of the %s class", qpepHeader.DestAddr.String(), qpepHeader.Class)
+	dialStart := time.Now()
+	tcpConn, err := server.outbound.DialContext(WithSourceAddr(stream.Context(), qpepHeader.SourceAddr), "tcp", qpepHeader.DestAddr.String())
 	if err != nil {
-		log.Printf("Unable to open TCP connection from QPEP stream: %s", err)
+		server.metrics.dialFailures.Inc()
+		connLog.Error("Unable to open TCP connection from QPEP stream: %s", err)
+		flowStream.SetCloseReason(flows.CLOSE_ERROR)
+		stream.CancelRead(shared.QPEP_ERROR_CONNECTION_FAILED)
+		stream.CancelWrite(shared.QPEP_ERROR_CONNECTION_FAILED)
 		return
 	}
-	log.Printf("Opened TCP Conn")
+	// a throttled copy waiting for its rate is interrupted by the resets and the end of the session
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	server.streams.SetReset(stream, func() {
+		cancel()
+		resetConn(tcpConn)
+	})
+	server.metrics.streamOpenTime.Observe(time.Since(dialStart).Seconds())
+	server.metrics.streamsActive.Inc()
+	defer server.metrics.streamsActive.Dec()
+	classBytesUp, classBytesDown := server.metrics.classes.Stream(qpepHeader.Class)
+	flowStream.SetAbort(func() {
+		flowStream.SetCloseReason(flows.CLOSE_RST)
+		stream.CancelRead(shared.QPEP_ERROR_ADMIN_ABORTED)
+		stream.CancelWrite(shared.QPEP_ERROR_ADMIN_ABORTED)
+		cancel()
+		tcpConn.Close()
+	})
+	flowStream.SetState(flows.STATE_OPEN)
+	connLog.Debug("Opened TCP Conn")
 
 	var streamWait sync.WaitGroup
 	streamWait.Add(2)
-	streamQUICtoTCP := func(dst *net.TCPConn, src quic.Stream) {
-		_, err = io.Copy(dst, src)
-		err1 := dst.SetLinger(3)
-		if err1 != nil {
-			log.Printf("error on setLinger: %s", err1)
-		}
-		dst.Close()
+	// each direction is half-closed on its own, a FIN is forwarded as a FIN and an error resets the other side
+	streamQUICtoTCP := func(dst net.Conn, src quic.Stream) {
+		_, err := copyAccounted(ctx, flowStream.Writer(metrics.CountingWriter(metrics.CountingWriter(dst, server.metrics.bytesUp), classBytesUp), true), src, server.accounting, identity, true, limiter)
 		if err != nil {
-			log.Printf("Error on Copy %s", err)
+			connLog.Warning("Error on Copy %s", err)
+			resetConn(dst)
+		} else {
+			closeWrite(dst)
 		}
+		flowStream.SetCloseReason(shared.CloseReason(err))
+		flowStream.SetState(flows.STATE_HALF_CLOSED)
 		streamWait.Done()
 	}
-	streamTCPtoQUIC := func(dst quic.Stream, src *net.TCPConn) {
-		_, err = io.Copy(dst, src)
-		log.Printf("Finished Copying TCP Conn %s->%s", src.LocalAddr().String(), src.RemoteAddr().String())
-		err1 := src.SetLinger(3)
-		if err1 != nil {
-			log.Printf("error on setLinger: %s", err1)
-		}
-		src.Close()
+	streamTCPtoQUIC := func(dst quic.Stream, src net.Conn) {
+		_, err := copyAccounted(ctx, flowStream.Writer(metrics.CountingWriter(metrics.CountingWriter(dst, server.metrics.bytesDown), classBytesDown), false), src, server.accounting, identity, false, limiter)
+		connLog.Debug("Finished Copying TCP Conn %s->%s", src.LocalAddr().String(), src.RemoteAddr().String())
 		if err != nil {
-			log.Printf("Error on Copy %s", err)
+			connLog.Warning("Error on Copy %s", err)
+			dst.CancelWrite(shared.QPEP_ERROR_CONNECTION_FAILED)
+		} else {
+			dst.Close()
 		}
+		flowStream.SetCloseReason(shared.CloseReason(err))
+		flowStream.SetState(flows.STATE_HALF_CLOSED)
 		streamWait.Done()
 	}
 
-	go streamQUICtoTCP(tcpConn.(*net.TCPConn), stream)
-	go streamTCPtoQUIC(stream, tcpConn.(*net.TCPConn))
+	go streamQUICtoTCP(tcpConn, stream)
+	go streamTCPtoQUIC(stream, tcpConn)
 
 	//we exit (and close the TCP connection) once both streams are done copying
 	streamWait.Wait()
-	stream.CancelRead(0)
-	stream.CancelWrite(0)
-	log.Printf("Closing TCP Conn %s->%s", tcpConn.LocalAddr().String(), tcpConn.RemoteAddr().String())
-}
-
-func generateTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		panic(err)
-	}
-	template := x509.Certificate{SerialNumber: big.NewInt(1)}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
-	if err != nil {
-		panic(err)
-	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		panic(err)
-	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"qpep"},
+	if linger, ok := tcpConn.(*net.TCPConn); ok {
+		if err1 := linger.SetLinger(3); err1 != nil {
+			connLog.Debug("error on setLinger: %s", err1)
+		}
 	}
+	tcpConn.Close()
+	connLog.Debug("Closing TCP Conn %s->%s", tcpConn.LocalAddr().String(), tcpConn.RemoteAddr().String())
 }
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/parvit/qpep/metrics"
+	"github.com/parvit/qpep/shared"
+)
+
+const (
+	// reconnectWindow is how long after the end of its last session a client opening a new one is
+	// counted as reconnecting
+	reconnectWindow = 10 * time.Minute
+	// seenClientsKept bounds the clients remembered for the reconnects, beyond it the clients
+	// without a live session are forgotten, the ones seen before the window first
+	seenClientsKept = 4096
+)
+
+// seenClient is the session history of a client used to count its reconnects
+type seenClient struct {
+	live int
+	last time.Time
+}
+
+// serverMetrics are the metrics of a server instance, each instance has its own registry
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	sessionsActive  *metrics.Gauge
+	streamsActive   *metrics.Gauge
+	bytesUp         *metrics.Counter
+	bytesDown       *metrics.Counter
+	dialFailures    *metrics.Counter
+	streamOpenTime  *metrics.Histogram
+	reconnects      *metrics.Counter
+	sessionsQUIC    *metrics.Counter
+	sessionsTCP     *metrics.Counter
+	authFailures    *metrics.Counter
+	policyDenied    *metrics.Counter
+	quotaRejected   *metrics.Counter
+	quicRTT         *metrics.Histogram
+	quicPacketsSent *metrics.Counter
+	quicPacketsLost *metrics.Counter
+	quicPacketSize  *metrics.Gauge
+	migrations      *metrics.Counter
+	fecSessions     *metrics.Counter
+	fecRecovered    *metrics.Counter
+	mtuDropped      *metrics.Counter
+	steeredPackets  *metrics.Counter
+	classes         *shared.ClassMetrics
+	tracer          logging.Tracer
+
+	seenClientsMtx sync.Mutex
+	seenClients    map[string]*seenClient
+}
+
+func newServerMetrics() *serverMetrics {
+	registry := metrics.NewRegistry("qpep_server")
+	bytesTotal := registry.CounterVec("bytes_total", "Bytes proxied through the tunnel", "direction")
+	sessionsTotal := registry.CounterVec("sessions_total", "Sessions accepted from clients", "transport")
+	m := &serverMetrics{
+		registry:        registry,
+		sessionsActive:  registry.Gauge("sessions_active", "QUIC sessions currently open from clients"),
+		streamsActive:   registry.Gauge("streams_active", "QUIC streams currently proxying a TCP connection"),
+		bytesUp:         bytesTotal.WithLabelValues("upstream"),
+		bytesDown:       bytesTotal.WithLabelValues("downstream"),
+		dialFailures:    registry.Counter("dial_failures_total", "Failed TCP connections to stream destinations"),
+		streamOpenTime:  registry.Histogram("stream_open_seconds", "Time taken to connect a stream to its destination", metrics.DefaultLatencyBuckets),
+		reconnects:      registry.Counter("session_reconnects_total", "QUIC sessions from clients that had a session open or closed within the reconnect window"),
+		sessionsQUIC:    sessionsTotal.WithLabelValues(shared.TRANSPORT_QUIC),
+		sessionsTCP:     sessionsTotal.WithLabelValues(shared.TRANSPORT_TCP),
+		authFailures:    registry.Counter("auth_failures_total", "QUIC sessions rejected by token authentication"),
+		policyDenied:    registry.Counter("policy_denied_streams_total", "Streams rejected by the destination policy"),
+		quotaRejected:   registry.Counter("quota_rejected_streams_total", "Streams rejected because the client quota is exhausted"),
+		quicRTT:         registry.Histogram("quic_rtt_seconds", "Smoothed round trip time of the QUIC sessions", metrics.DefaultLatencyBuckets),
+		quicPacketsSent: registry.Counter("quic_packets_sent_total", "QUIC packets sent"),
+		quicPacketsLost: registry.Counter("quic_packets_lost_total", "QUIC packets declared lost"),
+		quicPacketSize:  registry.Gauge("quic_packet_size_bytes", "Smallest, across the live QUIC sessions, of the largest packet acknowledged by the client as grown by the path MTU discovery"),
+		migrations:      registry.Counter("migrations_total", "QUIC sessions followed to a new client address"),
+		fecSessions:     registry.Counter("fec_sessions_total", "QUIC sessions whose packets are protected by FEC"),
+		fecRecovered:    registry.Counter("fec_recovered_packets_total", "QUIC packets of the clients recovered by FEC"),
+		mtuDropped:      registry.Counter("oversized_packets_dropped_total", "Packets to the clients dropped as larger than the max packet size or than the socket allows"),
+		steeredPackets:  registry.Counter("steered_packets_total", "QUIC packets read by another listen socket than the one of their session"),
+		classes:         shared.NewClassMetrics(registry),
+		seenClients:     map[string]*seenClient{},
+	}
+	m.tracer = shared.NewQuicMetricsTracer(shared.QuicMetrics{RTT: m.quicRTT, PacketsSent: m.quicPacketsSent, PacketsLost: m.quicPacketsLost, PacketSize: m.quicPacketSize})
+	return m
+}
+
+// countReconnect counts the new session as a reconnect if the client has a session open or closed
+// within reconnectWindow, sessionClosed must be called once it ends
+func (m *serverMetrics) countReconnect(identity ClientIdentity) {
+	key := accountKey(identity)
+	now := time.Now()
+	m.seenClientsMtx.Lock()
+	defer m.seenClientsMtx.Unlock()
+	client, ok := m.seenClients[key]
+	if !ok {
+		m.forgetClients(now)
+		client = &seenClient{}
+		m.seenClients[key] = client
+	} else if client.live > 0 || now.Sub(client.last) < reconnectWindow {
+		m.reconnects.Inc()
+	}
+	client.live++
+	client.last = now
+}
+
+// sessionClosed records the end of a session counted by countReconnect
+func (m *serverMetrics) sessionClosed(identity ClientIdentity) {
+	key := accountKey(identity)
+	m.seenClientsMtx.Lock()
+	defer m.seenClientsMtx.Unlock()
+	if client, ok := m.seenClients[key]; ok {
+		client.live--
+		client.last = time.Now()
+	}
+}
+
+// forgetClients drops the clients without a live session once there are more than seenClientsKept,
+// down to three quarters of it so that the scan doesn't run for every new client
+func (m *serverMetrics) forgetClients(now time.Time) {
+	if len(m.seenClients) <= seenClientsKept {
+		return
+	}
+	for key, client := range m.seenClients {
+		if client.live == 0 && now.Sub(client.last) >= reconnectWindow {
+			delete(m.seenClients, key)
+		}
+	}
+	for key, client := range m.seenClients {
+		if len(m.seenClients) <= seenClientsKept*3/4 {
+			return
+		}
+		if client.live == 0 {
+			delete(m.seenClients, key)
+		}
+	}
+}
+
+// countSession counts a session accepted on the transport
+func (m *serverMetrics) countSession(transport string) {
+	if transport == shared.TRANSPORT_TCP {
+		m.sessionsTCP.Inc()
+	} else {
+		m.sessionsQUIC.Inc()
+	}
+}
+
+// Stats is a snapshot of the counters of a server
+type Stats struct {
+	SessionsActive int
+	StreamsActive  int
+	BytesUp        uint64
+	BytesDown      uint64
+	DialFailures   uint64
+	Reconnects     uint64
+	AuthFailures   uint64
+	PolicyDenied   uint64
+	QuotaRejected  uint64
+	SessionsQUIC   uint64
+	SessionsTCP    uint64
+	Migrations     uint64
+	FECSessions    uint64
+	FECRecovered   uint64
+	MTUDropped     uint64
+	SteeredPackets uint64
+	// PacketSize is the smallest, across the live QUIC sessions, of the largest packet acknowledged by the client
+	PacketSize int
+	// Classes are the counters of the streams of each traffic class
+	Classes []shared.ClassStats
+}
+
+// Stats returns the current counters of the server
+func (server *Server) Stats() Stats {
+	m := server.metrics
+	return Stats{
+		SessionsActive: int(m.sessionsActive.Value()),
+		StreamsActive:  int(m.streamsActive.Value()),
+		BytesUp:        uint64(m.bytesUp.Value()),
+		BytesDown:      uint64(m.bytesDown.Value()),
+		DialFailures:   uint64(m.dialFailures.Value()),
+		Reconnects:     uint64(m.reconnects.Value()),
+		AuthFailures:   uint64(m.authFailures.Value()),
+		PolicyDenied:   uint64(m.policyDenied.Value()),
+		QuotaRejected:  uint64(m.quotaRejected.Value()),
+		SessionsQUIC:   uint64(m.sessionsQUIC.Value()),
+		SessionsTCP:    uint64(m.sessionsTCP.Value()),
+		Migrations:     uint64(m.migrations.Value()),
+		FECSessions:    uint64(m.fecSessions.Value()),
+		FECRecovered:   uint64(m.fecRecovered.Value()),
+		MTUDropped:     uint64(m.mtuDropped.Value()),
+		SteeredPackets: uint64(m.steeredPackets.Value()),
+		PacketSize:     int(m.quicPacketSize.Value()),
+		Classes:        m.classes.Stats(),
+	}
+}
+
+// Metrics returns the registry of the server metrics
+func (server *Server) Metrics() *metrics.Registry {
+	return server.metrics.registry
+}
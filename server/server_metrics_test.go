@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnects(t *testing.T) {
+	m := newServerMetrics()
+	client := ClientIdentity{Name: "branch-office"}
+
+	m.countReconnect(client)
+	m.countReconnect(client)
+	if reconnects := m.reconnects.Value(); reconnects != 1 {
+		t.Fatalf("counted %v reconnects with a live session, expected 1", reconnects)
+	}
+	m.sessionClosed(client)
+	m.sessionClosed(client)
+	m.countReconnect(client)
+	if reconnects := m.reconnects.Value(); reconnects != 2 {
+		t.Fatalf("counted %v reconnects after a recent session, expected 2", reconnects)
+	}
+	m.sessionClosed(client)
+
+	// a session long after the last one is not a reconnect
+	m.seenClients[accountKey(client)].last = time.Now().Add(-reconnectWindow)
+	m.countReconnect(client)
+	if reconnects := m.reconnects.Value(); reconnects != 2 {
+		t.Fatalf("counted %v reconnects after an old session, expected 2", reconnects)
+	}
+
+	// the clients without a live session are forgotten beyond the bound, the live one is kept
+	for i := 0; i < 2*seenClientsKept; i++ {
+		other := ClientIdentity{Address: &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 4242}}
+		m.countReconnect(other)
+		m.sessionClosed(other)
+	}
+	if seen := len(m.seenClients); seen > seenClientsKept+1 {
+		t.Fatalf("%d clients remembered, expected at most %d", seen, seenClientsKept+1)
+	}
+	if _, ok := m.seenClients[accountKey(client)]; !ok {
+		t.Fatalf("client %s with a live session forgotten", client)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/parvit/qpep/logger"
+	"github.com/parvit/qpep/pki"
+	"github.com/parvit/qpep/shared"
+)
+
+const SERVER_CERT_VALIDITY = 10 * 365 * 24 * time.Hour
+
+// loadTLSConfig reads the server certificate and key from disk, on the first run
+// the files don't exist yet so a new self-signed pair is generated and saved there
+func loadTLSConfig(certFile, keyFile, keyType, listenHost string) (*tls.Config, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		logger.Info("Server certificate not found, generating new %s one in %s / %s", keyType, certFile, keyFile)
+		if err := generateCertificateFiles(certFile, keyFile, keyType, listenHost); err != nil {
+			return nil, err
+		}
+	}
+
+	tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load %s / %s: %w", certFile, keyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", certFile, err)
+	}
+	tlsCert.Leaf = leaf
+	logger.Info("Server certificate SPKI pin: %s", shared.SPKIPin(leaf))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		NextProtos:   []string{shared.QPEP_PROTOCOL},
+	}, nil
+}
+
+// generateCertificateFiles creates a self-signed certificate meant to be pinned by the clients, it is valid
+// for the listen host unless the server listens on all the addresses
+func generateCertificateFiles(certFile, keyFile, keyType, listenHost string) error {
+	hosts := []string{shared.SELF_SIGNED_SERVER_NAME}
+	if ip := net.ParseIP(listenHost); ip == nil || !ip.IsUnspecified() {
+		hosts = append(hosts, listenHost)
+	}
+	cert, key, err := pki.SelfSignedServer(shared.SELF_SIGNED_SERVER_NAME, hosts, keyType, SERVER_CERT_VALIDITY)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := pki.EncodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pki.EncodeCertificate(cert), 0644)
+}
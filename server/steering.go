@@ -0,0 +1,248 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/parvit/qpep/shared"
+)
+
+// steeringGroup lets the QUIC listeners of the sockets bound to the same port with SO_REUSEPORT
+// hand each other the packets of their sessions: the kernel picks the socket of a packet from its
+// addresses, so the packets of a client that migrated are read by any of them. The connection IDs
+// are attributed to the session of the address they are first seen from, as the migratingPacketConn
+// does, and their packets are then read by the listener of the session whatever their address.
+type steeringGroup struct {
+	// steered is called for each packet read by another socket than the one of its session when set
+	steered func()
+
+	mtx sync.RWMutex
+	// peers are the accepted sessions by their first address, addresses maps the addresses the
+	// peers were seen at to their first one and connectionIDs the connection IDs of their packets
+	peers         map[shared.AddressKey]*steeringPeer
+	addresses     map[shared.AddressKey]shared.AddressKey
+	connectionIDs map[string]shared.AddressKey
+}
+
+type steeringPeer struct {
+	conn          *steeringConn
+	connectionIDs []string
+	addresses     []shared.AddressKey
+}
+
+// steeringQueueLength bounds the packets read by the other sockets waiting for a listener
+const steeringQueueLength = 256
+
+func newSteeringGroup(steered func()) *steeringGroup {
+	return &steeringGroup{
+		steered:       steered,
+		peers:         make(map[shared.AddressKey]*steeringPeer),
+		addresses:     make(map[shared.AddressKey]shared.AddressKey),
+		connectionIDs: make(map[string]shared.AddressKey),
+	}
+}
+
+// owner returns the conn whose listener reads the packet received by conn from the address
+func (group *steeringGroup) owner(conn *steeringConn, packet []byte, addr net.Addr) *steeringConn {
+	address := shared.NewAddressKey(addr)
+	// only the short header packets, sent once the handshake is complete, carry just the
+	// connection ID; the parity packets of FEC are steered by their address
+	var connectionID string
+	if quicPacket := shared.FECPayload(packet); len(quicPacket) >= 1+migrationConnectionIDLength && quicPacket[0]&0x80 == 0 {
+		connectionID = string(quicPacket[1 : 1+migrationConnectionIDLength])
+	}
+	group.mtx.RLock()
+	key, knownAddress := group.addresses[address]
+	knownID := false
+	if connectionID != "" {
+		var idKey shared.AddressKey
+		if idKey, knownID = group.connectionIDs[connectionID]; knownID {
+			key = idKey
+		}
+	}
+	// the connection ID is attributed, and the address recorded for the parity packets, the
+	// first time they are seen together
+	settled := connectionID == "" || knownID == knownAddress
+	owner := conn
+	if settled && (knownID || knownAddress) {
+		owner = group.peers[key].conn
+	}
+	group.mtx.RUnlock()
+	if !settled {
+		owner = group.attribute(conn, connectionID, address)
+	}
+	if owner != conn && group.steered != nil {
+		group.steered()
+	}
+	return owner
+}
+
+// attribute records a connection ID seen from an address of its session or a new address seen with
+// one of its connection IDs, it returns the conn of the session
+func (group *steeringGroup) attribute(conn *steeringConn, connectionID string, address shared.AddressKey) *steeringConn {
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	key, known := group.connectionIDs[connectionID]
+	if !known {
+		// a new connection ID is only attributed to a session from one of its addresses
+		if key, known = group.addresses[address]; !known {
+			return conn
+		}
+		group.connectionIDs[connectionID] = key
+		group.peers[key].connectionIDs = append(group.peers[key].connectionIDs, connectionID)
+	}
+	peer := group.peers[key]
+	if _, ok := group.addresses[address]; !ok {
+		group.addresses[address] = key
+		peer.addresses = append(peer.addresses, address)
+	}
+	return peer.conn
+}
+
+// steeringConn is the packet conn of a socket of a steeringGroup, it reads the packets of the
+// sessions of its listener whichever socket of the group received them. The packets of the other
+// listeners are queued to their conn, whose read of its own socket is interrupted to return them.
+type steeringConn struct {
+	conn    net.PacketConn
+	group   *steeringGroup
+	index   int
+	steered chan steeredPacket
+}
+
+type steeredPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// newSteeringConn wraps the socket of the given index in the group
+func newSteeringConn(conn net.PacketConn, group *steeringGroup, index int) *steeringConn {
+	return &steeringConn{
+		conn:    conn,
+		group:   group,
+		index:   index,
+		steered: make(chan steeredPacket, steeringQueueLength),
+	}
+}
+
+// track starts steering the packets of the session of the address, accepted by the listener of the conn
+func (conn *steeringConn) track(addr net.Addr) {
+	group := conn.group
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	key := shared.NewAddressKey(addr)
+	if _, ok := group.peers[key]; ok {
+		return
+	}
+	group.peers[key] = &steeringPeer{conn: conn, addresses: []shared.AddressKey{key}}
+	group.addresses[key] = key
+}
+
+// forget stops steering the packets of the session of the address once closed
+func (conn *steeringConn) forget(addr net.Addr) {
+	group := conn.group
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	key := shared.NewAddressKey(addr)
+	peer, ok := group.peers[key]
+	if !ok {
+		return
+	}
+	for _, connectionID := range peer.connectionIDs {
+		delete(group.connectionIDs, connectionID)
+	}
+	for _, address := range peer.addresses {
+		if group.addresses[address] == key {
+			delete(group.addresses, address)
+		}
+	}
+	delete(group.peers, key)
+}
+
+func (conn *steeringConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case packet := <-conn.steered:
+			return copy(p, packet.data), packet.addr, nil
+		default:
+		}
+		n, addr, err := conn.conn.ReadFrom(p)
+		if err != nil {
+			// quic-go sets no deadline, the timeouts are the interruptions of steer
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				conn.conn.SetReadDeadline(time.Time{})
+				continue
+			}
+			return n, addr, err
+		}
+		if owner := conn.group.owner(conn, p[:n], addr); owner != conn {
+			owner.steer(steeredPacket{data: append([]byte(nil), p[:n]...), addr: addr})
+			continue
+		}
+		return n, addr, nil
+	}
+}
+
+// steer queues a packet read by another socket, it is dropped as by a full socket buffer when the
+// queue is full
+func (conn *steeringConn) steer(packet steeredPacket) {
+	select {
+	case conn.steered <- packet:
+		// the deadline is set once the packet is queued, after which ReadFrom clears it before
+		// looking at the queue
+		conn.conn.SetReadDeadline(time.Unix(1, 0))
+	default:
+	}
+}
+
+func (conn *steeringConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return conn.conn.WriteTo(p, addr)
+}
+
+func (conn *steeringConn) Close() error {
+	return conn.conn.Close()
+}
+
+// LocalAddr tells the sockets apart, quic-go gives the conns of the same local address a single listener
+func (conn *steeringConn) LocalAddr() net.Addr {
+	addr := conn.conn.LocalAddr()
+	if udpAddr, ok := addr.(*net.UDPAddr); ok && conn.index > 0 {
+		return &socketAddr{UDPAddr: udpAddr, index: conn.index}
+	}
+	return addr
+}
+
+// socketAddr is the local address of a socket of a group but the first one, the qlog traces leave
+// it out of the start of their sessions
+type socketAddr struct {
+	*net.UDPAddr
+	index int
+}
+
+func (addr *socketAddr) Network() string {
+	return fmt.Sprintf("udp socket %d", addr.index)
+}
+
+func (conn *steeringConn) SetDeadline(t time.Time) error {
+	return errors.New("deadlines are not supported by steering conns")
+}
+
+func (conn *steeringConn) SetReadDeadline(t time.Time) error {
+	return conn.SetDeadline(t)
+}
+
+func (conn *steeringConn) SetWriteDeadline(t time.Time) error {
+	return conn.SetDeadline(t)
+}
+
+// SetReadBuffer and SyscallConn let quic-go size the receive buffer of the socket
+func (conn *steeringConn) SetReadBuffer(bytes int) error {
+	return shared.SetReadBuffer(conn.conn, bytes)
+}
+
+func (conn *steeringConn) SyscallConn() (syscall.RawConn, error) {
+	return shared.SyscallConn(conn.conn)
+}
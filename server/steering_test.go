@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSteeringGroup(t *testing.T) {
+	steered := 0
+	group := newSteeringGroup(func() { steered++ })
+	first, second := newSteeringConn(listenLoopback(t), group, 0), newSteeringConn(listenLoopback(t), group, 1)
+	defer first.Close()
+	defer second.Close()
+	client, migrated, spoofer := listenLoopback(t), listenLoopback(t), listenLoopback(t)
+	// both conns are read at all times as by their listeners
+	type readPacket struct {
+		conn *steeringConn
+		data []byte
+		addr net.Addr
+	}
+	read := make(chan readPacket, 4)
+	for _, conn := range []*steeringConn{first, second} {
+		go func(conn *steeringConn) {
+			for {
+				buf := make([]byte, 1500)
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				read <- readPacket{conn: conn, data: buf[:n], addr: addr}
+			}
+		}(conn)
+	}
+	// expectRead sends the packet to a socket of the group and checks it is read by expected
+	expectRead := func(from *net.UDPConn, to, expected *steeringConn, packet []byte) {
+		t.Helper()
+		if _, err := from.WriteTo(packet, to.conn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case received := <-read:
+			if received.conn != expected || !bytes.Equal(received.data, packet) || received.addr.String() != from.LocalAddr().String() {
+				t.Fatalf("packet from %s read by socket %d, expected %d from %s", received.addr, received.conn.index, expected.index, from.LocalAddr())
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("packet not read")
+		}
+	}
+
+	first.track(client.LocalAddr())
+	expectRead(client, first, first, shortHeaderPacket(1))
+	// the packets of the session read by the other socket are handed to the one of the session
+	expectRead(migrated, second, first, shortHeaderPacket(1))
+	// and so are the parity packets from the new address, which carry no connection ID
+	expectRead(migrated, second, first, []byte{0x03, 0, 0, 0, 0, 1, 0, 0, 0, 1, 2, 0xff})
+	// a connection ID first seen from another address is not attributed to the session
+	expectRead(spoofer, second, second, shortHeaderPacket(2))
+	if steered != 2 {
+		t.Errorf("%d packets steered, expected 2", steered)
+	}
+
+	first.forget(client.LocalAddr())
+	if len(group.peers) != 0 || len(group.addresses) != 0 || len(group.connectionIDs) != 0 {
+		t.Errorf("session state left after forget: %d peers, %d addresses, %d connection IDs", len(group.peers), len(group.addresses), len(group.connectionIDs))
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/parvit/qpep/shared"
+)
+
+// sessionToken associates a pre-shared token to the name of the client that owns it
+type sessionToken struct {
+	name  string
+	token string
+}
+
+// loadSessionTokens reads the token list file, each line contains a client name and its token separated
+// by whitespace, empty lines and lines starting with # are ignored
+func loadSessionTokens(path string) ([]sessionToken, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var tokens []sessionToken
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<name> <token>\"", path, lineNum)
+		}
+		tokens = append(tokens, sessionToken{name: fields[0], token: fields[1]})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens defined", path)
+	}
+	return tokens, nil
+}
+
+// authenticateSession waits for the control stream of the session and verifies that the client
+// knows one of the tokens, the name associated to the matching token is returned
+func authenticateSession(session quic.Session, tokens []sessionToken) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), shared.QPEP_AUTH_TIMEOUT)
+	defer cancel()
+
+	stream, err := session.AcceptStream(ctx)
+	if err != nil {
+		return "", fmt.Errorf("no control stream: %w", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(shared.QPEP_AUTH_TIMEOUT))
+
+	version := make([]byte, 1)
+	if _, err = io.ReadFull(stream, version); err != nil {
+		return "", fmt.Errorf("read version: %w", err)
+	}
+	if version[0] != shared.QPEP_AUTH_VERSION {
+		return "", fmt.Errorf("unsupported authentication version %d", version[0])
+	}
+
+	challenge := make([]byte, shared.QPEP_AUTH_CHALLENGE_LENGTH)
+	if _, err = rand.Read(challenge); err != nil {
+		return "", err
+	}
+	if _, err = stream.Write(challenge); err != nil {
+		return "", err
+	}
+	response := make([]byte, shared.QPEP_AUTH_RESPONSE_LENGTH)
+	if _, err = io.ReadFull(stream, response); err != nil {
+		return "", fmt.Errorf("read response: %w", err)
+	}
+
+	name := ""
+	for _, entry := range tokens {
+		if shared.CheckAuthResponse(entry.token, challenge, response) {
+			name = entry.name
+		}
+	}
+	if name == "" {
+		stream.Write([]byte{shared.QPEP_AUTH_REJECTED})
+		return "", errors.New("invalid token")
+	}
+	if _, err = stream.Write([]byte{shared.QPEP_AUTH_OK}); err != nil {
+		return "", err
+	}
+	return name, nil
+}
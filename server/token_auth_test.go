@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/parvit/qpep/shared"
+)
+
+// startSessionPair returns the client and server ends of a QUIC session on the loopback interface
+func startSessionPair(t *testing.T) (quic.Session, quic.Session) {
+	t.Helper()
+	cert, key := newTestCertificate(t, "qpep-server", nil, func(template *x509.Certificate) {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	})
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		NextProtos:   []string{shared.QPEP_PROTOCOL},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), shared.QPEP_AUTH_TIMEOUT)
+	defer cancel()
+	clientSession, err := quic.DialAddrContext(ctx, listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{shared.QPEP_PROTOCOL}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSession, err := listener.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		clientSession.CloseWithError(0, "")
+		serverSession.CloseWithError(0, "")
+	})
+	return clientSession, serverSession
+}
+
+// authenticate runs the client side with the token, or the raw bytes when it is empty, against the server side
+func authenticate(t *testing.T, tokens []sessionToken, token string, raw []byte) (string, error, error) {
+	t.Helper()
+	clientSession, serverSession := startSessionPair(t)
+	clientErr := make(chan error, 1)
+	go func() {
+		stream, err := clientSession.OpenStreamSync(context.Background())
+		if err != nil {
+			clientErr <- err
+			return
+		}
+		if raw != nil {
+			_, err = stream.Write(raw)
+			clientErr <- err
+			return
+		}
+		clientErr <- shared.RespondAuthChallenge(stream, token)
+	}()
+	name, err := authenticateSession(serverSession, tokens)
+	return name, err, <-clientErr
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	tokens := []sessionToken{{name: "branch-office", token: "first-secret"}, {name: "laptop", token: "second-secret"}}
+
+	name, serverErr, clientErr := authenticate(t, tokens, "second-secret", nil)
+	if serverErr != nil || clientErr != nil || name != "laptop" {
+		t.Fatalf("authenticated as %q with %v / %v, expected laptop", name, serverErr, clientErr)
+	}
+	_, serverErr, clientErr = authenticate(t, tokens, "guessed-secret", nil)
+	if serverErr == nil || clientErr != shared.ErrAuthRejected {
+		t.Fatalf("invalid token authenticated with %v / %v, expected a rejection", serverErr, clientErr)
+	}
+	_, serverErr, _ = authenticate(t, tokens, "", []byte{shared.QPEP_AUTH_VERSION + 1})
+	if serverErr == nil || !strings.Contains(serverErr.Error(), "unsupported authentication version") {
+		t.Fatalf("unknown version authenticated with %v, expected a rejection", serverErr)
+	}
+}
+
+func TestAuthResponse(t *testing.T) {
+	challenge := bytes.Repeat([]byte{0x5a}, shared.QPEP_AUTH_CHALLENGE_LENGTH)
+	response := shared.ComputeAuthResponse("secret", challenge)
+	if len(response) != shared.QPEP_AUTH_RESPONSE_LENGTH || !shared.CheckAuthResponse("secret", challenge, response) {
+		t.Fatal("response of the token not accepted")
+	}
+	if shared.CheckAuthResponse("other", challenge, response) {
+		t.Error("response accepted for another token")
+	}
+	otherChallenge := append([]byte{}, challenge...)
+	otherChallenge[0] ^= 1
+	if shared.CheckAuthResponse("secret", otherChallenge, response) {
+		t.Error("response replayed for another challenge")
+	}
+	if shared.CheckAuthResponse("secret", challenge, response[:len(response)-1]) {
+		t.Error("truncated response accepted")
+	}
+}
+
+func TestLoadSessionTokens(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "tokens")
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tokens, err := loadSessionTokens(write("# clients\n\nbranch-office  first-secret\n\t laptop\tsecond-secret \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []sessionToken{{name: "branch-office", token: "first-secret"}, {name: "laptop", token: "second-secret"}}
+	if len(tokens) != len(expected) || tokens[0] != expected[0] || tokens[1] != expected[1] {
+		t.Fatalf("loaded %+v, expected %+v", tokens, expected)
+	}
+
+	if _, err = loadSessionTokens(write("branch-office first-secret\nlaptop\n")); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("line without token loaded with %v, expected an error on line 2", err)
+	}
+	if _, err = loadSessionTokens(write("# no clients yet\n")); err == nil {
+		t.Error("file without tokens loaded")
+	}
+	if _, err = loadSessionTokens(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file loaded")
+	}
+}
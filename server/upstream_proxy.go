@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// PROXY_HANDSHAKE_TIMEOUT bounds the handshake with an upstream proxy when the context has no earlier deadline
+const PROXY_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+const (
+	socks5Version         = 0x05
+	socks5NoAuth          = 0x00
+	socks5UserPassAuth    = 0x02
+	socks5NoAcceptable    = 0xff
+	socks5UserPassVersion = 0x01
+	socks5Connect         = 0x01
+	socks5AddrIPv4        = 0x01
+	socks5AddrDomain      = 0x03
+	socks5AddrIPv6        = 0x04
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5Dialer connects to the destinations through a SOCKS5 proxy, authenticating with Username
+// and Password when Username is set
+type SOCKS5Dialer struct {
+	Address  string
+	Username string
+	Password string
+	// Forward connects to the proxy, a DirectDialer with the default timeout when nil
+	Forward OutboundDialer
+	// HandshakeTimeout bounds the handshake with the proxy, PROXY_HANDSHAKE_TIMEOUT when 0
+	HandshakeTimeout time.Duration
+}
+
+func (dialer *SOCKS5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := forwardDialer(dialer.Forward).DialContext(withoutSourceAddr(ctx), "tcp", dialer.Address)
+	if err != nil {
+		return nil, fmt.Errorf("connect to SOCKS5 proxy %s: %w", dialer.Address, err)
+	}
+	err = withContext(ctx, conn, dialer.HandshakeTimeout, func() error {
+		return dialer.handshake(conn, address)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %w", dialer.Address, err)
+	}
+	return conn, nil
+}
+
+func (dialer *SOCKS5Dialer) handshake(conn net.Conn, address string) error {
+	host, portName, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portName)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %q", portName)
+	}
+
+	method := byte(socks5NoAuth)
+	if dialer.Username != "" {
+		method = socks5UserPassAuth
+	}
+	if _, err = conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+	if reply[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+	if method == socks5UserPassAuth {
+		if len(dialer.Username) > 255 || len(dialer.Password) > 255 {
+			return errors.New("username or password longer than 255 bytes")
+		}
+		request := []byte{socks5UserPassVersion, byte(len(dialer.Username))}
+		request = append(request, dialer.Username...)
+		request = append(request, byte(len(dialer.Password)))
+		request = append(request, dialer.Password...)
+		if _, err = conn.Write(request); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[0] != socks5UserPassVersion {
+			return fmt.Errorf("unexpected authentication version %d", reply[0])
+		}
+		if reply[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	request := []byte{socks5Version, socks5Connect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %s longer than 255 bytes", host)
+		}
+		request = append(request, socks5AddrDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5AddrIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5AddrIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+
+	// the bound address that ends the reply is not used, it is read to leave only the data in the connection
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		if reason, ok := socks5Replies[header[1]]; ok {
+			return fmt.Errorf("connect to %s: %s", address, reason)
+		}
+		return fmt.Errorf("connect to %s: reply %d", address, header[1])
+	}
+	var boundLength int
+	switch header[3] {
+	case socks5AddrIPv4:
+		boundLength = net.IPv4len
+	case socks5AddrIPv6:
+		boundLength = net.IPv6len
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		boundLength = int(length[0])
+	default:
+		return fmt.Errorf("unexpected address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, boundLength+2))
+	return err
+}
+
+// HTTPConnectDialer connects to the destinations through an HTTP proxy with the CONNECT method,
+// authenticating with Username and Password (basic authentication) when Username is set
+type HTTPConnectDialer struct {
+	Address  string
+	Username string
+	Password string
+	// Forward connects to the proxy, a DirectDialer with the default timeout when nil
+	Forward OutboundDialer
+	// HandshakeTimeout bounds the handshake with the proxy, PROXY_HANDSHAKE_TIMEOUT when 0
+	HandshakeTimeout time.Duration
+}
+
+func (dialer *HTTPConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := forwardDialer(dialer.Forward).DialContext(withoutSourceAddr(ctx), "tcp", dialer.Address)
+	if err != nil {
+		return nil, fmt.Errorf("connect to HTTP proxy %s: %w", dialer.Address, err)
+	}
+	var reader *bufio.Reader
+	err = withContext(ctx, conn, dialer.HandshakeTimeout, func() error {
+		request := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: address},
+			Host:   address,
+			Header: make(http.Header),
+		}
+		if dialer.Username != "" {
+			credentials := base64.StdEncoding.EncodeToString([]byte(dialer.Username + ":" + dialer.Password))
+			request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+		}
+		if err := request.Write(conn); err != nil {
+			return err
+		}
+		reader = bufio.NewReader(conn)
+		response, err := http.ReadResponse(reader, request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("CONNECT to %s refused: %s", address, response.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %w", dialer.Address, err)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns first the data of the destination read with the proxy response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+func (conn *bufferedConn) CloseWrite() error {
+	return closeWrite(conn.Conn)
+}
+
+func forwardDialer(forward OutboundDialer) OutboundDialer {
+	if forward == nil {
+		return &DirectDialer{Timeout: DEFAULT_OUTBOUND_TIMEOUT}
+	}
+	return forward
+}
+
+// withContext runs the proxy handshake on conn, which is interrupted when ctx is done or, without an
+// earlier deadline, after timeout or PROXY_HANDSHAKE_TIMEOUT when it is 0
+func withContext(ctx context.Context, conn net.Conn, timeout time.Duration, handshake func() error) error {
+	if timeout == 0 {
+		timeout = PROXY_HANDSHAKE_TIMEOUT
+	}
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	err := handshake()
+	close(done)
+	<-watched
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	return err
+}
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+// standInProxy is a local SOCKS5 or HTTP CONNECT proxy requiring the user "qpep" with password "secret"
+type standInProxy struct {
+	listener    net.Listener
+	connections int32
+}
+
+func startStandInProxy(t *testing.T, serve func(proxy *standInProxy, conn net.Conn)) *standInProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &standInProxy{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&proxy.connections, 1)
+			go serve(proxy, conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return proxy
+}
+
+func (proxy *standInProxy) address() string {
+	return proxy.listener.Addr().String()
+}
+
+// relay connects the client to the destination, half-closing each direction on its own
+func relay(client net.Conn, destination string) {
+	upstream, err := net.Dial("tcp", destination)
+	if err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, client)
+		upstream.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(client, upstream)
+	client.(*net.TCPConn).CloseWrite()
+	<-done
+	upstream.Close()
+}
+
+func serveSOCKS5(proxy *standInProxy, conn net.Conn) {
+	defer conn.Close()
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if !strings.Contains(string(methods), string([]byte{socks5UserPassAuth})) {
+		conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return
+	}
+	conn.Write([]byte{socks5Version, socks5UserPassAuth})
+	reader := bufio.NewReader(conn)
+	reader.ReadByte()
+	username := readLengthPrefixed(reader)
+	password := readLengthPrefixed(reader)
+	if username != "qpep" || password != "secret" {
+		conn.Write([]byte{socks5UserPassVersion, 0x01})
+		return
+	}
+	conn.Write([]byte{socks5UserPassVersion, 0x00})
+
+	request := make([]byte, 4+net.IPv4len+2)
+	if _, err := io.ReadFull(reader, request); err != nil || request[3] != socks5AddrIPv4 {
+		return
+	}
+	destination := net.JoinHostPort(net.IP(request[4:8]).String(), strconv.Itoa(int(request[8])<<8|int(request[9])))
+	if probe, err := net.Dial("tcp", destination); err != nil {
+		conn.Write([]byte{socks5Version, 0x05, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	} else {
+		probe.Close()
+	}
+	conn.Write([]byte{socks5Version, 0x00, 0x00, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+	relay(conn, destination)
+}
+
+func readLengthPrefixed(reader *bufio.Reader) string {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return ""
+	}
+	value := make([]byte, length)
+	io.ReadFull(reader, value)
+	return string(value)
+}
+
+func serveHTTPConnect(proxy *standInProxy, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil || request.Method != http.MethodConnect {
+		return
+	}
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("qpep:secret"))
+	if request.Header.Get("Proxy-Authorization") != expected {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	relay(conn, request.Host)
+}
+
+func startEcho(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// checkEcho sends a payload, half-closes the connection and expects the payload back
+func checkEcho(t *testing.T, dialer OutboundDialer, address string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		t.Fatalf("dial %s: %s", address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	conn.Write([]byte("through the proxy"))
+	if err = closeWrite(conn); err != nil {
+		t.Fatalf("half-close: %s", err)
+	}
+	received, err := ioutil.ReadAll(conn)
+	if err != nil || string(received) != "through the proxy" {
+		t.Fatalf("received %q, %v", received, err)
+	}
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	proxy := startStandInProxy(t, serveSOCKS5)
+	echo := startEcho(t)
+
+	checkEcho(t, &SOCKS5Dialer{Address: proxy.address(), Username: "qpep", Password: "secret"}, echo.Addr().String())
+
+	_, err := (&SOCKS5Dialer{Address: proxy.address(), Username: "qpep", Password: "wrong"}).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("dial with a wrong password: %v", err)
+	}
+	_, err = (&SOCKS5Dialer{Address: proxy.address()}).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "no acceptable authentication method") {
+		t.Errorf("dial without credentials: %v", err)
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	_, err = (&SOCKS5Dialer{Address: proxy.address(), Username: "qpep", Password: "secret"}).DialContext(context.Background(), "tcp", closed.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("dial to a closed port: %v", err)
+	}
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	proxy := startStandInProxy(t, serveHTTPConnect)
+	echo := startEcho(t)
+
+	checkEcho(t, &HTTPConnectDialer{Address: proxy.address(), Username: "qpep", Password: "secret"}, echo.Addr().String())
+
+	_, err := (&HTTPConnectDialer{Address: proxy.address(), Username: "qpep", Password: "wrong"}).DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("dial with a wrong password: %v", err)
+	}
+}
+
+func TestProxyHandshakeCanceled(t *testing.T) {
+	// the stand-in accepts the connection but never answers the handshake
+	silent := startStandInProxy(t, func(proxy *standInProxy, conn net.Conn) {
+		defer conn.Close()
+		ioutil.ReadAll(conn)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := (&HTTPConnectDialer{Address: silent.address()}).DialContext(ctx, "tcp", "192.0.2.1:443")
+	if err == nil || time.Since(start) > testTimeout {
+		t.Fatalf("handshake with a silent proxy returned %v after %s", err, time.Since(start))
+	}
+
+	// without a deadline in the context the handshake timeout applies
+	start = time.Now()
+	_, err = (&SOCKS5Dialer{Address: silent.address(), HandshakeTimeout: 100 * time.Millisecond}).DialContext(context.Background(), "tcp", "192.0.2.1:443")
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > testTimeout {
+		t.Fatalf("handshake with a silent proxy and no deadline returned %v after %s", err, time.Since(start))
+	}
+}
+
+func TestSOCKS5AuthenticationVersion(t *testing.T) {
+	// the stand-in accepts the credentials with the version of the SOCKS5 messages
+	proxy := startStandInProxy(t, func(proxy *standInProxy, conn net.Conn) {
+		defer conn.Close()
+		greeting := make([]byte, 3)
+		io.ReadFull(conn, greeting)
+		conn.Write([]byte{socks5Version, socks5UserPassAuth})
+		reader := bufio.NewReader(conn)
+		reader.ReadByte()
+		readLengthPrefixed(reader)
+		readLengthPrefixed(reader)
+		conn.Write([]byte{socks5Version, 0x00})
+		ioutil.ReadAll(reader)
+	})
+	_, err := (&SOCKS5Dialer{Address: proxy.address(), Username: "qpep", Password: "secret"}).DialContext(context.Background(), "tcp", "192.0.2.1:443")
+	if err == nil || !strings.Contains(err.Error(), "unexpected authentication version 5") {
+		t.Errorf("dial with an authentication reply of version 5: %v", err)
+	}
+}
+
+// sourceRecorder records the source address carried by the contexts of its dials, which fail
+type sourceRecorder struct {
+	sources []*net.TCPAddr
+}
+
+func (recorder *sourceRecorder) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	recorder.sources = append(recorder.sources, SourceAddrFromContext(ctx))
+	return nil, fmt.Errorf("no route to %s", address)
+}
+
+func TestProxySourceAddr(t *testing.T) {
+	// the proxies are reached from the gateway address, the client source is left to the direct route
+	recorder := &sourceRecorder{}
+	ctx := WithSourceAddr(context.Background(), &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 40000})
+	(&SOCKS5Dialer{Address: "192.0.2.1:1080", Forward: recorder}).DialContext(ctx, "tcp", "192.0.2.2:443")
+	(&HTTPConnectDialer{Address: "192.0.2.1:3128", Forward: recorder}).DialContext(ctx, "tcp", "192.0.2.2:443")
+	recorder.DialContext(ctx, "tcp", "192.0.2.2:443")
+	if len(recorder.sources) != 3 || recorder.sources[0] != nil || recorder.sources[1] != nil || recorder.sources[2] == nil {
+		t.Fatalf("dials with the source addresses %v, expected none to the proxies", recorder.sources)
+	}
+}
+
+func TestEgressRules(t *testing.T) {
+	socksProxy := startStandInProxy(t, serveSOCKS5)
+	httpProxy := startStandInProxy(t, serveHTTPConnect)
+	viaSOCKS := startEcho(t)
+	viaHTTP := startEcho(t)
+	direct := startEcho(t)
+
+	rules := fmt.Sprintf(`
+proxies:
+  corporate: socks5://qpep:secret@%s
+  web: http://qpep:secret@%s
+rules:
+  - destinations: [127.0.0.1]
+    ports: ["%d"]
+    via: web
+  - destinations: [10.0.0.0/8]
+    via: direct
+  - ports: ["%d"]
+    via: corporate
+`, socksProxy.address(), httpProxy.address(), viaHTTP.Addr().(*net.TCPAddr).Port, viaSOCKS.Addr().(*net.TCPAddr).Port)
+	path := filepath.Join(t.TempDir(), "egress.yaml")
+	if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	egress, err := loadEgressRules(path, &DirectDialer{Timeout: testTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkEcho(t, egress, viaHTTP.Addr().String())
+	checkEcho(t, egress, viaSOCKS.Addr().String())
+	checkEcho(t, egress, direct.Addr().String())
+	if connections := atomic.LoadInt32(&httpProxy.connections); connections != 1 {
+		t.Errorf("HTTP proxy received %d connections, expected 1", connections)
+	}
+	if connections := atomic.LoadInt32(&socksProxy.connections); connections != 1 {
+		t.Errorf("SOCKS5 proxy received %d connections, expected 1", connections)
+	}
+	if route := egress.route("10.1.2.3:" + strconv.Itoa(viaSOCKS.Addr().(*net.TCPAddr).Port)); route != EGRESS_DIRECT {
+		t.Errorf("10.1.2.3 routed via %s, expected the first matching rule", route)
+	}
+
+	for _, invalid := range []string{
+		"rules:\n  - via: unknown\n",
+		"default: unknown\n",
+		"proxies:\n  direct: socks5://127.0.0.1:1080\n",
+		"proxies:\n  ftp: ftp://127.0.0.1:21\n",
+	} {
+		if err = ioutil.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = loadEgressRules(path, &DirectDialer{}); err == nil {
+			t.Errorf("egress file %q loaded without error", invalid)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package shared
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// ActiveStreams tracks the streams relaying a TCP connection so that they can be drained on shutdown
+type ActiveStreams struct {
+	mtx      sync.Mutex
+	draining bool
+	streams  map[quic.Stream]*activeStream
+	drained  chan struct{}
+}
+
+type activeStream struct {
+	// reset closes the TCP connection of the stream, wasReset is set once the stream has been reset
+	reset    func()
+	wasReset bool
+}
+
+// Add tracks the stream, it returns false once draining has started and the stream must be refused
+func (active *ActiveStreams) Add(stream quic.Stream) bool {
+	active.mtx.Lock()
+	defer active.mtx.Unlock()
+	if active.draining {
+		return false
+	}
+	if active.streams == nil {
+		active.streams = make(map[quic.Stream]*activeStream)
+	}
+	active.streams[stream] = &activeStream{}
+	return true
+}
+
+// SetReset sets the function resetting the TCP connection of the stream when the stream is reset at the
+// end of the grace period, which unblocks the reads of a connection whose other side is silent. It is
+// called right away when the stream has already been reset.
+func (active *ActiveStreams) SetReset(stream quic.Stream, reset func()) {
+	active.mtx.Lock()
+	tracked, ok := active.streams[stream]
+	if ok {
+		tracked.reset = reset
+	}
+	active.mtx.Unlock()
+	if ok && tracked.wasReset {
+		reset()
+	}
+}
+
+// Remove stops tracking the stream once both of its directions are closed
+func (active *ActiveStreams) Remove(stream quic.Stream) {
+	active.mtx.Lock()
+	defer active.mtx.Unlock()
+	delete(active.streams, stream)
+	if active.drained != nil && len(active.streams) == 0 {
+		close(active.drained)
+		active.drained = nil
+	}
+}
+
+// Drain refuses new streams and waits for the active ones to finish until ctx is done, the streams
+// still active then are reset with QPEP_ERROR_SHUTDOWN along with their TCP connection; it returns the
+// number of streams reset
+func (active *ActiveStreams) Drain(ctx context.Context) int {
+	active.mtx.Lock()
+	active.draining = true
+	if len(active.streams) == 0 {
+		active.mtx.Unlock()
+		return 0
+	}
+	drained := make(chan struct{})
+	active.drained = drained
+	active.mtx.Unlock()
+
+	select {
+	case <-drained:
+		return 0
+	case <-ctx.Done():
+	}
+
+	active.mtx.Lock()
+	streams := make([]quic.Stream, 0, len(active.streams))
+	resets := make([]func(), 0, len(active.streams))
+	for stream, tracked := range active.streams {
+		streams = append(streams, stream)
+		tracked.wasReset = true
+		if tracked.reset != nil {
+			resets = append(resets, tracked.reset)
+		}
+	}
+	active.mtx.Unlock()
+	for _, stream := range streams {
+		stream.CancelRead(QPEP_ERROR_SHUTDOWN)
+		stream.CancelWrite(QPEP_ERROR_SHUTDOWN)
+	}
+	for _, reset := range resets {
+		reset()
+	}
+	return len(streams)
+}
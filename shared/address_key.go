@@ -0,0 +1,25 @@
+package shared
+
+import "net"
+
+// AddressKey identifies a UDP address in maps without allocating on each packet
+type AddressKey struct {
+	ip   [net.IPv6len]byte
+	port int
+}
+
+// NewAddressKey returns the key of a UDP address, IPv4 addresses have the key of their IPv6 mapping
+func NewAddressKey(addr net.Addr) AddressKey {
+	var key AddressKey
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		// IPv4 addresses are mapped in IPv6 ones as To16 would, without its copy
+		if ip4 := udpAddr.IP.To4(); ip4 != nil {
+			key.ip[10], key.ip[11] = 0xff, 0xff
+			copy(key.ip[12:], ip4)
+		} else {
+			copy(key.ip[:], udpAddr.IP)
+		}
+		key.port = udpAddr.Port
+	}
+	return key
+}
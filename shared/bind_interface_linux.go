@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package shared
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// BindToInterface returns the socket control function binding the sockets to the interface
+func BindToInterface(name string) func(network, address string, rawConn syscall.RawConn) error {
+	return func(network, address string, rawConn syscall.RawConn) error {
+		var bindErr error
+		err := rawConn.Control(func(fd uintptr) {
+			bindErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, name)
+		})
+		if err != nil {
+			return err
+		}
+		return bindErr
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package shared
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// BindToInterface returns the socket control function binding the sockets to the interface
+func BindToInterface(name string) func(network, address string, rawConn syscall.RawConn) error {
+	return func(network, address string, rawConn syscall.RawConn) error {
+		return fmt.Errorf("binding to interface %s is only supported on linux", name)
+	}
+}
@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/parvit/qpep/flows"
+)
+
+// CloseReason classifies the error that ended a copy between a TCP connection and a QUIC stream.
+// An empty reason is returned when the copy was interrupted because the other side was closed first.
+func CloseReason(err error) string {
+	if err == nil || errors.Is(err, io.EOF) {
+		return flows.CLOSE_FIN
+	}
+	var streamErr quic.StreamError
+	if errors.As(err, &streamErr) && streamErr.Canceled() {
+		if streamErr.ErrorCode() == QPEP_ERROR_NONE {
+			return flows.CLOSE_FIN
+		}
+		return flows.CLOSE_RST
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return flows.CLOSE_RST
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return flows.CLOSE_TIMEOUT
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return ""
+	}
+	return flows.CLOSE_ERROR
+}
@@ -0,0 +1,24 @@
+package shared
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+const CONNECTION_ID_LENGTH = 8
+
+// ConnectionID identifies a proxied TCP connection in the logs of both client and server
+type ConnectionID [CONNECTION_ID_LENGTH]byte
+
+// NewConnectionID returns a random connection ID
+func NewConnectionID() ConnectionID {
+	var id ConnectionID
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (id ConnectionID) String() string {
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package shared
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetDontFragment sets the don't fragment bit on the packets of the UDP socket whatever the path
+// MTU known to the system, the path MTU discovery then learns the size of the packets crossing the
+// path rather than of their fragments
+func SetDontFragment(conn net.PacketConn) error {
+	rawConn, err := SyscallConn(conn)
+	if err != nil {
+		return err
+	}
+	// a dual stack socket takes both options, an IPv4 socket only the first one
+	var errIPv4, errIPv6 error
+	err = rawConn.Control(func(fd uintptr) {
+		errIPv4 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+		errIPv6 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+	})
+	if err != nil {
+		return err
+	}
+	if errIPv4 != nil && errIPv6 != nil {
+		return errIPv4
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package shared
+
+import (
+	"errors"
+	"net"
+)
+
+// SetDontFragment sets the don't fragment bit on the packets of the UDP socket whatever the path
+// MTU known to the system, the path MTU discovery then learns the size of the packets crossing the
+// path rather than of their fragments
+func SetDontFragment(conn net.PacketConn) error {
+	return errors.New("setting the don't fragment bit is only supported on linux")
+}
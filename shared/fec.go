@@ -0,0 +1,407 @@
+package shared
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// FEC_MAX_GROUP is the largest number of packets protected by a parity packet, used at low loss
+	FEC_MAX_GROUP = 16
+	// FEC_MIN_GROUP is the smallest number of packets protected by a parity packet, used at high loss
+	FEC_MIN_GROUP = 2
+	// FEC_MIN_LOSS is the loss reported by the peer below which no parity packet is sent
+	FEC_MIN_LOSS = 0.005
+	// FEC_FLUSH_INTERVAL is the longest a parity packet waits for its group to be complete, it
+	// bounds the time to recover the last packets of a burst
+	FEC_FLUSH_INTERVAL = 5 * time.Millisecond
+
+	// the groups are sized to expect a quarter of a loss each, so that most have at most the single
+	// loss a parity packet can recover
+	fecGroupLoss = 0.25
+	// the loss is averaged over windows of packets, the last window weighing a quarter
+	fecLossWindow = 64
+	fecLossWeight = 0.25
+	// fecGroupsKept bounds the groups still waiting for their packets
+	fecGroupsKept = 64
+	// the header is the type, the loss report, the sequence and group numbers and the index of the
+	// packet in its group, or the number of packets of the group for parity packets
+	fecHeaderLength = 11
+)
+
+// Types of the FEC packets, the two high bits are clear so that they are never taken for QUIC
+// packets, which have either the long header or the fixed bit set
+const (
+	fecTypePlain  = 0x01
+	fecTypeData   = 0x02
+	fecTypeParity = 0x03
+)
+
+// QPEP_MESSAGE_FEC is the datagram sent by the client to ask for FEC on its session, the server
+// answers with the same datagram when it supports it
+const QPEP_MESSAGE_FEC = 0x02
+
+// FECPayload returns the QUIC packet carried by a packet received on the socket of a FECConn, nil
+// for the parity packets
+func FECPayload(packet []byte) []byte {
+	if len(packet) == 0 || packet[0]&0xc0 != 0 {
+		return packet
+	}
+	if len(packet) < fecHeaderLength || (packet[0] != fecTypePlain && packet[0] != fecTypeData) {
+		return nil
+	}
+	return packet[fecHeaderLength:]
+}
+
+// FECConn protects the QUIC packets sent to the enabled addresses with XOR parity packets, each
+// recovering a single lost packet of its group. The peers report the loss they observe in every
+// packet, and the groups are smaller when it is higher. The FEC packets received are decoded from
+// any address, the parity packets are only used from the enabled addresses.
+type FECConn struct {
+	conn      net.PacketConn
+	recovered func()
+
+	mtx   sync.RWMutex
+	peers map[AddressKey]*fecPeer
+
+	// pending is the packet recovered by the last read, ReadFrom is called by a single goroutine
+	// as quic-go does
+	pending     []byte
+	pendingAddr net.Addr
+	// buf receives the packets, the FEC header making them larger than the QUIC packets read
+	buf []byte
+}
+
+// NewFECConn wraps a packet conn, recovered is called for each packet recovered when not nil
+func NewFECConn(conn net.PacketConn, recovered func()) *FECConn {
+	return &FECConn{
+		conn:      conn,
+		recovered: recovered,
+		peers:     make(map[AddressKey]*fecPeer),
+	}
+}
+
+// Enable starts encoding the packets sent to the address, once the peer has accepted to decode them
+func (conn *FECConn) Enable(addr net.Addr) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	key := NewAddressKey(addr)
+	if _, ok := conn.peers[key]; !ok {
+		conn.peers[key] = &fecPeer{conn: conn.conn, addr: addr, groups: make(map[uint32]*fecGroup)}
+	}
+}
+
+// Disable stops encoding the packets sent to the address
+func (conn *FECConn) Disable(addr net.Addr) {
+	conn.mtx.Lock()
+	key := NewAddressKey(addr)
+	peer := conn.peers[key]
+	delete(conn.peers, key)
+	conn.mtx.Unlock()
+	if peer != nil {
+		peer.close()
+	}
+}
+
+func (conn *FECConn) peer(addr net.Addr) *fecPeer {
+	conn.mtx.RLock()
+	defer conn.mtx.RUnlock()
+	return conn.peers[NewAddressKey(addr)]
+}
+
+func (conn *FECConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		if conn.pending != nil {
+			n := copy(p, conn.pending)
+			addr := conn.pendingAddr
+			conn.pending, conn.pendingAddr = nil, nil
+			return n, addr, nil
+		}
+		if len(conn.buf) < len(p)+fecHeaderLength {
+			conn.buf = make([]byte, len(p)+fecHeaderLength)
+		}
+		n, addr, err := conn.conn.ReadFrom(conn.buf)
+		if err != nil || n == 0 || conn.buf[0]&0xc0 != 0 {
+			return copy(p, conn.buf[:n]), addr, err
+		}
+		if n < fecHeaderLength {
+			continue
+		}
+		if peer := conn.peer(addr); peer != nil {
+			if recovered := peer.receive(conn.buf[:n]); recovered != nil {
+				conn.pending, conn.pendingAddr = recovered, addr
+				if conn.recovered != nil {
+					conn.recovered()
+				}
+			}
+		}
+		if conn.buf[0] != fecTypePlain && conn.buf[0] != fecTypeData {
+			continue
+		}
+		return copy(p, conn.buf[fecHeaderLength:n]), addr, nil
+	}
+}
+
+func (conn *FECConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if peer := conn.peer(addr); peer != nil {
+		return peer.write(p)
+	}
+	return conn.conn.WriteTo(p, addr)
+}
+
+func (conn *FECConn) Close() error {
+	conn.mtx.Lock()
+	for key, peer := range conn.peers {
+		peer.close()
+		delete(conn.peers, key)
+	}
+	conn.mtx.Unlock()
+	return conn.conn.Close()
+}
+
+func (conn *FECConn) LocalAddr() net.Addr {
+	return conn.conn.LocalAddr()
+}
+
+func (conn *FECConn) SetDeadline(t time.Time) error {
+	return conn.conn.SetDeadline(t)
+}
+
+func (conn *FECConn) SetReadDeadline(t time.Time) error {
+	return conn.conn.SetReadDeadline(t)
+}
+
+func (conn *FECConn) SetWriteDeadline(t time.Time) error {
+	return conn.conn.SetWriteDeadline(t)
+}
+
+func (conn *FECConn) SetReadBuffer(bytes int) error {
+	return SetReadBuffer(conn.conn, bytes)
+}
+
+func (conn *FECConn) SyscallConn() (syscall.RawConn, error) {
+	return SyscallConn(conn.conn)
+}
+
+// fecPeer is the state of the packets exchanged with an enabled address
+type fecPeer struct {
+	conn net.PacketConn
+	addr net.Addr
+
+	mtx    sync.Mutex
+	closed bool
+	// sequence is the number of the next packet sent, the packets of group are protected by parity
+	// once it has size packets, or when flushed by the timer
+	sequence uint32
+	group    uint32
+	count    int
+	size     int
+	parity   []byte
+	timer    *time.Timer
+	// remoteLoss is the loss reported by the peer, loss the one observed on the packets received
+	remoteLoss float64
+	loss       float64
+	receiving  bool
+	highest    uint32
+	expected   int
+	received   int
+	groups     map[uint32]*fecGroup
+}
+
+// fecGroup is a group of received packets, xor accumulates its packets and its parity
+type fecGroup struct {
+	size     int
+	indexes  uint32
+	parity   bool
+	xor      []byte
+	complete bool
+}
+
+// fecGroupSize returns the number of packets protected by each parity packet at the loss
+func fecGroupSize(loss float64) int {
+	if loss < FEC_MIN_LOSS {
+		return 0
+	}
+	size := int(fecGroupLoss / loss)
+	if size < FEC_MIN_GROUP {
+		return FEC_MIN_GROUP
+	}
+	if size > FEC_MAX_GROUP {
+		return FEC_MAX_GROUP
+	}
+	return size
+}
+
+// xorInto adds src to dst from offset, dst is extended with zeros to fit
+func xorInto(dst []byte, offset int, src []byte) []byte {
+	for len(dst) < offset+len(src) {
+		dst = append(dst, 0)
+	}
+	for i, b := range src {
+		dst[offset+i] ^= b
+	}
+	return dst
+}
+
+// xorPacket adds the length and the content of a packet to a parity
+func xorPacket(parity []byte, packet []byte) []byte {
+	return xorInto(xorInto(parity, 0, []byte{byte(len(packet) >> 8), byte(len(packet))}), 2, packet)
+}
+
+// packet encodes the next packet sent, the loss report is the loss observed on the packets of the peer
+func (peer *fecPeer) packet(packetType byte, index int, payload []byte) []byte {
+	packet := make([]byte, fecHeaderLength+len(payload))
+	packet[0] = packetType
+	packet[1] = byte(math.Min(255, math.Ceil(peer.loss*256)))
+	binary.BigEndian.PutUint32(packet[2:], peer.sequence)
+	binary.BigEndian.PutUint32(packet[6:], peer.group)
+	packet[10] = byte(index)
+	copy(packet[fecHeaderLength:], payload)
+	peer.sequence++
+	return packet
+}
+
+func (peer *fecPeer) write(p []byte) (int, error) {
+	peer.mtx.Lock()
+	defer peer.mtx.Unlock()
+	if peer.count == 0 {
+		// the size of the groups follows the loss reported by the peer
+		peer.size = fecGroupSize(peer.remoteLoss)
+	}
+	if peer.size == 0 {
+		_, err := peer.conn.WriteTo(peer.packet(fecTypePlain, 0, p), peer.addr)
+		return len(p), err
+	}
+	_, err := peer.conn.WriteTo(peer.packet(fecTypeData, peer.count, p), peer.addr)
+	peer.parity = xorPacket(peer.parity, p)
+	peer.count++
+	if peer.count == peer.size {
+		peer.flush()
+	} else if peer.count == 1 {
+		group := peer.group
+		peer.timer = time.AfterFunc(FEC_FLUSH_INTERVAL, func() {
+			peer.mtx.Lock()
+			defer peer.mtx.Unlock()
+			if group == peer.group && !peer.closed {
+				peer.flush()
+			}
+		})
+	}
+	return len(p), err
+}
+
+// flush sends the parity packet of the current group and starts the next one
+func (peer *fecPeer) flush() {
+	if peer.count == 0 {
+		return
+	}
+	peer.conn.WriteTo(peer.packet(fecTypeParity, peer.count, peer.parity), peer.addr)
+	if peer.timer != nil {
+		peer.timer.Stop()
+		peer.timer = nil
+	}
+	peer.group++
+	peer.count = 0
+	peer.parity = peer.parity[:0]
+}
+
+func (peer *fecPeer) close() {
+	peer.mtx.Lock()
+	defer peer.mtx.Unlock()
+	peer.closed = true
+	if peer.timer != nil {
+		peer.timer.Stop()
+	}
+}
+
+// receive handles a FEC packet of the peer, it returns the packet of its group recovered with it
+func (peer *fecPeer) receive(packet []byte) []byte {
+	peer.mtx.Lock()
+	defer peer.mtx.Unlock()
+	peer.remoteLoss = float64(packet[1]) / 256
+	peer.countReceived(binary.BigEndian.Uint32(packet[2:]))
+	if packet[0] != fecTypeData && packet[0] != fecTypeParity {
+		return nil
+	}
+	group := peer.receivedGroup(binary.BigEndian.Uint32(packet[6:]))
+	index := int(packet[10])
+	if group == nil || group.complete || index >= 32 {
+		return nil
+	}
+	if packet[0] == fecTypeData {
+		if group.indexes&(1<<index) != 0 {
+			return nil
+		}
+		group.indexes |= 1 << index
+		group.xor = xorPacket(group.xor, packet[fecHeaderLength:])
+	} else {
+		if group.parity || index == 0 {
+			return nil
+		}
+		group.parity, group.size = true, index
+		group.xor = xorInto(group.xor, 0, packet[fecHeaderLength:])
+	}
+	if !group.parity {
+		return nil
+	}
+	received := bits.OnesCount32(group.indexes)
+	if received < group.size-1 {
+		return nil
+	}
+	group.complete = true
+	xor := group.xor
+	group.xor = nil
+	if received == group.size || len(xor) < 2 {
+		return nil
+	}
+	length := int(xor[0])<<8 | int(xor[1])
+	if length == 0 || length > len(xor)-2 {
+		return nil
+	}
+	return xor[2 : 2+length]
+}
+
+// countReceived updates the loss observed from the sequence numbers of the packets received
+func (peer *fecPeer) countReceived(sequence uint32) {
+	if !peer.receiving {
+		peer.receiving, peer.highest = true, sequence
+		peer.expected, peer.received = 1, 1
+		return
+	}
+	if ahead := int32(sequence - peer.highest); ahead > 0 {
+		peer.expected += int(ahead)
+		peer.highest = sequence
+	}
+	peer.received++
+	if peer.expected < fecLossWindow {
+		return
+	}
+	lost := peer.expected - peer.received
+	if lost < 0 {
+		lost = 0
+	}
+	peer.loss = (1-fecLossWeight)*peer.loss + fecLossWeight*float64(lost)/float64(peer.expected)
+	peer.expected, peer.received = 0, 0
+}
+
+// receivedGroup returns the state of a group, nil when it is older than the groups kept
+func (peer *fecPeer) receivedGroup(id uint32) *fecGroup {
+	if group, ok := peer.groups[id]; ok {
+		return group
+	}
+	for kept := range peer.groups {
+		if age := int32(id - kept); age >= fecGroupsKept {
+			delete(peer.groups, kept)
+		} else if age <= -fecGroupsKept {
+			return nil
+		}
+	}
+	group := &fecGroup{}
+	peer.groups[id] = group
+	return group
+}
@@ -0,0 +1,116 @@
+package shared
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+// droppingConn drops the packets selected by drop
+type droppingConn struct {
+	*net.UDPConn
+	drop    func(packet []byte) bool
+	dropped int
+}
+
+func (conn *droppingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if conn.drop(p) {
+		conn.dropped++
+		return len(p), nil
+	}
+	return conn.UDPConn.WriteTo(p, addr)
+}
+
+func TestFECGroupSize(t *testing.T) {
+	for _, test := range []struct {
+		loss float64
+		size int
+	}{
+		{0, 0},
+		{0.004, 0},
+		{0.01, FEC_MAX_GROUP},
+		{0.05, 5},
+		{0.1, 2},
+		{0.5, FEC_MIN_GROUP},
+	} {
+		if size := fecGroupSize(test.loss); size != test.size {
+			t.Errorf("group size %d at loss %g, expected %d", size, test.loss, test.size)
+		}
+	}
+}
+
+func TestFECRecovery(t *testing.T) {
+	recovered := 0
+	senderSocket, receiverSocket := listenLoopback(t), listenLoopback(t)
+	// the groups are of 2 packets and their parity, the second packet of every other group is lost
+	dropping := &droppingConn{UDPConn: senderSocket, drop: func(packet []byte) bool {
+		return packet[0] == fecTypeData && packet[9]%2 == 0 && packet[10] == 1
+	}}
+	sender := NewFECConn(dropping, nil)
+	receiver := NewFECConn(receiverSocket, func() { recovered++ })
+	sender.Enable(receiver.LocalAddr())
+	receiver.Enable(sender.LocalAddr())
+	sender.peer(receiver.LocalAddr()).remoteLoss = 0.1
+
+	// QUIC packets are not encoded to the other addresses
+	other := listenLoopback(t)
+	buf := make([]byte, 1500)
+	quicPacket := append([]byte{0x40}, bytes.Repeat([]byte{1}, 100)...)
+	if _, err := sender.WriteTo(quicPacket, other.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := other.ReadFrom(buf); err != nil || !bytes.Equal(buf[:n], quicPacket) {
+		t.Fatalf("packet to a disabled address changed: %v", err)
+	}
+
+	var sent [][]byte
+	for i := 0; i < 60; i++ {
+		packet := append([]byte{0x40}, bytes.Repeat([]byte{byte(i)}, 100+i*20)...)
+		sent = append(sent, packet)
+		if _, err := sender.WriteTo(packet, receiver.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := make(map[string]bool)
+	for len(received) < len(sent) {
+		n, addr, err := receiver.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("received %d of %d packets: %s", len(received), len(sent), err)
+		}
+		if addr.String() != sender.LocalAddr().String() {
+			t.Fatalf("packet from %s, expected %s", addr, sender.LocalAddr())
+		}
+		received[string(buf[:n])] = true
+	}
+	for i, packet := range sent {
+		if !received[string(packet)] {
+			t.Errorf("packet %d not received", i)
+		}
+	}
+	if recovered != dropping.dropped || recovered == 0 {
+		t.Errorf("recovered %d packets, %d were lost", recovered, dropping.dropped)
+	}
+
+	// the loss observed by the receiver is reported to the sender with the next packet
+	if _, err := receiver.WriteTo(quicPacket, sender.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := sender.ReadFrom(buf); err != nil || !bytes.Equal(buf[:n], quicPacket) {
+		t.Fatalf("packet from the receiver not received: %v", err)
+	}
+	if size := fecGroupSize(sender.peer(receiver.LocalAddr()).remoteLoss); size == 0 || size == FEC_MAX_GROUP {
+		t.Errorf("group size %d after the loss report", size)
+	}
+}
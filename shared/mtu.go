@@ -0,0 +1,154 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/parvit/qpep/logger"
+)
+
+const (
+	// MIN_PACKET_SIZE is the size of the first QUIC packets of a session over IPv4, quic-go sends
+	// them before any probing and can't send smaller ones
+	MIN_PACKET_SIZE = 1252
+	// MAX_PACKET_SIZE is the largest QUIC packet sent by quic-go, the path MTU discovery probes up to it
+	MAX_PACKET_SIZE = 1452
+)
+
+// MinPacketSize returns the smallest UDP payload a path must carry for the QUIC sessions, the FEC
+// header being added to the QUIC packets when enabled
+func MinPacketSize(fec bool) int {
+	if fec {
+		return MIN_PACKET_SIZE + fecHeaderLength
+	}
+	return MIN_PACKET_SIZE
+}
+
+// ValidateMaxPacketSize checks that the QUIC sessions can be opened with UDP payloads up to the
+// size, 0 leaving the size to the path MTU discovery
+func ValidateMaxPacketSize(size int, fec bool) error {
+	if size != 0 && size < MinPacketSize(fec) {
+		return fmt.Errorf("max packet size %d is below the %d bytes of the first QUIC packets", size, MinPacketSize(fec))
+	}
+	return nil
+}
+
+// MTUConn drops the packets larger than the maximum size, and those refused by the socket as too
+// large, as a path with a smaller MTU would: the path MTU discovery of quic-go then settles below
+// them while the other packets are never that large. quic-go 0.20 has no setting for the size of
+// its packets and closes the session on a write error, the drops are left to its loss recovery
+type MTUConn struct {
+	conn          net.PacketConn
+	maxPacketSize int
+	dropped       func()
+}
+
+// oobPacketConn is a packet conn sending and receiving the ancillary data of the packets, quic-go
+// uses it for ECN and the packet info when the conn it is given implements it
+type oobPacketConn interface {
+	net.PacketConn
+	ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error)
+	WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error)
+}
+
+// mtuOOBConn is a MTUConn over a conn with ancillary data, such as a *net.UDPConn, keeping it
+type mtuOOBConn struct {
+	*MTUConn
+	oobConn oobPacketConn
+}
+
+// NewMTUConn wraps a packet conn, the packets are not bounded when maxPacketSize is 0; dropped is
+// called for each packet dropped when set. The conns with ancillary data keep it through the wrapper
+func NewMTUConn(conn net.PacketConn, maxPacketSize int, dropped func()) net.PacketConn {
+	mtuConn := &MTUConn{conn: conn, maxPacketSize: maxPacketSize, dropped: dropped}
+	if oobConn, ok := conn.(oobPacketConn); ok {
+		return &mtuOOBConn{MTUConn: mtuConn, oobConn: oobConn}
+	}
+	return mtuConn
+}
+
+// oversized reports whether a packet is larger than the maximum size, counting it as dropped
+func (conn *MTUConn) oversized(p []byte, addr net.Addr) bool {
+	if conn.maxPacketSize == 0 || len(p) <= conn.maxPacketSize {
+		return false
+	}
+	conn.drop(p, addr, fmt.Sprintf("over the max packet size %d", conn.maxPacketSize))
+	return true
+}
+
+// refused reports whether the socket refused a packet as too large, counting it as dropped
+func (conn *MTUConn) refused(p []byte, addr net.Addr, err error) bool {
+	if !errors.Is(err, syscall.EMSGSIZE) {
+		return false
+	}
+	conn.drop(p, addr, "refused by the socket")
+	return true
+}
+
+func (conn *MTUConn) drop(p []byte, addr net.Addr, reason string) {
+	logger.Debug("Dropped a packet of %d bytes to %s, %s", len(p), addr, reason)
+	if conn.dropped != nil {
+		conn.dropped()
+	}
+}
+
+func (conn *MTUConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	return conn.conn.ReadFrom(p)
+}
+
+func (conn *MTUConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if conn.oversized(p, addr) {
+		return len(p), nil
+	}
+	n, err := conn.conn.WriteTo(p, addr)
+	if conn.refused(p, addr, err) {
+		return len(p), nil
+	}
+	return n, err
+}
+
+func (conn *mtuOOBConn) ReadMsgUDP(b, oob []byte) (int, int, int, *net.UDPAddr, error) {
+	return conn.oobConn.ReadMsgUDP(b, oob)
+}
+
+func (conn *mtuOOBConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (int, int, error) {
+	if conn.oversized(b, addr) {
+		return len(b), len(oob), nil
+	}
+	n, oobn, err := conn.oobConn.WriteMsgUDP(b, oob, addr)
+	if conn.refused(b, addr, err) {
+		return len(b), len(oob), nil
+	}
+	return n, oobn, err
+}
+
+func (conn *MTUConn) Close() error {
+	return conn.conn.Close()
+}
+
+func (conn *MTUConn) LocalAddr() net.Addr {
+	return conn.conn.LocalAddr()
+}
+
+func (conn *MTUConn) SetDeadline(t time.Time) error {
+	return conn.conn.SetDeadline(t)
+}
+
+func (conn *MTUConn) SetReadDeadline(t time.Time) error {
+	return conn.conn.SetReadDeadline(t)
+}
+
+func (conn *MTUConn) SetWriteDeadline(t time.Time) error {
+	return conn.conn.SetWriteDeadline(t)
+}
+
+func (conn *MTUConn) SetReadBuffer(bytes int) error {
+	return SetReadBuffer(conn.conn, bytes)
+}
+
+func (conn *MTUConn) SyscallConn() (syscall.RawConn, error) {
+	return SyscallConn(conn.conn)
+}
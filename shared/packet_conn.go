@@ -0,0 +1,29 @@
+package shared
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errNotUDPSocket = errors.New("not a UDP socket")
+
+// SetReadBuffer sizes the receive buffer of the UDP socket under the packet conns that wrap one,
+// the wrappers forward it to let quic-go size the buffer without the optimizations of UDP sockets
+// that would bypass them
+func SetReadBuffer(conn net.PacketConn, bytes int) error {
+	if bufferConn, ok := conn.(interface{ SetReadBuffer(int) error }); ok {
+		return bufferConn.SetReadBuffer(bytes)
+	}
+	return errNotUDPSocket
+}
+
+// SyscallConn returns the raw connection of the UDP socket under the packet conns that wrap one
+func SyscallConn(conn net.PacketConn) (syscall.RawConn, error) {
+	if rawConn, ok := conn.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	}); ok {
+		return rawConn.SyscallConn()
+	}
+	return nil, errNotUDPSocket
+}
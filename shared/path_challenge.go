@@ -0,0 +1,43 @@
+package shared
+
+import "crypto/rand"
+
+// pathChallengeType starts the path challenges, the two high bits are clear so that they are never
+// taken for QUIC packets and the type is not one of the FEC packets
+const pathChallengeType = 0x04
+
+// PATH_NONCE_LENGTH is the length of the random nonce of a path challenge
+const PATH_NONCE_LENGTH = 8
+
+// NewPathChallenge returns the packet the server sends outside of the QUIC session to an address
+// the client may have migrated to, and its nonce; only the client can answer it on the session
+func NewPathChallenge() (nonce, packet []byte, err error) {
+	packet = make([]byte, 1+PATH_NONCE_LENGTH)
+	packet[0] = pathChallengeType
+	if _, err = rand.Read(packet[1:]); err != nil {
+		return nil, nil, err
+	}
+	return packet[1:], packet, nil
+}
+
+// ParsePathChallenge returns the nonce of a path challenge, false when the packet is not one
+func ParsePathChallenge(packet []byte) ([]byte, bool) {
+	if len(packet) != 1+PATH_NONCE_LENGTH || packet[0] != pathChallengeType {
+		return nil, false
+	}
+	return packet[1:], true
+}
+
+// PathResponse returns the QPEP_MESSAGE_PATH_RESPONSE datagram answering the challenge of the nonce
+func PathResponse(nonce []byte) []byte {
+	return append([]byte{QPEP_MESSAGE_PATH_RESPONSE}, nonce...)
+}
+
+// ParsePathResponse returns the nonce of a QPEP_MESSAGE_PATH_RESPONSE datagram, false when the
+// datagram is not one
+func ParsePathResponse(message []byte) ([]byte, bool) {
+	if len(message) != 1+PATH_NONCE_LENGTH || message[0] != QPEP_MESSAGE_PATH_RESPONSE {
+		return nil, false
+	}
+	return message[1:], true
+}
@@ -0,0 +1,238 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/lucas-clemente/quic-go/qlog"
+	"github.com/parvit/qpep/logger"
+)
+
+const (
+	QLOG_FILE_EXTENSION = ".sqlog"
+
+	// records of JSON text sequences (RFC 7464) start with the record separator
+	jsonSeqRecordSeparator = 0x1e
+)
+
+// QlogConfig selects the QUIC sessions traced to Directory, caps are in bytes and zero means unlimited
+type QlogConfig struct {
+	Directory    string
+	SampleRate   float64
+	MaxFileSize  int64
+	MaxTotalSize int64
+}
+
+// NewQlogTracer returns a tracer writing a qlog trace in JSON-SEQ format for each sampled session,
+// role is the prefix of the file names, which also contain the session ID and the peer address
+func NewQlogTracer(config QlogConfig, role string) (logging.Tracer, error) {
+	if err := os.MkdirAll(config.Directory, 0700); err != nil {
+		return nil, err
+	}
+	var totalSize int64
+	files, err := ioutil.ReadDir(config.Directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), QLOG_FILE_EXTENSION) {
+			totalSize += file.Size()
+		}
+	}
+
+	traces := &qlogTraces{config: config, role: role, totalSize: totalSize}
+	return &qlogTracer{Tracer: qlog.NewTracer(traces.newWriter), traces: traces}, nil
+}
+
+type qlogTraces struct {
+	totalSize int64
+
+	config QlogConfig
+	role   string
+	mtx    sync.Mutex
+	// writers created by TracerForConnection, waiting for StartedConnection to know their peer
+	pending map[string]*qlogWriter
+}
+
+func (traces *qlogTraces) newWriter(p logging.Perspective, connectionID []byte) io.WriteCloser {
+	if traces.config.SampleRate < 1 && rand.Float64() >= traces.config.SampleRate {
+		return nil
+	}
+	if traces.config.MaxTotalSize > 0 && atomic.LoadInt64(&traces.totalSize) >= traces.config.MaxTotalSize {
+		logger.Warning("qlog directory %s is over %d bytes, session not traced", traces.config.Directory, traces.config.MaxTotalSize)
+		return nil
+	}
+	writer := &qlogWriter{traces: traces, sessionID: hex.EncodeToString(connectionID), started: time.Now(), firstRecord: true}
+	traces.mtx.Lock()
+	if traces.pending == nil {
+		traces.pending = make(map[string]*qlogWriter)
+	}
+	traces.pending[writer.sessionID] = writer
+	traces.mtx.Unlock()
+	return writer
+}
+
+// setPeer names the trace file of the session once its peer is known
+func (traces *qlogTraces) setPeer(connectionID logging.ConnectionID, peer net.Addr) {
+	traces.mtx.Lock()
+	writer, ok := traces.pending[hex.EncodeToString(connectionID.Bytes())]
+	delete(traces.pending, hex.EncodeToString(connectionID.Bytes()))
+	traces.mtx.Unlock()
+	if ok {
+		writer.setPeer(peer.String())
+	}
+}
+
+func (traces *qlogTraces) forget(writer *qlogWriter) {
+	traces.mtx.Lock()
+	defer traces.mtx.Unlock()
+	if traces.pending[writer.sessionID] == writer {
+		delete(traces.pending, writer.sessionID)
+	}
+}
+
+// qlogTracer hooks the connection tracers to learn the peer of each traced session
+type qlogTracer struct {
+	logging.Tracer
+	traces *qlogTraces
+}
+
+func (tracer *qlogTracer) TracerForConnection(p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
+	connectionTracer := tracer.Tracer.TracerForConnection(p, odcid)
+	if connectionTracer == nil {
+		return nil
+	}
+	return &qlogConnectionTracer{ConnectionTracer: connectionTracer, traces: tracer.traces, odcid: odcid}
+}
+
+type qlogConnectionTracer struct {
+	logging.ConnectionTracer
+	traces *qlogTraces
+	odcid  logging.ConnectionID
+}
+
+func (tracer *qlogConnectionTracer) StartedConnection(local, remote net.Addr, srcConnID, destConnID logging.ConnectionID) {
+	tracer.traces.setPeer(tracer.odcid, remote)
+	tracer.ConnectionTracer.StartedConnection(local, remote, srcConnID, destConnID)
+}
+
+// qlogWriter buffers the trace until the peer is known, then writes it to its file as JSON-SEQ
+// records; the qlog tracer writes each record followed by a separate newline
+type qlogWriter struct {
+	traces    *qlogTraces
+	sessionID string
+	started   time.Time
+
+	mtx         sync.Mutex
+	peer        string
+	buffer      bytes.Buffer
+	file        *os.File
+	size        int64
+	firstRecord bool
+	atRecord    bool
+	truncated   bool
+	failed      bool
+}
+
+func (writer *qlogWriter) setPeer(peer string) {
+	writer.mtx.Lock()
+	defer writer.mtx.Unlock()
+	writer.peer = peer
+	writer.open()
+}
+
+func (writer *qlogWriter) Write(p []byte) (int, error) {
+	writer.mtx.Lock()
+	defer writer.mtx.Unlock()
+
+	var record bytes.Buffer
+	if !writer.atRecord && !bytes.Equal(p, []byte{'\n'}) {
+		record.WriteByte(jsonSeqRecordSeparator)
+		writer.atRecord = true
+	}
+	if writer.firstRecord {
+		p = bytes.Replace(p, []byte(`"qlog_format":"NDJSON"`), []byte(`"qlog_format":"JSON-SEQ"`), 1)
+		writer.firstRecord = false
+	}
+	record.Write(p)
+	if bytes.HasSuffix(p, []byte{'\n'}) {
+		writer.atRecord = false
+	}
+
+	if writer.file == nil {
+		writer.buffer.Write(record.Bytes())
+		return len(p), nil
+	}
+	writer.write(record.Bytes())
+	return len(p), nil
+}
+
+// open creates the trace file and flushes the buffered records, must be called with the lock held
+func (writer *qlogWriter) open() {
+	if writer.file != nil || writer.failed {
+		return
+	}
+	peer := writer.peer
+	if peer == "" {
+		peer = "unknown"
+	}
+	// ':' can't be used in file names on windows
+	peer = strings.NewReplacer(":", "_", "[", "", "]", "").Replace(peer)
+	name := fmt.Sprintf("%s_%s_%s_%s%s", writer.traces.role, writer.started.Format("20060102T150405"),
+		writer.sessionID, peer, QLOG_FILE_EXTENSION)
+	file, err := os.OpenFile(filepath.Join(writer.traces.config.Directory, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		logger.Error("Unable to create qlog trace: %s", err)
+		writer.failed = true
+		writer.buffer.Reset()
+		return
+	}
+	writer.file = file
+	buffered := writer.buffer.Bytes()
+	writer.buffer = bytes.Buffer{}
+	writer.write(buffered)
+}
+
+// write appends to the trace file until the file cap is reached, must be called with the lock held
+func (writer *qlogWriter) write(data []byte) {
+	if writer.truncated || writer.failed {
+		return
+	}
+	// the newline ending the last record is always written so that the trace stays well formed
+	maxFileSize := writer.traces.config.MaxFileSize
+	if maxFileSize > 0 && writer.size+int64(len(data)) > maxFileSize && !bytes.Equal(data, []byte{'\n'}) {
+		logger.Warning("qlog trace of session %s reached %d bytes, the rest is not traced", writer.sessionID, maxFileSize)
+		writer.truncated = true
+		return
+	}
+	n, err := writer.file.Write(data)
+	writer.size += int64(n)
+	atomic.AddInt64(&writer.traces.totalSize, int64(n))
+	if err != nil {
+		logger.Error("Unable to write qlog trace: %s", err)
+		writer.failed = true
+	}
+}
+
+func (writer *qlogWriter) Close() error {
+	writer.traces.forget(writer)
+	writer.mtx.Lock()
+	defer writer.mtx.Unlock()
+	writer.open()
+	if writer.file == nil {
+		return nil
+	}
+	return writer.file.Close()
+}
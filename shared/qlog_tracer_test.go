@@ -0,0 +1,141 @@
+package shared
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+func newTestQlogTraces(t *testing.T, config QlogConfig) *qlogTraces {
+	t.Helper()
+	tracer, err := NewQlogTracer(config, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracer.(*qlogTracer).traces
+}
+
+// writeRecord writes a record the way the qlog tracer does, followed by a separate newline
+func writeRecord(writer *qlogWriter, record string) {
+	writer.Write([]byte(record))
+	writer.Write([]byte{'\n'})
+}
+
+// readTraces returns the content of the traces in the directory by file name
+func readTraces(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+QLOG_FILE_EXTENSION))
+	if err != nil {
+		t.Fatal(err)
+	}
+	traces := make(map[string][]byte)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		traces[filepath.Base(path)] = data
+	}
+	return traces
+}
+
+func TestQlogSampling(t *testing.T) {
+	for _, test := range []struct {
+		rate     float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{0.5, 350, 650},
+		{1, 1000, 1000},
+	} {
+		traces := newTestQlogTraces(t, QlogConfig{Directory: t.TempDir(), SampleRate: test.rate})
+		sampled := 0
+		for i := 0; i < 1000; i++ {
+			if writer := traces.newWriter(logging.PerspectiveServer, []byte{byte(i >> 8), byte(i)}); writer != nil {
+				sampled++
+				writer.Close()
+			}
+		}
+		if sampled < test.min || sampled > test.max {
+			t.Errorf("sample rate %v: %d sessions of 1000 traced, expected between %d and %d", test.rate, sampled, test.min, test.max)
+		}
+	}
+}
+
+func TestQlogTrace(t *testing.T) {
+	dir := t.TempDir()
+	traces := newTestQlogTraces(t, QlogConfig{Directory: dir, SampleRate: 1})
+	writer := traces.newWriter(logging.PerspectiveServer, []byte{0xca, 0xfe}).(*qlogWriter)
+
+	// the records are buffered until the peer names the file
+	writeRecord(writer, `{"qlog_format":"NDJSON","qlog_version":"draft-02"}`)
+	if files := readTraces(t, dir); len(files) != 0 {
+		t.Fatalf("trace written before its peer is known: %v", files)
+	}
+	traces.setPeer(logging.ConnectionID{0xca, 0xfe}, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4242})
+	writeRecord(writer, `{"name":"transport:packet_sent"}`)
+	writer.Close()
+
+	files := readTraces(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("%d traces written, expected 1", len(files))
+	}
+	for name, data := range files {
+		if !strings.HasPrefix(name, "server_") || !strings.HasSuffix(name, "_cafe_2001_db8__1_4242"+QLOG_FILE_EXTENSION) {
+			t.Errorf("trace named %s, expected the role, the session and the peer", name)
+		}
+		expected := "\x1e{\"qlog_format\":\"JSON-SEQ\",\"qlog_version\":\"draft-02\"}\n\x1e{\"name\":\"transport:packet_sent\"}\n"
+		if string(data) != expected {
+			t.Errorf("trace %q, expected the JSON-SEQ records %q", data, expected)
+		}
+	}
+}
+
+func TestQlogSizeCaps(t *testing.T) {
+	dir := t.TempDir()
+	traces := newTestQlogTraces(t, QlogConfig{Directory: dir, SampleRate: 1, MaxFileSize: 100, MaxTotalSize: 120})
+	writer := traces.newWriter(logging.PerspectiveServer, []byte{0x01}).(*qlogWriter)
+	writer.setPeer("192.0.2.1:4242")
+	event := `{"name":"transport:packet_received","data":{"packet_size":1252}}`
+	for i := 0; i < 10; i++ {
+		writeRecord(writer, event)
+	}
+	writer.Close()
+
+	var size int64
+	for name, data := range readTraces(t, dir) {
+		size += int64(len(data))
+		if len(data) > 100 {
+			t.Errorf("trace %s of %d bytes, expected at most 100", name, len(data))
+		}
+		// the trace stops after a whole record
+		if !bytes.HasSuffix(data, []byte("}\n")) || bytes.Count(data, []byte{jsonSeqRecordSeparator}) != 1 {
+			t.Errorf("trace %s truncated as %q, expected the first record only", name, data)
+		}
+	}
+	if size != traces.totalSize {
+		t.Errorf("directory size %d, expected the %d bytes written", traces.totalSize, size)
+	}
+
+	// the sessions are no longer traced once the directory is over its cap, including after a restart
+	second := traces.newWriter(logging.PerspectiveServer, []byte{0x02}).(*qlogWriter)
+	second.setPeer("192.0.2.2:4242")
+	writeRecord(second, event)
+	writeRecord(second, event)
+	second.Close()
+	if writer := traces.newWriter(logging.PerspectiveServer, []byte{0x03}); writer != nil {
+		t.Error("session traced over the directory cap")
+	}
+	restarted := newTestQlogTraces(t, QlogConfig{Directory: dir, SampleRate: 1, MaxTotalSize: 120})
+	if restarted.totalSize != traces.totalSize {
+		t.Errorf("directory size %d after a restart, expected %d", restarted.totalSize, traces.totalSize)
+	}
+	if writer := restarted.newWriter(logging.PerspectiveServer, []byte{0x04}); writer != nil {
+		t.Error("session traced over the directory cap after a restart")
+	}
+}
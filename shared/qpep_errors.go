@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// Application error codes used by qpep when closing QUIC sessions and resetting streams,
+// CONNECTION_FAILED resets a stream whose TCP connection on the other end failed or could not be opened,
+// SHUTDOWN closes the sessions of a client or server shutting down and resets the streams not drained in time
+const (
+	QPEP_ERROR_NONE              quic.ErrorCode = 0x00
+	QPEP_ERROR_AUTH_FAILED       quic.ErrorCode = 0x01
+	QPEP_ERROR_POLICY_DENIED     quic.ErrorCode = 0x02
+	QPEP_ERROR_QUOTA_EXCEEDED    quic.ErrorCode = 0x03
+	QPEP_ERROR_ADMIN_ABORTED     quic.ErrorCode = 0x04
+	QPEP_ERROR_CONNECTION_FAILED quic.ErrorCode = 0x05
+	QPEP_ERROR_SHUTDOWN          quic.ErrorCode = 0x06
+)
+
+// IsNormalSessionClose reports whether the session error is an idle timeout or a close by either
+// side without error or on shutdown, quic-go doesn't export its error type so the message is matched
+func IsNormalSessionClose(err error) bool {
+	message := err.Error()
+	if message == "NO_ERROR: No recent network activity" {
+		return true
+	}
+	for _, code := range []quic.ErrorCode{QPEP_ERROR_NONE, QPEP_ERROR_SHUTDOWN} {
+		prefix := fmt.Sprintf("Application error %#x", uint64(code))
+		if message == prefix || strings.HasPrefix(message, prefix+":") {
+			return true
+		}
+	}
+	return false
+}
@@ -1,16 +1,27 @@
 package shared
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 )
 
 const QPEP_PREAMBLE_LENGTH = 2
 
+// QPEP_PROTOCOL is the ALPN protocol of the QUIC sessions, its version is the one of the stream
+// header. Version 2 added the connection ID and the traffic class, the peers of another version
+// then fail the TLS handshake instead of misreading the headers of the streams.
+const QPEP_PROTOCOL = "qpep/2"
+
+// QpepHeader is sent by the client at the start of every stream, the connection ID follows the
+// addresses and the traffic class the connection ID
 type QpepHeader struct {
-	SourceAddr *net.TCPAddr
-	DestAddr   *net.TCPAddr
+	SourceAddr   *net.TCPAddr
+	DestAddr     *net.TCPAddr
+	ConnectionID ConnectionID
+	Class        TrafficClass
 }
 
 func (header QpepHeader) ToBytes() []byte {
@@ -27,13 +38,16 @@ func (header QpepHeader) ToBytes() []byte {
 	byteOutput = append(byteOutput, ipToBytes(header.DestAddr.IP, destType)...)
 	byteOutput = append(byteOutput, portToBytes(header.DestAddr.Port)...)
 
+	byteOutput = append(byteOutput, header.ConnectionID[:]...)
+	byteOutput = append(byteOutput, byte(header.Class))
+
 	return byteOutput
 }
 
 func GetQpepHeader(stream io.Reader) (QpepHeader, error) {
 	header := QpepHeader{}
 	preamble := make([]byte, QPEP_PREAMBLE_LENGTH)
-	_, err := stream.Read(preamble)
+	_, err := io.ReadFull(stream, preamble)
 	if err != nil {
 		return header, err
 	}
@@ -54,9 +68,10 @@ func GetQpepHeader(stream io.Reader) (QpepHeader, error) {
 		destIpEnd = sourcePortEnd + net.IPv6len
 	}
 	destPortEnd := destIpEnd + 2
+	connectionIdEnd := destPortEnd + CONNECTION_ID_LENGTH
 
-	byteInput := make([]byte, destPortEnd)
-	_, err = stream.Read(byteInput)
+	byteInput := make([]byte, connectionIdEnd+1)
+	_, err = io.ReadFull(stream, byteInput)
 	if err != nil {
 		return header, err
 	}
@@ -66,37 +81,21 @@ func GetQpepHeader(stream io.Reader) (QpepHeader, error) {
 	destIPAddr := net.IP(byteInput[sourcePortEnd:destIpEnd])
 	destPort := int(binary.LittleEndian.Uint16(byteInput[destIpEnd:destPortEnd]))
 
-	srcAddr := &net.TCPAddr{IP: srcIPAddr, Port: srcPort}
-	dstAddr := &net.TCPAddr{IP: destIPAddr, Port: destPort}
-	return QpepHeader{SourceAddr: srcAddr, DestAddr: dstAddr}, nil
+	header.SourceAddr = &net.TCPAddr{IP: srcIPAddr, Port: srcPort}
+	header.DestAddr = &net.TCPAddr{IP: destIPAddr, Port: destPort}
+	copy(header.ConnectionID[:], byteInput[destPortEnd:connectionIdEnd])
+	header.Class = TrafficClass(byteInput[connectionIdEnd])
+	return header, nil
 }
 
-func QpepHeaderFromBytes(byteInput []byte) QpepHeader {
-	var sourceIpEnd int
-	if byteInput[0] == 0x04 {
-		sourceIpEnd = QPEP_PREAMBLE_LENGTH * +net.IPv4len
-	} else {
-		sourceIpEnd = QPEP_PREAMBLE_LENGTH + net.IPv6len
-	}
-	sourcePortEnd := sourceIpEnd + 2
-
-	var destIpEnd int
-	if byteInput[1] == 0x04 {
-		destIpEnd = sourcePortEnd + net.IPv4len
-	} else {
-		destIpEnd = sourcePortEnd + net.IPv6len
+// QpepHeaderFromBytes decodes the header at the start of byteInput, it fails when byteInput is
+// shorter than the header
+func QpepHeaderFromBytes(byteInput []byte) (QpepHeader, error) {
+	header, err := GetQpepHeader(bytes.NewReader(byteInput))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return header, fmt.Errorf("header truncated to %d bytes", len(byteInput))
 	}
-	destPortEnd := destIpEnd + 2
-
-	srcIPAddr := net.IP(byteInput[QPEP_PREAMBLE_LENGTH:sourceIpEnd])
-	srcPort := int(binary.LittleEndian.Uint16(byteInput[sourceIpEnd:sourcePortEnd]))
-
-	destIPAddr := net.IP(byteInput[sourcePortEnd:destIpEnd])
-	destPort := int(binary.LittleEndian.Uint16(byteInput[destIpEnd:destPortEnd]))
-
-	srcAddr := &net.TCPAddr{IP: srcIPAddr, Port: srcPort}
-	dstAddr := &net.TCPAddr{IP: destIPAddr, Port: destPort}
-	return QpepHeader{SourceAddr: srcAddr, DestAddr: dstAddr}
+	return header, err
 }
 
 func ipToBytes(addr net.IP, addrType byte) []byte {
@@ -127,8 +126,8 @@ func GetHeaderLength(preamble []byte) int {
 		headerLength += net.IPv6len
 	}
 
-	//add four bytes for TCP port numbers
-	headerLength += 4
+	//add four bytes for TCP port numbers, the connection ID and the traffic class
+	headerLength += 4 + CONNECTION_ID_LENGTH + 1
 	return headerLength
 }
 
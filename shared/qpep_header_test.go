@@ -0,0 +1,63 @@
+package shared
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestQpepHeader(t *testing.T) {
+	for _, test := range []struct {
+		name                string
+		source, destination string
+		length              int
+	}{
+		{"IPv4", "192.0.2.10:40000", "198.51.100.1:443", QPEP_PREAMBLE_LENGTH + 2*net.IPv4len + 4 + CONNECTION_ID_LENGTH + 1},
+		{"IPv6", "[2001:db8::10]:40000", "[2001:db8:1::1]:8443", QPEP_PREAMBLE_LENGTH + 2*net.IPv6len + 4 + CONNECTION_ID_LENGTH + 1},
+		{"IPv4 to IPv6", "192.0.2.10:65535", "[2001:db8:1::1]:1", QPEP_PREAMBLE_LENGTH + net.IPv4len + net.IPv6len + 4 + CONNECTION_ID_LENGTH + 1},
+		{"IPv6 to IPv4", "[::1]:1", "127.0.0.1:65535", QPEP_PREAMBLE_LENGTH + net.IPv6len + net.IPv4len + 4 + CONNECTION_ID_LENGTH + 1},
+	} {
+		source, _ := net.ResolveTCPAddr("tcp", test.source)
+		destination, _ := net.ResolveTCPAddr("tcp", test.destination)
+		header := QpepHeader{SourceAddr: source, DestAddr: destination, ConnectionID: NewConnectionID(), Class: CLASS_BULK}
+		data := header.ToBytes()
+		if len(data) != test.length || GetHeaderLength(data) != test.length {
+			t.Errorf("%s: header of %d bytes, announced as %d, expected %d", test.name, len(data), GetHeaderLength(data), test.length)
+			continue
+		}
+
+		// the header is followed by the data of the stream, which must be left unread
+		stream := bytes.NewReader(append(data, "payload"...))
+		parsed, err := GetQpepHeader(stream)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		fromBytes, err := QpepHeaderFromBytes(data)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		for _, decoded := range []QpepHeader{parsed, fromBytes} {
+			if decoded.SourceAddr.String() != source.String() || decoded.DestAddr.String() != destination.String() ||
+				decoded.ConnectionID != header.ConnectionID || decoded.Class != header.Class {
+				t.Errorf("%s: decoded %s -> %s %s class %d, expected %s -> %s %s class %d", test.name,
+					decoded.SourceAddr, decoded.DestAddr, decoded.ConnectionID, decoded.Class,
+					source, destination, header.ConnectionID, header.Class)
+			}
+		}
+		if rest, _ := ioutil.ReadAll(stream); string(rest) != "payload" {
+			t.Errorf("%s: %q left after the header, expected the payload", test.name, rest)
+		}
+
+		for _, truncated := range [][]byte{nil, data[:1], data[:len(data)-1]} {
+			if _, err = GetQpepHeader(bytes.NewReader(truncated)); err == nil {
+				t.Errorf("%s: truncated header of %d bytes decoded", test.name, len(truncated))
+			}
+			if _, err = QpepHeaderFromBytes(truncated); err == nil {
+				t.Errorf("%s: truncated header of %d bytes decoded from bytes", test.name, len(truncated))
+			}
+		}
+	}
+}
@@ -1 +1,21 @@
 package shared
+
+import "github.com/lucas-clemente/quic-go"
+
+// NewQuicConfig returns the QUIC configuration shared by the client and the server, each caller
+// gets its own copy to set the tracer on
+func NewQuicConfig() *quic.Config {
+	return &quic.Config{
+		MaxIncomingStreams: 40000,
+		// datagrams carry the control messages of the sessions
+		EnableDatagrams: true,
+	}
+}
+
+// QPEP_MESSAGE_MIGRATED is the datagram sent by the client once its session moved to a new local
+// address, the server then sends a path challenge to the new addresses the session was seen at
+const QPEP_MESSAGE_MIGRATED = 0x01
+
+// QPEP_MESSAGE_PATH_RESPONSE is the datagram answering a path challenge received by the client,
+// followed by its nonce; the server sends the packets of the session to the address of the challenge
+const QPEP_MESSAGE_PATH_RESPONSE = 0x03
@@ -3,6 +3,9 @@ package shared
 import (
 	"flag"
 	"os"
+	"time"
+
+	"github.com/parvit/qpep/flows"
 )
 
 type QuicConfig struct {
@@ -20,13 +23,56 @@ type QuicConfig struct {
 	ListenPort                     int
 	WinDivertThreads               int
 	Verbose                        bool
+	ServerCertFile                 string
+	ServerKeyFile                  string
+	ServerKeyType                  string
+	GatewayCAFile                  string
+	GatewayPin                     string
+	GatewayServerName              string
+	ClientCAFile                   string
+	CRLFile                        string
+	ClientCertFile                 string
+	ClientKeyFile                  string
+	TokensFile                     string
+	AuthToken                      string
+	PolicyFile                     string
+	AccountingFile                 string
+	QuotasFile                     string
+	MetricsAddress                 string
+	LogLevel                       string
+	LogFormat                      string
+	AdminAddress                   string
+	Qlog                           QlogConfig
+	FlowRecords                    flows.ExportConfig
+	ShutdownGrace                  time.Duration
+	OutboundAddress                string
+	OutboundInterface              string
+	OutboundTimeout                time.Duration
+	OutboundTransparent            bool
+	OutboundTransparentSources     string
+	EgressFile                     string
+	Transport                      string
+	TransportFallback              bool
+	ListenTCP                      bool
+	Paths                          string
+	PathPolicy                     string
+	InteractivePorts               string
+	Migration                      bool
+	FEC                            bool
+	ClassRules                     string
+	ClassSessions                  bool
+	MaxPacketSize                  int
+	MTUDiscovery                   bool
+	ListenSockets                  int
 }
 
 var (
 	QuicConfiguration QuicConfig
 )
 
-func init() {
+// ParseFlags parses the command line into QuicConfiguration, it is called by main only so that
+// the packages can be imported by tests and other programs
+func ParseFlags() {
 	ackElicitingFlag := flag.Int("acks", 10, "Number of acks to bundle")
 	ackDecimationFlag := flag.Int("decimate", 4, "Denominator of Ack Decimation Ratio")
 	congestionWindowFlag := flag.Int("congestion", 4, "Number of QUIC packets for initial congestion window")
@@ -41,6 +87,52 @@ func init() {
 	listenPortFlag := flag.Int("listenport", 9443, "Listen Port of qpep client")
 	winDiverterThreads := flag.Int("threads", 1, "Worker threads for windivert engine (min 1, max 8)")
 	verbose := flag.Bool("verbose", false, "Outputs data about diverted connections for debug")
+	serverCertFlag := flag.String("cert", "server_cert.pem", "TLS certificate file of qpep server, generated on first run if missing")
+	serverKeyFlag := flag.String("key", "server_key.pem", "TLS private key file of qpep server, generated on first run if missing")
+	serverKeyTypeFlag := flag.String("keyType", "ecdsa", "Type of the key generated for qpep server on first run, ecdsa or ed25519")
+	gatewayCAFlag := flag.String("ca", "", "CA bundle used by qpep client to verify the gateway certificate")
+	gatewayPinFlag := flag.String("pin", "", "SPKI pin (sha256/<base64>) of the gateway key, checked by qpep client")
+	gatewayServerNameFlag := flag.String("serverName", "", "Name expected in the gateway certificate when verifying with -ca (default is the gateway address)")
+	clientCAFlag := flag.String("clientCA", "", "CA bundle used by qpep server to require and verify client certificates (mutual TLS)")
+	crlFlag := flag.String("crl", "", "Certificate revocation list checked by qpep server against client certificates")
+	clientCertFlag := flag.String("clientCert", "", "TLS certificate file presented by qpep client to the gateway")
+	clientKeyFlag := flag.String("clientKey", "", "TLS private key file of the qpep client certificate")
+	tokensFileFlag := flag.String("tokens", "", "File of \"<name> <token>\" lines, qpep server requires clients to authenticate with one of the tokens")
+	authTokenFlag := flag.String("token", "", "Pre-shared token used by qpep client to authenticate to the gateway")
+	accountingFileFlag := flag.String("accounting", "", "File where qpep server keeps the traffic of each client across restarts, kept only in memory if empty")
+	quotasFileFlag := flag.String("quotas", "", "YAML file with the daily and monthly traffic quotas of qpep server clients")
+	metricsAddressFlag := flag.String("metrics", "", "Address (host:port) where the Prometheus metrics are served on /metrics, disabled if empty")
+	logLevelFlag := flag.String("logLevel", "info", "Minimum level of the logged lines: debug, info, warning or error (-verbose implies debug)")
+	logFormatFlag := flag.String("logFormat", "text", "Format of the logged lines: text or json")
+	adminAddressFlag := flag.String("admin", "", "Address of the admin API listing and aborting live sessions and streams, unix:<path> or a loopback host:port, disabled if empty")
+	qlogDirFlag := flag.String("qlog", "", "Directory where a qlog trace of each QUIC session is written, disabled if empty")
+	qlogSampleFlag := flag.Float64("qlogSample", 1, "Fraction of the QUIC sessions traced with -qlog, between 0 and 1")
+	qlogMaxFileSizeFlag := flag.Int64("qlogMaxFileSize", 64, "Maximum size in MB of a single qlog trace, the rest of the session is not traced (0 for no limit)")
+	qlogMaxTotalSizeFlag := flag.Int64("qlogMaxTotalSize", 1024, "Maximum size in MB of the qlog directory, new sessions are not traced beyond it (0 for no limit)")
+	flowRecordsFlag := flag.String("flowRecords", "", "JSON-lines file, or udp:<host:port> collector, receiving a record of every closed stream, disabled if empty")
+	flowRecordsMaxSizeFlag := flag.Int64("flowRecordsMaxSize", 100, "Size in MB at which the -flowRecords file is rotated (0 to never rotate)")
+	flowRecordsBackupsFlag := flag.Int("flowRecordsBackups", 5, "Number of rotated -flowRecords files kept")
+	shutdownGraceFlag := flag.Duration("shutdownGrace", 10*time.Second, "Time given to the active streams to finish on SIGTERM before they are reset")
+	outboundAddressFlag := flag.String("outboundAddress", "", "Source IP address of the connections opened by qpep server to the destinations")
+	outboundInterfaceFlag := flag.String("outboundInterface", "", "Network interface the connections of qpep server to the destinations are bound to (linux only)")
+	outboundTimeoutFlag := flag.Duration("outboundTimeout", 10*time.Second, "Timeout of the connections opened by qpep server to the destinations")
+	outboundTransparentFlag := flag.Bool("outboundTransparent", false, "Let qpep server open the connections to the destinations from the source address and port of the client connections with IP_TRANSPARENT, for a gateway routing the subnets of the clients (linux only, needs CAP_NET_ADMIN)")
+	outboundTransparentSourcesFlag := flag.String("outboundTransparentSources", "", "Comma separated networks of the client source addresses qpep server connects from with -outboundTransparent, the streams from any other source are refused")
+	egressFileFlag := flag.String("egress", "", "YAML file with the upstream SOCKS5 / HTTP proxies of qpep server and the rules choosing them per destination")
+	transportFlag := flag.String("transport", TRANSPORT_QUIC, "Transport preferred by qpep client to reach the gateway, quic or tcp (TLS over TCP, for networks blocking UDP)")
+	transportFallbackFlag := flag.Bool("transportFallback", true, "Let qpep client open the sessions on the other transport when the preferred one fails")
+	listenTCPFlag := flag.Bool("listenTCP", true, "Let qpep server also accept sessions over TLS on TCP, on the same port as QUIC")
+	pathsFlag := flag.String("paths", "", "Comma separated source addresses or interfaces (linux only) qpep client keeps a session to the gateway on, the streams being scheduled across them")
+	pathPolicyFlag := flag.String("pathPolicy", "split", "How qpep client schedules the streams across -paths: split (interactive ports on the lowest RTT, the rest on the highest capacity), lowest-rtt, highest-capacity or balance")
+	interactivePortsFlag := flag.String("interactivePorts", "22,23,53,3389,5900", "Comma separated destination ports of the interactive traffic class when no -classRules match, sent on the lowest RTT path by the split -pathPolicy")
+	migrationFlag := flag.Bool("migration", true, "Let qpep client move its QUIC sessions to a new socket when its local address changes, and qpep server follow them")
+	fecFlag := flag.Bool("fec", false, "Let qpep client ask for forward error correction on its QUIC sessions, and qpep server accept it, parity packets adapted to the loss then recover lost packets without retransmission")
+	classRulesFlag := flag.String("classRules", "", "Comma separated destination=class rules assigning the traffic class (interactive, bulk or default) of the streams of qpep client, the destination being a port, an address or network, or both as 10.0.0.0/8:873")
+	classSessionsFlag := flag.Bool("classSessions", true, "Let qpep client open a QUIC session for each traffic class, so that interactive streams don't wait behind bulk ones")
+	maxPacketSizeFlag := flag.Int("maxPacketSize", 0, "Largest UDP payload of the QUIC packets sent by qpep client and server, at least 1252 (1263 with -fec), for paths with a smaller MTU than they probe (0 for no bound)")
+	mtuDiscoveryFlag := flag.Bool("mtuDiscovery", true, "Let qpep client and server probe the path for the largest QUIC packets it carries, up to -maxPacketSize and 1452 bytes, sent without fragmentation on linux")
+	listenSocketsFlag := flag.Int("listenSockets", 1, "Number of UDP sockets qpep server binds to its port with SO_REUSEPORT, each read by its own QUIC listener (linux only)")
+	policyFileFlag := flag.String("policy", "", "YAML file with the destinations qpep server allows clients to reach (loopback, link-local and metadata addresses are denied by default)")
 
 	flag.Parse()
 	if !flag.Parsed() {
@@ -63,5 +155,55 @@ func init() {
 		ListenPort:                     *listenPortFlag,
 		WinDivertThreads:               *winDiverterThreads,
 		Verbose:                        *verbose,
+		ServerCertFile:                 *serverCertFlag,
+		ServerKeyFile:                  *serverKeyFlag,
+		ServerKeyType:                  *serverKeyTypeFlag,
+		GatewayCAFile:                  *gatewayCAFlag,
+		GatewayPin:                     *gatewayPinFlag,
+		GatewayServerName:              *gatewayServerNameFlag,
+		ClientCAFile:                   *clientCAFlag,
+		CRLFile:                        *crlFlag,
+		ClientCertFile:                 *clientCertFlag,
+		ClientKeyFile:                  *clientKeyFlag,
+		TokensFile:                     *tokensFileFlag,
+		AuthToken:                      *authTokenFlag,
+		PolicyFile:                     *policyFileFlag,
+		AccountingFile:                 *accountingFileFlag,
+		QuotasFile:                     *quotasFileFlag,
+		MetricsAddress:                 *metricsAddressFlag,
+		LogLevel:                       *logLevelFlag,
+		LogFormat:                      *logFormatFlag,
+		AdminAddress:                   *adminAddressFlag,
+		Qlog: QlogConfig{
+			Directory:    *qlogDirFlag,
+			SampleRate:   *qlogSampleFlag,
+			MaxFileSize:  *qlogMaxFileSizeFlag * 1024 * 1024,
+			MaxTotalSize: *qlogMaxTotalSizeFlag * 1024 * 1024,
+		},
+		FlowRecords: flows.ExportConfig{
+			Destination: *flowRecordsFlag,
+			MaxFileSize: *flowRecordsMaxSizeFlag * 1024 * 1024,
+			MaxBackups:  *flowRecordsBackupsFlag,
+		},
+		ShutdownGrace:              *shutdownGraceFlag,
+		OutboundAddress:            *outboundAddressFlag,
+		OutboundInterface:          *outboundInterfaceFlag,
+		OutboundTimeout:            *outboundTimeoutFlag,
+		OutboundTransparent:        *outboundTransparentFlag,
+		OutboundTransparentSources: *outboundTransparentSourcesFlag,
+		EgressFile:                 *egressFileFlag,
+		Transport:                  *transportFlag,
+		TransportFallback:          *transportFallbackFlag,
+		ListenTCP:                  *listenTCPFlag,
+		Paths:                      *pathsFlag,
+		PathPolicy:                 *pathPolicyFlag,
+		InteractivePorts:           *interactivePortsFlag,
+		Migration:                  *migrationFlag,
+		FEC:                        *fecFlag,
+		ClassRules:                 *classRulesFlag,
+		ClassSessions:              *classSessionsFlag,
+		MaxPacketSize:              *maxPacketSizeFlag,
+		MTUDiscovery:               *mtuDiscoveryFlag,
+		ListenSockets:              *listenSocketsFlag,
 	}
 }
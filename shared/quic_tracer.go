@@ -0,0 +1,172 @@
+package shared
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/parvit/qpep/metrics"
+)
+
+// RTT samples are taken at most once per interval for each connection, the tracer is called on every ack
+const QUIC_RTT_SAMPLE_INTERVAL = 1 * time.Second
+
+// packetSizesKept bounds the sizes of the packets waiting for their ack, the packets not eliciting
+// one are never removed otherwise
+const packetSizesKept = 64
+
+// QuicMetrics are the metrics updated from the QUIC connection statistics, each of them is optional
+type QuicMetrics struct {
+	RTT         *metrics.Histogram
+	PacketsSent *metrics.Counter
+	PacketsLost *metrics.Counter
+	// PacketSize is the smallest packet size among the live connections, so the size every current
+	// path is known to carry: each connection counts with the largest packet acknowledged by its
+	// peer, as grown by the path MTU discovery, and at least MIN_PACKET_SIZE that quic-go sends
+	// without probing. It is 0 until a connection gets a packet acknowledged.
+	PacketSize *metrics.Gauge
+	// Estimate receives the smoothed RTT and congestion window of the connection at each RTT sample
+	Estimate func(smoothedRTT time.Duration, congestionWindow logging.ByteCount)
+}
+
+// NewQuicMetricsTracer returns a QUIC tracer that reports RTT and loss of every connection to the metrics
+func NewQuicMetricsTracer(quicMetrics QuicMetrics) logging.Tracer {
+	return &quicMetricsTracer{metrics: quicMetrics, packetSizes: make(map[*quicMetricsConnectionTracer]logging.ByteCount)}
+}
+
+type quicMetricsTracer struct {
+	metrics QuicMetrics
+
+	// packetSizes are the packet sizes of the live connections with a packet acknowledged
+	packetSizesMtx sync.Mutex
+	packetSizes    map[*quicMetricsConnectionTracer]logging.ByteCount
+}
+
+func (tracer *quicMetricsTracer) TracerForConnection(logging.Perspective, logging.ConnectionID) logging.ConnectionTracer {
+	return &quicMetricsConnectionTracer{tracer: tracer, metrics: tracer.metrics, packetSizes: make(map[logging.PacketNumber]logging.ByteCount)}
+}
+
+// setPacketSize records the packet size of the connection, 0 once it is closed, and sets the gauge
+// to the smallest one
+func (tracer *quicMetricsTracer) setPacketSize(connection *quicMetricsConnectionTracer, size logging.ByteCount) {
+	tracer.packetSizesMtx.Lock()
+	defer tracer.packetSizesMtx.Unlock()
+	if size == 0 {
+		delete(tracer.packetSizes, connection)
+	} else {
+		tracer.packetSizes[connection] = size
+	}
+	var smallest logging.ByteCount
+	for _, size := range tracer.packetSizes {
+		if smallest == 0 || size < smallest {
+			smallest = size
+		}
+	}
+	tracer.metrics.PacketSize.Set(float64(smallest))
+}
+
+func (tracer *quicMetricsTracer) SentPacket(net.Addr, *logging.Header, logging.ByteCount, []logging.Frame) {
+}
+
+func (tracer *quicMetricsTracer) DroppedPacket(net.Addr, logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+// quicMetricsConnectionTracer is called by the connection goroutine only, so its state needs no locking
+type quicMetricsConnectionTracer struct {
+	tracer     *quicMetricsTracer
+	metrics    QuicMetrics
+	lastSample time.Time
+	// packetSizes are the sizes of the 1-RTT packets sent larger than the largest acknowledged
+	packetSizes      map[logging.PacketNumber]logging.ByteCount
+	largestAckedSize logging.ByteCount
+}
+
+func (tracer *quicMetricsConnectionTracer) SentPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, _ *logging.AckFrame, _ []logging.Frame) {
+	if tracer.metrics.PacketsSent != nil {
+		tracer.metrics.PacketsSent.Inc()
+	}
+	if tracer.metrics.PacketSize != nil && !hdr.IsLongHeader && size > tracer.largestAckedSize {
+		if len(tracer.packetSizes) >= packetSizesKept {
+			tracer.packetSizes = make(map[logging.PacketNumber]logging.ByteCount)
+		}
+		tracer.packetSizes[hdr.PacketNumber] = size
+	}
+}
+
+func (tracer *quicMetricsConnectionTracer) LostPacket(level logging.EncryptionLevel, packetNumber logging.PacketNumber, _ logging.PacketLossReason) {
+	if tracer.metrics.PacketsLost != nil {
+		tracer.metrics.PacketsLost.Inc()
+	}
+	if level == logging.Encryption1RTT {
+		delete(tracer.packetSizes, packetNumber)
+	}
+}
+
+func (tracer *quicMetricsConnectionTracer) AcknowledgedPacket(level logging.EncryptionLevel, packetNumber logging.PacketNumber) {
+	if level != logging.Encryption1RTT {
+		return
+	}
+	size, ok := tracer.packetSizes[packetNumber]
+	if !ok {
+		return
+	}
+	delete(tracer.packetSizes, packetNumber)
+	if size > tracer.largestAckedSize {
+		tracer.largestAckedSize = size
+		if size < MIN_PACKET_SIZE {
+			size = MIN_PACKET_SIZE
+		}
+		tracer.tracer.setPacketSize(tracer, size)
+	}
+}
+
+func (tracer *quicMetricsConnectionTracer) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, _ logging.ByteCount, _ int) {
+	now := time.Now()
+	if now.Sub(tracer.lastSample) < QUIC_RTT_SAMPLE_INTERVAL || rttStats.SmoothedRTT() == 0 {
+		return
+	}
+	tracer.lastSample = now
+	if tracer.metrics.RTT != nil {
+		tracer.metrics.RTT.Observe(rttStats.SmoothedRTT().Seconds())
+	}
+	if tracer.metrics.Estimate != nil {
+		tracer.metrics.Estimate(rttStats.SmoothedRTT(), cwnd)
+	}
+}
+
+func (tracer *quicMetricsConnectionTracer) StartedConnection(local, remote net.Addr, srcConnID, destConnID logging.ConnectionID) {
+}
+func (tracer *quicMetricsConnectionTracer) ClosedConnection(logging.CloseReason)                 {}
+func (tracer *quicMetricsConnectionTracer) SentTransportParameters(*logging.TransportParameters) {}
+func (tracer *quicMetricsConnectionTracer) ReceivedTransportParameters(*logging.TransportParameters) {
+}
+func (tracer *quicMetricsConnectionTracer) RestoredTransportParameters(*logging.TransportParameters) {
+}
+func (tracer *quicMetricsConnectionTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {
+}
+func (tracer *quicMetricsConnectionTracer) ReceivedRetry(*logging.Header) {}
+func (tracer *quicMetricsConnectionTracer) ReceivedPacket(*logging.ExtendedHeader, logging.ByteCount, []logging.Frame) {
+}
+func (tracer *quicMetricsConnectionTracer) BufferedPacket(logging.PacketType) {}
+func (tracer *quicMetricsConnectionTracer) DroppedPacket(logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+func (tracer *quicMetricsConnectionTracer) UpdatedCongestionState(logging.CongestionState) {}
+func (tracer *quicMetricsConnectionTracer) UpdatedPTOCount(uint32)                         {}
+func (tracer *quicMetricsConnectionTracer) UpdatedKeyFromTLS(logging.EncryptionLevel, logging.Perspective) {
+}
+func (tracer *quicMetricsConnectionTracer) UpdatedKey(logging.KeyPhase, bool)              {}
+func (tracer *quicMetricsConnectionTracer) DroppedEncryptionLevel(logging.EncryptionLevel) {}
+func (tracer *quicMetricsConnectionTracer) DroppedKey(logging.KeyPhase)                    {}
+func (tracer *quicMetricsConnectionTracer) SetLossTimer(logging.TimerType, logging.EncryptionLevel, time.Time) {
+}
+func (tracer *quicMetricsConnectionTracer) LossTimerExpired(logging.TimerType, logging.EncryptionLevel) {
+}
+func (tracer *quicMetricsConnectionTracer) LossTimerCanceled()     {}
+func (tracer *quicMetricsConnectionTracer) Debug(name, msg string) {}
+
+func (tracer *quicMetricsConnectionTracer) Close() {
+	if tracer.largestAckedSize > 0 {
+		tracer.tracer.setPacketSize(tracer, 0)
+	}
+}
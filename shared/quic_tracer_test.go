@@ -0,0 +1,49 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/parvit/qpep/metrics"
+)
+
+// ackPacket sends a 1-RTT packet of the size on the connection and acknowledges it
+func ackPacket(connection logging.ConnectionTracer, packetNumber logging.PacketNumber, size logging.ByteCount) {
+	connection.SentPacket(&logging.ExtendedHeader{PacketNumber: packetNumber}, size, nil, nil)
+	connection.AcknowledgedPacket(logging.Encryption1RTT, packetNumber)
+}
+
+func TestQuicPacketSize(t *testing.T) {
+	packetSize := metrics.NewRegistry("test").Gauge("packet_size", "")
+	tracer := NewQuicMetricsTracer(QuicMetrics{PacketSize: packetSize})
+	expectSize := func(expected float64) {
+		t.Helper()
+		if size := packetSize.Value(); size != expected {
+			t.Fatalf("packet size %v, expected %v", size, expected)
+		}
+	}
+
+	probed := tracer.TracerForConnection(logging.PerspectiveServer, nil)
+	ackPacket(probed, 1, 60)
+	expectSize(MIN_PACKET_SIZE)
+	ackPacket(probed, 2, 1400)
+	expectSize(1400)
+
+	// a connection whose packets didn't grow holds the size down until it is closed
+	other := tracer.TracerForConnection(logging.PerspectiveServer, nil)
+	ackPacket(other, 1, 1300)
+	expectSize(1300)
+	ackPacket(probed, 3, MAX_PACKET_SIZE)
+	expectSize(1300)
+	// the packets lost or smaller than the largest acknowledged don't change it
+	other.SentPacket(&logging.ExtendedHeader{PacketNumber: 2}, 1400, nil, nil)
+	other.LostPacket(logging.Encryption1RTT, 2, logging.PacketLossTimeThreshold)
+	other.AcknowledgedPacket(logging.Encryption1RTT, 2)
+	ackPacket(other, 3, 1200)
+	expectSize(1300)
+	other.Close()
+	expectSize(MAX_PACKET_SIZE)
+
+	probed.Close()
+	expectSize(0)
+}
@@ -0,0 +1,61 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Token authentication runs on the first stream of a session, before any data stream is opened:
+//
+//	client -> server: version
+//	server -> client: random challenge
+//	client -> server: HMAC-SHA256(token, challenge)
+//	server -> client: result
+const (
+	QPEP_AUTH_VERSION          = 0x01
+	QPEP_AUTH_CHALLENGE_LENGTH = 32
+	QPEP_AUTH_RESPONSE_LENGTH  = sha256.Size
+	QPEP_AUTH_OK               = 0x00
+	QPEP_AUTH_REJECTED         = 0x01
+	QPEP_AUTH_TIMEOUT          = 10 * time.Second
+)
+
+var ErrAuthRejected = errors.New("authentication rejected by gateway")
+
+// ComputeAuthResponse returns the proof of knowledge of the token for the challenge sent by the server
+func ComputeAuthResponse(token string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// CheckAuthResponse compares in constant time the response of the client with the one expected for the token
+func CheckAuthResponse(token string, challenge, response []byte) bool {
+	return hmac.Equal(ComputeAuthResponse(token, challenge), response)
+}
+
+// RespondAuthChallenge runs the client side of the token authentication on the control stream
+func RespondAuthChallenge(stream io.ReadWriter, token string) error {
+	if _, err := stream.Write([]byte{QPEP_AUTH_VERSION}); err != nil {
+		return err
+	}
+	challenge := make([]byte, QPEP_AUTH_CHALLENGE_LENGTH)
+	if _, err := io.ReadFull(stream, challenge); err != nil {
+		return fmt.Errorf("read challenge: %w", err)
+	}
+	if _, err := stream.Write(ComputeAuthResponse(token, challenge)); err != nil {
+		return err
+	}
+	result := make([]byte, 1)
+	if _, err := io.ReadFull(stream, result); err != nil {
+		return fmt.Errorf("read result: %w", err)
+	}
+	if result[0] != QPEP_AUTH_OK {
+		return ErrAuthRejected
+	}
+	return nil
+}
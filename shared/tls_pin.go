@@ -0,0 +1,30 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+)
+
+const (
+	SPKI_PIN_PREFIX = "sha256/"
+	// SELF_SIGNED_SERVER_NAME is the name of the certificate the server generates on its first run, the
+	// clients verifying it with a CA bundle accept it when no server name is configured
+	SELF_SIGNED_SERVER_NAME = "qpep-server"
+)
+
+// SPKIPin returns the pin of the certificate public key, in the form sha256/<base64 of the SubjectPublicKeyInfo hash>
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return SPKI_PIN_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// NormalizeSPKIPin accepts a pin with or without the sha256/ prefix and returns it in the SPKIPin form
+func NormalizeSPKIPin(pin string) string {
+	pin = strings.TrimSpace(pin)
+	if pin == "" {
+		return ""
+	}
+	return SPKI_PIN_PREFIX + strings.TrimPrefix(pin, SPKI_PIN_PREFIX)
+}
@@ -0,0 +1,91 @@
+package shared
+
+import (
+	"fmt"
+
+	"github.com/parvit/qpep/metrics"
+)
+
+// TrafficClass is the class of a stream, chosen by the client and sent in its QpepHeader
+type TrafficClass byte
+
+// Traffic classes of the streams, the client sends the streams of each class on their own session
+// so that the interactive ones don't wait behind the bulk ones
+const (
+	CLASS_DEFAULT TrafficClass = iota
+	CLASS_INTERACTIVE
+	CLASS_BULK
+
+	// TRAFFIC_CLASSES is the number of traffic classes
+	TRAFFIC_CLASSES = 3
+)
+
+var trafficClassNames = [TRAFFIC_CLASSES]string{"default", "interactive", "bulk"}
+
+func (class TrafficClass) String() string {
+	if int(class) < len(trafficClassNames) {
+		return trafficClassNames[class]
+	}
+	return fmt.Sprintf("class-%d", byte(class))
+}
+
+// ParseTrafficClass returns the class of the given name
+func ParseTrafficClass(name string) (TrafficClass, error) {
+	for class, className := range trafficClassNames {
+		if name == className {
+			return TrafficClass(class), nil
+		}
+	}
+	return CLASS_DEFAULT, fmt.Errorf("unknown traffic class %q", name)
+}
+
+// ClassStats are the counters of the streams of a traffic class
+type ClassStats struct {
+	Class     string
+	Streams   uint64
+	BytesUp   uint64
+	BytesDown uint64
+}
+
+// ClassMetrics are the metrics of the streams by traffic class, shared by client and server
+type ClassMetrics struct {
+	streams   [TRAFFIC_CLASSES]*metrics.Counter
+	bytesUp   [TRAFFIC_CLASSES]*metrics.Counter
+	bytesDown [TRAFFIC_CLASSES]*metrics.Counter
+}
+
+// NewClassMetrics registers the metrics of the traffic classes
+func NewClassMetrics(registry *metrics.Registry) *ClassMetrics {
+	streamsTotal := registry.CounterVec("class_streams_total", "Streams opened by traffic class", "class")
+	bytesTotal := registry.CounterVec("class_bytes_total", "Bytes proxied through the tunnel by traffic class", "class", "direction")
+	m := &ClassMetrics{}
+	for class, name := range trafficClassNames {
+		m.streams[class] = streamsTotal.WithLabelValues(name)
+		m.bytesUp[class] = bytesTotal.WithLabelValues(name, "upstream")
+		m.bytesDown[class] = bytesTotal.WithLabelValues(name, "downstream")
+	}
+	return m
+}
+
+// Stream counts a stream of the class and returns the counters of its bytes up and down
+func (m *ClassMetrics) Stream(class TrafficClass) (*metrics.Counter, *metrics.Counter) {
+	if int(class) >= TRAFFIC_CLASSES {
+		class = CLASS_DEFAULT
+	}
+	m.streams[class].Inc()
+	return m.bytesUp[class], m.bytesDown[class]
+}
+
+// Stats returns the counters of each class, in the order of the classes
+func (m *ClassMetrics) Stats() []ClassStats {
+	stats := make([]ClassStats, TRAFFIC_CLASSES)
+	for class, name := range trafficClassNames {
+		stats[class] = ClassStats{
+			Class:     name,
+			Streams:   uint64(m.streams[class].Value()),
+			BytesUp:   uint64(m.bytesUp[class].Value()),
+			BytesDown: uint64(m.bytesDown[class].Value()),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package shared
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// TransparentSource is the socket control function letting the sockets bind an address that is not
+// local to the host with IP_TRANSPARENT, which needs CAP_NET_ADMIN. SO_REUSEADDR is set as well so
+// that a source port can be bound again while the connection of an earlier stream from it lingers.
+func TransparentSource(network, address string, rawConn syscall.RawConn) error {
+	var optErr error
+	err := rawConn.Control(func(fd uintptr) {
+		if strings.HasSuffix(network, "6") {
+			optErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		} else {
+			optErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+		if optErr == nil {
+			optErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return optErr
+}
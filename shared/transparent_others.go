@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package shared
+
+import (
+	"errors"
+	"syscall"
+)
+
+// TransparentSource is the socket control function letting the sockets bind an address that is not
+// local to the host with IP_TRANSPARENT, which needs CAP_NET_ADMIN. SO_REUSEADDR is set as well so
+// that a source port can be bound again while the connection of an earlier stream from it lingers.
+func TransparentSource(network, address string, rawConn syscall.RawConn) error {
+	return errors.New("transparent source addresses are only supported on linux")
+}
@@ -0,0 +1,29 @@
+package shared
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"github.com/parvit/qpep/mux"
+)
+
+// Transports of the sessions between client and server, TCP carries the streams with a multiplexer
+// over TLS for the networks where UDP is blocked
+const (
+	TRANSPORT_QUIC = "quic"
+	TRANSPORT_TCP  = "tcp"
+)
+
+// FallbackTransport returns the transport tried when the given one fails
+func FallbackTransport(transport string) string {
+	if transport == TRANSPORT_TCP {
+		return TRANSPORT_QUIC
+	}
+	return TRANSPORT_TCP
+}
+
+// SessionTransport returns the transport of an open session
+func SessionTransport(session quic.Session) string {
+	if _, ok := session.(*mux.Session); ok {
+		return TRANSPORT_TCP
+	}
+	return TRANSPORT_QUIC
+}
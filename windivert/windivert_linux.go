@@ -22,7 +22,7 @@ func CloseWinDivertEngine() int {
 }
 
 func GetConnectionStateData(port int) (int, int, int, string, string) {
-	return DIVERT_OK, -1, -1, "", ""
+	return DIVERT_ERROR_NOTINITILIZED, -1, -1, "", ""
 }
 
 func EnableDiverterLogging(enable bool) {